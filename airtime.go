@@ -0,0 +1,351 @@
+package gomesh
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// meshHeaderLen is the size of the header the firmware adds to every packet sent over LoRa
+const meshHeaderLen = 16
+
+// defaultPreambleLen is the preamble length in symbols used by the firmware
+const defaultPreambleLen = 16
+
+// defaultDutyCycleWindow is the rolling window used when a budget doesn't set one
+const defaultDutyCycleWindow = time.Hour
+
+// ErrDutyCycleExceeded is returned when sending a packet would exceed the duty cycle budget
+var ErrDutyCycleExceeded = errors.New("duty cycle budget exceeded")
+
+// LoRaParams are the modem settings that decide how long a packet takes to transmit
+type LoRaParams struct {
+	// Bandwidth in kHz
+	Bandwidth float64
+	// SpreadFactor from 7 to 12
+	SpreadFactor int
+	// CodingRate is the denominator of the coding rate, 5 to 8 for 4/5 to 4/8
+	CodingRate int
+	// PreambleLen is the preamble length in symbols
+	PreambleLen int
+}
+
+// presetParams maps the firmware modem presets to their modem settings
+var presetParams = map[pb.Config_LoRaConfig_ModemPreset]LoRaParams{
+	pb.Config_LoRaConfig_SHORT_FAST:     {Bandwidth: 250, SpreadFactor: 7, CodingRate: 5, PreambleLen: defaultPreambleLen},
+	pb.Config_LoRaConfig_SHORT_SLOW:     {Bandwidth: 250, SpreadFactor: 8, CodingRate: 5, PreambleLen: defaultPreambleLen},
+	pb.Config_LoRaConfig_MEDIUM_FAST:    {Bandwidth: 250, SpreadFactor: 9, CodingRate: 5, PreambleLen: defaultPreambleLen},
+	pb.Config_LoRaConfig_MEDIUM_SLOW:    {Bandwidth: 250, SpreadFactor: 10, CodingRate: 5, PreambleLen: defaultPreambleLen},
+	pb.Config_LoRaConfig_LONG_FAST:      {Bandwidth: 250, SpreadFactor: 11, CodingRate: 5, PreambleLen: defaultPreambleLen},
+	pb.Config_LoRaConfig_LONG_MODERATE:  {Bandwidth: 125, SpreadFactor: 11, CodingRate: 8, PreambleLen: defaultPreambleLen},
+	pb.Config_LoRaConfig_LONG_SLOW:      {Bandwidth: 125, SpreadFactor: 12, CodingRate: 8, PreambleLen: defaultPreambleLen},
+	pb.Config_LoRaConfig_VERY_LONG_SLOW: {Bandwidth: 62.5, SpreadFactor: 12, CodingRate: 8, PreambleLen: defaultPreambleLen},
+}
+
+// specialBandwidths converts the shortened bandwidth values used in the config to kHz
+var specialBandwidths = map[uint32]float64{
+	31:   31.25,
+	62:   62.5,
+	200:  203.125,
+	400:  406.25,
+	800:  812.5,
+	1600: 1625,
+}
+
+// regionDutyCycles holds the duty cycle percentage for regions that limit it, other regions allow 100%
+var regionDutyCycles = map[pb.Config_LoRaConfig_RegionCode]float64{
+	pb.Config_LoRaConfig_EU_433: 10,
+	pb.Config_LoRaConfig_EU_868: 10,
+	pb.Config_LoRaConfig_UA_433: 10,
+	pb.Config_LoRaConfig_UA_868: 1,
+}
+
+// LoRaParamsFromConfig returns the modem settings in use for a LoRa config, using either the modem preset
+// or the custom bandwidth, spread factor and coding rate
+func LoRaParamsFromConfig(config *pb.Config_LoRaConfig) (LoRaParams, error) {
+
+	if config == nil || config.UsePreset {
+		preset, ok := presetParams[config.GetModemPreset()]
+		if !ok {
+			return LoRaParams{}, errors.New("unknown modem preset")
+		}
+		return preset, nil
+	}
+
+	bandwidth, ok := specialBandwidths[config.Bandwidth]
+	if !ok {
+		bandwidth = float64(config.Bandwidth)
+	}
+
+	params := LoRaParams{
+		Bandwidth:    bandwidth,
+		SpreadFactor: int(config.SpreadFactor),
+		CodingRate:   int(config.CodingRate),
+		PreambleLen:  defaultPreambleLen,
+	}
+
+	if params.Bandwidth <= 0 || params.SpreadFactor < 6 || params.SpreadFactor > 12 || params.CodingRate < 5 || params.CodingRate > 8 {
+		return LoRaParams{}, errors.New("invalid custom lora settings")
+	}
+
+	return params, nil
+}
+
+// RegionDutyCycle returns the duty cycle percentage allowed in a region
+func RegionDutyCycle(region pb.Config_LoRaConfig_RegionCode) float64 {
+	if dutyCycle, ok := regionDutyCycles[region]; ok {
+		return dutyCycle
+	}
+	return 100
+}
+
+// Airtime returns the time on air for a LoRa payload of the provided length in bytes
+func (p LoRaParams) Airtime(payloadLen int) time.Duration {
+
+	symbolTime := math.Pow(2, float64(p.SpreadFactor)) / (p.Bandwidth * 1000)
+
+	// Low data rate optimization is required when a symbol takes longer than 16ms
+	lowDataRate := 0.0
+	if symbolTime > 0.016 {
+		lowDataRate = 1
+	}
+
+	preambleTime := (float64(p.PreambleLen) + 4.25) * symbolTime
+
+	// Explicit header with CRC enabled, as used by the firmware
+	numerator := 8*float64(payloadLen) - 4*float64(p.SpreadFactor) + 28 + 16
+	denominator := 4 * (float64(p.SpreadFactor) - 2*lowDataRate)
+	payloadSymbols := 8 + math.Max(math.Ceil(numerator/denominator)*float64(p.CodingRate), 0)
+
+	seconds := preambleTime + payloadSymbols*symbolTime
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// PacketAirtime returns the time on air for a mesh packet including the firmware header
+func (p LoRaParams) PacketAirtime(packet *pb.MeshPacket) time.Duration {
+
+	size := 0
+	if data := packet.GetDecoded(); data != nil {
+		size = proto.Size(data)
+	} else {
+		size = len(packet.GetEncrypted())
+	}
+
+	return p.Airtime(meshHeaderLen + size)
+}
+
+// DutyCycleBudget limits the share of time the radio spends transmitting packets sent through goMesh
+type DutyCycleBudget struct {
+	// Percent of the window that may be spent transmitting, 0 uses the limit for the configured region
+	Percent float64
+	// Window is the rolling window the budget applies to, 0 uses one hour
+	Window time.Duration
+	// RejectWhenExceeded returns ErrDutyCycleExceeded immediately instead of waiting for the budget to free up
+	RejectWhenExceeded bool
+}
+
+// airtimeUse is the airtime of one transmitted packet
+type airtimeUse struct {
+	at      time.Time
+	airtime time.Duration
+}
+
+// dutyCycle tracks the LoRa settings of the radio and the airtime spent in the rolling window
+type dutyCycle struct {
+	mu      sync.Mutex
+	lora    *pb.Config_LoRaConfig
+	budget  *DutyCycleBudget
+	history []airtimeUse
+}
+
+// airtime returns the duty cycle tracker for the radio, creating it on first use
+func (r *Radio) airtime() *dutyCycle {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.dutyCycle == nil {
+		r.dutyCycle = &dutyCycle{}
+	}
+	return r.dutyCycle
+}
+
+// SetDutyCycleBudget enables a rolling duty cycle budget for packets sent through the radio
+func (r *Radio) SetDutyCycleBudget(budget DutyCycleBudget) {
+	d := r.airtime()
+	d.mu.Lock()
+	d.budget = &budget
+	d.mu.Unlock()
+}
+
+// ClearDutyCycleBudget removes the duty cycle budget so packets are sent without airtime checks
+func (r *Radio) ClearDutyCycleBudget() {
+	d := r.airtime()
+	d.mu.Lock()
+	d.budget = nil
+	d.history = nil
+	d.mu.Unlock()
+}
+
+// LoRaParams returns the modem settings of the radio. The LoRa config is captured during the config
+// handshake, if it hasn't been seen the firmware default of LONG_FAST is assumed
+func (r *Radio) LoRaParams() (LoRaParams, error) {
+	d := r.airtime()
+	d.mu.Lock()
+	lora := d.lora
+	d.mu.Unlock()
+
+	if lora == nil {
+		return presetParams[pb.Config_LoRaConfig_LONG_FAST], nil
+	}
+
+	return LoRaParamsFromConfig(lora)
+}
+
+// EstimateAirtime returns the estimated time on air of a mesh packet with the current LoRa settings
+func (r *Radio) EstimateAirtime(packet *pb.MeshPacket) (time.Duration, error) {
+	params, err := r.LoRaParams()
+	if err != nil {
+		return 0, err
+	}
+	return params.PacketAirtime(packet), nil
+}
+
+// AirtimeUsed returns the airtime spent in the current duty cycle window and the total allowed
+func (r *Radio) AirtimeUsed() (used time.Duration, allowed time.Duration) {
+	d := r.airtime()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.budget == nil {
+		return 0, 0
+	}
+
+	window, allowed := d.limits()
+	return d.used(time.Now(), window), allowed
+}
+
+// handleLoRaConfig records the LoRa config reported by the device
+func (d *dutyCycle) handleLoRaConfig(config *pb.Config_LoRaConfig) {
+	d.mu.Lock()
+	d.lora = config
+	d.mu.Unlock()
+}
+
+// limits returns the window and the airtime allowed in it. The lock must be held
+func (d *dutyCycle) limits() (window time.Duration, allowed time.Duration) {
+
+	window = d.budget.Window
+	if window <= 0 {
+		window = defaultDutyCycleWindow
+	}
+
+	percent := d.budget.Percent
+	if percent <= 0 {
+		percent = 100
+		if d.lora != nil && !d.lora.OverrideDutyCycle {
+			percent = RegionDutyCycle(d.lora.Region)
+		}
+	}
+
+	return window, time.Duration(float64(window) * percent / 100)
+}
+
+// used drops expired history and returns the airtime spent in the window. The lock must be held
+func (d *dutyCycle) used(now time.Time, window time.Duration) time.Duration {
+
+	start := now.Add(-window)
+	for len(d.history) > 0 && !d.history[0].at.After(start) {
+		d.history = d.history[1:]
+	}
+
+	total := time.Duration(0)
+	for _, use := range d.history {
+		total += use.airtime
+	}
+	return total
+}
+
+// reserve records the airtime of a packet if it fits in the budget, otherwise it returns how long
+// to wait until enough of the window has expired
+func (d *dutyCycle) reserve(airtime time.Duration, now time.Time) (time.Duration, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.budget == nil {
+		return 0, nil
+	}
+
+	window, allowed := d.limits()
+	if airtime > allowed {
+		return 0, ErrDutyCycleExceeded
+	}
+
+	used := d.used(now, window)
+	if used+airtime <= allowed {
+		d.history = append(d.history, airtimeUse{at: now, airtime: airtime})
+		return 0, nil
+	}
+
+	// Find when enough airtime leaves the window for this packet to fit
+	excess := used + airtime - allowed
+	for _, use := range d.history {
+		excess -= use.airtime
+		if excess <= 0 {
+			return use.at.Add(window).Sub(now), ErrDutyCycleExceeded
+		}
+	}
+
+	return window, ErrDutyCycleExceeded
+}
+
+// release gives back the airtime reserved for a packet that was never transmitted
+func (d *dutyCycle) release(use airtimeUse) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := range d.history {
+		if d.history[i] == use {
+			d.history = append(d.history[:i], d.history[i+1:]...)
+			return
+		}
+	}
+}
+
+// waitForAirtime blocks until the duty cycle budget has room for the packet or the context is done. The
+// returned function gives the reserved airtime back if the packet isn't sent after all
+func (r *Radio) waitForAirtime(ctx context.Context, packet *pb.MeshPacket) (release func(), err error) {
+	d := r.airtime()
+	d.mu.Lock()
+	budget := d.budget
+	d.mu.Unlock()
+
+	if budget == nil {
+		return func() {}, nil
+	}
+
+	airtime, err := r.EstimateAirtime(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		now := time.Now()
+		wait, err := d.reserve(airtime, now)
+		if err == nil {
+			return func() { d.release(airtimeUse{at: now, airtime: airtime}) }, nil
+		}
+		if budget.RejectWhenExceeded || wait == 0 {
+			return nil, err
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package gomesh
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+func TestAirtime(t *testing.T) {
+
+	params, err := LoRaParamsFromConfig(&pb.Config_LoRaConfig{UsePreset: true, ModemPreset: pb.Config_LoRaConfig_LONG_FAST})
+	if err != nil {
+		t.Fatalf("Error getting modem settings: %v", err)
+	}
+
+	// SF11 at 250kHz has an 8.192ms symbol, 20.25 preamble symbols and 58 payload symbols for 50 bytes
+	expected := 641024 * time.Microsecond
+	if airtime := params.Airtime(50); airtime != expected {
+		t.Fatalf("Expected airtime of %v, got %v", expected, airtime)
+	}
+
+	custom, err := LoRaParamsFromConfig(&pb.Config_LoRaConfig{Bandwidth: 62, SpreadFactor: 12, CodingRate: 8})
+	if err != nil {
+		t.Fatalf("Error getting custom modem settings: %v", err)
+	}
+
+	if custom != presetParams[pb.Config_LoRaConfig_VERY_LONG_SLOW] {
+		t.Fatalf("Custom settings don't match VERY_LONG_SLOW: %v", custom)
+	}
+}
+
+func TestDutyCycleBudget(t *testing.T) {
+
+	radio := Radio{}
+	radio.airtime().handleLoRaConfig(&pb.Config_LoRaConfig{UsePreset: true, Region: pb.Config_LoRaConfig_EU_868})
+	radio.SetDutyCycleBudget(DutyCycleBudget{Window: 10 * time.Second, RejectWhenExceeded: true})
+
+	d := radio.airtime()
+	now := time.Now()
+
+	if _, err := d.reserve(600*time.Millisecond, now); err != nil {
+		t.Fatalf("Expected packet to fit in the budget: %v", err)
+	}
+
+	wait, err := d.reserve(600*time.Millisecond, now.Add(time.Second))
+	if err != ErrDutyCycleExceeded {
+		t.Fatalf("Expected duty cycle limit, got: %v", err)
+	}
+	if wait != 9*time.Second {
+		t.Fatalf("Unexpected wait: %v", wait)
+	}
+
+	if _, err := d.reserve(600*time.Millisecond, now.Add(11*time.Second)); err != nil {
+		t.Fatalf("Expected packet to fit after the window moved: %v", err)
+	}
+}
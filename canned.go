@@ -0,0 +1,249 @@
+package gomesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// cannedMessageSeparator separates the canned messages stored by the firmware
+const cannedMessageSeparator = "|"
+
+// maxCannedMessagesLen is the longest canned message list the firmware stores, separators included
+const maxCannedMessagesLen = 200
+
+// maxCannedMessages is how many canned messages the firmware shows
+const maxCannedMessages = 50
+
+// maxRingtoneLen is the longest ringtone the firmware stores
+const maxRingtoneLen = 230
+
+// rtttlNote matches a single note of an RTTTL ringtone
+var rtttlNote = regexp.MustCompile(`^(1|2|4|8|16|32)?([a-gh]|p)(#?)(\.?)([4-7]?)(\.?)$`)
+
+// ValidateCannedMessages checks a canned message list against the limits of the firmware
+func ValidateCannedMessages(messages []string) error {
+
+	if len(messages) > maxCannedMessages {
+		return fmt.Errorf("too many canned messages, the limit is %d", maxCannedMessages)
+	}
+
+	for i, message := range messages {
+		if message == "" {
+			return fmt.Errorf("canned message %d is empty", i+1)
+		}
+		if strings.Contains(message, cannedMessageSeparator) {
+			return fmt.Errorf("canned message %d contains the separator %s", i+1, cannedMessageSeparator)
+		}
+	}
+
+	if length := len(strings.Join(messages, cannedMessageSeparator)); length > maxCannedMessagesLen {
+		return fmt.Errorf("canned messages are %d bytes, the limit is %d", length, maxCannedMessagesLen)
+	}
+
+	return nil
+}
+
+// SetCannedMessages replaces the canned messages of the radio
+func (r *Radio) SetCannedMessages(messages []string) error {
+
+	if err := ValidateCannedMessages(messages); err != nil {
+		return err
+	}
+
+	adminPacket := pb.AdminMessage{
+		PayloadVariant: &pb.AdminMessage_SetCannedMessageModuleMessages{
+			SetCannedMessageModuleMessages: strings.Join(messages, cannedMessageSeparator),
+		},
+	}
+
+	return sendAdminMessage(&adminPacket, r)
+}
+
+// GetCannedMessages returns the canned messages of the radio
+func (r *Radio) GetCannedMessages(ctx context.Context) ([]string, error) {
+
+	adminPacket := pb.AdminMessage{
+		PayloadVariant: &pb.AdminMessage_GetCannedMessageModuleMessagesRequest{
+			GetCannedMessageModuleMessagesRequest: true,
+		},
+	}
+
+	response, err := r.requestAdmin(ctx, &adminPacket, func(message *pb.AdminMessage) bool {
+		_, ok := message.PayloadVariant.(*pb.AdminMessage_GetCannedMessageModuleMessagesResponse)
+		return ok
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]string, 0)
+	for _, message := range strings.Split(response.GetGetCannedMessageModuleMessagesResponse(), cannedMessageSeparator) {
+		if message != "" {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages, nil
+}
+
+// RingtoneNote is a single note of an RTTTL ringtone. Duration and Octave are 0 when the ringtone defaults apply
+type RingtoneNote struct {
+	Duration int
+	// Note is a to g, h for b in some ringtones, or p for a pause
+	Note   string
+	Sharp  bool
+	Dotted bool
+	Octave int
+}
+
+// Ringtone is a parsed RTTTL ringtone
+type Ringtone struct {
+	Name string
+	// Duration, Octave and BPM are the defaults of the ringtone
+	Duration int
+	Octave   int
+	BPM      int
+	Notes    []RingtoneNote
+}
+
+// ParseRingtone parses and validates an RTTTL ringtone such as "scale:d=4,o=5,b=120:c,d,e,f,g,a,b,c6"
+func ParseRingtone(ringtone string) (Ringtone, error) {
+
+	parts := strings.Split(strings.TrimSpace(ringtone), ":")
+	if len(parts) != 3 {
+		return Ringtone{}, errors.New("ringtone must have a name, defaults and notes separated by ':'")
+	}
+
+	parsed := Ringtone{Name: strings.TrimSpace(parts[0]), Duration: 4, Octave: 6, BPM: 63}
+
+	if strings.TrimSpace(parts[1]) != "" {
+		for _, setting := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(setting), "=", 2)
+			if len(kv) != 2 {
+				return Ringtone{}, fmt.Errorf("invalid ringtone default %q", setting)
+			}
+
+			value, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return Ringtone{}, fmt.Errorf("invalid ringtone default %q", setting)
+			}
+
+			switch strings.ToLower(strings.TrimSpace(kv[0])) {
+			case "d":
+				if !validRingtoneDuration(value) {
+					return Ringtone{}, fmt.Errorf("invalid default duration %d", value)
+				}
+				parsed.Duration = value
+			case "o":
+				if value < 4 || value > 7 {
+					return Ringtone{}, fmt.Errorf("invalid default octave %d", value)
+				}
+				parsed.Octave = value
+			case "b":
+				if value <= 0 || value > 900 {
+					return Ringtone{}, fmt.Errorf("invalid beats per minute %d", value)
+				}
+				parsed.BPM = value
+			default:
+				return Ringtone{}, fmt.Errorf("unknown ringtone default %q", kv[0])
+			}
+		}
+	}
+
+	for _, note := range strings.Split(parts[2], ",") {
+		note = strings.ToLower(strings.TrimSpace(note))
+		match := rtttlNote.FindStringSubmatch(note)
+		if match == nil {
+			return Ringtone{}, fmt.Errorf("invalid ringtone note %q", note)
+		}
+
+		n := RingtoneNote{Note: match[2], Sharp: match[3] != "", Dotted: match[4] != "" || match[6] != ""}
+		if match[1] != "" {
+			n.Duration, _ = strconv.Atoi(match[1])
+		}
+		if match[5] != "" {
+			n.Octave, _ = strconv.Atoi(match[5])
+		}
+		parsed.Notes = append(parsed.Notes, n)
+	}
+
+	return parsed, nil
+}
+
+func validRingtoneDuration(duration int) bool {
+	switch duration {
+	case 1, 2, 4, 8, 16, 32:
+		return true
+	}
+	return false
+}
+
+// String returns the ringtone in RTTTL format
+func (r Ringtone) String() string {
+
+	notes := make([]string, len(r.Notes))
+	for i, n := range r.Notes {
+		note := ""
+		if n.Duration != 0 {
+			note += strconv.Itoa(n.Duration)
+		}
+		note += n.Note
+		if n.Sharp {
+			note += "#"
+		}
+		if n.Octave != 0 {
+			note += strconv.Itoa(n.Octave)
+		}
+		if n.Dotted {
+			note += "."
+		}
+		notes[i] = note
+	}
+
+	return fmt.Sprintf("%s:d=%d,o=%d,b=%d:%s", r.Name, r.Duration, r.Octave, r.BPM, strings.Join(notes, ","))
+}
+
+// SetRingtone sets the ringtone the radio plays on its buzzer. The ringtone is validated as RTTTL first
+func (r *Radio) SetRingtone(ringtone string) error {
+
+	if _, err := ParseRingtone(ringtone); err != nil {
+		return err
+	}
+	if len(ringtone) > maxRingtoneLen {
+		return fmt.Errorf("ringtone is %d bytes, the limit is %d", len(ringtone), maxRingtoneLen)
+	}
+
+	adminPacket := pb.AdminMessage{
+		PayloadVariant: &pb.AdminMessage_SetRingtoneMessage{
+			SetRingtoneMessage: ringtone,
+		},
+	}
+
+	return sendAdminMessage(&adminPacket, r)
+}
+
+// GetRingtone returns the ringtone of the radio in RTTTL format
+func (r *Radio) GetRingtone(ctx context.Context) (string, error) {
+
+	adminPacket := pb.AdminMessage{
+		PayloadVariant: &pb.AdminMessage_GetRingtoneRequest{
+			GetRingtoneRequest: true,
+		},
+	}
+
+	response, err := r.requestAdmin(ctx, &adminPacket, func(message *pb.AdminMessage) bool {
+		_, ok := message.PayloadVariant.(*pb.AdminMessage_GetRingtoneResponse)
+		return ok
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return response.GetGetRingtoneResponse(), nil
+}
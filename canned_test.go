@@ -0,0 +1,50 @@
+package gomesh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCannedMessages(t *testing.T) {
+
+	if err := ValidateCannedMessages([]string{"Yes", "No", "On my way"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	invalid := [][]string{
+		{"Yes", ""},
+		{"Yes|No"},
+		{strings.Repeat("a", 150), strings.Repeat("b", 50)},
+		make([]string, 51),
+	}
+	for _, messages := range invalid {
+		if err := ValidateCannedMessages(messages); err == nil {
+			t.Fatalf("Expected an error for %q", messages)
+		}
+	}
+}
+
+func TestParseRingtone(t *testing.T) {
+
+	ringtone, err := ParseRingtone("24:d=32,o=5,b=565:f6,p,f6,4p,p,f6,p,f6,2p,p,b6,p,b6,p,b6,p,b6,p,b,p,b,p,b,p,b,p,b,p,b,p,b")
+	if err != nil {
+		t.Fatalf("Error parsing ringtone: %v", err)
+	}
+	if ringtone.Name != "24" || ringtone.Duration != 32 || ringtone.Octave != 5 || ringtone.BPM != 565 || len(ringtone.Notes) != 31 {
+		t.Fatalf("Unexpected ringtone: %+v", ringtone)
+	}
+	if n := ringtone.Notes[3]; n.Duration != 4 || n.Note != "p" {
+		t.Fatalf("Unexpected note: %+v", n)
+	}
+
+	again, err := ParseRingtone("scale:d=4,o=5,b=120:8c#6.,d,e")
+	if err != nil || again.String() != "scale:d=4,o=5,b=120:8c#6.,d,e" {
+		t.Fatalf("Unexpected round trip: %v %v", again, err)
+	}
+
+	for _, invalid := range []string{"no notes", "x:d=3:c", "x:d=4:q", "x:z=1:c", "x:o=9:c"} {
+		if _, err := ParseRingtone(invalid); err == nil {
+			t.Fatalf("Expected an error for %q", invalid)
+		}
+	}
+}
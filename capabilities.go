@@ -0,0 +1,169 @@
+package gomesh
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// minFileTransferFirmware is the first firmware that transfers files over XModem
+var minFileTransferFirmware = FirmwareVersion{Major: 2, Minor: 2}
+
+// minFileListFirmware is the first firmware that lists its files during the config handshake
+var minFileListFirmware = FirmwareVersion{Major: 2, Minor: 5}
+
+// FirmwareVersion is the release part of a firmware version such as 2.3.2.63df972
+type FirmwareVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseFirmwareVersion parses the version string a device reports. Anything after the patch number, such
+// as the commit hash, is ignored
+func ParseFirmwareVersion(s string) (FirmwareVersion, error) {
+
+	parts := strings.SplitN(strings.TrimPrefix(s, "v"), ".", 4)
+	if len(parts) < 3 {
+		return FirmwareVersion{}, errors.New("invalid firmware version")
+	}
+
+	var numbers [3]int
+	for i := range numbers {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return FirmwareVersion{}, errors.New("invalid firmware version")
+		}
+		numbers[i] = n
+	}
+
+	return FirmwareVersion{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+// AtLeast reports whether the version is the same as or newer than another
+func (v FirmwareVersion) AtLeast(other FirmwareVersion) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor > other.Minor
+	}
+	return v.Patch >= other.Patch
+}
+
+func (v FirmwareVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Capabilities describes the connected device from the metadata it sends during the config handshake
+type Capabilities struct {
+	// Known is false until the device has sent its metadata, which firmware before 2.1 never does. Nothing
+	// is refused while it is false
+	Known bool
+	// FirmwareVersion is the version string as reported, Firmware is its parsed release
+	FirmwareVersion string
+	Firmware        FirmwareVersion
+	HwModel         pb.HardwareModel
+	Role            pb.Config_DeviceConfig_Role
+
+	CanShutdown       bool
+	HasWifi           bool
+	HasBluetooth      bool
+	HasEthernet       bool
+	HasRemoteHardware bool
+}
+
+// handleMetadata records the metadata the device sent
+func (c *connection) handleMetadata(metadata *pb.DeviceMetadata) {
+	c.mu.Lock()
+	c.metadata = proto.Clone(metadata).(*pb.DeviceMetadata)
+	c.mu.Unlock()
+}
+
+// Metadata returns the metadata the device sent during the config handshake
+func (r *Radio) Metadata() (*pb.DeviceMetadata, bool) {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.metadata == nil {
+		return nil, false
+	}
+	return proto.Clone(c.metadata).(*pb.DeviceMetadata), true
+}
+
+// Capabilities returns what the connected device reported it can do
+func (r *Radio) Capabilities() Capabilities {
+
+	metadata, ok := r.Metadata()
+	if !ok {
+		return Capabilities{}
+	}
+
+	// A version that doesn't parse is left as 0.0.0, which only limits features that need a newer release
+	firmware, _ := ParseFirmwareVersion(metadata.FirmwareVersion)
+
+	return Capabilities{
+		Known:             true,
+		FirmwareVersion:   metadata.FirmwareVersion,
+		Firmware:          firmware,
+		HwModel:           metadata.HwModel,
+		Role:              metadata.Role,
+		CanShutdown:       metadata.CanShutdown,
+		HasWifi:           metadata.HasWifi,
+		HasBluetooth:      metadata.HasBluetooth,
+		HasEthernet:       metadata.HasEthernet,
+		HasRemoteHardware: metadata.HasRemoteHardware,
+	}
+}
+
+// require returns ErrUnsupported when the device reported capabilities that fail a check
+func (r *Radio) require(supported func(Capabilities) bool) error {
+	caps := r.Capabilities()
+	if caps.Known && !supported(caps) {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+// supportsFiles reports whether the firmware can transfer files
+func supportsFiles(caps Capabilities) bool {
+	return caps.Firmware.AtLeast(minFileTransferFirmware)
+}
+
+// supportsFileList reports whether the firmware lists its files
+func supportsFileList(caps Capabilities) bool {
+	return caps.Firmware.AtLeast(minFileListFirmware)
+}
+
+// Shutdown turns the device off after a delay. Devices that can't power themselves off return ErrUnsupported
+func (r *Radio) Shutdown(seconds int32) error {
+
+	if err := r.require(func(caps Capabilities) bool { return caps.CanShutdown }); err != nil {
+		return err
+	}
+
+	adminPacket := pb.AdminMessage{
+		PayloadVariant: &pb.AdminMessage_ShutdownSeconds{
+			ShutdownSeconds: seconds,
+		},
+	}
+
+	return sendAdminMessage(&adminPacket, r)
+}
+
+// Reboot restarts the device after a delay
+func (r *Radio) Reboot(seconds int32) error {
+
+	adminPacket := pb.AdminMessage{
+		PayloadVariant: &pb.AdminMessage_RebootSeconds{
+			RebootSeconds: seconds,
+		},
+	}
+
+	return sendAdminMessage(&adminPacket, r)
+}
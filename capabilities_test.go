@@ -0,0 +1,65 @@
+package gomesh
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+func TestParseFirmwareVersion(t *testing.T) {
+
+	version, err := ParseFirmwareVersion("2.3.12.24458a7")
+	if err != nil {
+		t.Fatalf("Error parsing version: %v", err)
+	}
+	if version != (FirmwareVersion{2, 3, 12}) {
+		t.Errorf("Expected 2.3.12, got %v", version)
+	}
+	if !version.AtLeast(FirmwareVersion{2, 3, 2}) || version.AtLeast(FirmwareVersion{2, 4, 0}) {
+		t.Errorf("Unexpected comparison for %v", version)
+	}
+
+	for _, bad := range []string{"", "2.3", "two.3.1"} {
+		if _, err := ParseFirmwareVersion(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+
+	transport := newFakeDevice(nil, nil)
+	radio := Radio{nodeNum: 1, streamer: streamer{transport: transport}}
+
+	if caps := radio.Capabilities(); caps.Known {
+		t.Errorf("Expected unknown capabilities before the handshake, got %+v", caps)
+	}
+	if err := radio.Shutdown(5); err != nil {
+		t.Errorf("Expected shutdown to be sent to a device without metadata, got %v", err)
+	}
+
+	radio.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_Metadata{Metadata: &pb.DeviceMetadata{
+		FirmwareVersion: "2.1.5.abcdef0",
+		HwModel:         pb.HardwareModel_RAK4631,
+		HasBluetooth:    true,
+	}}})
+
+	caps := radio.Capabilities()
+	if !caps.Known || caps.Firmware != (FirmwareVersion{2, 1, 5}) || caps.HwModel != pb.HardwareModel_RAK4631 || !caps.HasBluetooth || caps.CanShutdown {
+		t.Errorf("Unexpected capabilities %+v", caps)
+	}
+
+	if err := radio.Shutdown(5); err != ErrUnsupported {
+		t.Errorf("Expected ErrUnsupported for shutdown, got %v", err)
+	}
+	if err := radio.UploadFile(context.Background(), "/prefs/test", []byte("x"), nil); err != ErrUnsupported {
+		t.Errorf("Expected ErrUnsupported for file transfer, got %v", err)
+	}
+	if _, err := radio.GetRemoteHardwarePins(context.Background()); err != ErrUnsupported {
+		t.Errorf("Expected ErrUnsupported for remote hardware, got %v", err)
+	}
+	if err := radio.Reboot(5); err != nil {
+		t.Errorf("Error rebooting: %v", err)
+	}
+}
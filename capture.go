@@ -0,0 +1,386 @@
+package gomesh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// CaptureLinkType is the pcapng link type of captured frames, LINKTYPE_USER0. Wireshark can be told how to
+// dissect it in its DLT_USER preferences
+const CaptureLinkType = 147
+
+// captureMagic starts a capture in the native format
+var captureMagic = []byte("GOMESHCAP\x01")
+
+// captureHeaderLen is the length of the time, direction and length before each frame in the native format
+const captureHeaderLen = 13
+
+// captureMaxFrameLen is the largest frame a capture holds
+const captureMaxFrameLen = 1 << 16
+
+// Block types and options of the pcapng format
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngOptionEnd      = 0
+	pcapngOptionEPBFlags = 2
+	pcapngOptionTSResol  = 9
+	pcapngFlagInbound    = 1
+	pcapngFlagOutbound   = 2
+	pcapngMaxBlockLen    = 1 << 20
+)
+
+// CaptureFormat is the file format of a capture
+type CaptureFormat int
+
+const (
+	// CaptureNative is a compact format that only goMesh reads
+	CaptureNative CaptureFormat = iota
+	// CapturePcapng can be opened in Wireshark and read back by goMesh
+	CapturePcapng
+)
+
+// CaptureFrame is a raw frame read from or written to the device, header included
+type CaptureFrame struct {
+	Time      time.Time
+	Direction PacketDirection
+	Data      []byte
+}
+
+// CaptureWriter records frames to a file
+type CaptureWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format CaptureFormat
+}
+
+// NewCaptureWriter starts a capture by writing the file header
+func NewCaptureWriter(w io.Writer, format CaptureFormat) (*CaptureWriter, error) {
+
+	c := &CaptureWriter{w: w, format: format}
+
+	var err error
+	switch format {
+	case CaptureNative:
+		_, err = w.Write(captureMagic)
+	case CapturePcapng:
+		err = c.writePcapngHeader()
+	default:
+		err = errors.New("unknown capture format")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// writePcapngHeader writes the section header and the interface description with nanosecond timestamps
+func (c *CaptureWriter) writePcapngHeader() error {
+
+	section := make([]byte, 28)
+	binary.LittleEndian.PutUint32(section[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(section[4:], 28)
+	binary.LittleEndian.PutUint32(section[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(section[12:], 1)
+	binary.LittleEndian.PutUint64(section[16:], math.MaxUint64)
+	binary.LittleEndian.PutUint32(section[24:], 28)
+
+	iface := make([]byte, 32)
+	binary.LittleEndian.PutUint32(iface[0:], pcapngInterface)
+	binary.LittleEndian.PutUint32(iface[4:], 32)
+	binary.LittleEndian.PutUint16(iface[8:], CaptureLinkType)
+	binary.LittleEndian.PutUint16(iface[16:], pcapngOptionTSResol)
+	binary.LittleEndian.PutUint16(iface[18:], 1)
+	iface[20] = 9
+	binary.LittleEndian.PutUint32(iface[28:], 32)
+
+	_, err := c.w.Write(append(section, iface...))
+	return err
+}
+
+// WriteFrame records a frame
+func (c *CaptureWriter) WriteFrame(frame CaptureFrame) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(frame.Data) > captureMaxFrameLen {
+		return errors.New("frame too large to capture")
+	}
+
+	var record []byte
+	if c.format == CapturePcapng {
+		record = encodePcapngPacket(frame)
+	} else {
+		record = make([]byte, captureHeaderLen, captureHeaderLen+len(frame.Data))
+		binary.BigEndian.PutUint64(record, uint64(frame.Time.UnixNano()))
+		record[8] = byte(frame.Direction)
+		binary.BigEndian.PutUint32(record[9:], uint32(len(frame.Data)))
+		record = append(record, frame.Data...)
+	}
+
+	_, err := c.w.Write(record)
+	return err
+}
+
+// encodePcapngPacket builds an enhanced packet block with the direction in the flags option
+func encodePcapngPacket(frame CaptureFrame) []byte {
+
+	padded := (len(frame.Data) + 3) &^ 3
+	length := 28 + padded + 12 + 4
+	block := make([]byte, length)
+
+	ts := uint64(frame.Time.UnixNano())
+	binary.LittleEndian.PutUint32(block[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(block[4:], uint32(length))
+	binary.LittleEndian.PutUint32(block[12:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(ts))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(frame.Data)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(len(frame.Data)))
+	copy(block[28:], frame.Data)
+
+	options := block[28+padded:]
+	flags := uint32(pcapngFlagInbound)
+	if frame.Direction == PacketSent {
+		flags = pcapngFlagOutbound
+	}
+	binary.LittleEndian.PutUint16(options[0:], pcapngOptionEPBFlags)
+	binary.LittleEndian.PutUint16(options[2:], 4)
+	binary.LittleEndian.PutUint32(options[4:], flags)
+	binary.LittleEndian.PutUint32(block[length-4:], uint32(length))
+
+	return block
+}
+
+// CaptureReader reads frames back from a capture in either format
+type CaptureReader struct {
+	r      *bufio.Reader
+	format CaptureFormat
+	order  binary.ByteOrder
+	// resolution holds the timestamp unit of each pcapng interface
+	resolution []time.Duration
+}
+
+// NewCaptureReader reads the file header of a capture and detects its format
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+
+	c := &CaptureReader{r: bufio.NewReader(r)}
+
+	start, err := c.r.Peek(len(captureMagic))
+	if err != nil {
+		return nil, errors.New("not a capture file")
+	}
+
+	if bytes.Equal(start, captureMagic) {
+		c.format = CaptureNative
+		c.r.Discard(len(captureMagic))
+		return c, nil
+	}
+
+	if binary.LittleEndian.Uint32(start) == pcapngSectionHeader {
+		c.format = CapturePcapng
+		return c, nil
+	}
+
+	return nil, errors.New("not a capture file")
+}
+
+// Format returns the format of the capture
+func (c *CaptureReader) Format() CaptureFormat {
+	return c.format
+}
+
+// ReadFrame returns the next frame, or io.EOF at the end of the capture
+func (c *CaptureReader) ReadFrame() (CaptureFrame, error) {
+
+	if c.format == CapturePcapng {
+		return c.readPcapngFrame()
+	}
+
+	header := make([]byte, captureHeaderLen)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return CaptureFrame{}, errors.New("capture ends in the middle of a frame")
+		}
+		return CaptureFrame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[9:])
+	if length > captureMaxFrameLen {
+		return CaptureFrame{}, errors.New("invalid frame length in capture")
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return CaptureFrame{}, errors.New("capture ends in the middle of a frame")
+	}
+
+	return CaptureFrame{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header))),
+		Direction: PacketDirection(header[8]),
+		Data:      data,
+	}, nil
+}
+
+// readPcapngFrame reads blocks until the next enhanced packet block
+func (c *CaptureReader) readPcapngFrame() (CaptureFrame, error) {
+
+	for {
+		header := make([]byte, 12)
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return CaptureFrame{}, errors.New("capture ends in the middle of a block")
+			}
+			return CaptureFrame{}, err
+		}
+
+		// The section header sets the byte order of everything that follows
+		if binary.LittleEndian.Uint32(header) == pcapngSectionHeader {
+			switch {
+			case binary.LittleEndian.Uint32(header[8:]) == pcapngByteOrderMagic:
+				c.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(header[8:]) == pcapngByteOrderMagic:
+				c.order = binary.BigEndian
+			default:
+				return CaptureFrame{}, errors.New("invalid pcapng section header")
+			}
+			c.resolution = nil
+		}
+		if c.order == nil {
+			return CaptureFrame{}, errors.New("pcapng block before the section header")
+		}
+
+		length := c.order.Uint32(header[4:])
+		if length < 16 || length%4 != 0 || length > pcapngMaxBlockLen {
+			return CaptureFrame{}, errors.New("invalid pcapng block length")
+		}
+
+		// The body is everything after the type and length, without the trailing length
+		body := make([]byte, length-12)
+		copy(body, header[8:])
+		if _, err := io.ReadFull(c.r, body[4:]); err != nil {
+			return CaptureFrame{}, errors.New("capture ends in the middle of a block")
+		}
+		if _, err := c.r.Discard(4); err != nil {
+			return CaptureFrame{}, errors.New("capture ends in the middle of a block")
+		}
+
+		switch c.order.Uint32(header) {
+		case pcapngInterface:
+			c.resolution = append(c.resolution, c.interfaceResolution(body))
+		case pcapngEnhancedPacket:
+			return c.parsePcapngPacket(body)
+		}
+	}
+}
+
+// interfaceResolution reads the timestamp unit of an interface description, microseconds by default
+func (c *CaptureReader) interfaceResolution(body []byte) time.Duration {
+
+	resolution := time.Microsecond
+	if len(body) < 8 {
+		return resolution
+	}
+
+	pcapngOptions(c.order, body[8:], func(code uint16, value []byte) {
+		if code != pcapngOptionTSResol || len(value) < 1 {
+			return
+		}
+		exponent := int(value[0] & 0x7f)
+		if value[0]&0x80 != 0 {
+			resolution = time.Duration(float64(time.Second) / math.Pow(2, float64(exponent)))
+		} else {
+			resolution = time.Duration(float64(time.Second) / math.Pow(10, float64(exponent)))
+		}
+	})
+
+	return resolution
+}
+
+// parsePcapngPacket converts an enhanced packet block body to a frame
+func (c *CaptureReader) parsePcapngPacket(body []byte) (CaptureFrame, error) {
+
+	if len(body) < 20 {
+		return CaptureFrame{}, errors.New("invalid pcapng packet block")
+	}
+
+	iface := c.order.Uint32(body[0:])
+	ts := uint64(c.order.Uint32(body[4:]))<<32 | uint64(c.order.Uint32(body[8:]))
+	captured := int(c.order.Uint32(body[12:]))
+	padded := (captured + 3) &^ 3
+	if 20+padded > len(body) {
+		return CaptureFrame{}, errors.New("invalid pcapng packet length")
+	}
+
+	resolution := time.Microsecond
+	if int(iface) < len(c.resolution) {
+		resolution = c.resolution[iface]
+	}
+
+	frame := CaptureFrame{
+		Time:      time.Unix(0, 0).Add(time.Duration(ts) * resolution),
+		Direction: PacketReceived,
+		Data:      append([]byte(nil), body[20:20+captured]...),
+	}
+
+	pcapngOptions(c.order, body[20+padded:], func(code uint16, value []byte) {
+		if code == pcapngOptionEPBFlags && len(value) >= 4 && c.order.Uint32(value)&3 == pcapngFlagOutbound {
+			frame.Direction = PacketSent
+		}
+	})
+
+	return frame, nil
+}
+
+// pcapngOptions calls fn with every option in an options block
+func pcapngOptions(order binary.ByteOrder, options []byte, fn func(code uint16, value []byte)) {
+	for len(options) >= 4 {
+		code := order.Uint16(options)
+		length := int(order.Uint16(options[2:]))
+		if code == pcapngOptionEnd || 4+length > len(options) {
+			return
+		}
+		fn(code, options[4:4+length])
+		options = options[4+(length+3)&^3:]
+	}
+}
+
+// SetCapture records every frame read from or written to the device, nil stops recording. Frames are
+// recorded on the goroutine reading or writing, errors stop the capture
+func (r *Radio) SetCapture(w *CaptureWriter) {
+	c := r.conn()
+	c.mu.Lock()
+	c.capture = w
+	c.mu.Unlock()
+}
+
+// captureFrame records a frame when a capture is set
+func (r *Radio) captureFrame(direction PacketDirection, data []byte) {
+
+	c := r.conn()
+	c.mu.Lock()
+	w := c.capture
+	c.mu.Unlock()
+
+	if w == nil {
+		return
+	}
+
+	frame := CaptureFrame{Time: time.Now(), Direction: direction, Data: append([]byte(nil), data...)}
+	if err := w.WriteFrame(frame); err != nil {
+		c.mu.Lock()
+		if c.capture == w {
+			c.capture = nil
+		}
+		c.mu.Unlock()
+	}
+}
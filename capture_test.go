@@ -0,0 +1,128 @@
+package gomesh
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// testFrame frames a FromRadio message as the device sends it
+func testFrame(t *testing.T, fromRadio *pb.FromRadio) []byte {
+	out, err := proto.Marshal(fromRadio)
+	if err != nil {
+		t.Fatalf("Error marshalling frame: %v", err)
+	}
+	return append([]byte{start1, start2, byte(len(out) >> 8), byte(len(out))}, out...)
+}
+
+func TestCaptureFormats(t *testing.T) {
+
+	frames := []CaptureFrame{
+		{Time: time.Unix(1700000000, 123456789), Direction: PacketSent, Data: []byte{start1, start2, 0, 1, 0x18}},
+		{Time: time.Unix(1700000001, 5), Direction: PacketReceived, Data: bytes.Repeat([]byte{7}, 301)},
+	}
+
+	for _, format := range []CaptureFormat{CaptureNative, CapturePcapng} {
+		var file bytes.Buffer
+		w, err := NewCaptureWriter(&file, format)
+		if err != nil {
+			t.Fatalf("Error creating capture: %v", err)
+		}
+		for _, frame := range frames {
+			if err := w.WriteFrame(frame); err != nil {
+				t.Fatalf("Error writing frame: %v", err)
+			}
+		}
+
+		r, err := NewCaptureReader(&file)
+		if err != nil || r.Format() != format {
+			t.Fatalf("Capture format not detected: %v", err)
+		}
+		for _, want := range frames {
+			got, err := r.ReadFrame()
+			if err != nil {
+				t.Fatalf("Error reading frame: %v", err)
+			}
+			if !got.Time.Equal(want.Time) || got.Direction != want.Direction || !bytes.Equal(got.Data, want.Data) {
+				t.Fatalf("Frame changed in format %d: %+v", format, got)
+			}
+		}
+		if _, err := r.ReadFrame(); err == nil {
+			t.Fatalf("Expected the end of the capture")
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+
+	var file bytes.Buffer
+	w, _ := NewCaptureWriter(&file, CaptureNative)
+
+	at := time.Unix(1700000000, 0)
+	// The text arrives two minutes after the handshake, over a second at the replay speed
+	offsets := []time.Duration{0, time.Second, 2 * time.Minute}
+	for i, fromRadio := range []*pb.FromRadio{
+		{PayloadVariant: &pb.FromRadio_MyInfo{MyInfo: &pb.MyNodeInfo{MyNodeNum: 0xabcd}}},
+		{PayloadVariant: &pb.FromRadio_ConfigCompleteId{ConfigCompleteId: 42}},
+		textPacket(1, 0x1234, broadcastNum, 0, "replayed", 0, false),
+	} {
+		w.WriteFrame(CaptureFrame{Time: at.Add(offsets[i]), Direction: PacketReceived, Data: testFrame(t, fromRadio)})
+	}
+
+	capture, err := NewCaptureReader(&file)
+	if err != nil {
+		t.Fatalf("Error opening capture: %v", err)
+	}
+
+	radio := Radio{}
+	var recorded bytes.Buffer
+	recording, _ := NewCaptureWriter(&recorded, CapturePcapng)
+	radio.SetCapture(recording)
+
+	if err := radio.InitReplay(capture, ReplayOptions{Speed: 100}); err != nil {
+		t.Fatalf("Error starting replay: %v", err)
+	}
+	if radio.nodeNum != 0xabcd || radio.State() != StateConfigured {
+		t.Fatalf("Handshake wasn't replayed: node %x state %v", radio.nodeNum, radio.State())
+	}
+
+	var text string
+	for {
+		packets, err := radio.ReadResponse(true)
+		for _, packet := range packets {
+			if data := packet.GetPacket().GetDecoded(); data != nil {
+				text = string(data.Payload)
+			}
+		}
+		if err != nil {
+			if err != ErrReplayFinished {
+				t.Fatalf("Expected the replay to finish, got %v", err)
+			}
+			break
+		}
+	}
+	if text != "replayed" {
+		t.Fatalf("Replayed text packet wasn't read, got %q", text)
+	}
+
+	// The recording holds the config request and every replayed frame
+	reader, _ := NewCaptureReader(&recorded)
+	sent, received := 0, 0
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			break
+		}
+		if frame.Direction == PacketSent {
+			sent++
+		} else {
+			received++
+		}
+	}
+	if sent != 1 || received != 3 {
+		t.Fatalf("Expected 1 sent and 3 received frames, got %d and %d", sent, received)
+	}
+}
@@ -0,0 +1,89 @@
+// Command gomesh-http serves a radio over the goMesh HTTP API
+//
+//	gomesh-http -radio /dev/ttyUSB0 -addr :8080 -token secret
+//
+// Without a token the API is only served on a loopback address, and only to requests addressed to a
+// loopback name unless -hosts lists others
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/lmatte7/gomesh"
+	"github.com/lmatte7/gomesh/httpapi"
+)
+
+func main() {
+
+	port := flag.String("radio", "", "serial port or IP address of the radio")
+	addr := flag.String("addr", "127.0.0.1:8080", "address to serve the API on")
+	token := flag.String("token", os.Getenv("GOMESH_API_TOKEN"), "bearer token clients must send, none when empty")
+	hosts := flag.String("hosts", "", "comma separated host names clients may address the API as besides loopback ones, any with a token when empty")
+	flag.Parse()
+
+	if *port == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *token == "" && !isLoopback(*addr) {
+		log.Fatalf("Refusing to serve on %s without -token, the API can send messages and change the radio", *addr)
+	}
+
+	radio := gomesh.Radio{}
+	if err := radio.Init(*port); err != nil {
+		log.Fatalf("Error connecting to %s: %v", *port, err)
+	}
+	defer radio.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	opts := httpapi.Options{Token: *token}
+	if *hosts != "" {
+		opts.AllowedHosts = strings.Split(*hosts, ",")
+	}
+	api := httpapi.New(&radio, opts)
+	defer api.Close()
+
+	go func() {
+		if err := api.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Error reading from radio: %v", err)
+			stop()
+		}
+	}()
+
+	server := &http.Server{Addr: *addr, Handler: api}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	log.Printf("Serving %s on %s", *port, *addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// isLoopback reports whether an address only accepts connections from this machine
+func isLoopback(addr string) bool {
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
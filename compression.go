@@ -0,0 +1,98 @@
+package gomesh
+
+import (
+	"bytes"
+	"context"
+	"unicode/utf8"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// SetTextCompression makes SendTextMessage send Unishox2 compressed text on TEXT_MESSAGE_COMPRESSED_APP
+// when that makes the message smaller. Messages that don't shrink are sent as plain text
+func (r *Radio) SetTextCompression(enabled bool) {
+	c := r.conn()
+	c.mu.Lock()
+	r.compressText = enabled
+	c.mu.Unlock()
+}
+
+// textCompression reports whether text messages are compressed
+func (r *Radio) textCompression() bool {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return r.compressText
+}
+
+// CompressText compresses a text message with Unishox2 as the firmware does for TEXT_MESSAGE_COMPRESSED_APP.
+// It returns false when the compressed text isn't smaller than the original
+func CompressText(message string) ([]byte, bool) {
+
+	compressed := unishoxCompress([]byte(message))
+	if len(compressed) >= len(message) {
+		return nil, false
+	}
+
+	// Only use output that is known to decompress to the same text
+	if decompressed, err := unishoxDecompress(compressed); err != nil || !bytes.Equal(decompressed, []byte(message)) {
+		return nil, false
+	}
+
+	return compressed, true
+}
+
+// DecompressText decompresses the payload of a TEXT_MESSAGE_COMPRESSED_APP packet
+func DecompressText(payload []byte) (string, error) {
+	text, err := unishoxDecompress(payload)
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// textPayload returns the port and payload to send a text message with, compressing it when enabled
+func textPayload(message string, compress bool) (pb.PortNum, []byte) {
+	if compress {
+		if compressed, ok := CompressText(message); ok {
+			return pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP, compressed
+		}
+	}
+	return pb.PortNum_TEXT_MESSAGE_APP, []byte(message)
+}
+
+// SendCompressedText sends a text message compressed with Unishox2, falling back to plain text when
+// compression doesn't make it smaller. Compression also allows messages that are too long as plain text.
+// It returns the id of the sent packet
+func (r *Radio) SendCompressedText(ctx context.Context, message string, to uint32, channel uint32) (uint32, error) {
+
+	port, payload := textPayload(message, true)
+	if len(payload) > int(pb.Constants_DATA_PAYLOAD_LEN) {
+		return 0, ErrPayloadTooLarge
+	}
+
+	return r.SendData(ctx, DataRequest{
+		To:      to,
+		Channel: channel,
+		Port:    port,
+		Payload: payload,
+		WantAck: true,
+	})
+}
+
+// decompressTextPacket returns a plain text copy of a compressed text packet, so handlers and readers of
+// TEXT_MESSAGE_APP receive it like any other message. The packet itself is left as the device sent it, and
+// it is returned unchanged with false when its payload doesn't decompress
+func decompressTextPacket(packet *pb.MeshPacket) (*pb.MeshPacket, bool) {
+
+	text, err := unishoxDecompress(packet.GetDecoded().GetPayload())
+	if err != nil || !utf8.Valid(text) {
+		return packet, false
+	}
+
+	plain := proto.Clone(packet).(*pb.MeshPacket)
+	plain.GetDecoded().Portnum = pb.PortNum_TEXT_MESSAGE_APP
+	plain.GetDecoded().Payload = text
+	return plain, true
+}
@@ -0,0 +1,104 @@
+package gomesh
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+func TestTextPayload(t *testing.T) {
+
+	message := "meet at the north trailhead at seven, bring the spare batteries"
+	port, payload := textPayload(message, true)
+	if port != pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP || len(payload) >= len(message) {
+		t.Fatalf("Expected a smaller compressed payload, got %v with %d bytes", port, len(payload))
+	}
+
+	packet := &pb.MeshPacket{PayloadVariant: &pb.MeshPacket_Decoded{Decoded: &pb.Data{Portnum: port, Payload: payload}}}
+	plain, ok := decompressTextPacket(packet)
+	if data := plain.GetDecoded(); !ok || data.Portnum != pb.PortNum_TEXT_MESSAGE_APP || string(data.Payload) != message {
+		t.Fatalf("Unexpected decompressed packet %v %q", data.Portnum, data.Payload)
+	}
+	if data := packet.GetDecoded(); data.Portnum != port || !bytes.Equal(data.Payload, payload) {
+		t.Fatalf("Expected the compressed packet to be left as it was, got %v %q", data.Portnum, data.Payload)
+	}
+
+	// Text that doesn't shrink is sent as is
+	port, payload = textPayload("\x01\x02", true)
+	if port != pb.PortNum_TEXT_MESSAGE_APP || string(payload) != "\x01\x02" {
+		t.Fatalf("Expected plain text fallback, got %v", port)
+	}
+
+	port, _ = textPayload(message, false)
+	if port != pb.PortNum_TEXT_MESSAGE_APP {
+		t.Fatalf("Compressed without compression enabled")
+	}
+
+	// Long text fits once compressed
+	long := strings.Repeat("all stations check in on the hour ", 8)
+	if _, payload := textPayload(long, true); len(long) <= int(pb.Constants_DATA_PAYLOAD_LEN) || len(payload) > int(pb.Constants_DATA_PAYLOAD_LEN) {
+		t.Fatalf("Expected %d bytes of text to compress under the payload limit, got %d", len(long), len(payload))
+	}
+}
+
+func TestCompressionVectors(t *testing.T) {
+
+	for _, vector := range unishoxVectors {
+		port, payload := textPayload(vector.text, true)
+		if len(vector.data) < len(vector.text) {
+			if port != pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP || !bytes.Equal(payload, vector.data) {
+				t.Errorf("Expected %q to be sent compressed as % x, got %v % x", vector.text, vector.data, port, payload)
+			}
+		} else if port != pb.PortNum_TEXT_MESSAGE_APP {
+			t.Errorf("Expected %q to be sent as plain text, got %v", vector.text, port)
+		}
+
+		text, err := DecompressText(vector.data)
+		if err != nil || text != vector.text {
+			t.Errorf("Expected % x to decompress to %q, got %q, %v", vector.data, vector.text, text, err)
+		}
+	}
+}
+
+func TestCompressedTextRead(t *testing.T) {
+
+	compressed := unishoxVectors[1]
+	fromRadio := &pb.FromRadio{Id: 3, PayloadVariant: &pb.FromRadio_Packet{Packet: &pb.MeshPacket{
+		Id:             30,
+		From:           0xabcd,
+		To:             broadcastNum,
+		PayloadVariant: &pb.MeshPacket_Decoded{Decoded: &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP, Payload: compressed.data}},
+	}}}
+
+	link := newFakeDevice(testFrame(t, fromRadio), nil)
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: link}}
+
+	var handled, raw []byte
+	radio.HandlePort(pb.PortNum_TEXT_MESSAGE_APP, func(packet *pb.MeshPacket, data *pb.Data) { handled = data.Payload })
+	radio.onFromRadio(func(fromRadio *pb.FromRadio) { raw = fromRadio.GetPacket().GetDecoded().GetPayload() })
+
+	packets, err := radio.ReadResponse(true)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if len(packets) != 1 {
+		t.Fatalf("Expected 1 packet, got %d", len(packets))
+	}
+	if data := packets[0].GetPacket().GetDecoded(); data.Portnum != pb.PortNum_TEXT_MESSAGE_APP || string(data.Payload) != compressed.text {
+		t.Errorf("Expected readers to get plain text, got %v %q", data.Portnum, data.Payload)
+	}
+	if string(handled) != compressed.text {
+		t.Errorf("Expected handlers to get plain text, got %q", handled)
+	}
+	if !bytes.Equal(raw, compressed.data) {
+		t.Errorf("Expected the message read from the device to stay compressed, got % x", raw)
+	}
+
+	// Handling a message directly doesn't change it either
+	radio.handleFromRadio(fromRadio)
+	if data := fromRadio.GetPacket().GetDecoded(); data.Portnum != pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP || !bytes.Equal(data.Payload, compressed.data) {
+		t.Errorf("Expected the packet to be left compressed, got %v % x", data.Portnum, data.Payload)
+	}
+}
@@ -1,6 +1,7 @@
 package gomesh
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"strconv"
@@ -64,7 +65,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -85,7 +86,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -106,7 +107,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -127,7 +128,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -148,7 +149,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -169,7 +170,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -190,7 +191,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -220,7 +221,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -242,7 +243,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -264,7 +265,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -286,7 +287,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -308,7 +309,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -330,7 +331,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -352,7 +353,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -374,7 +375,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -396,7 +397,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -418,7 +419,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -440,7 +441,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -462,7 +463,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -484,7 +485,7 @@ func (r *Radio) SetRadioConfig(key string, value string) error {
 						},
 					},
 				}
-				err = sendAdminMessage(adminMessage, r)
+				err = sendAdminMessage(&adminMessage, r)
 				if err != nil {
 					return err
 				}
@@ -552,8 +553,8 @@ func setProtoValue(t interface{}, key string, value string) error {
 	return nil
 }
 
-func sendAdminMessage(adminPacket pb.AdminMessage, r *Radio) error {
-	out, err := proto.Marshal(&adminPacket)
+func sendAdminMessage(adminPacket *pb.AdminMessage, r *Radio) error {
+	out, err := proto.Marshal(adminPacket)
 	if err != nil {
 		return err
 	}
@@ -571,3 +572,41 @@ func sendAdminMessage(adminPacket pb.AdminMessage, r *Radio) error {
 
 	return nil
 }
+
+// SendAdmin sends an admin message to the connected device without waiting for a response
+func (r *Radio) SendAdmin(adminPacket *pb.AdminMessage) error {
+	return sendAdminMessage(adminPacket, r)
+}
+
+// requestAdmin sends an admin message to the radio and waits for the response accepted by match. Admin
+// messages from other nodes are ignored
+func (r *Radio) requestAdmin(ctx context.Context, adminPacket *pb.AdminMessage, match func(*pb.AdminMessage) bool) (*pb.AdminMessage, error) {
+
+	waiter := r.expectData(pb.PortNum_ADMIN_APP, func(packet *pb.MeshPacket, data *pb.Data) bool {
+		if packet.From != r.nodeNum {
+			return false
+		}
+		response := pb.AdminMessage{}
+		if err := proto.Unmarshal(data.Payload, &response); err != nil {
+			return false
+		}
+		return match(&response)
+	})
+	defer waiter.close()
+
+	if err := sendAdminMessage(adminPacket, r); err != nil {
+		return nil, err
+	}
+
+	packet, err := waiter.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response := pb.AdminMessage{}
+	if err := proto.Unmarshal(packet.GetDecoded().GetPayload(), &response); err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
@@ -0,0 +1,376 @@
+package gomesh
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// maxPendingPackets caps how many outbound packets are held while the link is down
+const maxPendingPackets = 64
+
+// errConnectionLost is returned when the device side of the link has gone away
+var errConnectionLost = errors.New("connection lost")
+
+// ErrClosed is returned by reads and reconnects on a radio that has been closed
+var ErrClosed = errors.New("radio closed")
+
+// ConnectionState describes the state of the link between a Radio and its device
+type ConnectionState int
+
+const (
+	// StateDisconnected means the Radio has no open link to a device
+	StateDisconnected ConnectionState = iota
+	// StateConnecting means the link is being opened and the config handshake has not finished
+	StateConnecting
+	// StateConfigured means the device has sent its full config and the link is usable
+	StateConfigured
+	// StateLost means an established link failed and has not yet been recovered
+	StateLost
+)
+
+// String returns a readable name for the connection state
+func (s ConnectionState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConfigured:
+		return "configured"
+	case StateLost:
+		return "lost"
+	}
+	return "unknown"
+}
+
+// ReconnectPolicy controls how a Radio re-establishes a dropped serial or TCP link.
+// The zero value disables reconnecting, which matches the behaviour of earlier versions
+type ReconnectPolicy struct {
+	// InitialBackoff is the wait before the first reconnect attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after every failed attempt, values below 1 are treated as 2
+	Multiplier float64
+	// MaxAttempts limits the number of attempts before giving up, 0 retries forever
+	MaxAttempts int
+}
+
+// DefaultReconnectPolicy is a reasonable policy for USB and WiFi attached radios
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	MaxAttempts:    10,
+}
+
+func (p ReconnectPolicy) enabled() bool {
+	return p.InitialBackoff > 0
+}
+
+// next returns the backoff that follows the provided one
+func (p ReconnectPolicy) next(backoff time.Duration) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	backoff = time.Duration(float64(backoff) * multiplier)
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+// connection holds the supervision state shared by copies of a Radio
+type connection struct {
+	mu       sync.Mutex
+	policy   ReconnectPolicy
+	state    ConnectionState
+	onState  func(ConnectionState)
+	configID uint32
+	pending  [][]byte
+	// generation increases every time the link is re-established
+	generation uint64
+	// backlog holds packets read while a send waited on the device queue
+	backlog []*pb.FromRadio
+	// capture records the frames on the link when set
+	capture *CaptureWriter
+	// logging holds the protocol logging setup when set
+	logging *protocolLog
+	// httpOptions configures links to devices over their HTTP API
+	httpOptions HTTPOptions
+	// metadata is what the device reported about itself during the config handshake
+	metadata *pb.DeviceMetadata
+	// files are the files the device listed during the config handshake
+	files []FileInfo
+	// dial opens the link when reconnecting instead of the port, used with fake transports in tests
+	dial func() (io.ReadWriteCloser, error)
+	// closed is closed by Close so a reconnect in progress stops instead of reopening the link
+	closed chan struct{}
+
+	// reconnecting serializes recovery so concurrent failures only reconnect once
+	reconnecting sync.Mutex
+	// writeMu keeps frames from interleaving on the wire
+	writeMu sync.Mutex
+	// readMu keeps a single reader on the stream at a time
+	readMu sync.Mutex
+}
+
+// conn returns the supervision state for the radio, creating it on first use
+func (r *Radio) conn() *connection {
+	if r.connection == nil {
+		r.connection = &connection{closed: make(chan struct{})}
+	}
+	return r.connection
+}
+
+// SetReconnectPolicy enables automatic reconnecting when the serial or TCP link drops.
+// Pass DefaultReconnectPolicy for sensible defaults or the zero value to disable it
+func (r *Radio) SetReconnectPolicy(policy ReconnectPolicy) {
+	c := r.conn()
+	c.mu.Lock()
+	c.policy = policy
+	c.mu.Unlock()
+}
+
+// OnStateChange registers a function that is called every time the connection state changes.
+// The function is called synchronously and should return quickly
+func (r *Radio) OnStateChange(fn func(ConnectionState)) {
+	c := r.conn()
+	c.mu.Lock()
+	c.onState = fn
+	c.mu.Unlock()
+}
+
+// State returns the current state of the link to the device
+func (r *Radio) State() ConnectionState {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// setState records a new connection state and notifies the registered observer
+func (r *Radio) setState(state ConnectionState) {
+	c := r.conn()
+	c.mu.Lock()
+	if c.state == state {
+		c.mu.Unlock()
+		return
+	}
+	c.state = state
+	fn := c.onState
+	c.mu.Unlock()
+
+	if fn != nil {
+		fn(state)
+	}
+}
+
+// newConfigID generates a fresh non zero id for a WantConfigId handshake
+func (r *Radio) newConfigID() uint32 {
+	id := newPacketID()
+
+	c := r.conn()
+	c.mu.Lock()
+	c.configID = id
+	// The device lists its files again in answer to the new request
+	c.files = nil
+	c.mu.Unlock()
+
+	return id
+}
+
+// holdPending stores a packet that could not be written so it can be replayed after a reconnect
+func (r *Radio) holdPending(packet []byte) {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) >= maxPendingPackets {
+		c.pending = c.pending[1:]
+	}
+	c.pending = append(c.pending, packet)
+}
+
+// replayPending writes any packets that were held while the link was down
+func (r *Radio) replayPending() error {
+	c := r.conn()
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	for i, packet := range pending {
+		if err := r.writePacket(packet); err != nil {
+			c.mu.Lock()
+			c.pending = append(pending[i:], c.pending...)
+			c.mu.Unlock()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// swapStreamer closes the current stream and replaces it once no reads or writes are in flight.
+// A radio closed in the meantime keeps its closed stream and the new one is closed instead
+func (r *Radio) swapStreamer(s streamer) bool {
+	c := r.conn()
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if r.isClosed() {
+		s.Close()
+		return false
+	}
+
+	r.streamer.Close()
+	r.streamer = s
+	return true
+}
+
+// isClosed reports whether Close has been called on the radio
+func (r *Radio) isClosed() bool {
+	c := r.conn()
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+
+	select {
+	case <-closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// markClosed records that the radio is closed and wakes any reconnect that is waiting to retry
+func (r *Radio) markClosed() {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+}
+
+// reopen clears the closed mark so a closed radio can be initialized again
+func (r *Radio) reopen() {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		c.closed = make(chan struct{})
+	default:
+	}
+}
+
+// generation returns the current link generation, used to detect a link that was already recovered
+func (r *Radio) generation() uint64 {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// reconnectEnabled reports if a reconnect policy has been set
+func (r *Radio) reconnectEnabled() bool {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.policy.enabled()
+}
+
+// reconnect reopens the link after a failure, repeats the config handshake and replays
+// pending packets. gen is the link generation the failing operation ran on. If no
+// reconnect policy is set the original error is returned
+func (r *Radio) reconnect(cause error, gen uint64) error {
+	c := r.conn()
+	c.mu.Lock()
+	policy := c.policy
+	port := r.port
+	httpOptions := c.httpOptions
+	closed := c.closed
+	dial := c.dial
+	c.mu.Unlock()
+
+	if r.isClosed() {
+		return ErrClosed
+	}
+
+	if !policy.enabled() || (port == "" && dial == nil) {
+		r.setState(StateLost)
+		return cause
+	}
+
+	c.reconnecting.Lock()
+	defer c.reconnecting.Unlock()
+
+	// Another caller may have already recovered the link while we waited
+	if r.generation() != gen {
+		return nil
+	}
+
+	r.setState(StateLost)
+
+	backoff := policy.InitialBackoff
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-closed:
+			timer.Stop()
+			return ErrClosed
+		}
+		backoff = policy.next(backoff)
+
+		r.setState(StateConnecting)
+
+		s := streamer{httpOptions: httpOptions}
+		if dial != nil {
+			transport, err := dial()
+			if err != nil {
+				r.setState(StateLost)
+				continue
+			}
+			s.transport = transport
+		} else if err := s.Init(port); err != nil {
+			r.setState(StateLost)
+			continue
+		}
+		if !r.swapStreamer(s) {
+			return ErrClosed
+		}
+
+		if err := r.getNodeNum(); err != nil {
+			r.setState(StateLost)
+			continue
+		}
+
+		c.mu.Lock()
+		c.generation++
+		c.mu.Unlock()
+
+		if err := r.replayPending(); err != nil {
+			r.setState(StateLost)
+			continue
+		}
+
+		return nil
+	}
+
+	r.setState(StateDisconnected)
+	return cause
+}
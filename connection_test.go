@@ -0,0 +1,216 @@
+package gomesh
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// answerConfig answers the config handshake like a device with a node number
+func answerConfig(nodeNum uint32) func(*pb.ToRadio) []*pb.FromRadio {
+	return func(toRadio *pb.ToRadio) []*pb.FromRadio {
+		id := toRadio.GetWantConfigId()
+		if id == 0 {
+			return nil
+		}
+		return []*pb.FromRadio{
+			{PayloadVariant: &pb.FromRadio_MyInfo{MyInfo: &pb.MyNodeInfo{MyNodeNum: nodeNum}}},
+			{PayloadVariant: &pb.FromRadio_ConfigCompleteId{ConfigCompleteId: id}},
+		}
+	}
+}
+
+// fakeDialer hands out fake devices, failing the first attempts
+type fakeDialer struct {
+	mu       sync.Mutex
+	failures int
+	dials    int
+	devices  []*fakeDevice
+}
+
+func (f *fakeDialer) dial() (io.ReadWriteCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dials++
+	if f.dials <= f.failures {
+		return nil, errors.New("no device")
+	}
+	device := newFakeDevice(nil, answerConfig(42))
+	f.devices = append(f.devices, device)
+	return device, nil
+}
+
+// reconnectRadio connects a radio to a fake device and lets it reconnect through a dialer
+func reconnectRadio(t *testing.T, dialer *fakeDialer) (*Radio, *fakeDevice) {
+
+	device := newFakeDevice(nil, answerConfig(42))
+	radio := &Radio{}
+	if err := radio.InitTransport(device); err != nil {
+		t.Fatalf("Error initializing radio: %v", err)
+	}
+	radio.SetReconnectPolicy(ReconnectPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond, MaxAttempts: 5})
+	radio.conn().dial = dialer.dial
+	return radio, device
+}
+
+func TestReconnectBackoff(t *testing.T) {
+
+	policy := ReconnectPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 3}
+	expected := []time.Duration{300 * time.Millisecond, 900 * time.Millisecond, time.Second, time.Second}
+
+	backoff := policy.InitialBackoff
+	for i, want := range expected {
+		backoff = policy.next(backoff)
+		if backoff != want {
+			t.Errorf("Expected backoff %d to be %v, got %v", i+1, want, backoff)
+		}
+	}
+
+	policy.Multiplier = 0
+	if backoff := policy.next(100 * time.Millisecond); backoff != 200*time.Millisecond {
+		t.Errorf("Expected an unset multiplier to double the backoff, got %v", backoff)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+
+	dialer := &fakeDialer{failures: 2}
+	radio, device := reconnectRadio(t, dialer)
+
+	var mu sync.Mutex
+	var states []ConnectionState
+	radio.OnStateChange(func(state ConnectionState) {
+		mu.Lock()
+		states = append(states, state)
+		mu.Unlock()
+	})
+
+	held, err := proto.Marshal(&pb.ToRadio{PayloadVariant: &pb.ToRadio_Packet{Packet: &pb.MeshPacket{
+		To:             7,
+		PayloadVariant: &pb.MeshPacket_Decoded{Decoded: &pb.Data{Portnum: pb.PortNum_PRIVATE_APP, Payload: []byte("held")}},
+	}}})
+	if err != nil {
+		t.Fatalf("Error marshalling packet: %v", err)
+	}
+
+	device.fail()
+	if err := radio.sendPacket(held); err != nil {
+		t.Fatalf("Error sending while the link is down: %v", err)
+	}
+
+	mu.Lock()
+	expected := []ConnectionState{
+		StateLost, StateConnecting, StateLost, StateConnecting, StateLost, StateConnecting, StateConfigured,
+	}
+	if len(states) != len(expected) {
+		t.Fatalf("Expected states %v, got %v", expected, states)
+	}
+	for i := range expected {
+		if states[i] != expected[i] {
+			t.Errorf("Expected states %v, got %v", expected, states)
+			break
+		}
+	}
+	mu.Unlock()
+
+	if len(dialer.devices) != 1 {
+		t.Fatalf("Expected one successful dial, got %d", len(dialer.devices))
+	}
+	if radio.nodeNum != 42 {
+		t.Errorf("Expected node number 42 after reconnecting, got %d", radio.nodeNum)
+	}
+
+	first := device.requests()[0].GetWantConfigId()
+	requests := dialer.devices[0].requests()
+	if len(requests) != 2 {
+		t.Fatalf("Expected a handshake and the replayed packet, got %d messages", len(requests))
+	}
+	if id := requests[0].GetWantConfigId(); id == 0 || id == first {
+		t.Errorf("Expected a fresh config id, got %d after %d", id, first)
+	}
+	if data := requests[1].GetPacket().GetDecoded(); string(data.GetPayload()) != "held" {
+		t.Errorf("Expected the held packet to be replayed, got %v", requests[1])
+	}
+}
+
+func TestReconnectOnce(t *testing.T) {
+
+	dialer := &fakeDialer{}
+	radio, device := reconnectRadio(t, dialer)
+	device.fail()
+
+	gen := radio.generation()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := radio.reconnect(errConnectionLost, gen); err != nil {
+				t.Errorf("Error reconnecting: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if dialer.dials != 1 {
+		t.Errorf("Expected concurrent failures to reconnect once, got %d dials", dialer.dials)
+	}
+	if radio.State() != StateConfigured {
+		t.Errorf("Expected configured, got %v", radio.State())
+	}
+}
+
+func TestReconnectClosed(t *testing.T) {
+
+	dialer := &fakeDialer{failures: 1000}
+	radio, device := reconnectRadio(t, dialer)
+	radio.SetReconnectPolicy(ReconnectPolicy{InitialBackoff: time.Millisecond})
+	device.fail()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := radio.ReadResponse(true)
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	radio.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Close to stop the reconnect")
+	}
+
+	if radio.State() != StateDisconnected {
+		t.Errorf("Expected disconnected, got %v", radio.State())
+	}
+}
+
+func TestReadSkipsBadFrame(t *testing.T) {
+
+	stream := testFrame(t, &pb.FromRadio{PayloadVariant: &pb.FromRadio_MyInfo{MyInfo: &pb.MyNodeInfo{MyNodeNum: 1}}})
+	stream = append(stream, start1, start2, 0, 2, 0xff, 0xff)
+	stream = append(stream, testFrame(t, &pb.FromRadio{PayloadVariant: &pb.FromRadio_ConfigCompleteId{ConfigCompleteId: 5}})...)
+
+	radio := &Radio{streamer: streamer{transport: newFakeDevice(stream, nil)}}
+	packets, err := radio.ReadResponse(true)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("Expected the frames around the bad one, got %d packets", len(packets))
+	}
+	if packets[1].GetConfigCompleteId() != 5 {
+		t.Errorf("Expected config complete 5, got %v", packets[1])
+	}
+}
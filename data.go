@@ -0,0 +1,325 @@
+package gomesh
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// defaultResponseTimeout bounds how long to wait for a response when the context has no deadline
+const defaultResponseTimeout = 30 * time.Second
+
+// ErrPayloadTooLarge is returned when a payload doesn't fit in a single packet
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// DataRequest describes a data packet to send on any port
+type DataRequest struct {
+	// To is the destination node number, 0 broadcasts to all nodes
+	To uint32
+	// Channel is the index of the channel to send on
+	Channel uint32
+	// Port is the application port the receiving node delivers the payload to
+	Port    pb.PortNum
+	Payload []byte
+	// WantAck asks the mesh to deliver the packet reliably
+	WantAck bool
+	// WantResponse asks the receiving application to respond
+	WantResponse bool
+	// HopLimit sets how many times the packet may be relayed, 0 uses the device setting
+	HopLimit uint32
+	Priority pb.MeshPacket_Priority
+	// ReplyId is the id of the message this packet replies to
+	ReplyId uint32
+	// Emoji marks the payload as an emoji reaction to ReplyId
+	Emoji uint32
+}
+
+// DataHandler handles an incoming data packet. Handlers run on the goroutine reading from the radio and
+// may send replies, but packets after the one being handled wait until the handler returns
+type DataHandler func(packet *pb.MeshPacket, data *pb.Data)
+
+// portHandler is a registered handler, wrapped so it can be removed again
+type portHandler struct {
+	handle DataHandler
+}
+
+// PacketDirection tells whether a packet was received from the radio or sent to it
+type PacketDirection int
+
+const (
+	// PacketReceived is a packet read from the radio
+	PacketReceived PacketDirection = iota
+	// PacketSent is a packet written to the radio
+	PacketSent
+)
+
+func (d PacketDirection) String() string {
+	if d == PacketSent {
+		return "sent"
+	}
+	return "received"
+}
+
+// PacketObserver is called with every mesh packet received from or sent to the radio, including packets the
+// radio couldn't decrypt. Observers run on the goroutine that read or sent the packet and must not change it
+type PacketObserver func(packet *pb.MeshPacket, direction PacketDirection)
+
+// packetObserver is a registered observer, wrapped so it can be removed again
+type packetObserver struct {
+	observe PacketObserver
+}
+
+// fromRadioObserver is called with every message read from the radio, wrapped so it can be removed again
+type fromRadioObserver struct {
+	observe func(*pb.FromRadio)
+}
+
+// handlerRegistry holds the data handlers registered for each port and the packet observers
+type handlerRegistry struct {
+	mu        sync.Mutex
+	handlers  map[pb.PortNum][]*portHandler
+	observers []*packetObserver
+	fromRadio []*fromRadioObserver
+}
+
+// registry returns the handler registry for the radio, creating it on first use
+func (r *Radio) registry() *handlerRegistry {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.handlers == nil {
+		r.handlers = &handlerRegistry{handlers: make(map[pb.PortNum][]*portHandler)}
+	}
+	return r.handlers
+}
+
+// SendData sends a payload on any port and returns the id of the sent packet. The context bounds how
+// long the send waits for the duty cycle budget and room in the device queue
+func (r *Radio) SendData(ctx context.Context, req DataRequest) (uint32, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if req.Port == pb.PortNum_UNKNOWN_APP {
+		return 0, errors.New("no port provided")
+	}
+
+	if len(req.Payload) > int(pb.Constants_DATA_PAYLOAD_LEN) {
+		return 0, ErrPayloadTooLarge
+	}
+
+	to := req.To
+	if to == 0 {
+		to = broadcastNum
+	}
+
+	packet := pb.MeshPacket{
+		To:       to,
+		Channel:  req.Channel,
+		Id:       newPacketID(),
+		WantAck:  req.WantAck,
+		HopLimit: req.HopLimit,
+		Priority: req.Priority,
+		PayloadVariant: &pb.MeshPacket_Decoded{
+			Decoded: &pb.Data{
+				Portnum:      req.Port,
+				Payload:      req.Payload,
+				WantResponse: req.WantResponse,
+				ReplyId:      req.ReplyId,
+				Emoji:        req.Emoji,
+			},
+		},
+	}
+
+	if err := r.sendMeshPacket(ctx, &packet); err != nil {
+		return 0, err
+	}
+
+	return packet.Id, nil
+}
+
+// HandlePort registers a handler for incoming data packets on a port. Several handlers can be
+// registered for the same port. The returned function removes the handler
+func (r *Radio) HandlePort(port pb.PortNum, handler DataHandler) (remove func()) {
+
+	reg := r.registry()
+	h := &portHandler{handle: handler}
+
+	reg.mu.Lock()
+	reg.handlers[port] = append(reg.handlers[port], h)
+	reg.mu.Unlock()
+
+	return func() {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+
+		handlers := reg.handlers[port]
+		for i, registered := range handlers {
+			if registered == h {
+				reg.handlers[port] = append(handlers[:i:i], handlers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// dispatch passes a decoded packet to the handlers registered for its port
+func (reg *handlerRegistry) dispatch(packet *pb.MeshPacket, data *pb.Data) {
+
+	reg.mu.Lock()
+	handlers := reg.handlers[data.Portnum]
+	reg.mu.Unlock()
+
+	for _, h := range handlers {
+		h.handle(packet, data)
+	}
+}
+
+// OnPacket registers an observer for every mesh packet received from or sent to the radio. The returned
+// function removes it
+func (r *Radio) OnPacket(observer PacketObserver) (remove func()) {
+
+	reg := r.registry()
+	o := &packetObserver{observe: observer}
+
+	reg.mu.Lock()
+	reg.observers = append(reg.observers, o)
+	reg.mu.Unlock()
+
+	return func() {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+
+		for i, registered := range reg.observers {
+			if registered == o {
+				reg.observers = append(reg.observers[:i:i], reg.observers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// observe passes a packet to the registered observers
+func (reg *handlerRegistry) observe(packet *pb.MeshPacket, direction PacketDirection) {
+
+	reg.mu.Lock()
+	observers := reg.observers
+	reg.mu.Unlock()
+
+	for _, o := range observers {
+		o.observe(packet, direction)
+	}
+}
+
+// onFromRadio registers a function that is called with every message read from the radio after the
+// radio has handled it. The returned function removes it
+func (r *Radio) onFromRadio(fn func(*pb.FromRadio)) (remove func()) {
+
+	reg := r.registry()
+	o := &fromRadioObserver{observe: fn}
+
+	reg.mu.Lock()
+	reg.fromRadio = append(reg.fromRadio, o)
+	reg.mu.Unlock()
+
+	return func() {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+
+		for i, registered := range reg.fromRadio {
+			if registered == o {
+				reg.fromRadio = append(reg.fromRadio[:i:i], reg.fromRadio[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// observeFromRadio passes a message read from the radio to the registered functions
+func (reg *handlerRegistry) observeFromRadio(fromRadio *pb.FromRadio) {
+
+	reg.mu.Lock()
+	observers := reg.fromRadio
+	reg.mu.Unlock()
+
+	for _, o := range observers {
+		o.observe(fromRadio)
+	}
+}
+
+// Listen reads from the radio until the context is done so registered handlers receive packets
+// without the caller polling ReadResponse
+func (r *Radio) Listen(ctx context.Context) error {
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if _, err := r.ReadResponse(true); err != nil {
+			return err
+		}
+	}
+}
+
+// dataWaiter waits for a single incoming data packet. It is registered before a request is sent so a
+// response read by another goroutine isn't missed
+type dataWaiter struct {
+	radio  *Radio
+	found  chan *pb.MeshPacket
+	remove func()
+}
+
+// expectData starts watching a port for a packet accepted by match. The waiter must be closed
+func (r *Radio) expectData(port pb.PortNum, match func(packet *pb.MeshPacket, data *pb.Data) bool) *dataWaiter {
+
+	w := &dataWaiter{radio: r, found: make(chan *pb.MeshPacket, 1)}
+	w.remove = r.HandlePort(port, func(packet *pb.MeshPacket, data *pb.Data) {
+		if !match(packet, data) {
+			return
+		}
+		select {
+		case w.found <- packet:
+		default:
+		}
+	})
+
+	return w
+}
+
+// wait blocks until the expected packet arrives, reading from the radio while waiting. If the context
+// has no deadline the wait gives up after 30 seconds
+func (w *dataWaiter) wait(ctx context.Context) (*pb.MeshPacket, error) {
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultResponseTimeout)
+		defer cancel()
+	}
+
+	for {
+		select {
+		case packet := <-w.found:
+			return packet, nil
+		default:
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if err := w.radio.pollBacklog(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// close stops watching for the packet
+func (w *dataWaiter) close() {
+	w.remove()
+}
@@ -0,0 +1,108 @@
+package gomesh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// dataPacket is a received data packet on a port
+func dataPacket(id, from uint32, port pb.PortNum, payload []byte) *pb.FromRadio {
+	return &pb.FromRadio{PayloadVariant: &pb.FromRadio_Packet{Packet: &pb.MeshPacket{
+		Id:             id,
+		From:           from,
+		To:             1,
+		PayloadVariant: &pb.MeshPacket_Decoded{Decoded: &pb.Data{Portnum: port, Payload: payload}},
+	}}}
+}
+
+func TestHandlePort(t *testing.T) {
+
+	radio := Radio{nodeNum: 1}
+
+	var private, serial []uint32
+	removePrivate := radio.HandlePort(pb.PortNum_PRIVATE_APP, func(packet *pb.MeshPacket, data *pb.Data) {
+		private = append(private, packet.Id)
+	})
+	radio.HandlePort(pb.PortNum_SERIAL_APP, func(packet *pb.MeshPacket, data *pb.Data) {
+		serial = append(serial, packet.Id)
+	})
+	var second int
+	removeSecond := radio.HandlePort(pb.PortNum_PRIVATE_APP, func(*pb.MeshPacket, *pb.Data) { second++ })
+
+	radio.handleFromRadio(dataPacket(1, 5, pb.PortNum_PRIVATE_APP, []byte("a")))
+	radio.handleFromRadio(dataPacket(2, 5, pb.PortNum_SERIAL_APP, []byte("b")))
+	radio.handleFromRadio(dataPacket(3, 5, pb.PortNum_TEXT_MESSAGE_APP, []byte("c")))
+
+	if len(private) != 1 || private[0] != 1 || second != 1 {
+		t.Errorf("Expected both PRIVATE_APP handlers to get packet 1, got %v and %d", private, second)
+	}
+	if len(serial) != 1 || serial[0] != 2 {
+		t.Errorf("Expected the SERIAL_APP handler to get packet 2, got %v", serial)
+	}
+
+	removeSecond()
+	removeSecond()
+	radio.handleFromRadio(dataPacket(4, 5, pb.PortNum_PRIVATE_APP, []byte("d")))
+	if len(private) != 2 || second != 1 {
+		t.Errorf("Expected only the remaining handler to get packet 4, got %v and %d", private, second)
+	}
+
+	removePrivate()
+	radio.handleFromRadio(dataPacket(5, 5, pb.PortNum_PRIVATE_APP, []byte("e")))
+	if len(private) != 2 {
+		t.Errorf("Expected no packets after removing the handler, got %v", private)
+	}
+}
+
+func TestHandlerSendsReply(t *testing.T) {
+
+	// The device queue is full when the request arrives, and the update freeing it follows the request
+	var stream []byte
+	for _, fromRadio := range []*pb.FromRadio{
+		{PayloadVariant: &pb.FromRadio_QueueStatus{QueueStatus: &pb.QueueStatus{Free: 0, Maxlen: 16}}},
+		dataPacket(10, 5, pb.PortNum_PRIVATE_APP, []byte("ping")),
+		{PayloadVariant: &pb.FromRadio_QueueStatus{QueueStatus: &pb.QueueStatus{Free: 4, Maxlen: 16}}},
+	} {
+		stream = append(stream, testFrame(t, fromRadio)...)
+	}
+
+	link := newFakeDevice(stream, nil)
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: link}}
+
+	replied := make(chan error, 1)
+	radio.HandlePort(pb.PortNum_PRIVATE_APP, func(packet *pb.MeshPacket, data *pb.Data) {
+		_, err := radio.SendData(context.Background(), DataRequest{
+			To:      packet.From,
+			Port:    pb.PortNum_PRIVATE_APP,
+			Payload: []byte("pong"),
+			ReplyId: packet.Id,
+		})
+		replied <- err
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := radio.ReadResponse(true)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a handler that sends to not block the reader")
+	}
+
+	if err := <-replied; err != nil {
+		t.Fatalf("Error sending reply: %v", err)
+	}
+	sent := sentPackets(t, link.written())
+	if len(sent) != 1 || sent[0].To != 5 || sent[0].GetDecoded().GetReplyId() != 10 {
+		t.Errorf("Expected a reply to packet 10 for node 5, got %v", sent)
+	}
+}
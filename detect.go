@@ -0,0 +1,189 @@
+package gomesh
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// ErrNotMeshtastic is returned when a probed device doesn't answer the config handshake like a Meshtastic
+// device
+var ErrNotMeshtastic = errors.New("device did not identify as a meshtastic node")
+
+// ErrPortBusy is returned when a probed serial port is in use by another program
+var ErrPortBusy = errors.New("serial port in use")
+
+// defaultProbeTimeout bounds a probe when its context has no deadline
+const defaultProbeTimeout = 10 * time.Second
+
+// DetectedDevice is a serial device that answered the config handshake
+type DetectedDevice struct {
+	Port    SerialPort
+	NodeNum uint32
+	// Owner is the user configured on the device, nil if the device didn't send it
+	Owner           *pb.User
+	FirmwareVersion string
+	HwModel         pb.HardwareModel
+}
+
+// DetectOptions configures device detection
+type DetectOptions struct {
+	// IDs are the USB ids of the ports to probe, MeshtasticUSBIDs when not set
+	IDs []USBID
+	// OnError is called for each port that was probed and didn't answer, or was skipped with ErrPortBusy
+	OnError func(port SerialPort, err error)
+	// Timeout bounds each probe, 10 seconds when not set
+	Timeout time.Duration
+}
+
+// DetectDevices probes the USB serial ports that look like Meshtastic devices and returns those that
+// answer the config handshake. Ports are probed at the same time. Every probe has finished and closed its
+// port when DetectDevices returns.
+//
+// On Linux a port is skipped with ErrPortBusy when another program holds a flock on it or opened it in
+// exclusive mode, as the Python client does. A program that opened the port without either can't be
+// detected, and probing it writes a config request the device answers to both programs. Elsewhere ports
+// are probed without checking whether they are in use
+func DetectDevices(ctx context.Context, opts DetectOptions) ([]DetectedDevice, error) {
+
+	if len(opts.IDs) == 0 {
+		opts.IDs = MeshtasticUSBIDs
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultProbeTimeout
+	}
+
+	ports, err := ListSerialPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		device DetectedDevice
+		err    error
+	}
+
+	var candidates []SerialPort
+	for _, port := range ports {
+		if port.Matches(opts.IDs) {
+			candidates = append(candidates, port)
+		}
+	}
+
+	results := make([]chan result, len(candidates))
+	for i, port := range candidates {
+		results[i] = make(chan result, 1)
+		go func(port SerialPort, out chan<- result) {
+			probeCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+			defer cancel()
+			device, err := ProbePort(probeCtx, port)
+			out <- result{device, err}
+		}(port, results[i])
+	}
+
+	// Probes stop when the context is done, so waiting for all of them doesn't outlast it
+	var devices []DetectedDevice
+	for i, port := range candidates {
+		res := <-results[i]
+		if res.err != nil {
+			if opts.OnError != nil && ctx.Err() == nil {
+				opts.OnError(port, res.err)
+			}
+			continue
+		}
+		devices = append(devices, res.device)
+	}
+
+	return devices, ctx.Err()
+}
+
+// ProbePort opens a serial port, runs the config handshake and closes it again. On Linux the port is locked
+// and kept exclusive while it is probed, and a port in use returns ErrPortBusy before anything is written.
+// The probe gives up when the context is done, or after 10 seconds if the context has no deadline
+func ProbePort(ctx context.Context, port SerialPort) (DetectedDevice, error) {
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultProbeTimeout)
+		defer cancel()
+	}
+
+	s := streamer{}
+	if err := s.Init(port.Path); err != nil {
+		if isPortBusy(err) {
+			return DetectedDevice{}, ErrPortBusy
+		}
+		return DetectedDevice{}, err
+	}
+	if err := lockSerialPort(s.serialPort); err != nil {
+		s.Close()
+		return DetectedDevice{}, err
+	}
+
+	radio := &Radio{port: port.Path, streamer: s}
+	return radio.probe(ctx, port)
+}
+
+// probe runs the config handshake on an open link and closes it. A probe still running when the context
+// is done has its link closed under it, which ends any read it is blocked in
+func (r *Radio) probe(ctx context.Context, port SerialPort) (DetectedDevice, error) {
+
+	type result struct {
+		device DetectedDevice
+		err    error
+	}
+
+	// The connection state is created lazily, so create it before the handshake shares the radio
+	r.conn()
+
+	done := make(chan result, 1)
+	go func() {
+		device, err := r.describe(port)
+		done <- result{device, err}
+	}()
+
+	select {
+	case res := <-done:
+		r.Close()
+		return res.device, res.err
+	case <-ctx.Done():
+		// Close would wait for the blocked read, so the link is closed directly
+		r.markClosed()
+		r.streamer.Close()
+		<-done
+		r.setState(StateDisconnected)
+		return DetectedDevice{}, ctx.Err()
+	}
+}
+
+// describe runs the config handshake and describes the device from its answers
+func (r *Radio) describe(port SerialPort) (DetectedDevice, error) {
+
+	responses, err := r.handshake()
+	if err != nil {
+		return DetectedDevice{}, err
+	}
+
+	caps := r.Capabilities()
+	device := DetectedDevice{Port: port, FirmwareVersion: caps.FirmwareVersion, HwModel: caps.HwModel}
+	for _, response := range responses {
+		if info, ok := response.GetPayloadVariant().(*pb.FromRadio_MyInfo); ok {
+			device.NodeNum = info.MyInfo.MyNodeNum
+		}
+	}
+
+	if device.NodeNum == 0 {
+		return DetectedDevice{}, ErrNotMeshtastic
+	}
+
+	if node, ok := r.Node(device.NodeNum); ok {
+		device.Owner = node.User
+		if device.HwModel == pb.HardwareModel_UNSET {
+			device.HwModel = node.GetUser().GetHwModel()
+		}
+	}
+
+	return device, nil
+}
@@ -0,0 +1,89 @@
+package gomesh
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+func TestProbe(t *testing.T) {
+
+	var stream []byte
+	for _, fromRadio := range []*pb.FromRadio{
+		{PayloadVariant: &pb.FromRadio_MyInfo{MyInfo: &pb.MyNodeInfo{MyNodeNum: 0x1234abcd}}},
+		{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: &pb.NodeInfo{Num: 0x1234abcd, User: &pb.User{LongName: "Base Camp", ShortName: "BC"}}}},
+		{PayloadVariant: &pb.FromRadio_Metadata{Metadata: &pb.DeviceMetadata{FirmwareVersion: "2.3.2.63df972", HwModel: pb.HardwareModel_HELTEC_V3}}},
+	} {
+		stream = append(stream, testFrame(t, fromRadio)...)
+	}
+
+	port := SerialPort{Path: "/dev/ttyUSB0", Vendor: 0x10c4, Product: 0xea60}
+	radio := &Radio{streamer: streamer{transport: newFakeDevice(stream, nil)}}
+	device, err := radio.probe(context.Background(), port)
+	if err != nil {
+		t.Fatalf("Error probing device: %v", err)
+	}
+
+	if device.NodeNum != 0x1234abcd || device.Port.Path != port.Path {
+		t.Errorf("Expected node !1234abcd on %s, got %x on %s", port.Path, device.NodeNum, device.Port.Path)
+	}
+	if device.Owner.GetLongName() != "Base Camp" {
+		t.Errorf("Expected owner Base Camp, got %q", device.Owner.GetLongName())
+	}
+	if device.FirmwareVersion != "2.3.2.63df972" || device.HwModel != pb.HardwareModel_HELTEC_V3 {
+		t.Errorf("Unexpected firmware %q on %v", device.FirmwareVersion, device.HwModel)
+	}
+
+	radio = &Radio{streamer: streamer{transport: newFakeDevice([]byte("boot log\n"), nil)}}
+	if _, err := radio.probe(context.Background(), port); err == nil {
+		t.Errorf("Expected a device without a config answer to fail")
+	}
+}
+
+// blockingTransport is a link whose reads block until it is closed
+type blockingTransport struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (t *blockingTransport) Read(p []byte) (int, error) {
+	<-t.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (t *blockingTransport) Write(p []byte) (int, error) { return len(p), nil }
+
+func (t *blockingTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+func TestProbeTimeout(t *testing.T) {
+
+	transport := &blockingTransport{closed: make(chan struct{})}
+	radio := &Radio{streamer: streamer{transport: transport}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := radio.probe(ctx, SerialPort{Path: "/dev/ttyACM0"}); err != context.DeadlineExceeded {
+		t.Errorf("Expected the probe to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the probe to stop at its deadline, took %v", elapsed)
+	}
+
+	select {
+	case <-transport.closed:
+	default:
+		t.Errorf("Expected the link to be closed")
+	}
+	if radio.State() != StateDisconnected {
+		t.Errorf("Expected disconnected, got %v", radio.State())
+	}
+}
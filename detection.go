@@ -0,0 +1,226 @@
+package gomesh
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// maxDetectionNameLen is the longest sensor name the firmware accepts
+const maxDetectionNameLen = 20
+
+// detectionAlertTimeout bounds how long an alerter may take for a single event
+const detectionAlertTimeout = 30 * time.Second
+
+// DetectionEvent is a report from the detection sensor module of a node
+type DetectionEvent struct {
+	From    uint32
+	Channel uint32
+	// Name is the sensor name configured on the reporting node
+	Name string
+	// State is true while the sensor is triggered
+	State bool
+	// Heartbeat is set for the periodic state reports, which are sent whether or not the state changed
+	Heartbeat bool
+	// Bell is set when the node asked for an alert bell with the report
+	Bell bool
+	Time time.Time
+	// Text is the message as sent by the node
+	Text string
+}
+
+// DetectionTrigger is the pin level that counts as a detection
+type DetectionTrigger int
+
+const (
+	// TriggerLow detects when the monitored pin is low
+	TriggerLow DetectionTrigger = iota
+	// TriggerHigh detects when the monitored pin is high
+	TriggerHigh
+)
+
+// DetectionSensorSettings configures the detection sensor module of the radio
+type DetectionSensorSettings struct {
+	Enabled bool
+	// Name is used in the messages sent to the mesh, for example "Motion" sends "Motion detected". At most 20 characters
+	Name string
+	// MonitorPin is the GPIO pin watched for state changes
+	MonitorPin uint32
+	Trigger    DetectionTrigger
+	// UsePullup enables the input pullup of the monitored pin
+	UsePullup bool
+	// MinBroadcastInterval is the shortest time between detection messages
+	MinBroadcastInterval time.Duration
+	// StateBroadcastInterval sends the current state periodically, 0 only sends changes
+	StateBroadcastInterval time.Duration
+	// SendBell adds an alert bell to detection messages
+	SendBell bool
+}
+
+// DetectionAlerter is notified of detections, for example to forward them to a notification service
+type DetectionAlerter interface {
+	Alert(ctx context.Context, event DetectionEvent) error
+}
+
+// DetectionAlerterFunc adapts a function to a DetectionAlerter
+type DetectionAlerterFunc func(ctx context.Context, event DetectionEvent) error
+
+// Alert calls the function
+func (f DetectionAlerterFunc) Alert(ctx context.Context, event DetectionEvent) error {
+	return f(ctx, event)
+}
+
+// ParseDetectionEvent parses the text of a detection sensor packet
+func ParseDetectionEvent(text string) (DetectionEvent, bool) {
+
+	event := DetectionEvent{Text: text}
+	if strings.ContainsRune(text, '\a') {
+		event.Bell = true
+		text = strings.ReplaceAll(text, "\a", "")
+	}
+	text = strings.TrimSpace(text)
+
+	if name := strings.TrimSuffix(text, " detected"); name != text {
+		event.Name = name
+		event.State = true
+		return event, true
+	}
+
+	if i := strings.LastIndex(text, " state: "); i >= 0 {
+		event.Name = text[:i]
+		event.Heartbeat = true
+		switch text[i+len(" state: "):] {
+		case "1":
+			event.State = true
+		case "0":
+		default:
+			return DetectionEvent{}, false
+		}
+		return event, true
+	}
+
+	return DetectionEvent{}, false
+}
+
+// OnDetection registers a function that is called with every detection sensor report received from the mesh.
+// It runs on the goroutine reading from the radio. The returned function removes it
+func (r *Radio) OnDetection(fn func(DetectionEvent)) (remove func()) {
+	return r.HandlePort(pb.PortNum_DETECTION_SENSOR_APP, func(packet *pb.MeshPacket, data *pb.Data) {
+		event, ok := ParseDetectionEvent(string(data.Payload))
+		if !ok {
+			return
+		}
+
+		event.From = packet.From
+		event.Channel = packet.Channel
+		event.Time = time.Now()
+		if packet.RxTime != 0 {
+			event.Time = time.Unix(int64(packet.RxTime), 0)
+		}
+
+		fn(event)
+	})
+}
+
+// AddDetectionAlerter passes detections to an alerter. Periodic state reports aren't passed on. Alerts run on
+// their own goroutine and errors are passed to onError when it isn't nil. The returned function removes the alerter
+func (r *Radio) AddDetectionAlerter(alerter DetectionAlerter, onError func(error)) (remove func()) {
+	return r.OnDetection(func(event DetectionEvent) {
+		if event.Heartbeat || !event.State {
+			return
+		}
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), detectionAlertTimeout)
+			defer cancel()
+
+			if err := alerter.Alert(ctx, event); err != nil && onError != nil {
+				onError(err)
+			}
+		}()
+	})
+}
+
+// toConfig converts the settings to the module config sent to the radio
+func (s DetectionSensorSettings) toConfig() (*pb.ModuleConfig_DetectionSensorConfig, error) {
+
+	if len(s.Name) > maxDetectionNameLen {
+		return nil, errors.New("detection sensor name is longer than 20 characters")
+	}
+	if s.MinBroadcastInterval < 0 || s.StateBroadcastInterval < 0 {
+		return nil, errors.New("broadcast intervals can't be negative")
+	}
+
+	return &pb.ModuleConfig_DetectionSensorConfig{
+		Enabled:                s.Enabled,
+		MinimumBroadcastSecs:   uint32(s.MinBroadcastInterval / time.Second),
+		StateBroadcastSecs:     uint32(s.StateBroadcastInterval / time.Second),
+		SendBell:               s.SendBell,
+		Name:                   s.Name,
+		MonitorPin:             s.MonitorPin,
+		DetectionTriggeredHigh: s.Trigger == TriggerHigh,
+		UsePullup:              s.UsePullup,
+	}, nil
+}
+
+// detectionSettings converts the module config reported by the radio to settings
+func detectionSettings(config *pb.ModuleConfig_DetectionSensorConfig) DetectionSensorSettings {
+
+	settings := DetectionSensorSettings{
+		Enabled:                config.Enabled,
+		Name:                   config.Name,
+		MonitorPin:             config.MonitorPin,
+		UsePullup:              config.UsePullup,
+		MinBroadcastInterval:   time.Duration(config.MinimumBroadcastSecs) * time.Second,
+		StateBroadcastInterval: time.Duration(config.StateBroadcastSecs) * time.Second,
+		SendBell:               config.SendBell,
+	}
+	if config.DetectionTriggeredHigh {
+		settings.Trigger = TriggerHigh
+	}
+
+	return settings
+}
+
+// SetDetectionSensor configures the detection sensor module of the radio
+func (r *Radio) SetDetectionSensor(settings DetectionSensorSettings) error {
+
+	config, err := settings.toConfig()
+	if err != nil {
+		return err
+	}
+
+	adminMessage := pb.AdminMessage{
+		PayloadVariant: &pb.AdminMessage_SetModuleConfig{
+			SetModuleConfig: &pb.ModuleConfig{
+				PayloadVariant: &pb.ModuleConfig_DetectionSensor{
+					DetectionSensor: config,
+				},
+			},
+		},
+	}
+
+	return sendAdminMessage(&adminMessage, r)
+}
+
+// GetDetectionSensor returns the detection sensor module settings of the radio
+func (r *Radio) GetDetectionSensor(ctx context.Context) (DetectionSensorSettings, error) {
+
+	adminPacket := pb.AdminMessage{
+		PayloadVariant: &pb.AdminMessage_GetModuleConfigRequest{
+			GetModuleConfigRequest: pb.AdminMessage_DETECTIONSENSOR_CONFIG,
+		},
+	}
+
+	response, err := r.requestAdmin(ctx, &adminPacket, func(message *pb.AdminMessage) bool {
+		return message.GetGetModuleConfigResponse().GetDetectionSensor() != nil
+	})
+	if err != nil {
+		return DetectionSensorSettings{}, err
+	}
+
+	return detectionSettings(response.GetGetModuleConfigResponse().GetDetectionSensor()), nil
+}
@@ -0,0 +1,51 @@
+package gomesh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDetectionEvent(t *testing.T) {
+
+	event, ok := ParseDetectionEvent("Motion detected\a")
+	if !ok || event.Name != "Motion" || !event.State || event.Heartbeat || !event.Bell {
+		t.Fatalf("Unexpected detection: %+v", event)
+	}
+
+	event, ok = ParseDetectionEvent("Back door state: 0")
+	if !ok || event.Name != "Back door" || event.State || !event.Heartbeat {
+		t.Fatalf("Unexpected state report: %+v", event)
+	}
+
+	if _, ok := ParseDetectionEvent("hello"); ok {
+		t.Fatalf("Parsed a message that isn't a detection")
+	}
+}
+
+func TestDetectionSettings(t *testing.T) {
+
+	settings := DetectionSensorSettings{
+		Enabled:                true,
+		Name:                   "Motion",
+		MonitorPin:             21,
+		Trigger:                TriggerHigh,
+		MinBroadcastInterval:   45 * time.Second,
+		StateBroadcastInterval: time.Hour,
+	}
+
+	config, err := settings.toConfig()
+	if err != nil {
+		t.Fatalf("Error converting settings: %v", err)
+	}
+	if !config.DetectionTriggeredHigh || config.MinimumBroadcastSecs != 45 || config.StateBroadcastSecs != 3600 {
+		t.Fatalf("Unexpected config: %v", config)
+	}
+	if back := detectionSettings(config); back != settings {
+		t.Fatalf("Settings changed: %+v", back)
+	}
+
+	settings.Name = "A name that is far too long"
+	if _, err := settings.toConfig(); err == nil {
+		t.Fatalf("Expected an error for a long name")
+	}
+}
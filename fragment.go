@@ -0,0 +1,443 @@
+package gomesh
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// fragmentHeaderLen is the size of the header at the start of every fragment: magic, kind, message id, index
+// and count
+const fragmentHeaderLen = 8
+
+// fragmentMagic starts every fragment and NAK so other traffic on the same port, such as streams, is ignored
+const fragmentMagic = byte(0xcf)
+
+// fragmentChunkLen is how much of a message fits in a single fragment
+const fragmentChunkLen = int(pb.Constants_DATA_PAYLOAD_LEN) - fragmentHeaderLen
+
+// maxFragments is the most fragments a single message can be split into
+const maxFragments = 255
+
+// Fragment kinds, stored in the first byte of every fragment
+const (
+	fragmentText   = byte(1)
+	fragmentBinary = byte(2)
+	fragmentNak    = byte(3)
+)
+
+const defaultFragmentTimeout = 2 * time.Minute
+const defaultFragmentNakDelay = 15 * time.Second
+const defaultFragmentMaxNaks = 3
+
+// ErrMessageTooLong is returned when a message needs more than 255 fragments
+var ErrMessageTooLong = errors.New("message too long to fragment")
+
+// errFragmentationDisabled is returned when a long message is sent before EnableFragmentation
+var errFragmentationDisabled = errors.New("fragmentation not enabled")
+
+// FragmentOptions configures the long message fragmentation protocol. Both ends of a conversation
+// must be goMesh clients using the same port
+type FragmentOptions struct {
+	// Port carries the fragments, 0 uses PRIVATE_APP
+	Port pb.PortNum
+	// Timeout is how long a partial message is kept waiting for missing fragments, and how long sent
+	// messages are kept for retransmits. 0 uses two minutes
+	Timeout time.Duration
+	// NakDelay is how long to wait without new fragments before asking the sender for the missing ones. 0 uses 15 seconds
+	NakDelay time.Duration
+	// MaxNaks limits how many times missing fragments are requested for one message. 0 uses 3
+	MaxNaks int
+	// OnMessage is called with every reassembled message, every text message and every payload on Port
+	// that fit in one packet
+	OnMessage func(LongMessage)
+}
+
+// LongMessage is a message reassembled from fragments
+type LongMessage struct {
+	ID      uint32
+	From    uint32
+	To      uint32
+	Channel uint32
+	// Text is true when the message was sent with SendLongText
+	Text    bool
+	Payload []byte
+}
+
+// fragmentKey identifies a partial message, ids are only unique per sender
+type fragmentKey struct {
+	from uint32
+	id   uint32
+}
+
+// partialMessage is a message whose fragments are still arriving
+type partialMessage struct {
+	key       fragmentKey
+	to        uint32
+	channel   uint32
+	kind      byte
+	fragments [][]byte
+	received  int
+	naks      int
+	started   time.Time
+	timer     *time.Timer
+}
+
+// sentMessage holds the fragments of a sent message so they can be retransmitted
+type sentMessage struct {
+	to        uint32
+	channel   uint32
+	fragments [][]byte
+}
+
+// fragmenter splits outgoing long messages and reassembles incoming ones
+type fragmenter struct {
+	mu      sync.Mutex
+	opts    FragmentOptions
+	partial map[fragmentKey]*partialMessage
+	sent    map[uint32]*sentMessage
+	// finished holds recently completed or abandoned messages so late duplicates don't start them again
+	finished map[fragmentKey]bool
+}
+
+// EnableFragmentation turns on sending and reassembling messages larger than a single packet
+func (r *Radio) EnableFragmentation(opts FragmentOptions) {
+
+	if opts.Port == 0 {
+		opts.Port = pb.PortNum_PRIVATE_APP
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultFragmentTimeout
+	}
+	if opts.NakDelay <= 0 {
+		opts.NakDelay = defaultFragmentNakDelay
+	}
+	if opts.MaxNaks <= 0 {
+		opts.MaxNaks = defaultFragmentMaxNaks
+	}
+
+	c := r.conn()
+	c.mu.Lock()
+	r.fragments = &fragmenter{
+		opts:     opts,
+		partial:  make(map[fragmentKey]*partialMessage),
+		sent:     make(map[uint32]*sentMessage),
+		finished: make(map[fragmentKey]bool),
+	}
+	c.mu.Unlock()
+}
+
+// fragmenter returns the fragmentation state, or nil if fragmentation isn't enabled
+func (r *Radio) fragmenter() *fragmenter {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return r.fragments
+}
+
+// SendLongText sends a text message of any length. Text that fits in one packet is sent as a plain text
+// message that any client can read, longer text is split into fragments
+func (r *Radio) SendLongText(message string, to int64, channel int64) error {
+
+	if r.fragmenter() == nil {
+		return errFragmentationDisabled
+	}
+
+	if _, payload := textPayload(message, r.textCompression()); len(payload) <= int(pb.Constants_DATA_PAYLOAD_LEN) {
+		return r.SendTextMessage(message, to, channel)
+	}
+
+	return r.sendLong(fragmentText, []byte(message), to, channel)
+}
+
+// SendLongData sends a binary payload of any length. A payload that fits in one packet is sent as it is on
+// the fragmentation port, longer payloads are split into fragments
+func (r *Radio) SendLongData(payload []byte, to int64, channel int64) error {
+	return r.sendLong(fragmentBinary, payload, to, channel)
+}
+
+// sendLong sends a payload that fits in one packet unchanged, otherwise it fragments it, keeps the
+// fragments for retransmits and sends them in order
+func (r *Radio) sendLong(kind byte, payload []byte, to int64, channel int64) error {
+
+	f := r.fragmenter()
+	if f == nil {
+		return errFragmentationDisabled
+	}
+
+	address := uint32(to)
+	if to == 0 {
+		address = broadcastNum
+	}
+
+	// A payload starting with a marker byte would be taken for a fragment or stream packet, so it is
+	// fragmented even when it fits
+	if len(payload) <= int(pb.Constants_DATA_PAYLOAD_LEN) && !hasFragmentMarker(payload) {
+		return r.sendFragment(f, payload, address, uint32(channel))
+	}
+
+	id := newPacketID()
+	fragments, err := splitFragments(kind, id, payload)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.sent[id] = &sentMessage{to: address, channel: uint32(channel), fragments: fragments}
+	timeout := f.opts.Timeout
+	f.mu.Unlock()
+
+	time.AfterFunc(timeout, func() {
+		f.mu.Lock()
+		delete(f.sent, id)
+		f.mu.Unlock()
+	})
+
+	for _, fragment := range fragments {
+		if err := r.sendFragment(f, fragment, address, uint32(channel)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasFragmentMarker reports whether a payload starts like a fragment or stream packet
+func hasFragmentMarker(payload []byte) bool {
+	return len(payload) > 0 && (payload[0] == fragmentMagic || payload[0] == streamMagic)
+}
+
+// sendFragment sends a single fragment or NAK on the fragmentation port
+func (r *Radio) sendFragment(f *fragmenter, fragment []byte, to uint32, channel uint32) error {
+
+	_, err := r.SendData(context.Background(), DataRequest{
+		To:      to,
+		Channel: channel,
+		Port:    f.opts.Port,
+		Payload: fragment,
+		WantAck: true,
+	})
+
+	return err
+}
+
+// splitFragments splits a payload into fragments that each fit in a single packet
+func splitFragments(kind byte, id uint32, payload []byte) ([][]byte, error) {
+
+	count := (len(payload) + fragmentChunkLen - 1) / fragmentChunkLen
+	if count == 0 {
+		count = 1
+	}
+	if count > maxFragments {
+		return nil, ErrMessageTooLong
+	}
+
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * fragmentChunkLen
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		fragment := make([]byte, fragmentHeaderLen, fragmentHeaderLen+end-i*fragmentChunkLen)
+		fragment[0] = fragmentMagic
+		fragment[1] = kind
+		binary.BigEndian.PutUint32(fragment[2:6], id)
+		fragment[6] = byte(i)
+		fragment[7] = byte(count)
+		fragment = append(fragment, payload[i*fragmentChunkLen:end]...)
+
+		fragments = append(fragments, fragment)
+	}
+
+	return fragments, nil
+}
+
+// handleUnfragmented passes a text message, or a payload on the fragmentation port sent without fragments,
+// to OnMessage
+func (f *fragmenter) handleUnfragmented(packet *pb.MeshPacket, text bool) {
+	if f.opts.OnMessage == nil {
+		return
+	}
+	f.opts.OnMessage(LongMessage{
+		ID:      packet.Id,
+		From:    packet.From,
+		To:      packet.To,
+		Channel: packet.Channel,
+		Text:    text,
+		Payload: packet.GetDecoded().GetPayload(),
+	})
+}
+
+// handleFragment processes a packet received on the fragmentation port
+func (r *Radio) handleFragment(f *fragmenter, packet *pb.MeshPacket) {
+
+	payload := packet.GetDecoded().GetPayload()
+	if !hasFragmentMarker(payload) {
+		f.handleUnfragmented(packet, false)
+		return
+	}
+
+	// Every fragment and NAK starts with the magic byte, the kind and the message id
+	if len(payload) < 6 || payload[0] != fragmentMagic {
+		return
+	}
+
+	kind := payload[1]
+	id := binary.BigEndian.Uint32(payload[2:6])
+
+	if kind == fragmentNak {
+		// Sending from here would block the reader, so retransmit in the background
+		go r.resendFragments(f, id, payload[6:])
+		return
+	}
+	if kind != fragmentText && kind != fragmentBinary {
+		return
+	}
+
+	if len(payload) < fragmentHeaderLen {
+		return
+	}
+
+	message, complete := f.add(packet, func(p *partialMessage) {
+		go r.requestMissing(f, p)
+	})
+	if complete && f.opts.OnMessage != nil {
+		f.opts.OnMessage(message)
+	}
+}
+
+// add stores a fragment and returns the message once every fragment has arrived. nak is scheduled
+// to run when fragments stop arriving before the message is complete
+func (f *fragmenter) add(packet *pb.MeshPacket, nak func(*partialMessage)) (LongMessage, bool) {
+
+	payload := packet.GetDecoded().GetPayload()
+	kind := payload[1]
+	key := fragmentKey{from: packet.From, id: binary.BigEndian.Uint32(payload[2:6])}
+	index := int(payload[6])
+	count := int(payload[7])
+
+	if count == 0 || index >= count {
+		return LongMessage{}, false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.finished[key] {
+		return LongMessage{}, false
+	}
+
+	partial, ok := f.partial[key]
+	if !ok {
+		partial = &partialMessage{
+			key:       key,
+			to:        packet.To,
+			channel:   packet.Channel,
+			kind:      kind,
+			fragments: make([][]byte, count),
+			started:   time.Now(),
+		}
+		partial.timer = time.AfterFunc(f.opts.NakDelay, func() { nak(partial) })
+		f.partial[key] = partial
+	}
+
+	if len(partial.fragments) != count || partial.fragments[index] != nil {
+		return LongMessage{}, false
+	}
+
+	partial.fragments[index] = append([]byte{}, payload[fragmentHeaderLen:]...)
+	partial.received++
+	partial.timer.Reset(f.opts.NakDelay)
+
+	if partial.received < count {
+		return LongMessage{}, false
+	}
+
+	partial.timer.Stop()
+	f.finishLocked(key)
+
+	message := LongMessage{
+		ID:      key.id,
+		From:    key.from,
+		To:      partial.to,
+		Channel: partial.channel,
+		Text:    partial.kind == fragmentText,
+	}
+	for _, fragment := range partial.fragments {
+		message.Payload = append(message.Payload, fragment...)
+	}
+
+	return message, true
+}
+
+// finishLocked drops a partial message and ignores its fragments until the timeout has passed, by which
+// time the sender has stopped retransmitting it
+func (f *fragmenter) finishLocked(key fragmentKey) {
+	delete(f.partial, key)
+	f.finished[key] = true
+
+	time.AfterFunc(f.opts.Timeout, func() {
+		f.mu.Lock()
+		delete(f.finished, key)
+		f.mu.Unlock()
+	})
+}
+
+// requestMissing asks the sender of a partial message for its missing fragments, giving up once the
+// message has timed out or too many requests have been made
+func (r *Radio) requestMissing(f *fragmenter, partial *partialMessage) {
+
+	f.mu.Lock()
+	if f.partial[partial.key] != partial {
+		f.mu.Unlock()
+		return
+	}
+
+	if partial.naks >= f.opts.MaxNaks || time.Since(partial.started) > f.opts.Timeout {
+		f.finishLocked(partial.key)
+		f.mu.Unlock()
+		return
+	}
+	partial.naks++
+
+	nak := make([]byte, 6, 6+len(partial.fragments))
+	nak[0] = fragmentMagic
+	nak[1] = fragmentNak
+	binary.BigEndian.PutUint32(nak[2:6], partial.key.id)
+	for i, fragment := range partial.fragments {
+		if fragment == nil {
+			nak = append(nak, byte(i))
+		}
+	}
+
+	partial.timer.Reset(f.opts.NakDelay)
+	f.mu.Unlock()
+
+	r.sendFragment(f, nak, partial.key.from, partial.channel)
+}
+
+// resendFragments retransmits the fragments of a sent message listed in a NAK
+func (r *Radio) resendFragments(f *fragmenter, id uint32, missing []byte) {
+
+	f.mu.Lock()
+	sent, ok := f.sent[id]
+	f.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for _, index := range missing {
+		if int(index) >= len(sent.fragments) {
+			continue
+		}
+		if err := r.sendFragment(f, sent.fragments[index], sent.to, sent.channel); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package gomesh
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFragmentReassembly(t *testing.T) {
+
+	radio := Radio{}
+	radio.EnableFragmentation(FragmentOptions{})
+	f := radio.fragmenter()
+
+	payload := bytes.Repeat([]byte("0123456789"), 60)
+	fragments, err := splitFragments(fragmentText, 99, payload)
+	if err != nil {
+		t.Fatalf("Error splitting message: %v", err)
+	}
+
+	if len(fragments) != 3 {
+		t.Fatalf("Expected 3 fragments, got %d", len(fragments))
+	}
+
+	for _, fragment := range fragments {
+		if len(fragment) > int(pb.Constants_DATA_PAYLOAD_LEN) {
+			t.Fatalf("Fragment too large: %d bytes", len(fragment))
+		}
+	}
+
+	// Deliver out of order with a duplicate to check the message is only completed once
+	order := []int{2, 0, 2, 1}
+	completed := 0
+	var message LongMessage
+	for _, i := range order {
+		packet := &pb.MeshPacket{
+			From: 1234,
+			To:   broadcastNum,
+			PayloadVariant: &pb.MeshPacket_Decoded{
+				Decoded: &pb.Data{Portnum: pb.PortNum_PRIVATE_APP, Payload: fragments[i]},
+			},
+		}
+
+		if m, ok := f.add(packet, func(*partialMessage) {}); ok {
+			message = m
+			completed++
+		}
+	}
+
+	if completed != 1 {
+		t.Fatalf("Expected message to complete once, completed %d times", completed)
+	}
+
+	if !message.Text || message.From != 1234 || message.ID != 99 || !bytes.Equal(message.Payload, payload) {
+		t.Fatalf("Reassembled message doesn't match: %+v", message)
+	}
+}
+
+// fromNode marks a sent packet as received from a node
+func fromNode(packet *pb.MeshPacket, from uint32) *pb.MeshPacket {
+	packet = proto.Clone(packet).(*pb.MeshPacket)
+	packet.From = from
+	return packet
+}
+
+func TestFragmentNak(t *testing.T) {
+
+	senderLink := newFakeDevice(nil, nil)
+	sender := &Radio{nodeNum: 1, streamer: streamer{transport: senderLink}}
+	sender.EnableFragmentation(FragmentOptions{})
+
+	messages := make(chan LongMessage, 2)
+	receiverLink := newFakeDevice(nil, nil)
+	receiver := &Radio{nodeNum: 2, streamer: streamer{transport: receiverLink}}
+	receiver.EnableFragmentation(FragmentOptions{
+		NakDelay:  10 * time.Millisecond,
+		OnMessage: func(message LongMessage) { messages <- message },
+	})
+
+	payload := bytes.Repeat([]byte("abcdefghij"), 60)
+	if err := sender.SendLongData(payload, 2, 0); err != nil {
+		t.Fatalf("Error sending long data: %v", err)
+	}
+	fragments := waitSent(t, senderLink, 3)
+
+	// The middle fragment is lost, so the receiver asks for it again
+	receiver.handleFragment(receiver.fragmenter(), fromNode(fragments[0], 1))
+	receiver.handleFragment(receiver.fragmenter(), fromNode(fragments[2], 1))
+
+	nak := waitSent(t, receiverLink, 1)[0]
+	missing := nak.GetDecoded().GetPayload()
+	if nak.To != 1 || len(missing) != 7 || missing[0] != fragmentMagic || missing[1] != fragmentNak || missing[6] != 1 {
+		t.Fatalf("Expected a NAK to node 1 for fragment 1, got %v", nak)
+	}
+
+	sender.handleFragment(sender.fragmenter(), fromNode(nak, 2))
+	resent := waitSent(t, senderLink, 4)[3]
+	if !bytes.Equal(resent.GetDecoded().GetPayload(), fragments[1].GetDecoded().GetPayload()) {
+		t.Fatalf("Expected fragment 1 to be retransmitted")
+	}
+
+	receiver.handleFragment(receiver.fragmenter(), fromNode(resent, 1))
+	select {
+	case message := <-messages:
+		if message.Text || message.From != 1 || !bytes.Equal(message.Payload, payload) {
+			t.Errorf("Reassembled message doesn't match: %+v", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the message to be reassembled")
+	}
+
+	// A late duplicate of a completed message is ignored rather than starting it again
+	receiver.handleFragment(receiver.fragmenter(), fromNode(fragments[1], 1))
+	time.Sleep(30 * time.Millisecond)
+
+	f := receiver.fragmenter()
+	f.mu.Lock()
+	partials := len(f.partial)
+	f.mu.Unlock()
+	if partials != 0 {
+		t.Errorf("Expected no partial messages, got %d", partials)
+	}
+	if sent := sentPackets(t, receiverLink.written()); len(sent) != 1 {
+		t.Errorf("Expected no NAK for a completed message, got %d packets", len(sent))
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected the message to complete once")
+	}
+}
+
+func TestFragmentTimeout(t *testing.T) {
+
+	link := newFakeDevice(nil, nil)
+	radio := &Radio{nodeNum: 2, streamer: streamer{transport: link}}
+	radio.EnableFragmentation(FragmentOptions{NakDelay: 5 * time.Millisecond, MaxNaks: 2})
+	f := radio.fragmenter()
+
+	fragments, err := splitFragments(fragmentBinary, 7, bytes.Repeat([]byte{1}, 300))
+	if err != nil {
+		t.Fatalf("Error splitting message: %v", err)
+	}
+	packet := &pb.MeshPacket{
+		From:           1,
+		To:             2,
+		PayloadVariant: &pb.MeshPacket_Decoded{Decoded: &pb.Data{Portnum: pb.PortNum_PRIVATE_APP, Payload: fragments[0]}},
+	}
+
+	radio.handleFragment(f, packet)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		f.mu.Lock()
+		partials := len(f.partial)
+		f.mu.Unlock()
+		if partials == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the partial message to be dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if naks := sentPackets(t, link.written()); len(naks) != 2 {
+		t.Errorf("Expected 2 NAKs before giving up, got %d", len(naks))
+	}
+
+	// The sender retransmitting after the receiver gave up doesn't start the message again
+	radio.handleFragment(f, packet)
+	f.mu.Lock()
+	partials := len(f.partial)
+	f.mu.Unlock()
+	if partials != 0 {
+		t.Errorf("Expected the abandoned message to stay dropped, got %d partials", partials)
+	}
+}
+
+func TestSendLongShortMessages(t *testing.T) {
+
+	link := newFakeDevice(nil, nil)
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: link}}
+	messages := make(chan LongMessage, 3)
+	radio.EnableFragmentation(FragmentOptions{OnMessage: func(message LongMessage) { messages <- message }})
+
+	if err := radio.SendLongText("short", 5, 1); err != nil {
+		t.Fatalf("Error sending text: %v", err)
+	}
+	if err := radio.SendLongData([]byte("data"), 5, 1); err != nil {
+		t.Fatalf("Error sending data: %v", err)
+	}
+	marked := []byte{fragmentMagic, 1, 2}
+	if err := radio.SendLongData(marked, 5, 1); err != nil {
+		t.Fatalf("Error sending data: %v", err)
+	}
+
+	sent := sentPackets(t, link.written())
+	if len(sent) != 3 {
+		t.Fatalf("Expected 3 packets, got %d", len(sent))
+	}
+	if data := sent[0].GetDecoded(); data.Portnum != pb.PortNum_TEXT_MESSAGE_APP || string(data.Payload) != "short" {
+		t.Errorf("Expected short text as a plain text message, got %v %q", data.Portnum, data.Payload)
+	}
+	if data := sent[1].GetDecoded(); data.Portnum != pb.PortNum_PRIVATE_APP || string(data.Payload) != "data" {
+		t.Errorf("Expected a short payload without a fragment header, got %v %q", data.Portnum, data.Payload)
+	}
+	if data := sent[2].GetDecoded(); len(data.Payload) != fragmentHeaderLen+len(marked) || data.Payload[0] != fragmentMagic {
+		t.Errorf("Expected a payload starting with the marker to be fragmented, got % x", data.Payload)
+	}
+
+	for _, packet := range sent {
+		radio.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_Packet{Packet: fromNode(packet, 5)}})
+	}
+	for i, want := range []LongMessage{{Text: true, Payload: []byte("short")}, {Payload: []byte("data")}, {Payload: marked}} {
+		select {
+		case message := <-messages:
+			if message.From != 5 || message.Text != want.Text || !bytes.Equal(message.Payload, want.Payload) {
+				t.Errorf("Expected message %d to be %q, got %+v", i, want.Payload, message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected message %d to be delivered", i)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 module github.com/lmatte7/gomesh
 
-go 1.16
+go 1.21
 
 require (
+	github.com/gorilla/websocket v1.5.0
 	github.com/jacobsa/go-serial v0.0.0-20180131005756-15cf729a72d4
-	golang.org/x/sys v0.0.0-20210525143221-35b2ab0089ea // indirect
+	go.etcd.io/bbolt v1.3.6
 	google.golang.org/protobuf v1.26.0
 )
+
+require golang.org/x/sys v0.0.0-20210525143221-35b2ab0089ea // indirect
@@ -0,0 +1,134 @@
+package gomesh
+
+import (
+	"context"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// GPIOEvent is a change of watched pins reported by a remote node
+type GPIOEvent struct {
+	Node  uint32
+	Mask  uint64
+	Value uint64
+}
+
+// GPIOClient drives the GPIO pins of a remote node through its remote hardware module. The firmware only
+// accepts remote hardware messages on a channel named "gpio", so Channel should be the index of that channel
+type GPIOClient struct {
+	radio   *Radio
+	Node    uint32
+	Channel uint32
+}
+
+// NewGPIOClient returns a client for the GPIO pins of a remote node, sending on the provided channel index
+func (r *Radio) NewGPIOClient(node uint32, channel uint32) *GPIOClient {
+	return &GPIOClient{radio: r, Node: node, Channel: channel}
+}
+
+// send sends a hardware message to the remote node
+func (g *GPIOClient) send(ctx context.Context, message *pb.HardwareMessage, wantResponse bool) error {
+
+	out, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.radio.SendData(ctx, DataRequest{
+		To:           g.Node,
+		Channel:      g.Channel,
+		Port:         pb.PortNum_REMOTE_HARDWARE_APP,
+		Payload:      out,
+		WantAck:      true,
+		WantResponse: wantResponse,
+	})
+
+	return err
+}
+
+// Write sets the pins in mask to the matching bits of value
+func (g *GPIOClient) Write(ctx context.Context, mask uint64, value uint64) error {
+	return g.send(ctx, &pb.HardwareMessage{
+		Type:      pb.HardwareMessage_WRITE_GPIOS,
+		GpioMask:  mask,
+		GpioValue: value,
+	}, false)
+}
+
+// Read returns the current value of the pins in mask. The remote node replies with the pin values, so the
+// context should allow for a round trip across the mesh
+func (g *GPIOClient) Read(ctx context.Context, mask uint64) (uint64, error) {
+
+	waiter := g.radio.expectData(pb.PortNum_REMOTE_HARDWARE_APP, func(packet *pb.MeshPacket, data *pb.Data) bool {
+		reply, ok := decodeHardwareMessage(data)
+		return ok && packet.From == g.Node && reply.Type == pb.HardwareMessage_READ_GPIOS_REPLY
+	})
+	defer waiter.close()
+
+	if err := g.send(ctx, &pb.HardwareMessage{Type: pb.HardwareMessage_READ_GPIOS, GpioMask: mask}, true); err != nil {
+		return 0, err
+	}
+
+	packet, err := waiter.wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	reply, _ := decodeHardwareMessage(packet.GetDecoded())
+	return reply.GpioValue & mask, nil
+}
+
+// Watch asks the remote node to report changes of the pins in mask. Changes are delivered to the
+// functions registered with OnChange
+func (g *GPIOClient) Watch(ctx context.Context, mask uint64) error {
+	return g.send(ctx, &pb.HardwareMessage{
+		Type:     pb.HardwareMessage_WATCH_GPIOS,
+		GpioMask: mask,
+	}, false)
+}
+
+// OnChange registers a function that is called when the remote node reports a change of watched pins.
+// It runs on the goroutine reading from the radio. The returned function removes it
+func (g *GPIOClient) OnChange(fn func(GPIOEvent)) (remove func()) {
+	return g.radio.HandlePort(pb.PortNum_REMOTE_HARDWARE_APP, func(packet *pb.MeshPacket, data *pb.Data) {
+		message, ok := decodeHardwareMessage(data)
+		if !ok || packet.From != g.Node || message.Type != pb.HardwareMessage_GPIOS_CHANGED {
+			return
+		}
+		fn(GPIOEvent{Node: packet.From, Mask: message.GpioMask, Value: message.GpioValue})
+	})
+}
+
+// decodeHardwareMessage decodes the payload of a remote hardware packet
+func decodeHardwareMessage(data *pb.Data) (*pb.HardwareMessage, bool) {
+	message := pb.HardwareMessage{}
+	if err := proto.Unmarshal(data.GetPayload(), &message); err != nil {
+		return nil, false
+	}
+	return &message, true
+}
+
+// GetRemoteHardwarePins returns the GPIO pins the nodes in the mesh make available to the remote hardware module.
+// Devices that report the module as disabled return ErrUnsupported
+func (r *Radio) GetRemoteHardwarePins(ctx context.Context) ([]*pb.NodeRemoteHardwarePin, error) {
+
+	if err := r.require(func(caps Capabilities) bool { return caps.HasRemoteHardware }); err != nil {
+		return nil, err
+	}
+
+	adminPacket := pb.AdminMessage{
+		PayloadVariant: &pb.AdminMessage_GetNodeRemoteHardwarePinsRequest{
+			GetNodeRemoteHardwarePinsRequest: true,
+		},
+	}
+
+	response, err := r.requestAdmin(ctx, &adminPacket, func(message *pb.AdminMessage) bool {
+		return message.GetGetNodeRemoteHardwarePinsResponse() != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.GetGetNodeRemoteHardwarePinsResponse().NodeRemoteHardwarePins, nil
+}
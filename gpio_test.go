@@ -0,0 +1,179 @@
+package gomesh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// answerPackets answers the mesh packets written to a fake device like the device and the mesh behind it
+func answerPackets(answer func(packet *pb.MeshPacket) []*pb.FromRadio) func(*pb.ToRadio) []*pb.FromRadio {
+	return func(toRadio *pb.ToRadio) []*pb.FromRadio {
+		if packet := toRadio.GetPacket(); packet != nil {
+			return answer(packet)
+		}
+		return nil
+	}
+}
+
+// hardwarePacket is a remote hardware message received from a node
+func hardwarePacket(t *testing.T, from uint32, message *pb.HardwareMessage) *pb.FromRadio {
+	payload, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatalf("Error encoding hardware message: %v", err)
+	}
+	return dataPacket(0, from, pb.PortNum_REMOTE_HARDWARE_APP, payload)
+}
+
+// adminPacket is an admin message received from a node
+func adminPacket(t *testing.T, from uint32, message *pb.AdminMessage) *pb.FromRadio {
+	payload, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatalf("Error encoding admin message: %v", err)
+	}
+	return dataPacket(0, from, pb.PortNum_ADMIN_APP, payload)
+}
+
+func TestGPIOWrite(t *testing.T) {
+
+	device := newFakeDevice(nil, nil)
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+	gpio := radio.NewGPIOClient(0xabcd, 2)
+
+	if err := gpio.Write(context.Background(), 0b1010, 0b1000); err != nil {
+		t.Fatalf("Error writing pins: %v", err)
+	}
+
+	sent := sentPackets(t, device.written())
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 packet, got %d", len(sent))
+	}
+	packet := sent[0]
+	if packet.To != 0xabcd || packet.Channel != 2 || packet.GetDecoded().GetPortnum() != pb.PortNum_REMOTE_HARDWARE_APP {
+		t.Fatalf("Expected a remote hardware packet for 0xabcd on channel 2, got %v", packet)
+	}
+	message, _ := decodeHardwareMessage(packet.GetDecoded())
+	if message.Type != pb.HardwareMessage_WRITE_GPIOS || message.GpioMask != 0b1010 || message.GpioValue != 0b1000 {
+		t.Errorf("Unexpected hardware message: %v", message)
+	}
+}
+
+func TestGPIORead(t *testing.T) {
+
+	// Replies from another node and changes of watched pins arrive before the reply
+	device := newFakeDevice(nil, answerPackets(func(packet *pb.MeshPacket) []*pb.FromRadio {
+		return []*pb.FromRadio{
+			hardwarePacket(t, 0x1234, &pb.HardwareMessage{Type: pb.HardwareMessage_READ_GPIOS_REPLY, GpioValue: 0b0000}),
+			hardwarePacket(t, 0xabcd, &pb.HardwareMessage{Type: pb.HardwareMessage_GPIOS_CHANGED, GpioValue: 0b0000}),
+			hardwarePacket(t, 0xabcd, &pb.HardwareMessage{Type: pb.HardwareMessage_READ_GPIOS_REPLY, GpioValue: 0b1110}),
+		}
+	}))
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+	gpio := radio.NewGPIOClient(0xabcd, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	value, err := gpio.Read(ctx, 0b0110)
+	if err != nil {
+		t.Fatalf("Error reading pins: %v", err)
+	}
+	if value != 0b0110 {
+		t.Errorf("Expected the masked value 0b0110, got %#b", value)
+	}
+
+	sent := sentPackets(t, device.written())
+	if len(sent) != 1 || !sent[0].GetDecoded().GetWantResponse() {
+		t.Fatalf("Expected 1 packet asking for a response, got %v", sent)
+	}
+	message, _ := decodeHardwareMessage(sent[0].GetDecoded())
+	if message.Type != pb.HardwareMessage_READ_GPIOS || message.GpioMask != 0b0110 {
+		t.Errorf("Unexpected hardware message: %v", message)
+	}
+}
+
+func TestGPIOReadTimeout(t *testing.T) {
+
+	device := newFakeDevice(nil, nil)
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+	gpio := radio.NewGPIOClient(0xabcd, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := gpio.Read(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestGPIOWatch(t *testing.T) {
+
+	device := newFakeDevice(nil, nil)
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+	gpio := radio.NewGPIOClient(0xabcd, 2)
+
+	if err := gpio.Watch(context.Background(), 0b0100); err != nil {
+		t.Fatalf("Error watching pins: %v", err)
+	}
+	message, _ := decodeHardwareMessage(sentPackets(t, device.written())[0].GetDecoded())
+	if message.Type != pb.HardwareMessage_WATCH_GPIOS || message.GpioMask != 0b0100 {
+		t.Errorf("Unexpected hardware message: %v", message)
+	}
+
+	var events []GPIOEvent
+	remove := gpio.OnChange(func(event GPIOEvent) { events = append(events, event) })
+
+	radio.handleFromRadio(hardwarePacket(t, 0xabcd, &pb.HardwareMessage{Type: pb.HardwareMessage_GPIOS_CHANGED, GpioMask: 0b0100, GpioValue: 0b0100}))
+	radio.handleFromRadio(hardwarePacket(t, 0x1234, &pb.HardwareMessage{Type: pb.HardwareMessage_GPIOS_CHANGED, GpioMask: 0b0100}))
+	radio.handleFromRadio(hardwarePacket(t, 0xabcd, &pb.HardwareMessage{Type: pb.HardwareMessage_READ_GPIOS_REPLY, GpioValue: 0b0100}))
+
+	if len(events) != 1 || events[0] != (GPIOEvent{Node: 0xabcd, Mask: 0b0100, Value: 0b0100}) {
+		t.Fatalf("Expected only the change from 0xabcd, got %v", events)
+	}
+
+	remove()
+	radio.handleFromRadio(hardwarePacket(t, 0xabcd, &pb.HardwareMessage{Type: pb.HardwareMessage_GPIOS_CHANGED, GpioMask: 0b0100}))
+	if len(events) != 1 {
+		t.Errorf("Expected no events after removing the handler, got %v", events)
+	}
+}
+
+func TestRequestAdminMatchesNodeAndType(t *testing.T) {
+
+	pins := []*pb.NodeRemoteHardwarePin{{NodeNum: 0xabcd, Pin: &pb.RemoteHardwarePin{GpioPin: 5, Name: "relay"}}}
+
+	// Another node's answer and a different response from the device arrive before the right one
+	device := newFakeDevice(nil, answerPackets(func(packet *pb.MeshPacket) []*pb.FromRadio {
+		return []*pb.FromRadio{
+			adminPacket(t, 0x1234, &pb.AdminMessage{PayloadVariant: &pb.AdminMessage_GetNodeRemoteHardwarePinsResponse{
+				GetNodeRemoteHardwarePinsResponse: &pb.NodeRemoteHardwarePinsResponse{},
+			}}),
+			adminPacket(t, 1, &pb.AdminMessage{PayloadVariant: &pb.AdminMessage_GetOwnerResponse{
+				GetOwnerResponse: &pb.User{LongName: "Base Camp"},
+			}}),
+			adminPacket(t, 1, &pb.AdminMessage{PayloadVariant: &pb.AdminMessage_GetNodeRemoteHardwarePinsResponse{
+				GetNodeRemoteHardwarePinsResponse: &pb.NodeRemoteHardwarePinsResponse{NodeRemoteHardwarePins: pins},
+			}}),
+		}
+	}))
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	got, err := radio.GetRemoteHardwarePins(ctx)
+	if err != nil {
+		t.Fatalf("Error getting pins: %v", err)
+	}
+	if len(got) != 1 || got[0].GetPin().GetName() != "relay" {
+		t.Errorf("Expected the pins from the connected device, got %v", got)
+	}
+
+	sent := sentPackets(t, device.written())
+	if len(sent) != 1 || sent[0].To != 1 || sent[0].GetDecoded().GetPortnum() != pb.PortNum_ADMIN_APP {
+		t.Errorf("Expected 1 admin packet for the connected device, got %v", sent)
+	}
+}
@@ -0,0 +1,599 @@
+package gomesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+// Buckets of the history database. Index keys end with the time and sequence number of the packet so each
+// index is ordered by time
+var (
+	historyPackets   = []byte("packets")
+	historyByTime    = []byte("by_time")
+	historyByNode    = []byte("by_node")
+	historyByChannel = []byte("by_channel")
+	historyByPort    = []byte("by_port")
+	historyNodes     = []byte("nodes")
+	historyTelemetry = []byte("telemetry")
+)
+
+// historyPruneEvery is how many recorded packets pass between applying the retention policy
+const historyPruneEvery = 100
+
+// HistoryOptions configures a history store
+type HistoryOptions struct {
+	// MaxAge drops packets older than this, 0 keeps them regardless of age
+	MaxAge time.Duration
+	// MaxPackets drops the oldest packets beyond this count, 0 keeps any number
+	MaxPackets int
+	// OnError is called when recording a packet or node from the radio fails
+	OnError func(err error)
+}
+
+// HistoryRecord is a packet stored in the history
+type HistoryRecord struct {
+	ID        uint64
+	Time      time.Time
+	Direction PacketDirection
+	Packet    *pb.MeshPacket
+}
+
+// TelemetryRecord is a telemetry report stored in the history
+type TelemetryRecord struct {
+	Node      uint32
+	Time      time.Time
+	Telemetry *pb.Telemetry
+}
+
+// HistoryQuery selects packets from the history. Zero fields don't filter
+type HistoryQuery struct {
+	// Node matches packets sent by or addressed to the node
+	Node uint32
+	// Channel matches packets on a channel index when it isn't nil
+	Channel *uint32
+	Port    pb.PortNum
+	Since   time.Time
+	Until   time.Time
+	// Limit is the most records returned, 0 returns all
+	Limit int
+	// Newest returns the newest records first
+	Newest bool
+}
+
+// HistoryStore records packets, messages, node info and telemetry in a bbolt database so they survive restarts
+type HistoryStore struct {
+	db   *bolt.DB
+	opts HistoryOptions
+
+	mu      sync.Mutex
+	pending int
+}
+
+// OpenHistory opens or creates a history database
+func OpenHistory(path string, opts HistoryOptions) (*HistoryStore, error) {
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{historyPackets, historyByTime, historyByNode, historyByChannel, historyByPort, historyNodes, historyTelemetry} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &HistoryStore{db: db, opts: opts}, nil
+}
+
+// Close closes the database
+func (s *HistoryStore) Close() error {
+	return s.db.Close()
+}
+
+// RecordHistory stores every packet received from or sent to the radio along with the nodes it knows.
+// The returned function stops recording
+func (r *Radio) RecordHistory(s *HistoryStore) (remove func()) {
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, node := range r.Nodes() {
+			if err := putHistoryNode(tx, node); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.report(err)
+	}
+
+	return r.OnPacket(func(packet *pb.MeshPacket, direction PacketDirection) {
+		if direction == PacketSent && packet.From == 0 {
+			packet = proto.Clone(packet).(*pb.MeshPacket)
+			packet.From = r.nodeNum
+		}
+		node, hasNode := r.Node(packet.From)
+
+		// The packet and its sender are stored together so the history never has one without the other
+		record := HistoryRecord{Time: time.Now(), Direction: direction, Packet: packet}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if err := addHistoryRecord(tx, &record); err != nil {
+				return err
+			}
+			if hasNode && direction == PacketReceived {
+				return putHistoryNode(tx, node)
+			}
+			return nil
+		})
+		if err == nil {
+			err = s.added()
+		}
+		if err != nil {
+			s.report(err)
+		}
+	})
+}
+
+// report passes an error to OnError
+func (s *HistoryStore) report(err error) {
+	if s.opts.OnError != nil {
+		s.opts.OnError(err)
+	}
+}
+
+// historyTime converts a time to an index key part. Zero times sort first
+func historyTime(t time.Time) uint64 {
+	if t.IsZero() || t.UnixNano() < 0 {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+// historyKey builds an index key from a prefix, a time and a sequence number
+func historyKey(prefix []byte, at uint64, seq uint64) []byte {
+	key := make([]byte, len(prefix)+16)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], at)
+	binary.BigEndian.PutUint64(key[len(prefix)+8:], seq)
+	return key
+}
+
+func historyUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// historyIndexKeys returns the keys a packet is stored under in each index bucket
+func historyIndexKeys(record HistoryRecord) map[string][][]byte {
+
+	at := historyTime(record.Time)
+	packet := record.Packet
+
+	keys := map[string][][]byte{
+		string(historyByTime):    {historyKey(nil, at, record.ID)},
+		string(historyByChannel): {historyKey(historyUint32(packet.Channel), at, record.ID)},
+		string(historyByNode):    {historyKey(historyUint32(packet.From), at, record.ID)},
+	}
+	if packet.To != packet.From && packet.To != broadcastNum {
+		keys[string(historyByNode)] = append(keys[string(historyByNode)], historyKey(historyUint32(packet.To), at, record.ID))
+	}
+	if data := packet.GetDecoded(); data != nil {
+		keys[string(historyByPort)] = [][]byte{historyKey(historyUint32(uint32(data.Portnum)), at, record.ID)}
+	}
+
+	return keys
+}
+
+// encodeHistoryRecord serializes a record as its time, direction and packet
+func encodeHistoryRecord(record HistoryRecord) ([]byte, error) {
+
+	packet, err := proto.Marshal(record.Packet)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, 9, 9+len(packet))
+	binary.BigEndian.PutUint64(value, historyTime(record.Time))
+	value[8] = byte(record.Direction)
+	return append(value, packet...), nil
+}
+
+// decodeHistoryRecord parses a stored record
+func decodeHistoryRecord(id uint64, value []byte) (HistoryRecord, error) {
+
+	if len(value) < 9 {
+		return HistoryRecord{}, errors.New("invalid history record")
+	}
+
+	packet := &pb.MeshPacket{}
+	if err := proto.Unmarshal(value[9:], packet); err != nil {
+		return HistoryRecord{}, err
+	}
+
+	return HistoryRecord{
+		ID:        id,
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(value))),
+		Direction: PacketDirection(value[8]),
+		Packet:    packet,
+	}, nil
+}
+
+// Add stores a packet, which allows importing packets recorded elsewhere. Telemetry packets are also stored
+// as telemetry records
+func (s *HistoryStore) Add(record HistoryRecord) error {
+
+	if record.Packet == nil {
+		return errors.New("no packet in history record")
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return addHistoryRecord(tx, &record)
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.added()
+}
+
+// addHistoryRecord stores a packet and its index entries in a transaction and sets the ID of the record
+func addHistoryRecord(tx *bolt.Tx, record *HistoryRecord) error {
+
+	packets := tx.Bucket(historyPackets)
+	seq, err := packets.NextSequence()
+	if err != nil {
+		return err
+	}
+	record.ID = seq
+
+	value, err := encodeHistoryRecord(*record)
+	if err != nil {
+		return err
+	}
+	if err := packets.Put(historySeq(seq), value); err != nil {
+		return err
+	}
+
+	for bucket, keys := range historyIndexKeys(*record) {
+		for _, key := range keys {
+			if err := tx.Bucket([]byte(bucket)).Put(key, []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if data := record.Packet.GetDecoded(); data != nil && data.Portnum == pb.PortNum_TELEMETRY_APP {
+		key := historyKey(historyUint32(record.Packet.From), historyTime(record.Time), seq)
+		if err := tx.Bucket(historyTelemetry).Put(key, data.Payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// added counts a stored packet and applies the retention policy every historyPruneEvery packets
+func (s *HistoryStore) added() error {
+
+	s.mu.Lock()
+	s.pending++
+	prune := s.pending >= historyPruneEvery
+	if prune {
+		s.pending = 0
+	}
+	s.mu.Unlock()
+
+	if prune {
+		_, err := s.Prune()
+		return err
+	}
+	return nil
+}
+
+// historySeq converts a sequence number to a packet key
+func historySeq(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+// PutNode stores the latest info of a node
+func (s *HistoryStore) PutNode(node *pb.NodeInfo) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putHistoryNode(tx, node)
+	})
+}
+
+// putHistoryNode stores the info of a node in a transaction
+func putHistoryNode(tx *bolt.Tx, node *pb.NodeInfo) error {
+	value, err := proto.Marshal(node)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(historyNodes).Put(historyUint32(node.Num), value)
+}
+
+// Nodes returns the stored nodes, ordered by node number
+func (s *HistoryStore) Nodes() ([]*pb.NodeInfo, error) {
+
+	nodes := make([]*pb.NodeInfo, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyNodes).ForEach(func(_, value []byte) error {
+			node := &pb.NodeInfo{}
+			if err := proto.Unmarshal(value, node); err != nil {
+				return err
+			}
+			nodes = append(nodes, node)
+			return nil
+		})
+	})
+
+	return nodes, err
+}
+
+// Prune applies the retention policy and returns how many packets were dropped. Recording prunes periodically
+func (s *HistoryStore) Prune() (int, error) {
+
+	if s.opts.MaxAge <= 0 && s.opts.MaxPackets <= 0 {
+		return 0, nil
+	}
+
+	dropped := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		packets := tx.Bucket(historyPackets)
+		excess := 0
+		if s.opts.MaxPackets > 0 {
+			excess = packets.Stats().KeyN - s.opts.MaxPackets
+		}
+		cutoff := uint64(0)
+		if s.opts.MaxAge > 0 {
+			cutoff = historyTime(time.Now().Add(-s.opts.MaxAge))
+		}
+
+		// Collect first, a bucket can't be changed while a cursor walks it
+		var expired [][]byte
+		c := tx.Bucket(historyByTime).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if len(expired) >= excess && binary.BigEndian.Uint64(k) >= cutoff {
+				break
+			}
+			expired = append(expired, append([]byte(nil), k...))
+		}
+
+		for _, k := range expired {
+			seq := binary.BigEndian.Uint64(k[8:])
+			value := packets.Get(historySeq(seq))
+			if value == nil {
+				continue
+			}
+			record, err := decodeHistoryRecord(seq, value)
+			if err != nil {
+				return err
+			}
+
+			for bucket, keys := range historyIndexKeys(record) {
+				for _, key := range keys {
+					if err := tx.Bucket([]byte(bucket)).Delete(key); err != nil {
+						return err
+					}
+				}
+			}
+			key := historyKey(historyUint32(record.Packet.From), historyTime(record.Time), seq)
+			if err := tx.Bucket(historyTelemetry).Delete(key); err != nil {
+				return err
+			}
+			if err := packets.Delete(historySeq(seq)); err != nil {
+				return err
+			}
+			dropped++
+		}
+
+		return nil
+	})
+
+	return dropped, err
+}
+
+// Packets returns the stored packets matching the query, oldest first unless Newest is set
+func (s *HistoryStore) Packets(q HistoryQuery) ([]HistoryRecord, error) {
+
+	// Walk the most selective index and check the other conditions on each packet
+	index, prefix := historyByTime, []byte(nil)
+	switch {
+	case q.Node != 0:
+		index, prefix = historyByNode, historyUint32(q.Node)
+	case q.Port != pb.PortNum_UNKNOWN_APP:
+		index, prefix = historyByPort, historyUint32(uint32(q.Port))
+	case q.Channel != nil:
+		index, prefix = historyByChannel, historyUint32(*q.Channel)
+	}
+
+	records := make([]HistoryRecord, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		packets := tx.Bucket(historyPackets)
+		return walkHistoryIndex(tx.Bucket(index), prefix, q.Since, q.Until, q.Newest, func(key, _ []byte) bool {
+			seq := binary.BigEndian.Uint64(key[len(key)-8:])
+			value := packets.Get(historySeq(seq))
+			if value == nil {
+				return true
+			}
+			record, err := decodeHistoryRecord(seq, value)
+			if err != nil || !q.matches(record.Packet) {
+				return true
+			}
+
+			records = append(records, record)
+			return q.Limit <= 0 || len(records) < q.Limit
+		})
+	})
+
+	return records, err
+}
+
+// matches checks a packet against every condition of the query
+func (q HistoryQuery) matches(packet *pb.MeshPacket) bool {
+	if q.Node != 0 && packet.From != q.Node && packet.To != q.Node {
+		return false
+	}
+	if q.Channel != nil && packet.Channel != *q.Channel {
+		return false
+	}
+	if q.Port != pb.PortNum_UNKNOWN_APP && packet.GetDecoded().GetPortnum() != q.Port {
+		return false
+	}
+	return true
+}
+
+// walkHistoryIndex calls fn with each entry under prefix between since and until, stopping when fn returns false
+func walkHistoryIndex(bucket *bolt.Bucket, prefix []byte, since, until time.Time, newest bool, fn func(key, value []byte) bool) error {
+
+	lower := historyKey(prefix, historyTime(since), 0)
+	upper := historyKey(prefix, math.MaxUint64, math.MaxUint64)
+	if !until.IsZero() {
+		upper = historyKey(prefix, historyTime(until), math.MaxUint64)
+	}
+
+	c := bucket.Cursor()
+	if !newest {
+		for k, v := c.Seek(lower); k != nil && bytes.Compare(k, upper) <= 0; k, v = c.Next() {
+			if !fn(k, v) {
+				break
+			}
+		}
+		return nil
+	}
+
+	k, v := c.Seek(upper)
+	if k == nil {
+		k, v = c.Last()
+	} else if bytes.Compare(k, upper) > 0 {
+		k, v = c.Prev()
+	}
+	for ; k != nil && bytes.Compare(k, lower) >= 0; k, v = c.Prev() {
+		if !fn(k, v) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Messages returns the stored text messages matching the query, plain and compressed. Senders are filled in
+// from the stored nodes
+func (s *HistoryStore) Messages(q HistoryQuery) ([]Message, error) {
+
+	q.Port = pb.PortNum_TEXT_MESSAGE_APP
+	records, err := s.Packets(q)
+	if err != nil {
+		return nil, err
+	}
+
+	// Received text is stored decompressed, but sent and imported packets can still be compressed
+	q.Port = pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP
+	compressed, err := s.Packets(q)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range compressed {
+		if plain, ok := decompressTextPacket(record.Packet); ok {
+			record.Packet = plain
+			records = append(records, record)
+		}
+	}
+
+	// Both lists are in index order, merged they must be too
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if q.Newest {
+			a, b = b, a
+		}
+		if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+		return a.ID < b.ID
+	})
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[:q.Limit]
+	}
+
+	users := make(map[uint32]*pb.User)
+	if nodes, err := s.Nodes(); err == nil {
+		for _, node := range nodes {
+			users[node.Num] = node.User
+		}
+	}
+
+	messages := make([]Message, 0, len(records))
+	for _, record := range records {
+		packet := record.Packet
+		data := packet.GetDecoded()
+		message := Message{
+			ID:       packet.Id,
+			From:     packet.From,
+			To:       packet.To,
+			Channel:  packet.Channel,
+			Sender:   users[packet.From],
+			Text:     string(data.Payload),
+			ReplyID:  data.ReplyId,
+			Emoji:    data.Emoji != 0,
+			Time:     record.Time,
+			SNR:      packet.RxSnr,
+			RSSI:     packet.RxRssi,
+			ViaMQTT:  packet.ViaMqtt,
+			Outgoing: record.Direction == PacketSent,
+		}
+
+		message.Conversation = ChannelConversation(packet.Channel)
+		switch {
+		case packet.To == broadcastNum:
+		case message.Outgoing:
+			message.Conversation = DirectConversation(packet.To)
+		default:
+			message.Conversation = DirectConversation(packet.From)
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+// Telemetry returns the telemetry reports of a node between since and until, oldest first. Zero times don't limit
+func (s *HistoryStore) Telemetry(node uint32, since, until time.Time) ([]TelemetryRecord, error) {
+
+	records := make([]TelemetryRecord, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return walkHistoryIndex(tx.Bucket(historyTelemetry), historyUint32(node), since, until, false, func(key, value []byte) bool {
+			telemetry := &pb.Telemetry{}
+			if err := proto.Unmarshal(value, telemetry); err != nil {
+				return true
+			}
+
+			at := binary.BigEndian.Uint64(key[4:])
+			records = append(records, TelemetryRecord{Node: node, Time: time.Unix(0, int64(at)), Telemetry: telemetry})
+			return true
+		})
+	})
+
+	return records, err
+}
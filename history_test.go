@@ -0,0 +1,165 @@
+package gomesh
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHistoryQueries(t *testing.T) {
+
+	store, err := OpenHistory(filepath.Join(t.TempDir(), "history.db"), HistoryOptions{})
+	if err != nil {
+		t.Fatalf("Error opening history: %v", err)
+	}
+	defer store.Close()
+
+	radio := Radio{nodeNum: 1}
+	defer radio.RecordHistory(store)()
+
+	radio.handleFromRadio(textPacket(1, 0xabcd, broadcastNum, 0, "first", 0, false))
+	radio.handleFromRadio(textPacket(2, 0xabcd, 1, 0, "direct", 0, false))
+	radio.handleFromRadio(textPacket(3, 0x1234, broadcastNum, 2, "other channel", 0, false))
+
+	telemetry, _ := proto.Marshal(&pb.Telemetry{Variant: &pb.Telemetry_DeviceMetrics{DeviceMetrics: &pb.DeviceMetrics{BatteryLevel: 87}}})
+	radio.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_Packet{Packet: &pb.MeshPacket{
+		Id:             4,
+		From:           0xabcd,
+		To:             broadcastNum,
+		PayloadVariant: &pb.MeshPacket_Decoded{Decoded: &pb.Data{Portnum: pb.PortNum_TELEMETRY_APP, Payload: telemetry}},
+	}}})
+
+	all, err := store.Packets(HistoryQuery{})
+	if err != nil || len(all) != 4 {
+		t.Fatalf("Expected 4 packets, got %d %v", len(all), err)
+	}
+
+	fromNode, _ := store.Packets(HistoryQuery{Node: 0xabcd, Newest: true, Limit: 2})
+	if len(fromNode) != 2 || fromNode[0].Packet.Id != 4 || fromNode[1].Packet.Id != 2 {
+		t.Fatalf("Unexpected node query result %v", fromNode)
+	}
+
+	channel := uint32(2)
+	onChannel, _ := store.Packets(HistoryQuery{Channel: &channel})
+	if len(onChannel) != 1 || onChannel[0].Packet.Id != 3 {
+		t.Fatalf("Unexpected channel query result %v", onChannel)
+	}
+
+	messages, _ := store.Messages(HistoryQuery{Node: 1})
+	if len(messages) != 1 || messages[0].Text != "direct" || messages[0].Conversation != DirectConversation(0xabcd) {
+		t.Fatalf("Unexpected messages %+v", messages)
+	}
+
+	reports, _ := store.Telemetry(0xabcd, time.Time{}, time.Time{})
+	if len(reports) != 1 || reports[0].Telemetry.GetDeviceMetrics().GetBatteryLevel() != 87 {
+		t.Fatalf("Unexpected telemetry %v", reports)
+	}
+
+	nodes, _ := store.Nodes()
+	if len(nodes) != 2 {
+		t.Fatalf("Expected 2 stored nodes, got %d", len(nodes))
+	}
+
+	if future, _ := store.Packets(HistoryQuery{Since: time.Now().Add(time.Hour)}); len(future) != 0 {
+		t.Fatalf("Expected no packets in the future, got %d", len(future))
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+
+	store, err := OpenHistory(filepath.Join(t.TempDir(), "history.db"), HistoryOptions{MaxAge: time.Hour, MaxPackets: 3})
+	if err != nil {
+		t.Fatalf("Error opening history: %v", err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	for i, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 30 * time.Minute, 20 * time.Minute, 10 * time.Minute, 0} {
+		packet := textPacket(uint32(i+1), 0xabcd, broadcastNum, 0, "message", 0, false).GetPacket()
+		if err := store.Add(HistoryRecord{Time: now.Add(-age), Packet: packet}); err != nil {
+			t.Fatalf("Error adding packet: %v", err)
+		}
+	}
+
+	dropped, err := store.Prune()
+	if err != nil || dropped != 3 {
+		t.Fatalf("Expected 3 packets dropped, got %d %v", dropped, err)
+	}
+
+	left, _ := store.Packets(HistoryQuery{Node: 0xabcd})
+	if len(left) != 3 || left[0].Packet.Id != 4 {
+		t.Fatalf("Unexpected packets left %v", left)
+	}
+}
+
+func TestHistoryRecordErrors(t *testing.T) {
+
+	var errs []error
+	store, err := OpenHistory(filepath.Join(t.TempDir(), "history.db"), HistoryOptions{OnError: func(err error) { errs = append(errs, err) }})
+	if err != nil {
+		t.Fatalf("Error opening history: %v", err)
+	}
+
+	radio := Radio{nodeNum: 1}
+	defer radio.RecordHistory(store)()
+
+	radio.handleFromRadio(textPacket(1, 0xabcd, broadcastNum, 0, "stored", 0, false))
+	if len(errs) != 0 {
+		t.Fatalf("Error recording: %v", errs)
+	}
+
+	store.Close()
+	radio.handleFromRadio(textPacket(2, 0xabcd, broadcastNum, 0, "lost", 0, false))
+	if len(errs) != 1 {
+		t.Fatalf("Expected the failed write to be reported, got %v", errs)
+	}
+}
+
+func TestHistoryCompressedMessages(t *testing.T) {
+
+	store, err := OpenHistory(filepath.Join(t.TempDir(), "history.db"), HistoryOptions{})
+	if err != nil {
+		t.Fatalf("Error opening history: %v", err)
+	}
+	defer store.Close()
+
+	compressed, ok := CompressText("hello hello hello, this compresses")
+	if !ok {
+		t.Fatal("Expected the text to compress")
+	}
+
+	now := time.Now()
+	plain := textPacket(1, 0xabcd, broadcastNum, 0, "plain", 0, false).GetPacket()
+	sent := &pb.MeshPacket{
+		Id:             2,
+		From:           1,
+		To:             broadcastNum,
+		PayloadVariant: &pb.MeshPacket_Decoded{Decoded: &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP, Payload: compressed}},
+	}
+	later := textPacket(3, 0xabcd, broadcastNum, 0, "later", 0, false).GetPacket()
+	for i, packet := range []*pb.MeshPacket{plain, sent, later} {
+		record := HistoryRecord{Time: now.Add(time.Duration(i) * time.Second), Packet: packet}
+		if i == 1 {
+			record.Direction = PacketSent
+		}
+		if err := store.Add(record); err != nil {
+			t.Fatalf("Error adding packet: %v", err)
+		}
+	}
+
+	messages, err := store.Messages(HistoryQuery{})
+	if err != nil || len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d %v", len(messages), err)
+	}
+	if messages[1].Text != "hello hello hello, this compresses" || !messages[1].Outgoing || messages[2].Text != "later" {
+		t.Fatalf("Unexpected messages %+v", messages)
+	}
+
+	newest, _ := store.Messages(HistoryQuery{Newest: true, Limit: 2})
+	if len(newest) != 2 || newest[0].ID != 3 || newest[1].ID != 2 {
+		t.Fatalf("Unexpected newest messages %+v", newest)
+	}
+}
@@ -0,0 +1,128 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lmatte7/gomesh"
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// pingInterval is how often WebSocket clients are pinged to detect dead connections
+const pingInterval = 30 * time.Second
+
+// event is a message on the event stream
+type event struct {
+	Type      string          `json:"type"`
+	Direction string          `json:"direction"`
+	Time      time.Time       `json:"time"`
+	Packet    json.RawMessage `json:"packet"`
+}
+
+// publish sends a packet to every WebSocket client. It runs on the read goroutine of the radio so it never
+// blocks
+func (s *Server) publish(packet *pb.MeshPacket, direction gomesh.PacketDirection) {
+
+	s.mu.Lock()
+	subscribers := make([]*subscriber, 0, len(s.subscribers))
+	for sub := range s.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	s.mu.Unlock()
+
+	if len(subscribers) == 0 {
+		return
+	}
+
+	out, err := marshaller.Marshal(packet)
+	if err != nil {
+		return
+	}
+	message, err := json.Marshal(event{Type: "packet", Direction: direction.String(), Time: time.Now().UTC(), Packet: out})
+	if err != nil {
+		return
+	}
+
+	for _, sub := range subscribers {
+		select {
+		case sub.events <- message:
+		case <-sub.done:
+		default:
+			s.unsubscribe(sub)
+		}
+	}
+}
+
+// unsubscribe removes a WebSocket client
+func (s *Server) unsubscribe(sub *subscriber) {
+	sub.once.Do(func() {
+		s.mu.Lock()
+		delete(s.subscribers, sub)
+		s.mu.Unlock()
+		close(sub.done)
+	})
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	// Subscribe before the upgrade so no packet is missed once the client sees the connection open
+	sub := &subscriber{events: make(chan []byte, s.opts.EventBuffer), done: make(chan struct{})}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		writeError(w, http.StatusServiceUnavailable, errors.New("server closed"))
+		return
+	}
+	s.subscribers[sub] = struct{}{}
+	s.mu.Unlock()
+	defer s.unsubscribe(sub)
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already wrote the error response
+		return
+	}
+	defer conn.Close()
+
+	// Reading handles pongs and close frames, and ends the stream when the client goes away
+	go func() {
+		defer s.unsubscribe(sub)
+		conn.SetReadLimit(4096)
+		conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-sub.done:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+			return
+		case message := <-sub.events:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
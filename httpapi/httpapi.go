@@ -0,0 +1,506 @@
+// Package httpapi serves a connected radio over HTTP. REST endpoints expose nodes, channels and config,
+// send messages and run admin actions, and a WebSocket streams every packet as protojson
+package httpapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lmatte7/gomesh"
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// prefix is the path all API endpoints are under
+const prefix = "/api/v1"
+
+// errNotFound is returned for an unknown node
+var errNotFound = errors.New("not found")
+
+// marshaller writes protobufs with the field names of the proto files
+var marshaller = protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: false}
+
+// Options configures a Server
+type Options struct {
+	// Token enables bearer token auth when set. WebSocket clients that can't set headers may pass it as the
+	// access_token query parameter instead
+	Token string
+	// SendTimeout bounds how long a send waits for the device, 30 seconds when not set
+	SendTimeout time.Duration
+	// EventBuffer is the number of events queued for each WebSocket client before a slow client is
+	// disconnected, 256 when not set
+	EventBuffer int
+	// CheckOrigin decides whether a WebSocket or POST request from a browser page is allowed. When not set
+	// only pages from the same host are
+	CheckOrigin func(r *http.Request) bool
+	// AllowedHosts are the host names requests may be addressed to besides localhost and loopback
+	// addresses, with or without a port. When not set any host is allowed with a token and none without,
+	// so a page that rebinds its DNS name to this machine can't read the API
+	AllowedHosts []string
+}
+
+// Server is an http.Handler for a radio
+type Server struct {
+	radio    *gomesh.Radio
+	opts     Options
+	mux      *http.ServeMux
+	upgrader websocket.Upgrader
+	remove   func()
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	closed      bool
+}
+
+// subscriber is a WebSocket client and its queue of events
+type subscriber struct {
+	events chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+// New creates a server for a connected radio. Packets reach the event stream while the radio is listening,
+// which Run does
+func New(radio *gomesh.Radio, opts Options) *Server {
+
+	if opts.SendTimeout <= 0 {
+		opts.SendTimeout = 30 * time.Second
+	}
+	if opts.EventBuffer <= 0 {
+		opts.EventBuffer = 256
+	}
+
+	s := &Server{
+		radio:       radio,
+		opts:        opts,
+		mux:         http.NewServeMux(),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+	s.upgrader.CheckOrigin = opts.CheckOrigin
+
+	s.mux.HandleFunc(prefix+"/openapi.json", s.handleOpenAPI)
+	s.mux.HandleFunc(prefix+"/node", s.authorized(s.handleLocalNode))
+	s.mux.HandleFunc(prefix+"/nodes", s.authorized(s.handleNodes))
+	s.mux.HandleFunc(prefix+"/nodes/", s.authorized(s.handleNode))
+	s.mux.HandleFunc(prefix+"/channels", s.authorized(s.handleChannels))
+	s.mux.HandleFunc(prefix+"/config", s.authorized(s.handleConfig))
+	s.mux.HandleFunc(prefix+"/messages", s.authorized(s.handleSendMessage))
+	s.mux.HandleFunc(prefix+"/admin", s.authorized(s.handleAdmin))
+	s.mux.HandleFunc(prefix+"/admin/owner", s.authorized(s.handleSetOwner))
+	s.mux.HandleFunc(prefix+"/admin/position", s.authorized(s.handleSetPosition))
+	s.mux.HandleFunc(prefix+"/admin/reboot", s.authorized(s.handleReboot))
+	s.mux.HandleFunc(prefix+"/admin/factory-reset", s.authorized(s.handleFactoryReset))
+	s.mux.HandleFunc(prefix+"/events", s.authorized(s.handleEvents))
+
+	s.remove = radio.OnPacket(s.publish)
+	return s
+}
+
+// Run reads from the radio until the context is done so events reach WebSocket clients. It is not needed
+// when the radio is already listening elsewhere
+func (s *Server) Run(ctx context.Context) error {
+	return s.radio.Listen(ctx)
+}
+
+// ServeHTTP serves the API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if !s.allowedHost(r.Host) {
+		writeError(w, http.StatusMisdirectedRequest, errors.New("host not allowed"))
+		return
+	}
+
+	// Browsers send cross site requests with cookies and without preflight for some content types, so
+	// anything that changes the radio has to come from the same origin
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.sameOrigin(r) {
+		writeError(w, http.StatusForbidden, errors.New("cross origin request"))
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// allowedHost checks the Host header of a request against AllowedHosts
+func (s *Server) allowedHost(host string) bool {
+
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	name = strings.Trim(name, "[]")
+
+	if ip := net.ParseIP(name); strings.EqualFold(name, "localhost") || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+	if len(s.opts.AllowedHosts) == 0 {
+		return s.opts.Token != ""
+	}
+
+	for _, allowed := range s.opts.AllowedHosts {
+		if strings.EqualFold(allowed, host) || strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether a request was made by a page of this server or by something other than a
+// browser, using CheckOrigin when it is set
+func (s *Server) sameOrigin(r *http.Request) bool {
+
+	if s.opts.CheckOrigin != nil && r.Header.Get("Origin") != "" {
+		return s.opts.CheckOrigin(r)
+	}
+
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Close disconnects every WebSocket client and stops publishing events
+func (s *Server) Close() {
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	subscribers := make([]*subscriber, 0, len(s.subscribers))
+	for sub := range s.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	s.mu.Unlock()
+
+	s.remove()
+	for _, sub := range subscribers {
+		s.unsubscribe(sub)
+	}
+}
+
+// authorized checks the bearer token before calling a handler
+func (s *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.Token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" || token == r.Header.Get("Authorization") {
+				token = r.URL.Query().Get("access_token")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="gomesh"`)
+				writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// allow checks the method of a request, and that a POST is JSON so browsers can't send it as a form
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return false
+	}
+	if method == http.MethodPost {
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+			return false
+		}
+	}
+	return true
+}
+
+// writeJSON writes a value as JSON
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError writes an error as JSON
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeProto writes a protobuf as protojson
+func writeProto(w http.ResponseWriter, message proto.Message) {
+	out, err := marshaller.Marshal(message)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, json.RawMessage(out))
+}
+
+// writeProtoList writes a list of protobufs as a JSON array of protojson
+func writeProtoList[M proto.Message](w http.ResponseWriter, messages []M) {
+	list, err := protoList(messages)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// protoList converts protobufs to protojson
+func protoList[M proto.Message](messages []M) ([]json.RawMessage, error) {
+	list := make([]json.RawMessage, 0, len(messages))
+	for _, message := range messages {
+		out, err := marshaller.Marshal(message)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, out)
+	}
+	return list, nil
+}
+
+// decode reads a JSON request body
+func decode(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(value); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// parseNodeNum parses a node number written in decimal or as a node id such as !1234abcd
+func parseNodeNum(s string) (uint32, error) {
+	if strings.HasPrefix(s, "!") {
+		n, err := strconv.ParseUint(s[1:], 16, 32)
+		return uint32(n), err
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err
+}
+
+func (s *Server) handleLocalNode(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	node, ok := s.radio.Node(s.radio.NodeNum())
+	if !ok {
+		node = &pb.NodeInfo{Num: s.radio.NodeNum()}
+	}
+	writeProto(w, node)
+}
+
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	writeProtoList(w, s.radio.Nodes())
+}
+
+func (s *Server) handleNode(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	num, err := parseNodeNum(strings.TrimPrefix(r.URL.Path, prefix+"/nodes/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	node, ok := s.radio.Node(num)
+	if !ok {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	writeProto(w, node)
+}
+
+func (s *Server) handleChannels(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	writeProtoList(w, s.radio.Channels())
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	config, modules := s.radio.Config()
+	configList, err := protoList(config)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	moduleList, err := protoList(modules)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"config": configList, "module_config": moduleList})
+}
+
+// messageRequest is the body of a send message request
+type messageRequest struct {
+	Text string `json:"text"`
+	// To is a node number or node id, empty broadcasts
+	To      string `json:"to"`
+	Channel uint32 `json:"channel"`
+	WantAck bool   `json:"want_ack"`
+	ReplyID uint32 `json:"reply_id"`
+}
+
+func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+
+	var req messageRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Text == "" {
+		writeError(w, http.StatusBadRequest, errors.New("text is required"))
+		return
+	}
+
+	var to uint32
+	if req.To != "" {
+		num, err := parseNodeNum(req.To)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		to = num
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.opts.SendTimeout)
+	defer cancel()
+
+	id, err := s.radio.SendData(ctx, gomesh.DataRequest{
+		To:      to,
+		Channel: req.Channel,
+		Port:    pb.PortNum_TEXT_MESSAGE_APP,
+		Payload: []byte(req.Text),
+		WantAck: req.WantAck,
+		ReplyId: req.ReplyID,
+	})
+	if errors.Is(err, gomesh.ErrPayloadTooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]uint32{"id": id})
+}
+
+// writeResult writes the result of an admin action
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]bool{"ok": true})
+}
+
+func (s *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+
+	body := json.RawMessage{}
+	if !decode(w, r, &body) {
+		return
+	}
+	admin := pb.AdminMessage{}
+	if err := protojson.Unmarshal(body, &admin); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if admin.GetPayloadVariant() == nil {
+		writeError(w, http.StatusBadRequest, errors.New("admin message is empty"))
+		return
+	}
+
+	writeResult(w, s.radio.SendAdmin(&admin))
+}
+
+func (s *Server) handleSetOwner(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if len(req.Name) <= 2 {
+		writeError(w, http.StatusBadRequest, errors.New("name too short"))
+		return
+	}
+
+	writeResult(w, s.radio.SetRadioOwner(req.Name))
+}
+
+func (s *Server) handleSetPosition(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+		Altitude  int32   `json:"altitude"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	writeResult(w, s.radio.SetPosition(req.Latitude, req.Longitude, req.Altitude))
+}
+
+func (s *Server) handleReboot(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+
+	req := struct {
+		Seconds int32 `json:"seconds"`
+	}{Seconds: 5}
+	if r.ContentLength != 0 && !decode(w, r, &req) {
+		return
+	}
+
+	writeResult(w, s.radio.Reboot(req.Seconds))
+}
+
+func (s *Server) handleFactoryReset(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	writeResult(w, s.radio.FactoryRest())
+}
@@ -0,0 +1,273 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lmatte7/gomesh"
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// testTransport delivers a config dump, then stays quiet, and records what the radio writes
+type testTransport struct {
+	in  *bytes.Reader
+	mu  sync.Mutex
+	out bytes.Buffer
+}
+
+func (t *testTransport) Read(p []byte) (int, error) {
+	if t.in.Len() == 0 {
+		time.Sleep(5 * time.Millisecond)
+		return 0, os.ErrDeadlineExceeded
+	}
+	return t.in.Read(p)
+}
+
+func (t *testTransport) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.out.Write(p)
+}
+
+func (t *testTransport) Close() error { return nil }
+
+func (t *testTransport) written() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.out.Bytes()...)
+}
+
+// testServer serves a radio that reported two nodes, a channel and a LoRa config
+func testServer(t *testing.T, opts Options) (*httptest.Server, *testTransport) {
+
+	var stream []byte
+	for _, fromRadio := range []*pb.FromRadio{
+		{PayloadVariant: &pb.FromRadio_MyInfo{MyInfo: &pb.MyNodeInfo{MyNodeNum: 1}}},
+		{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: &pb.NodeInfo{Num: 1, User: &pb.User{LongName: "Base"}}}},
+		{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: &pb.NodeInfo{Num: 2, User: &pb.User{LongName: "Hiker"}}}},
+		{PayloadVariant: &pb.FromRadio_Channel{Channel: &pb.Channel{Index: 0, Role: pb.Channel_PRIMARY}}},
+		{PayloadVariant: &pb.FromRadio_Config{Config: &pb.Config{PayloadVariant: &pb.Config_Lora{Lora: &pb.Config_LoRaConfig{UsePreset: true}}}}},
+	} {
+		out, err := proto.Marshal(fromRadio)
+		if err != nil {
+			t.Fatalf("Error marshalling frame: %v", err)
+		}
+		stream = append(stream, 0x94, 0xc3, byte(len(out)>>8), byte(len(out)))
+		stream = append(stream, out...)
+	}
+
+	transport := &testTransport{in: bytes.NewReader(stream)}
+	radio := &gomesh.Radio{}
+	if err := radio.InitTransport(transport); err != nil {
+		t.Fatalf("Error connecting radio: %v", err)
+	}
+
+	api := New(radio, opts)
+	server := httptest.NewServer(api)
+	t.Cleanup(func() {
+		server.Close()
+		api.Close()
+	})
+
+	return server, transport
+}
+
+// request makes an API request and decodes the JSON response
+func request(t *testing.T, method, url, token, body string, out interface{}) int {
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Error decoding %s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPIReads(t *testing.T) {
+
+	server, _ := testServer(t, Options{Token: "secret"})
+	api := server.URL + prefix
+
+	if status := request(t, "GET", api+"/nodes", "", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", status)
+	}
+	if status := request(t, "GET", api+"/openapi.json", "", "", &map[string]interface{}{}); status != http.StatusOK {
+		t.Errorf("Expected the OpenAPI document without a token, got %d", status)
+	}
+
+	var nodes []map[string]interface{}
+	if status := request(t, "GET", api+"/nodes", "secret", "", &nodes); status != http.StatusOK || len(nodes) != 2 {
+		t.Fatalf("Expected 2 nodes, got %d with status %d", len(nodes), status)
+	}
+
+	var node struct {
+		Num  uint32 `json:"num"`
+		User struct {
+			LongName string `json:"long_name"`
+		} `json:"user"`
+	}
+	if status := request(t, "GET", api+"/nodes/!00000002", "secret", "", &node); status != http.StatusOK || node.User.LongName != "Hiker" {
+		t.Errorf("Expected node Hiker, got %+v with status %d", node, status)
+	}
+	if status := request(t, "GET", api+"/nodes/7", "secret", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown node, got %d", status)
+	}
+
+	var channels []map[string]interface{}
+	if status := request(t, "GET", api+"/channels", "secret", "", &channels); status != http.StatusOK || len(channels) != 1 {
+		t.Errorf("Expected 1 channel, got %d with status %d", len(channels), status)
+	}
+
+	var config struct {
+		Config []map[string]interface{} `json:"config"`
+	}
+	if status := request(t, "GET", api+"/config", "secret", "", &config); status != http.StatusOK || len(config.Config) != 1 || config.Config[0]["lora"] == nil {
+		t.Errorf("Expected the LoRa config, got %+v with status %d", config, status)
+	}
+}
+
+func TestAPISendAndEvents(t *testing.T) {
+
+	server, transport := testServer(t, Options{Token: "secret"})
+	api := server.URL + prefix
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(api, "http")+"/events?access_token=secret", nil)
+	if err != nil {
+		t.Fatalf("Error connecting to the event stream: %v", err)
+	}
+	defer ws.Close()
+
+	var sent struct {
+		ID uint32 `json:"id"`
+	}
+	if status := request(t, "POST", api+"/messages", "secret", `{"text":"hello mesh","to":"!00000002"}`, &sent); status != http.StatusAccepted || sent.ID == 0 {
+		t.Fatalf("Expected the message to be sent, got id %d with status %d", sent.ID, status)
+	}
+	if !bytes.Contains(transport.written(), []byte("hello mesh")) {
+		t.Errorf("Expected the message to be written to the radio")
+	}
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var ev struct {
+		Type      string `json:"type"`
+		Direction string `json:"direction"`
+		Packet    struct {
+			ID uint32 `json:"id"`
+			To uint32 `json:"to"`
+		} `json:"packet"`
+	}
+	if err := ws.ReadJSON(&ev); err != nil {
+		t.Fatalf("Error reading event: %v", err)
+	}
+	if ev.Type != "packet" || ev.Direction != "sent" || ev.Packet.ID != sent.ID || ev.Packet.To != 2 {
+		t.Errorf("Unexpected event %+v", ev)
+	}
+
+	if status := request(t, "POST", api+"/messages", "secret", `{"text":""}`, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty message, got %d", status)
+	}
+	if status := request(t, "POST", api+"/admin", "secret", `{"reboot_seconds":3}`, nil); status != http.StatusAccepted {
+		t.Errorf("Expected the admin message to be sent, got %d", status)
+	}
+}
+
+func TestAPIBrowserRequests(t *testing.T) {
+
+	server, transport := testServer(t, Options{})
+	api := server.URL + prefix
+
+	post := func(contentType string, headers map[string]string) int {
+		req, err := http.NewRequest("POST", api+"/messages", strings.NewReader(`{"text":"from a page"}`))
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// A form or fetch without preflight can't set a JSON content type
+	if status := post("text/plain", nil); status != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for a text/plain body, got %d", status)
+	}
+	if status := post("", nil); status != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 without a content type, got %d", status)
+	}
+
+	if status := post("application/json", map[string]string{"Origin": "http://evil.example"}); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for another origin, got %d", status)
+	}
+	if status := post("application/json", map[string]string{"Sec-Fetch-Site": "cross-site"}); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a cross site request, got %d", status)
+	}
+	if bytes.Contains(transport.written(), []byte("from a page")) {
+		t.Fatal("Expected no refused message to reach the radio")
+	}
+
+	origin := map[string]string{"Origin": server.URL, "Sec-Fetch-Site": "same-origin"}
+	if status := post("application/json; charset=utf-8", origin); status != http.StatusAccepted {
+		t.Errorf("Expected a same origin request to be sent, got %d", status)
+	}
+
+	// A rebound DNS name reaches this server with a foreign Host header
+	req, _ := http.NewRequest("GET", api+"/channels", nil)
+	req.Host = "rebind.example:8080"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("Expected 421 for a host that isn't loopback, got %d", resp.StatusCode)
+	}
+
+	allowed, _ := testServer(t, Options{Token: "secret", AllowedHosts: []string{"radio.lan"}})
+	for host, want := range map[string]int{"radio.lan:8080": http.StatusOK, "localhost": http.StatusOK, "rebind.example": http.StatusMisdirectedRequest} {
+		req, _ = http.NewRequest("GET", allowed.URL+prefix+"/channels", nil)
+		req.Host = host
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error making request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Expected %d for host %s, got %d", want, host, resp.StatusCode)
+		}
+	}
+}
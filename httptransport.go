@@ -0,0 +1,219 @@
+package gomesh
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPOptions configures the connection to a device over its HTTP API
+type HTTPOptions struct {
+	// InsecureSkipVerify accepts any certificate, which HTTPS devices with their self-signed certificate need
+	InsecureSkipVerify bool
+	// PollInterval is how long a read waits after fromradio comes back empty before asking again,
+	// 500 milliseconds when not set
+	PollInterval time.Duration
+	// Timeout bounds each request, 10 seconds when not set
+	Timeout time.Duration
+	// Client replaces the HTTP client, which makes InsecureSkipVerify and Timeout unused
+	Client *http.Client
+}
+
+// HTTPTransport talks to a device through /api/v1/toradio and /api/v1/fromradio, the API WiFi devices serve.
+// It carries the same framed stream as a serial or TCP link so a Radio can use it as its transport
+type HTTPTransport struct {
+	base   string
+	client *http.Client
+	opts   HTTPOptions
+	closed chan struct{}
+	once   sync.Once
+
+	// buf holds frames fetched but not read yet, only used by the reading goroutine
+	buf []byte
+}
+
+// isHTTPAddr reports whether a radio address is the URL of a device HTTP API
+func isHTTPAddr(addr string) bool {
+	return strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://")
+}
+
+// NewHTTPTransport creates a transport for the device at a URL such as https://meshtastic.local. A host
+// without a scheme uses http
+func NewHTTPTransport(addr string, opts HTTPOptions) (*HTTPTransport, error) {
+
+	if !isHTTPAddr(addr) {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing device host")
+	}
+
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 500 * time.Millisecond
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	client := opts.Client
+	if client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if opts.InsecureSkipVerify {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		client = &http.Client{Transport: transport, Timeout: opts.Timeout}
+	}
+
+	return &HTTPTransport{
+		base:   strings.TrimSuffix(u.String(), "/"),
+		client: client,
+		opts:   opts,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// InitHTTP connects the radio to a device over its HTTP API and runs the config handshake. Reconnecting uses
+// the same options
+func (r *Radio) InitHTTP(addr string, opts HTTPOptions) error {
+
+	c := r.conn()
+	c.mu.Lock()
+	c.httpOptions = opts
+	c.mu.Unlock()
+
+	if !isHTTPAddr(addr) {
+		addr = "http://" + addr
+	}
+	return r.Init(addr)
+}
+
+// fetch gets the next protobuf from fromradio, empty when the device has nothing to send
+func (t *HTTPTransport) fetch() ([]byte, error) {
+
+	req, err := http.NewRequest(http.MethodGet, t.base+"/api/v1/fromradio?all=false", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/x-protobuf")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fromradio: unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxToFromRadioSzie+1))
+}
+
+// Read delivers the messages from fromradio as frames. It polls until fromradio is empty and reports a
+// quiet stream when there was nothing to read
+func (t *HTTPTransport) Read(p []byte) (int, error) {
+
+	if len(t.buf) == 0 {
+		select {
+		case <-t.closed:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+
+		for {
+			payload, err := t.fetch()
+			if err != nil {
+				return 0, err
+			}
+			if len(payload) == 0 {
+				break
+			}
+			t.buf = append(t.buf, start1, start2, byte(len(payload)>>8), byte(len(payload)))
+			t.buf = append(t.buf, payload...)
+		}
+
+		if len(t.buf) == 0 {
+			timer := time.NewTimer(t.opts.PollInterval)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				return 0, os.ErrDeadlineExceeded
+			case <-t.closed:
+				return 0, io.ErrClosedPipe
+			}
+		}
+	}
+
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+// Write sends each frame to toradio
+func (t *HTTPTransport) Write(p []byte) (int, error) {
+
+	select {
+	case <-t.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	for rest := p; len(rest) > 0; {
+		payload := rest
+		rest = nil
+		if len(payload) >= headerLen && payload[0] == start1 && payload[1] == start2 {
+			size := int(payload[2])<<8 | int(payload[3])
+			if headerLen+size > len(payload) {
+				return 0, errors.New("incomplete frame")
+			}
+			payload, rest = payload[headerLen:headerLen+size], payload[headerLen+size:]
+		}
+
+		if err := t.put(payload); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// put sends one protobuf to toradio
+func (t *HTTPTransport) put(payload []byte) error {
+
+	req, err := http.NewRequest(http.MethodPut, t.base+"/api/v1/toradio", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("toradio: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Close stops the transport. There is no connection to close
+func (t *HTTPTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
@@ -0,0 +1,90 @@
+package gomesh
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeDeviceAPI serves toradio and fromradio like a WiFi device, answering config requests
+type fakeDeviceAPI struct {
+	mu      sync.Mutex
+	queue   [][]byte
+	toRadio []*pb.ToRadio
+}
+
+func (d *fakeDeviceAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/api/v1/toradio" && r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		toRadio := &pb.ToRadio{}
+		if err := proto.Unmarshal(body, toRadio); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.toRadio = append(d.toRadio, toRadio)
+		if id := toRadio.GetWantConfigId(); id != 0 {
+			for _, fromRadio := range []*pb.FromRadio{
+				{PayloadVariant: &pb.FromRadio_MyInfo{MyInfo: &pb.MyNodeInfo{MyNodeNum: 0x55}}},
+				{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: &pb.NodeInfo{Num: 0x55}}},
+				{PayloadVariant: &pb.FromRadio_ConfigCompleteId{ConfigCompleteId: id}},
+			} {
+				out, _ := proto.Marshal(fromRadio)
+				d.queue = append(d.queue, out)
+			}
+		}
+	case r.URL.Path == "/api/v1/fromradio" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		if len(d.queue) > 0 {
+			w.Write(d.queue[0])
+			d.queue = d.queue[1:]
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+
+	device := &fakeDeviceAPI{}
+	server := httptest.NewTLSServer(device)
+	defer server.Close()
+
+	insecure := Radio{}
+	if err := insecure.InitHTTP(server.URL, HTTPOptions{PollInterval: 10 * time.Millisecond}); err == nil {
+		t.Errorf("Expected the self-signed certificate to be rejected")
+	}
+
+	radio := Radio{}
+	if err := radio.InitHTTP(server.URL, HTTPOptions{InsecureSkipVerify: true, PollInterval: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("Error connecting over HTTP: %v", err)
+	}
+	defer radio.Close()
+
+	if radio.NodeNum() != 0x55 {
+		t.Errorf("Expected node 0x55, got %x", radio.NodeNum())
+	}
+	if radio.State() != StateConfigured {
+		t.Errorf("Expected the radio to be configured, got %v", radio.State())
+	}
+
+	if err := radio.SendTextMessage("over http", 0, 0); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if n := len(device.toRadio); n != 2 || string(device.toRadio[1].GetPacket().GetDecoded().GetPayload()) != "over http" {
+		t.Errorf("Expected the config request and the message, got %v", device.toRadio)
+	}
+}
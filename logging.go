@@ -0,0 +1,269 @@
+package gomesh
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxDebugLineLen caps a serial debug line that never ends
+const maxDebugLineLen = 1024
+
+// Categories of protocol log events, set as the "category" attribute
+const (
+	LogFrames = "frame"
+	LogSends  = "send"
+	LogAdmin  = "admin"
+)
+
+// ansiEscape matches the color codes in the firmware console output
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// debugLevels maps the level names the firmware prints to slog levels
+var debugLevels = map[string]slog.Level{
+	"TRACE": slog.LevelDebug - 4,
+	"DEBUG": slog.LevelDebug,
+	"INFO":  slog.LevelInfo,
+	"WARN":  slog.LevelWarn,
+	"ERROR": slog.LevelError,
+	"CRIT":  slog.LevelError + 4,
+}
+
+// LogOptions configures protocol logging. Each category logs at its own level so the handler can filter them
+type LogOptions struct {
+	// Logger receives protocol events, nil turns protocol logging off
+	Logger *slog.Logger
+	// FrameLevel is the level of frames read and written, debug when not set
+	FrameLevel slog.Leveler
+	// SendLevel is the level of mesh packets sent, debug when not set
+	SendLevel slog.Leveler
+	// AdminLevel is the level of admin messages sent and received, info when not set
+	AdminLevel slog.Leveler
+	// DeviceLog receives the log records the device sends and the debug lines it prints on the serial port.
+	// Nil drops them
+	DeviceLog slog.Handler
+}
+
+// protocolLog holds the logging setup and the partial serial debug line
+type protocolLog struct {
+	opts LogOptions
+	line []byte
+}
+
+// SetLogging turns on protocol logging and device log forwarding
+func (r *Radio) SetLogging(opts LogOptions) {
+
+	if opts.FrameLevel == nil {
+		opts.FrameLevel = slog.LevelDebug
+	}
+	if opts.SendLevel == nil {
+		opts.SendLevel = slog.LevelDebug
+	}
+	if opts.AdminLevel == nil {
+		opts.AdminLevel = slog.LevelInfo
+	}
+
+	c := r.conn()
+	c.mu.Lock()
+	c.logging = &protocolLog{opts: opts}
+	c.mu.Unlock()
+}
+
+// protocolLogger returns the logging setup, or nil if logging isn't enabled
+func (r *Radio) protocolLogger() *protocolLog {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logging
+}
+
+// log writes an event of a category when the logger accepts its level
+func (l *protocolLog) log(category string, level slog.Leveler, msg string, args ...any) {
+
+	if l == nil || l.opts.Logger == nil {
+		return
+	}
+
+	ctx := context.Background()
+	if !l.opts.Logger.Enabled(ctx, level.Level()) {
+		return
+	}
+
+	l.opts.Logger.Log(ctx, level.Level(), msg, append([]any{slog.String("category", category)}, args...)...)
+}
+
+// logFrame logs a frame read from or written to the device
+func (r *Radio) logFrame(direction PacketDirection, frame []byte) {
+
+	l := r.protocolLogger()
+	if l == nil {
+		return
+	}
+
+	args := []any{slog.String("direction", direction.String()), slog.Int("length", len(frame))}
+	if len(frame) > headerLen {
+		if direction == PacketReceived {
+			fromRadio := pb.FromRadio{}
+			if err := proto.Unmarshal(frame[headerLen:], &fromRadio); err == nil {
+				args = append(args, slog.String("variant", variantName(fromRadio.GetPayloadVariant())))
+			}
+		} else {
+			toRadio := pb.ToRadio{}
+			if err := proto.Unmarshal(frame[headerLen:], &toRadio); err == nil {
+				args = append(args, slog.String("variant", variantName(toRadio.GetPayloadVariant())))
+			}
+		}
+	}
+
+	l.log(LogFrames, l.opts.FrameLevel, "frame", args...)
+}
+
+// variantName returns the name of a oneof variant, for example FromRadio_Packet becomes Packet
+func variantName(variant interface{}) string {
+	if variant == nil {
+		return "none"
+	}
+	name := fmt.Sprintf("%T", variant)
+	if i := strings.LastIndex(name, "_"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// logSend logs a mesh packet sent to the device
+func (r *Radio) logSend(packet *pb.MeshPacket, err error) {
+
+	l := r.protocolLogger()
+	if l == nil {
+		return
+	}
+
+	args := []any{
+		slog.String("id", nodeID(packet.Id)),
+		slog.String("to", nodeID(packet.To)),
+		slog.Uint64("channel", uint64(packet.Channel)),
+		slog.String("port", packet.GetDecoded().GetPortnum().String()),
+		slog.Int("size", len(packet.GetDecoded().GetPayload())),
+		slog.Bool("want_ack", packet.WantAck),
+	}
+	if err != nil {
+		l.log(LogSends, slog.LevelWarn, "send failed", append(args, slog.Any("error", err))...)
+		return
+	}
+
+	l.log(LogSends, l.opts.SendLevel, "packet sent", args...)
+}
+
+// logAdmin logs an admin message sent to or received from a node
+func (r *Radio) logAdmin(direction PacketDirection, node uint32, payload []byte) {
+
+	l := r.protocolLogger()
+	if l == nil {
+		return
+	}
+
+	admin := pb.AdminMessage{}
+	if err := proto.Unmarshal(payload, &admin); err != nil {
+		return
+	}
+
+	l.log(LogAdmin, l.opts.AdminLevel, "admin message",
+		slog.String("direction", direction.String()),
+		slog.String("node", nodeID(node)),
+		slog.String("variant", variantName(admin.GetPayloadVariant())),
+	)
+}
+
+// nodeID formats a node number or packet id the way clients show it
+func nodeID(num uint32) string {
+	return fmt.Sprintf("!%08x", num)
+}
+
+// handleLogRecord forwards a log record sent by the device
+func (r *Radio) handleLogRecord(record *pb.LogRecord) {
+
+	l := r.protocolLogger()
+	if l == nil || l.opts.DeviceLog == nil {
+		return
+	}
+
+	var level slog.Level
+	switch {
+	case record.Level >= pb.LogRecord_CRITICAL:
+		level = slog.LevelError + 4
+	case record.Level >= pb.LogRecord_ERROR:
+		level = slog.LevelError
+	case record.Level >= pb.LogRecord_WARNING:
+		level = slog.LevelWarn
+	case record.Level >= pb.LogRecord_INFO || record.Level == pb.LogRecord_UNSET:
+		level = slog.LevelInfo
+	case record.Level >= pb.LogRecord_DEBUG:
+		level = slog.LevelDebug
+	default:
+		level = slog.LevelDebug - 4
+	}
+
+	at := time.Now()
+	if record.Time != 0 {
+		at = time.Unix(int64(record.Time), 0)
+	}
+
+	out := slog.NewRecord(at, level, record.Message, 0)
+	if record.Source != "" {
+		out.AddAttrs(slog.String("source", record.Source))
+	}
+	l.emitDeviceLog(out)
+}
+
+// emitDeviceLog passes a record to the device log handler when it accepts the level
+func (l *protocolLog) emitDeviceLog(record slog.Record) {
+	ctx := context.Background()
+	if l.opts.DeviceLog.Enabled(ctx, record.Level) {
+		l.opts.DeviceLog.Handle(ctx, record)
+	}
+}
+
+// debugBytes collects bytes read outside of frames, which are the debug console of the device, and forwards
+// them a line at a time
+func (r *Radio) debugBytes(b ...byte) {
+
+	l := r.protocolLogger()
+	if l == nil || l.opts.DeviceLog == nil {
+		return
+	}
+
+	for _, c := range b {
+		if c != '\n' && len(l.line) < maxDebugLineLen {
+			l.line = append(l.line, c)
+			continue
+		}
+
+		line := strings.TrimSpace(ansiEscape.ReplaceAllString(string(l.line), ""))
+		l.line = l.line[:0]
+		if c != '\n' {
+			l.line = append(l.line, c)
+		}
+		if line == "" {
+			continue
+		}
+
+		// Console lines look like "INFO  | 12:34:56 120 [Router] message"
+		level := slog.LevelDebug
+		if i := strings.Index(line, "|"); i > 0 {
+			if parsed, ok := debugLevels[strings.TrimSpace(line[:i])]; ok {
+				level = parsed
+				line = strings.TrimSpace(line[i+1:])
+			}
+		}
+
+		record := slog.NewRecord(time.Now(), level, line, 0)
+		record.AddAttrs(slog.String("source", "serial"))
+		l.emitDeviceLog(record)
+	}
+}
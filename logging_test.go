@@ -0,0 +1,117 @@
+package gomesh
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// bufferTransport is a transport that reads from a fixed buffer and records writes
+type bufferTransport struct {
+	in  *bytes.Reader
+	out bytes.Buffer
+}
+
+func (t *bufferTransport) Read(p []byte) (int, error)  { return t.in.Read(p) }
+func (t *bufferTransport) Write(p []byte) (int, error) { return t.out.Write(p) }
+func (t *bufferTransport) Close() error                { return nil }
+
+// recordHandler keeps every record it handles
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+func (h *recordHandler) Handle(_ context.Context, record slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, record)
+	return nil
+}
+
+func TestDeviceLog(t *testing.T) {
+
+	var stream []byte
+	stream = append(stream, "\x1b[34mINFO  | 12:00:01 5 [Router] Received routing\x1b[0m\r\n"...)
+	stream = append(stream, testFrame(t, &pb.FromRadio{PayloadVariant: &pb.FromRadio_LogRecord{LogRecord: &pb.LogRecord{
+		Message: "Low battery",
+		Source:  "Power",
+		Level:   pb.LogRecord_WARNING,
+	}}})...)
+	stream = append(stream, "plain line\n"...)
+
+	var protocol bytes.Buffer
+	device := &recordHandler{}
+
+	radio := Radio{nodeNum: 1, streamer: streamer{transport: &bufferTransport{in: bytes.NewReader(stream)}}}
+	radio.SetLogging(LogOptions{
+		Logger:    slog.New(slog.NewTextHandler(&protocol, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		DeviceLog: device,
+	})
+
+	packets, err := radio.readPackets()
+	if err != nil {
+		t.Fatalf("Error reading packets: %v", err)
+	}
+	if len(packets) != 1 {
+		t.Fatalf("Expected 1 packet, got %d", len(packets))
+	}
+
+	expected := []struct {
+		level slog.Level
+		msg   string
+	}{
+		{slog.LevelInfo, "12:00:01 5 [Router] Received routing"},
+		{slog.LevelWarn, "Low battery"},
+		{slog.LevelDebug, "plain line"},
+	}
+	if len(device.records) != len(expected) {
+		t.Fatalf("Expected %d device records, got %d", len(expected), len(device.records))
+	}
+	for i, want := range expected {
+		if got := device.records[i]; got.Level != want.level || got.Message != want.msg {
+			t.Errorf("Expected record %d to be %v %q, got %v %q", i, want.level, want.msg, got.Level, got.Message)
+		}
+	}
+
+	if out := protocol.String(); !strings.Contains(out, "category=frame") || !strings.Contains(out, "variant=LogRecord") {
+		t.Errorf("Expected a frame event, got %q", out)
+	}
+}
+
+func TestProtocolLogLevels(t *testing.T) {
+
+	var protocol bytes.Buffer
+	radio := Radio{nodeNum: 1, streamer: streamer{transport: &bufferTransport{in: bytes.NewReader(nil)}}}
+	radio.SetLogging(LogOptions{
+		Logger: slog.New(slog.NewTextHandler(&protocol, &slog.HandlerOptions{Level: slog.LevelInfo})),
+	})
+
+	admin, err := proto.Marshal(&pb.AdminMessage{PayloadVariant: &pb.AdminMessage_GetOwnerRequest{GetOwnerRequest: true}})
+	if err != nil {
+		t.Fatalf("Error marshalling admin message: %v", err)
+	}
+	if _, err := radio.createAdminPacket(1, admin); err != nil {
+		t.Fatalf("Error creating admin packet: %v", err)
+	}
+	if err := radio.writePacket([]byte{0x18, 0x01}); err != nil {
+		t.Fatalf("Error writing packet: %v", err)
+	}
+
+	out := protocol.String()
+	if !strings.Contains(out, "category=admin") || !strings.Contains(out, "variant=GetOwnerRequest") {
+		t.Errorf("Expected an admin event at info, got %q", out)
+	}
+	if strings.Contains(out, "category=frame") {
+		t.Errorf("Expected frame events to be filtered at info, got %q", out)
+	}
+}
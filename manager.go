@@ -0,0 +1,358 @@
+package gomesh
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// ErrNoRadio is returned when the manager has no radio to use
+var ErrNoRadio = errors.New("no radio available")
+
+// ErrInterfaceExists is returned when adding a radio under a name that is already in use
+var ErrInterfaceExists = errors.New("interface already exists")
+
+// ManagerOptions configures a Manager
+type ManagerOptions struct {
+	// DedupWindow is how long a packet is remembered so copies heard by other radios are dropped,
+	// 10 minutes when not set
+	DedupWindow time.Duration
+	// Buffer is the number of packets the stream holds before new packets are dropped, 256 when not set
+	Buffer int
+	// OnError is called when a radio stops listening, for example because its link failed
+	OnError func(iface string, err error)
+}
+
+// ManagedPacket is a packet received by one of the radios of a Manager
+type ManagedPacket struct {
+	// Interface is the name of the radio that heard the packet first
+	Interface string
+	Packet    *pb.MeshPacket
+	Time      time.Time
+}
+
+// dedupKey identifies a packet across radios
+type dedupKey struct {
+	from uint32
+	id   uint32
+}
+
+// managedRadio is a radio of the manager and the goroutine listening to it
+type managedRadio struct {
+	name   string
+	radio  *Radio
+	remove func()
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Manager runs several radios together. Their received packets are merged into one stream with duplicates
+// removed, and sends go to a chosen radio or the one best placed to reach the destination
+type Manager struct {
+	opts    ManagerOptions
+	packets chan ManagedPacket
+
+	mu      sync.Mutex
+	radios  map[string]*managedRadio
+	order   []string
+	seen    map[dedupKey]time.Time
+	dropped uint64
+	closed  bool
+}
+
+// NewManager creates an empty manager
+func NewManager(opts ManagerOptions) *Manager {
+	if opts.DedupWindow <= 0 {
+		opts.DedupWindow = 10 * time.Minute
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = 256
+	}
+	return &Manager{
+		opts:    opts,
+		packets: make(chan ManagedPacket, opts.Buffer),
+		radios:  make(map[string]*managedRadio),
+		seen:    make(map[dedupKey]time.Time),
+	}
+}
+
+// Open connects to a radio by serial port or IP address and adds it under a name
+func (m *Manager) Open(name, addr string) (*Radio, error) {
+
+	radio := &Radio{}
+	if err := radio.Init(addr); err != nil {
+		return nil, err
+	}
+
+	if err := m.Add(name, radio); err != nil {
+		radio.Close()
+		return nil, err
+	}
+
+	return radio, nil
+}
+
+// Discover opens every Meshtastic serial device that isn't managed yet, named after its device path, and
+// returns the names of the radios it added. Devices that fail to open are reported to OnError
+func (m *Manager) Discover() ([]string, error) {
+
+	ports, err := MeshtasticPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	var added []string
+	for _, port := range ports {
+		if _, ok := m.Radio(port.Path); ok {
+			continue
+		}
+		if _, err := m.Open(port.Path, port.Path); err != nil {
+			m.report(port.Path, err)
+			continue
+		}
+		added = append(added, port.Path)
+	}
+
+	return added, nil
+}
+
+// Add starts managing a connected radio. The manager listens to the radio, so callers must not call
+// Listen or ReadResponse on it themselves
+func (m *Manager) Add(name string, radio *Radio) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrNoRadio
+	}
+	if _, ok := m.radios[name]; ok {
+		return ErrInterfaceExists
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	managed := &managedRadio{name: name, radio: radio, cancel: cancel, done: make(chan struct{})}
+	managed.remove = radio.OnPacket(func(packet *pb.MeshPacket, direction PacketDirection) {
+		if direction == PacketReceived {
+			m.receive(name, packet)
+		}
+	})
+
+	m.radios[name] = managed
+	m.order = append(m.order, name)
+
+	go func() {
+		defer close(managed.done)
+		if err := radio.Listen(ctx); err != nil && ctx.Err() == nil {
+			m.report(name, err)
+		}
+	}()
+
+	return nil
+}
+
+// Remove stops managing a radio and closes it
+func (m *Manager) Remove(name string) error {
+
+	m.mu.Lock()
+	managed, ok := m.radios[name]
+	if ok {
+		delete(m.radios, name)
+		for i, n := range m.order {
+			if n == name {
+				m.order = append(m.order[:i], m.order[i+1:]...)
+				break
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return ErrNoRadio
+	}
+
+	m.stop(managed)
+	return nil
+}
+
+// stop ends the listener of a radio and closes it
+func (m *Manager) stop(managed *managedRadio) {
+	managed.remove()
+	managed.cancel()
+	managed.radio.Close()
+	<-managed.done
+}
+
+// Radio returns a managed radio by name
+func (m *Manager) Radio(name string) (*Radio, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	managed, ok := m.radios[name]
+	if !ok {
+		return nil, false
+	}
+	return managed.radio, true
+}
+
+// Interfaces returns the names of the managed radios in the order they were added
+func (m *Manager) Interfaces() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string(nil), m.order...)
+}
+
+// Packets returns the merged stream of received packets. It is closed by Close
+func (m *Manager) Packets() <-chan ManagedPacket {
+	return m.packets
+}
+
+// Dropped returns the number of packets dropped because the stream was full
+func (m *Manager) Dropped() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dropped
+}
+
+// receive adds a packet heard by a radio to the stream unless another radio already heard it. It runs
+// on the read goroutine of the radio so it never blocks
+func (m *Manager) receive(name string, packet *pb.MeshPacket) {
+
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	if packet.Id != 0 {
+		key := dedupKey{from: packet.From, id: packet.Id}
+		if at, ok := m.seen[key]; ok && now.Sub(at) < m.opts.DedupWindow {
+			return
+		}
+		m.seen[key] = now
+		m.expire(now)
+	}
+
+	select {
+	case m.packets <- ManagedPacket{Interface: name, Packet: packet, Time: now}:
+	default:
+		m.dropped++
+	}
+}
+
+// expire forgets packets older than the dedup window once the table grows
+func (m *Manager) expire(now time.Time) {
+	if len(m.seen) < 4*m.opts.Buffer {
+		return
+	}
+	for key, at := range m.seen {
+		if now.Sub(at) >= m.opts.DedupWindow {
+			delete(m.seen, key)
+		}
+	}
+}
+
+// report passes an error to OnError
+func (m *Manager) report(name string, err error) {
+	if m.opts.OnError != nil {
+		m.opts.OnError(name, err)
+	}
+}
+
+// Send sends data through the named radio, or through the best radio when the name is empty, and returns
+// the radio used with the packet id
+func (m *Manager) Send(ctx context.Context, name string, req DataRequest) (string, uint32, error) {
+
+	var radio *Radio
+	if name == "" {
+		name, radio = m.route(req.To)
+	} else {
+		radio, _ = m.Radio(name)
+	}
+	if radio == nil {
+		return "", 0, ErrNoRadio
+	}
+
+	id, err := radio.SendData(ctx, req)
+	return name, id, err
+}
+
+// route picks the radio for a destination. For a direct message it is the connected radio with the fewest
+// hops to the node, the most recently heard on a tie, and otherwise the first connected radio added
+func (m *Manager) route(to uint32) (string, *Radio) {
+
+	m.mu.Lock()
+	candidates := make([]*managedRadio, 0, len(m.order))
+	for _, name := range m.order {
+		candidates = append(candidates, m.radios[name])
+	}
+	m.mu.Unlock()
+
+	type route struct {
+		name      string
+		radio     *Radio
+		hops      uint32
+		lastHeard uint32
+	}
+
+	var routes []route
+	var fallback *managedRadio
+	for _, managed := range candidates {
+		if managed.radio.State() == StateDisconnected {
+			continue
+		}
+		if fallback == nil {
+			fallback = managed
+		}
+		if to == 0 || to == broadcastNum {
+			continue
+		}
+		if node, ok := managed.radio.Node(to); ok && node.LastHeard != 0 {
+			routes = append(routes, route{managed.name, managed.radio, node.HopsAway, node.LastHeard})
+		}
+	}
+
+	if len(routes) > 0 {
+		sort.SliceStable(routes, func(i, j int) bool {
+			if routes[i].hops != routes[j].hops {
+				return routes[i].hops < routes[j].hops
+			}
+			return routes[i].lastHeard > routes[j].lastHeard
+		})
+		return routes[0].name, routes[0].radio
+	}
+
+	if fallback == nil {
+		return "", nil
+	}
+	return fallback.name, fallback.radio
+}
+
+// Close stops and closes every radio and closes the packet stream
+func (m *Manager) Close() {
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	radios := m.radios
+	m.radios = make(map[string]*managedRadio)
+	m.order = nil
+	m.mu.Unlock()
+
+	for _, managed := range radios {
+		m.stop(managed)
+	}
+
+	close(m.packets)
+}
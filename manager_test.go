@@ -0,0 +1,112 @@
+package gomesh
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+func idleRadio(nodeNum uint32) *Radio {
+	radio := &Radio{nodeNum: nodeNum, streamer: streamer{transport: newFakeDevice(nil, nil)}}
+	radio.setState(StateConfigured)
+	return radio
+}
+
+func TestManagerStream(t *testing.T) {
+
+	m := NewManager(ManagerOptions{})
+	a, b := idleRadio(1), idleRadio(2)
+	if err := m.Add("a", a); err != nil {
+		t.Fatalf("Error adding radio: %v", err)
+	}
+	if err := m.Add("b", b); err != nil {
+		t.Fatalf("Error adding radio: %v", err)
+	}
+	if err := m.Add("a", b); err != ErrInterfaceExists {
+		t.Errorf("Expected ErrInterfaceExists, got %v", err)
+	}
+
+	b.handleFromRadio(textPacket(10, 5, broadcastNum, 0, "hello", 0, false))
+	a.handleFromRadio(textPacket(10, 5, broadcastNum, 0, "hello", 0, false))
+	a.handleFromRadio(textPacket(11, 5, broadcastNum, 0, "again", 0, false))
+
+	m.Close()
+
+	var got []ManagedPacket
+	for packet := range m.Packets() {
+		got = append(got, packet)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 packets, got %d", len(got))
+	}
+	if got[0].Interface != "b" || got[0].Packet.Id != 10 {
+		t.Errorf("Expected packet 10 from b, got %d from %s", got[0].Packet.Id, got[0].Interface)
+	}
+	if got[1].Interface != "a" || got[1].Packet.Id != 11 {
+		t.Errorf("Expected packet 11 from a, got %d from %s", got[1].Packet.Id, got[1].Interface)
+	}
+}
+
+func TestManagerRoute(t *testing.T) {
+
+	m := NewManager(ManagerOptions{})
+	defer m.Close()
+
+	a, b, c := idleRadio(1), idleRadio(2), idleRadio(3)
+	c.setState(StateDisconnected)
+	for i, radio := range []*Radio{a, b, c} {
+		if err := m.Add(string(rune('a'+i)), radio); err != nil {
+			t.Fatalf("Error adding radio: %v", err)
+		}
+	}
+
+	a.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: &pb.NodeInfo{Num: 9, HopsAway: 2, LastHeard: 200}}})
+	b.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: &pb.NodeInfo{Num: 9, HopsAway: 1, LastHeard: 100}}})
+	c.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: &pb.NodeInfo{Num: 9, HopsAway: 0, LastHeard: 300}}})
+
+	if name, _ := m.route(9); name != "b" {
+		t.Errorf("Expected route through b, got %q", name)
+	}
+	if name, _ := m.route(broadcastNum); name != "a" {
+		t.Errorf("Expected a broadcast through the first connected radio, got %q", name)
+	}
+	if name, _ := m.route(42); name != "a" {
+		t.Errorf("Expected an unknown node to use the first connected radio, got %q", name)
+	}
+}
+
+func TestManagerRemoveReconnecting(t *testing.T) {
+
+	dialer := &fakeDialer{failures: 1000}
+	radio, device := reconnectRadio(t, dialer)
+	radio.SetReconnectPolicy(ReconnectPolicy{InitialBackoff: time.Minute})
+	device.fail()
+
+	m := NewManager(ManagerOptions{})
+	defer m.Close()
+	if err := m.Add("a", radio); err != nil {
+		t.Fatalf("Error adding radio: %v", err)
+	}
+
+	// Wait for the listener to hit the failing link and start waiting to reconnect
+	deadline := time.Now().Add(2 * time.Second)
+	for radio.State() != StateLost && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if radio.State() != StateLost {
+		t.Fatalf("Expected the link to be lost, got %v", radio.State())
+	}
+
+	removed := make(chan error, 1)
+	go func() { removed <- m.Remove("a") }()
+
+	select {
+	case err := <-removed:
+		if err != nil {
+			t.Errorf("Error removing radio: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Remove to return while the radio was reconnecting")
+	}
+}
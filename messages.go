@@ -0,0 +1,397 @@
+package gomesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// defaultConversationLimit is how many messages a conversation keeps when no limit is set
+const defaultConversationLimit = 500
+
+// ConversationKey identifies a conversation. Channel conversations have Peer 0, direct conversations
+// are keyed by the other node
+type ConversationKey struct {
+	Channel uint32
+	Peer    uint32
+}
+
+// ChannelConversation returns the key of the conversation on a channel
+func ChannelConversation(channel uint32) ConversationKey {
+	return ConversationKey{Channel: channel}
+}
+
+// DirectConversation returns the key of the direct conversation with a node
+func DirectConversation(peer uint32) ConversationKey {
+	return ConversationKey{Peer: peer}
+}
+
+// Direct reports whether the conversation is with a single node
+func (k ConversationKey) Direct() bool {
+	return k.Peer != 0
+}
+
+func (k ConversationKey) String() string {
+	if k.Direct() {
+		return fmt.Sprintf("!%08x", k.Peer)
+	}
+	return fmt.Sprintf("channel %d", k.Channel)
+}
+
+// Reaction is a tapback on a message
+type Reaction struct {
+	From  uint32
+	Emoji string
+	Time  time.Time
+}
+
+// Message is a text message sent or received on the mesh
+type Message struct {
+	ID           uint32
+	Conversation ConversationKey
+	From         uint32
+	To           uint32
+	Channel      uint32
+	// ChannelName is the name of the channel as clients show it
+	ChannelName string
+	// Sender is the user info of the sending node, nil when it isn't known yet
+	Sender *pb.User
+	Text   string
+	// ReplyID is the id of the message this one replies to, 0 when it isn't a reply
+	ReplyID uint32
+	// Emoji is set when the message is a tapback on ReplyID that has no message to attach to
+	Emoji bool
+	// Time is when the message was received, or sent for outgoing messages
+	Time     time.Time
+	SNR      float32
+	RSSI     int32
+	HopsAway uint32
+	ViaMQTT  bool
+	Outgoing bool
+	// Reactions holds the tapbacks on the message
+	Reactions []Reaction
+}
+
+// Conversation is the message history with a node or on a channel
+type Conversation struct {
+	Key          ConversationKey
+	Title        string
+	Messages     []Message
+	Unread       int
+	LastActivity time.Time
+}
+
+// MessengerOptions configures a Messenger
+type MessengerOptions struct {
+	// Limit is how many messages each conversation keeps, 500 when not set
+	Limit int
+}
+
+// Messenger keeps the text conversations of the radio for chat front ends. Messages are received while the
+// radio is read, for example with Listen
+type Messenger struct {
+	radio  *Radio
+	opts   MessengerOptions
+	remove func()
+
+	mu            sync.Mutex
+	conversations map[ConversationKey]*Conversation
+	listeners     []*messageListener
+}
+
+// messageListener is a registered message function, wrapped so it can be removed again
+type messageListener struct {
+	fn func(Message)
+}
+
+// NewMessenger starts recording the text messages of the radio
+func (r *Radio) NewMessenger(opts MessengerOptions) *Messenger {
+
+	if opts.Limit <= 0 {
+		opts.Limit = defaultConversationLimit
+	}
+
+	m := &Messenger{radio: r, opts: opts, conversations: make(map[ConversationKey]*Conversation)}
+	m.remove = r.HandlePort(pb.PortNum_TEXT_MESSAGE_APP, func(packet *pb.MeshPacket, data *pb.Data) {
+		m.receive(m.normalize(packet, data))
+	})
+
+	return m
+}
+
+// Close stops recording messages. Recorded conversations stay available
+func (m *Messenger) Close() {
+	if m.remove != nil {
+		m.remove()
+	}
+}
+
+// OnMessage registers a function that is called with every new message, reaction or not. It runs on the
+// goroutine reading from the radio. The returned function removes it
+func (m *Messenger) OnMessage(fn func(Message)) (remove func()) {
+
+	l := &messageListener{fn: fn}
+
+	m.mu.Lock()
+	m.listeners = append(m.listeners, l)
+	m.mu.Unlock()
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		for i, registered := range m.listeners {
+			if registered == l {
+				m.listeners = append(m.listeners[:i:i], m.listeners[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// normalize converts a received text packet to a message
+func (m *Messenger) normalize(packet *pb.MeshPacket, data *pb.Data) Message {
+
+	d := m.radio.directory()
+	message := Message{
+		ID:          packet.Id,
+		From:        packet.From,
+		To:          packet.To,
+		Channel:     packet.Channel,
+		ChannelName: d.channelName(packet.Channel),
+		Sender:      d.user(packet.From),
+		Text:        string(data.Payload),
+		ReplyID:     data.ReplyId,
+		Emoji:       data.Emoji != 0,
+		Time:        time.Now(),
+		SNR:         packet.RxSnr,
+		RSSI:        packet.RxRssi,
+		ViaMQTT:     packet.ViaMqtt,
+	}
+	if packet.RxTime != 0 {
+		message.Time = time.Unix(int64(packet.RxTime), 0)
+	}
+	if packet.HopStart >= packet.HopLimit {
+		message.HopsAway = packet.HopStart - packet.HopLimit
+	}
+
+	message.Conversation = ChannelConversation(packet.Channel)
+	if packet.To != broadcastNum {
+		message.Conversation = DirectConversation(packet.From)
+	}
+
+	return message
+}
+
+// conversation returns a conversation, creating it when needed. The lock must be held
+func (m *Messenger) conversation(key ConversationKey) *Conversation {
+
+	c, ok := m.conversations[key]
+	if !ok {
+		c = &Conversation{Key: key}
+		m.conversations[key] = c
+	}
+	return c
+}
+
+// title returns the name front ends show for a conversation
+func (m *Messenger) title(key ConversationKey) string {
+
+	d := m.radio.directory()
+	if !key.Direct() {
+		if name := d.channelName(key.Channel); name != "" {
+			return name
+		}
+		return key.String()
+	}
+
+	if user := d.user(key.Peer); user != nil && user.LongName != "" {
+		return user.LongName
+	}
+	return key.String()
+}
+
+// receive records a message and notifies the listeners
+func (m *Messenger) receive(message Message) {
+
+	title := m.title(message.Conversation)
+
+	m.mu.Lock()
+	c := m.conversation(message.Conversation)
+	c.Title = title
+	m.add(c, message)
+	if !message.Outgoing {
+		c.Unread++
+	}
+	listeners := m.listeners
+	m.mu.Unlock()
+
+	for _, l := range listeners {
+		l.fn(message)
+	}
+}
+
+// add adds a message to a conversation, attaching tapbacks to the message they react to. The lock must be held
+func (m *Messenger) add(c *Conversation, message Message) {
+
+	if message.Time.After(c.LastActivity) {
+		c.LastActivity = message.Time
+	}
+
+	if message.Emoji && message.ReplyID != 0 {
+		for i := len(c.Messages) - 1; i >= 0; i-- {
+			if c.Messages[i].ID == message.ReplyID {
+				c.Messages[i].Reactions = append(c.Messages[i].Reactions, Reaction{
+					From:  message.From,
+					Emoji: message.Text,
+					Time:  message.Time,
+				})
+				return
+			}
+		}
+	}
+
+	c.Messages = append(c.Messages, message)
+	if len(c.Messages) > m.opts.Limit {
+		c.Messages = c.Messages[len(c.Messages)-m.opts.Limit:]
+	}
+}
+
+// copyConversation returns a copy that is safe to use without the lock. The lock must be held
+func copyConversation(c *Conversation, withMessages bool) Conversation {
+
+	copied := *c
+	copied.Messages = nil
+	if withMessages {
+		copied.Messages = make([]Message, len(c.Messages))
+		for i, message := range c.Messages {
+			message.Reactions = append([]Reaction(nil), message.Reactions...)
+			copied.Messages[i] = message
+		}
+	}
+	return copied
+}
+
+// Conversations returns every conversation without its messages, most recently active first
+func (m *Messenger) Conversations() []Conversation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conversations := make([]Conversation, 0, len(m.conversations))
+	for _, c := range m.conversations {
+		conversations = append(conversations, copyConversation(c, false))
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].LastActivity.After(conversations[j].LastActivity)
+	})
+	return conversations
+}
+
+// Conversation returns a conversation with its messages, oldest first
+func (m *Messenger) Conversation(key ConversationKey) (Conversation, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.conversations[key]
+	if !ok {
+		return Conversation{}, false
+	}
+	return copyConversation(c, true), true
+}
+
+// MarkRead clears the unread count of a conversation
+func (m *Messenger) MarkRead(key ConversationKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if c, ok := m.conversations[key]; ok {
+		c.Unread = 0
+	}
+}
+
+// Unread returns the number of unread messages in all conversations
+func (m *Messenger) Unread() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unread := 0
+	for _, c := range m.conversations {
+		unread += c.Unread
+	}
+	return unread
+}
+
+// Send sends a text message to a conversation
+func (m *Messenger) Send(ctx context.Context, key ConversationKey, text string) (Message, error) {
+	return m.send(ctx, key, key.Channel, text, 0, false)
+}
+
+// Reply sends a text message as a reply to another message, on the channel the message arrived on
+func (m *Messenger) Reply(ctx context.Context, to Message, text string) (Message, error) {
+	return m.send(ctx, to.Conversation, to.Channel, text, to.ID, false)
+}
+
+// React sends a tapback on a message. The emoji must be a single character
+func (m *Messenger) React(ctx context.Context, to Message, emoji string) (Message, error) {
+
+	if utf8.RuneCountInString(emoji) != 1 {
+		return Message{}, errors.New("reaction must be a single emoji")
+	}
+
+	return m.send(ctx, to.Conversation, to.Channel, emoji, to.ID, true)
+}
+
+// send sends a text packet to a conversation on a channel and records it. Direct conversations aren't tied
+// to a channel, so replies in them go out on the channel of the message they answer
+func (m *Messenger) send(ctx context.Context, key ConversationKey, channel uint32, text string, replyID uint32, emoji bool) (Message, error) {
+
+	if text == "" {
+		return Message{}, errors.New("message is empty")
+	}
+
+	port, payload := textPayload(text, m.radio.textCompression())
+	req := DataRequest{
+		To:      key.Peer,
+		Channel: channel,
+		Port:    port,
+		Payload: payload,
+		WantAck: true,
+		ReplyId: replyID,
+	}
+	if emoji {
+		req.Emoji = 1
+	}
+
+	id, err := m.radio.SendData(ctx, req)
+	if err != nil {
+		return Message{}, err
+	}
+
+	to := key.Peer
+	if to == 0 {
+		to = broadcastNum
+	}
+	message := Message{
+		ID:           id,
+		Conversation: key,
+		From:         m.radio.nodeNum,
+		To:           to,
+		Channel:      channel,
+		ChannelName:  m.radio.ChannelName(channel),
+		Sender:       m.radio.directory().user(m.radio.nodeNum),
+		Text:         text,
+		ReplyID:      replyID,
+		Emoji:        emoji,
+		Time:         time.Now(),
+		Outgoing:     true,
+	}
+	m.receive(message)
+
+	return message, nil
+}
@@ -0,0 +1,144 @@
+package gomesh
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+func textPacket(id, from, to, channel uint32, text string, replyID uint32, emoji bool) *pb.FromRadio {
+	data := &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_APP, Payload: []byte(text), ReplyId: replyID}
+	if emoji {
+		data.Emoji = 1
+	}
+	return &pb.FromRadio{PayloadVariant: &pb.FromRadio_Packet{Packet: &pb.MeshPacket{
+		Id:             id,
+		From:           from,
+		To:             to,
+		Channel:        channel,
+		RxSnr:          6.5,
+		RxTime:         1700000000,
+		HopStart:       3,
+		HopLimit:       2,
+		PayloadVariant: &pb.MeshPacket_Decoded{Decoded: data},
+	}}}
+}
+
+func TestMessengerConversations(t *testing.T) {
+
+	radio := Radio{nodeNum: 1}
+	messenger := radio.NewMessenger(MessengerOptions{})
+	defer messenger.Close()
+
+	radio.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: &pb.NodeInfo{
+		Num:  0xabcd,
+		User: &pb.User{LongName: "Base Camp", ShortName: "BC"},
+	}}})
+	radio.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_Channel{Channel: &pb.Channel{
+		Index:    1,
+		Role:     pb.Channel_SECONDARY,
+		Settings: &pb.ChannelSettings{Name: "Team"},
+	}}})
+
+	var received []Message
+	messenger.OnMessage(func(message Message) { received = append(received, message) })
+
+	radio.handleFromRadio(textPacket(10, 0xabcd, broadcastNum, 1, "checking in", 0, false))
+	radio.handleFromRadio(textPacket(11, 0xabcd, 1, 0, "are you there?", 0, false))
+	radio.handleFromRadio(textPacket(12, 0x1234, broadcastNum, 1, "👍", 10, true))
+
+	if len(received) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(received))
+	}
+
+	first := received[0]
+	if first.Sender.GetLongName() != "Base Camp" || first.ChannelName != "Team" || first.SNR != 6.5 || first.HopsAway != 1 {
+		t.Fatalf("Message wasn't normalized: %+v", first)
+	}
+
+	team, ok := messenger.Conversation(ChannelConversation(1))
+	if !ok || team.Title != "Team" || len(team.Messages) != 1 || team.Unread != 2 {
+		t.Fatalf("Unexpected channel conversation: %+v", team)
+	}
+	if reactions := team.Messages[0].Reactions; len(reactions) != 1 || reactions[0].Emoji != "👍" || reactions[0].From != 0x1234 {
+		t.Fatalf("Tapback wasn't attached: %+v", reactions)
+	}
+
+	direct, ok := messenger.Conversation(DirectConversation(0xabcd))
+	if !ok || direct.Title != "Base Camp" || len(direct.Messages) != 1 {
+		t.Fatalf("Unexpected direct conversation: %+v", direct)
+	}
+
+	if messenger.Unread() != 3 {
+		t.Fatalf("Expected 3 unread messages, got %d", messenger.Unread())
+	}
+	messenger.MarkRead(ChannelConversation(1))
+	if messenger.Unread() != 1 {
+		t.Fatalf("Expected 1 unread message after marking read, got %d", messenger.Unread())
+	}
+
+	if primary := radio.ChannelName(0); primary != "LongFast" {
+		t.Fatalf("Expected the primary channel to be named after the preset, got %q", primary)
+	}
+}
+
+func TestMessengerCompressedText(t *testing.T) {
+
+	radio := Radio{nodeNum: 1}
+	messenger := radio.NewMessenger(MessengerOptions{})
+	defer messenger.Close()
+
+	text := "meet at the north trailhead at seven"
+	compressed, ok := CompressText(text)
+	if !ok {
+		t.Fatalf("Text didn't compress")
+	}
+
+	packet := textPacket(20, 0xabcd, broadcastNum, 0, "", 0, false)
+	data := packet.GetPacket().GetDecoded()
+	data.Portnum = pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP
+	data.Payload = compressed
+	radio.handleFromRadio(packet)
+
+	conversation, _ := messenger.Conversation(ChannelConversation(0))
+	if len(conversation.Messages) != 1 || conversation.Messages[0].Text != text {
+		t.Fatalf("Compressed message wasn't decompressed: %+v", conversation.Messages)
+	}
+}
+
+func TestMessengerDirectReplyChannel(t *testing.T) {
+
+	link := newFakeDevice(nil, nil)
+	radio := Radio{nodeNum: 1, streamer: streamer{transport: link}}
+	messenger := radio.NewMessenger(MessengerOptions{})
+	defer messenger.Close()
+
+	var received []Message
+	messenger.OnMessage(func(message Message) { received = append(received, message) })
+	radio.handleFromRadio(textPacket(20, 0xabcd, 1, 2, "meet at the hut?", 0, false))
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(received))
+	}
+
+	reply, err := messenger.Reply(context.Background(), received[0], "on my way")
+	if err != nil {
+		t.Fatalf("Error replying: %v", err)
+	}
+	if reply.Channel != 2 || reply.Conversation != DirectConversation(0xabcd) {
+		t.Errorf("Expected the reply on channel 2 in the direct conversation, got %+v", reply)
+	}
+	if _, err := messenger.React(context.Background(), received[0], "👍"); err != nil {
+		t.Fatalf("Error reacting: %v", err)
+	}
+
+	sent := sentPackets(t, link.written())
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 packets, got %d", len(sent))
+	}
+	for _, packet := range sent {
+		if packet.To != 0xabcd || packet.Channel != 2 || packet.GetDecoded().GetReplyId() != 20 {
+			t.Errorf("Expected a reply to message 20 for 0xabcd on channel 2, got %v", packet)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package gomesh
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// nodeDirectory keeps the nodes and channels reported by the device, updated with what is heard on the mesh
+type nodeDirectory struct {
+	mu       sync.Mutex
+	nodes    map[uint32]*pb.NodeInfo
+	channels map[uint32]*pb.Channel
+	// config and modules hold the last config section of each kind the device reported
+	config  map[string]*pb.Config
+	modules map[string]*pb.ModuleConfig
+	// preset is the name of the modem preset, which unnamed primary channels are shown as
+	preset string
+}
+
+// directory returns the node directory for the radio, creating it on first use
+func (r *Radio) directory() *nodeDirectory {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.nodeDB == nil {
+		r.nodeDB = &nodeDirectory{
+			nodes:    make(map[uint32]*pb.NodeInfo),
+			channels: make(map[uint32]*pb.Channel),
+			config:   make(map[string]*pb.Config),
+			modules:  make(map[string]*pb.ModuleConfig),
+			preset:   presetName(pb.Config_LoRaConfig_LONG_FAST),
+		}
+	}
+	return r.nodeDB
+}
+
+// presetName converts a modem preset to the name clients show, for example LONG_FAST to LongFast
+func presetName(preset pb.Config_LoRaConfig_ModemPreset) string {
+	words := strings.Split(strings.ToLower(preset.String()), "_")
+	for i, word := range words {
+		if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// handleNodeInfo records a node from the device node database
+func (d *nodeDirectory) handleNodeInfo(info *pb.NodeInfo) {
+	d.mu.Lock()
+	d.nodes[info.Num] = proto.Clone(info).(*pb.NodeInfo)
+	d.mu.Unlock()
+}
+
+// handleChannel records a channel reported by the device
+func (d *nodeDirectory) handleChannel(channel *pb.Channel) {
+	d.mu.Lock()
+	d.channels[uint32(channel.Index)] = proto.Clone(channel).(*pb.Channel)
+	d.mu.Unlock()
+}
+
+// handleConfig records a config section reported by the device
+func (d *nodeDirectory) handleConfig(config *pb.Config) {
+	d.mu.Lock()
+	d.config[variantName(config.GetPayloadVariant())] = proto.Clone(config).(*pb.Config)
+	d.mu.Unlock()
+}
+
+// handleModuleConfig records a module config section reported by the device
+func (d *nodeDirectory) handleModuleConfig(config *pb.ModuleConfig) {
+	d.mu.Lock()
+	d.modules[variantName(config.GetPayloadVariant())] = proto.Clone(config).(*pb.ModuleConfig)
+	d.mu.Unlock()
+}
+
+// handleLoRaConfig records the modem preset reported by the device
+func (d *nodeDirectory) handleLoRaConfig(config *pb.Config_LoRaConfig) {
+	d.mu.Lock()
+	if config.UsePreset {
+		d.preset = presetName(config.ModemPreset)
+	} else {
+		d.preset = "Custom"
+	}
+	d.mu.Unlock()
+}
+
+// handlePacket updates the sender of a packet heard on the mesh
+func (d *nodeDirectory) handlePacket(packet *pb.MeshPacket, data *pb.Data) {
+
+	if packet.From == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	node, ok := d.nodes[packet.From]
+	if !ok {
+		node = &pb.NodeInfo{Num: packet.From}
+		d.nodes[packet.From] = node
+	}
+
+	node.LastHeard = uint32(time.Now().Unix())
+	if packet.RxTime != 0 {
+		node.LastHeard = packet.RxTime
+	}
+	if packet.RxSnr != 0 {
+		node.Snr = packet.RxSnr
+	}
+	node.ViaMqtt = packet.ViaMqtt
+	if packet.HopStart >= packet.HopLimit && packet.HopStart != 0 {
+		node.HopsAway = packet.HopStart - packet.HopLimit
+	}
+
+	switch data.Portnum {
+	case pb.PortNum_NODEINFO_APP:
+		user := pb.User{}
+		if err := proto.Unmarshal(data.Payload, &user); err == nil {
+			node.User = &user
+		}
+	case pb.PortNum_TELEMETRY_APP:
+		telemetry := pb.Telemetry{}
+		if err := proto.Unmarshal(data.Payload, &telemetry); err == nil && telemetry.GetDeviceMetrics() != nil {
+			node.DeviceMetrics = telemetry.GetDeviceMetrics()
+		}
+	}
+}
+
+// user returns the user of a node, or nil when it isn't known
+func (d *nodeDirectory) user(num uint32) *pb.User {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if node, ok := d.nodes[num]; ok && node.User != nil {
+		return proto.Clone(node.User).(*pb.User)
+	}
+	return nil
+}
+
+// channelName returns the name of a channel. Unnamed primary channels are named after the modem preset
+func (d *nodeDirectory) channelName(index uint32) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	channel, ok := d.channels[index]
+	if name := channel.GetSettings().GetName(); name != "" {
+		return name
+	}
+	if (ok && channel.Role == pb.Channel_PRIMARY) || (!ok && index == 0) {
+		return d.preset
+	}
+	return ""
+}
+
+// Node returns what is known about a node from the device node database and packets heard since
+func (r *Radio) Node(num uint32) (*pb.NodeInfo, bool) {
+	d := r.directory()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	node, ok := d.nodes[num]
+	if !ok {
+		return nil, false
+	}
+	return proto.Clone(node).(*pb.NodeInfo), true
+}
+
+// Nodes returns every known node, ordered by node number
+func (r *Radio) Nodes() []*pb.NodeInfo {
+	d := r.directory()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	nodes := make([]*pb.NodeInfo, 0, len(d.nodes))
+	for _, node := range d.nodes {
+		nodes = append(nodes, proto.Clone(node).(*pb.NodeInfo))
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Num < nodes[j].Num })
+	return nodes
+}
+
+// Channels returns the channels the device reported, ordered by index. Unlike GetChannels it doesn't
+// query the device, so it can be used while the radio is listening
+func (r *Radio) Channels() []*pb.Channel {
+	d := r.directory()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	channels := make([]*pb.Channel, 0, len(d.channels))
+	for _, channel := range d.channels {
+		channels = append(channels, proto.Clone(channel).(*pb.Channel))
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Index < channels[j].Index })
+	return channels
+}
+
+// Config returns the config and module config sections the device reported, ordered by name. Unlike
+// GetRadioConfig it doesn't query the device
+func (r *Radio) Config() ([]*pb.Config, []*pb.ModuleConfig) {
+	d := r.directory()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	config := make([]*pb.Config, 0, len(d.config))
+	for _, name := range sortedKeys(d.config) {
+		config = append(config, proto.Clone(d.config[name]).(*pb.Config))
+	}
+	modules := make([]*pb.ModuleConfig, 0, len(d.modules))
+	for _, name := range sortedKeys(d.modules) {
+		modules = append(modules, proto.Clone(d.modules[name]).(*pb.ModuleConfig))
+	}
+	return config, modules
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NodeNum returns the node number of the connected device
+func (r *Radio) NodeNum() uint32 {
+	return r.nodeNum
+}
+
+// ChannelName returns the name of a channel as clients show it
+func (r *Radio) ChannelName(index uint32) string {
+	return r.directory().channelName(index)
+}
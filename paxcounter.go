@@ -0,0 +1,238 @@
+package gomesh
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// PaxSample is a people count reported by a paxcounter node
+type PaxSample struct {
+	Node uint32
+	Time time.Time
+	// Wifi is the number of wifi devices seen
+	Wifi uint32
+	// BLE is the number of bluetooth devices seen
+	BLE uint32
+	// Uptime of the reporting node in seconds
+	Uptime uint32
+}
+
+// Total returns the number of wifi and bluetooth devices seen
+func (s PaxSample) Total() uint32 {
+	return s.Wifi + s.BLE
+}
+
+// PaxRollup summarizes the samples of a node over a period
+type PaxRollup struct {
+	Node    uint32
+	Start   time.Time
+	Period  time.Duration
+	Samples int
+	WifiAvg float64
+	WifiMax uint32
+	BLEAvg  float64
+	BLEMax  uint32
+	// TotalMax is the highest combined wifi and bluetooth count in the period
+	TotalMax uint32
+}
+
+// PaxCollector records the counts reported by paxcounter nodes in the mesh. Samples are received while
+// the radio is read, for example with Listen
+type PaxCollector struct {
+	mu        sync.Mutex
+	samples   map[uint32][]PaxSample
+	retention time.Duration
+	remove    func()
+}
+
+// NewPaxCollector starts collecting paxcounter reports. Samples older than retention are dropped,
+// 0 keeps them all
+func (r *Radio) NewPaxCollector(retention time.Duration) *PaxCollector {
+
+	c := &PaxCollector{samples: make(map[uint32][]PaxSample), retention: retention}
+	c.remove = r.HandlePort(pb.PortNum_PAXCOUNTER_APP, func(packet *pb.MeshPacket, data *pb.Data) {
+		count := pb.Paxcount{}
+		if err := proto.Unmarshal(data.Payload, &count); err != nil {
+			return
+		}
+
+		at := time.Now()
+		if packet.RxTime != 0 {
+			at = time.Unix(int64(packet.RxTime), 0)
+		}
+
+		c.Add(PaxSample{Node: packet.From, Time: at, Wifi: count.Wifi, BLE: count.Ble, Uptime: count.Uptime})
+	})
+
+	return c
+}
+
+// Close stops collecting reports. Collected samples stay available
+func (c *PaxCollector) Close() {
+	if c.remove != nil {
+		c.remove()
+	}
+}
+
+// Add records a sample, which allows importing samples collected elsewhere
+func (c *PaxCollector) Add(sample PaxSample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	samples := c.samples[sample.Node]
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].Time.After(sample.Time) })
+	samples = append(samples, PaxSample{})
+	copy(samples[i+1:], samples[i:])
+	samples[i] = sample
+
+	if c.retention > 0 {
+		cutoff := time.Now().Add(-c.retention)
+		drop := sort.Search(len(samples), func(i int) bool { return samples[i].Time.After(cutoff) })
+		samples = samples[drop:]
+	}
+
+	c.samples[sample.Node] = samples
+}
+
+// Nodes returns the nodes that reported counts, ordered by node number
+func (c *PaxCollector) Nodes() []uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nodes := make([]uint32, 0, len(c.samples))
+	for node := range c.samples {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+	return nodes
+}
+
+// Samples returns the samples of a node, oldest first
+func (c *PaxCollector) Samples(node uint32) []PaxSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]PaxSample(nil), c.samples[node]...)
+}
+
+// Latest returns the most recent sample of every node
+func (c *PaxCollector) Latest() []PaxSample {
+	latest := make([]PaxSample, 0)
+	for _, node := range c.Nodes() {
+		if samples := c.Samples(node); len(samples) > 0 {
+			latest = append(latest, samples[len(samples)-1])
+		}
+	}
+	return latest
+}
+
+// Rollup summarizes the samples of a node in periods aligned to UTC, for example time.Hour
+func (c *PaxCollector) Rollup(node uint32, period time.Duration) []PaxRollup {
+
+	rollups := make([]PaxRollup, 0)
+	sums := make([]struct{ wifi, ble float64 }, 0)
+
+	for _, sample := range c.Samples(node) {
+		start := sample.Time.UTC().Truncate(period)
+		if len(rollups) == 0 || !rollups[len(rollups)-1].Start.Equal(start) {
+			rollups = append(rollups, PaxRollup{Node: node, Start: start, Period: period})
+			sums = append(sums, struct{ wifi, ble float64 }{})
+		}
+
+		rollup := &rollups[len(rollups)-1]
+		sum := &sums[len(sums)-1]
+		rollup.Samples++
+		sum.wifi += float64(sample.Wifi)
+		sum.ble += float64(sample.BLE)
+		if sample.Wifi > rollup.WifiMax {
+			rollup.WifiMax = sample.Wifi
+		}
+		if sample.BLE > rollup.BLEMax {
+			rollup.BLEMax = sample.BLE
+		}
+		if sample.Total() > rollup.TotalMax {
+			rollup.TotalMax = sample.Total()
+		}
+	}
+
+	for i := range rollups {
+		rollups[i].WifiAvg = sums[i].wifi / float64(rollups[i].Samples)
+		rollups[i].BLEAvg = sums[i].ble / float64(rollups[i].Samples)
+	}
+
+	return rollups
+}
+
+// Hourly summarizes the samples of a node per hour
+func (c *PaxCollector) Hourly(node uint32) []PaxRollup {
+	return c.Rollup(node, time.Hour)
+}
+
+// Daily summarizes the samples of a node per UTC day
+func (c *PaxCollector) Daily(node uint32) []PaxRollup {
+	return c.Rollup(node, 24*time.Hour)
+}
+
+// WriteCSV writes every collected sample as CSV
+func (c *PaxCollector) WriteCSV(w io.Writer) error {
+
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"node", "time", "wifi", "ble", "total", "uptime"}); err != nil {
+		return err
+	}
+
+	for _, node := range c.Nodes() {
+		for _, s := range c.Samples(node) {
+			record := []string{
+				fmt.Sprintf("!%08x", s.Node),
+				s.Time.UTC().Format(time.RFC3339),
+				strconv.FormatUint(uint64(s.Wifi), 10),
+				strconv.FormatUint(uint64(s.BLE), 10),
+				strconv.FormatUint(uint64(s.Total()), 10),
+				strconv.FormatUint(uint64(s.Uptime), 10),
+			}
+			if err := out.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// WritePaxRollupCSV writes rollups as CSV
+func WritePaxRollupCSV(w io.Writer, rollups []PaxRollup) error {
+
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"node", "start", "period", "samples", "wifi_avg", "wifi_max", "ble_avg", "ble_max", "total_max"}); err != nil {
+		return err
+	}
+
+	for _, r := range rollups {
+		record := []string{
+			fmt.Sprintf("!%08x", r.Node),
+			r.Start.UTC().Format(time.RFC3339),
+			r.Period.String(),
+			strconv.Itoa(r.Samples),
+			strconv.FormatFloat(r.WifiAvg, 'f', 2, 64),
+			strconv.FormatUint(uint64(r.WifiMax), 10),
+			strconv.FormatFloat(r.BLEAvg, 'f', 2, 64),
+			strconv.FormatUint(uint64(r.BLEMax), 10),
+			strconv.FormatUint(uint64(r.TotalMax), 10),
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,39 @@
+package gomesh
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPaxRollup(t *testing.T) {
+
+	c := &PaxCollector{samples: make(map[uint32][]PaxSample)}
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	c.Add(PaxSample{Node: 1, Time: start.Add(70 * time.Minute), Wifi: 8, BLE: 2})
+	c.Add(PaxSample{Node: 1, Time: start.Add(10 * time.Minute), Wifi: 10, BLE: 4})
+	c.Add(PaxSample{Node: 1, Time: start.Add(40 * time.Minute), Wifi: 20, BLE: 6})
+
+	hourly := c.Hourly(1)
+	if len(hourly) != 2 {
+		t.Fatalf("Expected 2 hourly rollups, got %d", len(hourly))
+	}
+	if hourly[0].Samples != 2 || hourly[0].WifiAvg != 15 || hourly[0].WifiMax != 20 || hourly[0].BLEAvg != 5 || hourly[0].TotalMax != 26 {
+		t.Fatalf("Unexpected first hour: %+v", hourly[0])
+	}
+
+	daily := c.Daily(1)
+	if len(daily) != 1 || daily[0].Samples != 3 || !daily[0].Start.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected daily rollup: %+v", daily)
+	}
+
+	out := bytes.Buffer{}
+	if err := WritePaxRollupCSV(&out, hourly); err != nil {
+		t.Fatalf("Error writing csv: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[1], "!00000001,2024-06-01T10:00:00Z,1h0m0s,2,15.00,20,5.00,6,26") {
+		t.Fatalf("Unexpected csv: %s", out.String())
+	}
+}
@@ -0,0 +1,557 @@
+package gomesh
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultTrackLimit is how many positions are kept per node when no limit is set
+const defaultTrackLimit = 1000
+
+// metersPerDegree is the length of a degree of latitude
+const metersPerDegree = 111320
+
+// Position is a decoded node position in degrees
+type Position struct {
+	Node      uint32
+	Latitude  float64
+	Longitude float64
+	// Altitude in meters above sea level
+	Altitude int32
+	Time     time.Time
+	// PrecisionBits is the number of significant bits of the coordinates, 32 for a full precision position
+	PrecisionBits uint32
+	// Accuracy is the approximate radius in meters of the area the node is in, 0 for a full precision position
+	Accuracy float64
+	// GroundSpeed in meters per second
+	GroundSpeed uint32
+	// GroundTrack is the heading in degrees
+	GroundTrack uint32
+	SatsInView  uint32
+	Channel     uint32
+}
+
+// Track is the position history of a node, oldest first
+type Track struct {
+	Node   uint32
+	Name   string
+	Points []Position
+}
+
+// Last returns the last known position of the track
+func (t Track) Last() (Position, bool) {
+	if len(t.Points) == 0 {
+		return Position{}, false
+	}
+	return t.Points[len(t.Points)-1], true
+}
+
+// DegreesToInt converts degrees to the integer encoding used in positions
+func DegreesToInt(degrees float64) int32 {
+	return int32(math.Round(degrees * 1e7))
+}
+
+// IntToDegrees converts the integer encoding used in positions to degrees
+func IntToDegrees(value int32) float64 {
+	return float64(value) * 1e-7
+}
+
+// effectivePrecision returns the precision of a position, using the channel precision when the position doesn't
+// carry one. Positions without either are full precision
+func effectivePrecision(bits uint32, channelBits uint32) uint32 {
+	if bits == 0 {
+		bits = channelBits
+	}
+	if bits == 0 || bits > 32 {
+		return 32
+	}
+	return bits
+}
+
+// reducePrecision keeps the significant bits of a coordinate and moves it to the center of the area they describe,
+// the same way the firmware does
+func reducePrecision(value int32, bits uint32) int32 {
+	if bits >= 32 {
+		return value
+	}
+	mask := uint32(math.MaxUint32) << (32 - bits)
+	return int32(uint32(value)&mask + uint32(1)<<(31-bits))
+}
+
+// precisionAccuracy returns the approximate radius in meters of the area described by coordinates with the
+// provided number of significant bits
+func precisionAccuracy(bits uint32) float64 {
+	if bits >= 32 {
+		return 0
+	}
+	return float64(uint32(1)<<(31-bits)) * 1e-7 * metersPerDegree
+}
+
+// DecodePosition converts a position from the mesh to degrees. The precision in the position is used, or the
+// position precision of the channel it was received on when the position doesn't report one
+func DecodePosition(node uint32, position *pb.Position, channelPrecision uint32) Position {
+
+	bits := effectivePrecision(position.PrecisionBits, channelPrecision)
+
+	decoded := Position{
+		Node:          node,
+		Latitude:      IntToDegrees(reducePrecision(position.LatitudeI, bits)),
+		Longitude:     IntToDegrees(reducePrecision(position.LongitudeI, bits)),
+		Altitude:      position.Altitude,
+		PrecisionBits: bits,
+		Accuracy:      precisionAccuracy(bits),
+		GroundSpeed:   position.GroundSpeed,
+		GroundTrack:   position.GroundTrack,
+		SatsInView:    position.SatsInView,
+	}
+
+	switch {
+	case position.Timestamp != 0:
+		decoded.Time = time.Unix(int64(position.Timestamp), 0)
+	case position.Time != 0:
+		decoded.Time = time.Unix(int64(position.Time), 0)
+	}
+
+	return decoded
+}
+
+// positionTracker keeps the position history of the nodes in the mesh
+type positionTracker struct {
+	mu sync.Mutex
+	// precision holds the position precision of each channel index
+	precision map[uint32]uint32
+	names     map[uint32]string
+	tracks    map[uint32][]Position
+	limit     int
+	listeners []*positionListener
+}
+
+// positionListener is a registered position function, wrapped so it can be removed again
+type positionListener struct {
+	fn func(Position)
+}
+
+// positions returns the position tracker for the radio, creating it on first use
+func (r *Radio) positions() *positionTracker {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.tracker == nil {
+		r.tracker = &positionTracker{
+			precision: make(map[uint32]uint32),
+			names:     make(map[uint32]string),
+			tracks:    make(map[uint32][]Position),
+			limit:     defaultTrackLimit,
+		}
+	}
+	return r.tracker
+}
+
+// handleChannel records the position precision of a channel reported by the device
+func (t *positionTracker) handleChannel(channel *pb.Channel) {
+	t.mu.Lock()
+	t.precision[uint32(channel.Index)] = channel.GetSettings().GetModuleSettings().GetPositionPrecision()
+	t.mu.Unlock()
+}
+
+// handleNodeInfo records the name and last known position of a node from the device node database
+func (t *positionTracker) handleNodeInfo(info *pb.NodeInfo) {
+
+	t.mu.Lock()
+	if name := info.GetUser().GetLongName(); name != "" {
+		t.names[info.Num] = name
+	}
+	t.mu.Unlock()
+
+	if position := info.GetPosition(); position != nil && (position.LatitudeI != 0 || position.LongitudeI != 0) {
+		decoded := DecodePosition(info.Num, position, 0)
+		decoded.Channel = info.Channel
+		if decoded.Time.IsZero() && info.LastHeard != 0 {
+			decoded.Time = time.Unix(int64(info.LastHeard), 0)
+		}
+		t.record(decoded)
+	}
+}
+
+// handlePosition records a position packet received from the mesh
+func (t *positionTracker) handlePosition(packet *pb.MeshPacket, data *pb.Data) {
+
+	position := pb.Position{}
+	if err := proto.Unmarshal(data.Payload, &position); err != nil {
+		return
+	}
+	// Nodes without a fix send empty positions
+	if position.LatitudeI == 0 && position.LongitudeI == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	channelPrecision := t.precision[packet.Channel]
+	t.mu.Unlock()
+
+	decoded := DecodePosition(packet.From, &position, channelPrecision)
+	decoded.Channel = packet.Channel
+	if decoded.Time.IsZero() {
+		decoded.Time = time.Now()
+		if packet.RxTime != 0 {
+			decoded.Time = time.Unix(int64(packet.RxTime), 0)
+		}
+	}
+
+	t.record(decoded)
+}
+
+// record adds a position to the track of its node and passes it to the listeners
+func (t *positionTracker) record(position Position) {
+
+	t.mu.Lock()
+	track := append(t.tracks[position.Node], position)
+	if len(track) > t.limit {
+		track = track[len(track)-t.limit:]
+	}
+	t.tracks[position.Node] = track
+	listeners := t.listeners
+	t.mu.Unlock()
+
+	for _, l := range listeners {
+		l.fn(position)
+	}
+}
+
+// SetTrackLimit sets how many positions are kept for each node
+func (r *Radio) SetTrackLimit(limit int) {
+	if limit <= 0 {
+		limit = defaultTrackLimit
+	}
+
+	t := r.positions()
+	t.mu.Lock()
+	t.limit = limit
+	t.mu.Unlock()
+}
+
+// OnPosition registers a function that is called with every position received from the mesh. It runs on the
+// goroutine reading from the radio. The returned function removes it
+func (r *Radio) OnPosition(fn func(Position)) (remove func()) {
+
+	t := r.positions()
+	l := &positionListener{fn: fn}
+
+	t.mu.Lock()
+	t.listeners = append(t.listeners, l)
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		for i, registered := range t.listeners {
+			if registered == l {
+				t.listeners = append(t.listeners[:i:i], t.listeners[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Track returns the position history of a node
+func (r *Radio) Track(node uint32) Track {
+	t := r.positions()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return Track{
+		Node:   node,
+		Name:   t.names[node],
+		Points: append([]Position(nil), t.tracks[node]...),
+	}
+}
+
+// Tracks returns the position history of every node with a known position, ordered by node number
+func (r *Radio) Tracks() []Track {
+	t := r.positions()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracks := make([]Track, 0, len(t.tracks))
+	for node, points := range t.tracks {
+		tracks = append(tracks, Track{
+			Node:   node,
+			Name:   t.names[node],
+			Points: append([]Position(nil), points...),
+		})
+	}
+
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].Node < tracks[j].Node })
+	return tracks
+}
+
+// LastPositions returns the last known position of every node
+func (r *Radio) LastPositions() []Position {
+	positions := make([]Position, 0)
+	for _, track := range r.Tracks() {
+		if last, ok := track.Last(); ok {
+			positions = append(positions, last)
+		}
+	}
+	return positions
+}
+
+// SetPosition sets a fixed position for the radio in degrees
+func (r *Radio) SetPosition(latitude float64, longitude float64, altitude int32) error {
+	return r.SetLocation(DegreesToInt(latitude), DegreesToInt(longitude), altitude)
+}
+
+// SendPosition sends a position to a node, 0 broadcasts it. The precision of the position is reduced to its
+// PrecisionBits, or the position precision of the channel when it has none
+func (r *Radio) SendPosition(ctx context.Context, to uint32, channel uint32, position Position) (uint32, error) {
+
+	t := r.positions()
+	t.mu.Lock()
+	channelPrecision := t.precision[channel]
+	t.mu.Unlock()
+
+	bits := effectivePrecision(position.PrecisionBits, channelPrecision)
+
+	out, err := proto.Marshal(&pb.Position{
+		LatitudeI:     reducePrecision(DegreesToInt(position.Latitude), bits),
+		LongitudeI:    reducePrecision(DegreesToInt(position.Longitude), bits),
+		Altitude:      position.Altitude,
+		Time:          uint32(time.Now().Unix()),
+		PrecisionBits: bits,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return r.SendData(ctx, DataRequest{
+		To:      to,
+		Channel: channel,
+		Port:    pb.PortNum_POSITION_APP,
+		Payload: out,
+	})
+}
+
+// trackName returns the name of a track, or the node id when the node name isn't known
+func trackName(track Track) string {
+	if track.Name != "" {
+		return track.Name
+	}
+	return fmt.Sprintf("!%08x", track.Node)
+}
+
+type gpxFile struct {
+	XMLName   xml.Name   `xml:"gpx"`
+	Xmlns     string     `xml:"xmlns,attr"`
+	Version   string     `xml:"version,attr"`
+	Creator   string     `xml:"creator,attr"`
+	Waypoints []gpxPoint `xml:"wpt"`
+	Tracks    []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name"`
+	Segment []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Ele  int32   `xml:"ele"`
+	Time string  `xml:"time,omitempty"`
+	Name string  `xml:"name,omitempty"`
+}
+
+func newGPXPoint(p Position) gpxPoint {
+	point := gpxPoint{Lat: p.Latitude, Lon: p.Longitude, Ele: p.Altitude}
+	if !p.Time.IsZero() {
+		point.Time = p.Time.UTC().Format(time.RFC3339)
+	}
+	return point
+}
+
+// WriteGPX writes tracks as GPX, with a waypoint for the last known position of each node
+func WriteGPX(w io.Writer, tracks []Track) error {
+
+	file := gpxFile{Xmlns: "http://www.topografix.com/GPX/1/1", Version: "1.1", Creator: "goMesh"}
+
+	for _, track := range tracks {
+		last, ok := track.Last()
+		if !ok {
+			continue
+		}
+
+		waypoint := newGPXPoint(last)
+		waypoint.Name = trackName(track)
+		file.Waypoints = append(file.Waypoints, waypoint)
+
+		if len(track.Points) > 1 {
+			gpx := gpxTrack{Name: trackName(track)}
+			for _, p := range track.Points {
+				gpx.Segment = append(gpx.Segment, newGPXPoint(p))
+			}
+			file.Tracks = append(file.Tracks, gpx)
+		}
+	}
+
+	return writeXML(w, &file)
+}
+
+type kmlFile struct {
+	XMLName  xml.Name `xml:"kml"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Document kmlDocument
+}
+
+type kmlDocument struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name       string        `xml:"name"`
+	TimeStamp  *kmlTimeStamp `xml:"TimeStamp,omitempty"`
+	Point      *kmlGeometry  `xml:"Point,omitempty"`
+	LineString *kmlGeometry  `xml:"LineString,omitempty"`
+}
+
+type kmlTimeStamp struct {
+	When string `xml:"when"`
+}
+
+type kmlGeometry struct {
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+func kmlCoordinates(points []Position) string {
+	coordinates := make([]string, len(points))
+	for i, p := range points {
+		coordinates[i] = fmt.Sprintf("%g,%g,%d", p.Longitude, p.Latitude, p.Altitude)
+	}
+	return strings.Join(coordinates, " ")
+}
+
+// WriteKML writes tracks as KML, with a placemark for the last known position of each node
+func WriteKML(w io.Writer, tracks []Track) error {
+
+	file := kmlFile{Xmlns: "http://www.opengis.net/kml/2.2", Document: kmlDocument{Name: "goMesh"}}
+
+	for _, track := range tracks {
+		last, ok := track.Last()
+		if !ok {
+			continue
+		}
+
+		placemark := kmlPlacemark{
+			Name:  trackName(track),
+			Point: &kmlGeometry{AltitudeMode: "absolute", Coordinates: kmlCoordinates([]Position{last})},
+		}
+		if !last.Time.IsZero() {
+			placemark.TimeStamp = &kmlTimeStamp{When: last.Time.UTC().Format(time.RFC3339)}
+		}
+		file.Document.Placemarks = append(file.Document.Placemarks, placemark)
+
+		if len(track.Points) > 1 {
+			file.Document.Placemarks = append(file.Document.Placemarks, kmlPlacemark{
+				Name:       trackName(track) + " track",
+				LineString: &kmlGeometry{AltitudeMode: "absolute", Coordinates: kmlCoordinates(track.Points)},
+			})
+		}
+	}
+
+	return writeXML(w, &file)
+}
+
+func writeXML(w io.Writer, v interface{}) error {
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+func geoJSONCoordinates(p Position) []float64 {
+	return []float64{p.Longitude, p.Latitude, float64(p.Altitude)}
+}
+
+// WriteGeoJSON writes tracks as a GeoJSON feature collection, with a point for the last known position of each
+// node and a line string for its track
+func WriteGeoJSON(w io.Writer, tracks []Track) error {
+
+	collection := geoJSONCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, 0)}
+
+	for _, track := range tracks {
+		last, ok := track.Last()
+		if !ok {
+			continue
+		}
+
+		properties := map[string]interface{}{
+			"node":     fmt.Sprintf("!%08x", track.Node),
+			"name":     trackName(track),
+			"accuracy": last.Accuracy,
+		}
+		if !last.Time.IsZero() {
+			properties["time"] = last.Time.UTC().Format(time.RFC3339)
+		}
+
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONGeometry{Type: "Point", Coordinates: geoJSONCoordinates(last)},
+			Properties: properties,
+		})
+
+		if len(track.Points) > 1 {
+			line := make([][]float64, len(track.Points))
+			for i, p := range track.Points {
+				line[i] = geoJSONCoordinates(p)
+			}
+			collection.Features = append(collection.Features, geoJSONFeature{
+				Type:       "Feature",
+				Geometry:   geoJSONGeometry{Type: "LineString", Coordinates: line},
+				Properties: map[string]interface{}{"node": fmt.Sprintf("!%08x", track.Node), "name": trackName(track)},
+			})
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&collection)
+}
@@ -0,0 +1,80 @@
+package gomesh
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+func TestDecodePositionPrecision(t *testing.T) {
+
+	position := &pb.Position{LatitudeI: DegreesToInt(37.7749295), LongitudeI: DegreesToInt(-122.4194155), Altitude: 10}
+
+	full := DecodePosition(1, position, 0)
+	if full.PrecisionBits != 32 || full.Accuracy != 0 || math.Abs(full.Latitude-37.7749295) > 1e-7 {
+		t.Fatalf("Unexpected full precision position: %+v", full)
+	}
+
+	// The channel precision applies when the position doesn't report one
+	reduced := DecodePosition(1, position, 16)
+	if reduced.PrecisionBits != 16 || math.Abs(reduced.Accuracy-364.8) > 1 {
+		t.Fatalf("Unexpected reduced position: %+v", reduced)
+	}
+	if math.Abs(reduced.Latitude-37.7749295) > 0.0066 || math.Abs(reduced.Longitude+122.4194155) > 0.0066 {
+		t.Fatalf("Reduced position is too far off: %+v", reduced)
+	}
+
+	// Reducing an already reduced position doesn't move it
+	position.PrecisionBits = 16
+	position.LatitudeI = DegreesToInt(reduced.Latitude)
+	position.LongitudeI = DegreesToInt(reduced.Longitude)
+	if again := DecodePosition(1, position, 32); again.Latitude != reduced.Latitude || again.Longitude != reduced.Longitude {
+		t.Fatalf("Position moved: %+v %+v", again, reduced)
+	}
+}
+
+func TestTrackExport(t *testing.T) {
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tracks := []Track{{
+		Node: 0x1234,
+		Name: "Base <1>",
+		Points: []Position{
+			{Node: 0x1234, Latitude: 37.1, Longitude: -122.1, Altitude: 5, Time: start},
+			{Node: 0x1234, Latitude: 37.2, Longitude: -122.2, Altitude: 6, Time: start.Add(time.Minute)},
+		},
+	}}
+
+	gpx := bytes.Buffer{}
+	if err := WriteGPX(&gpx, tracks); err != nil {
+		t.Fatalf("Error writing gpx: %v", err)
+	}
+	if !strings.Contains(gpx.String(), `<wpt lat="37.2" lon="-122.2">`) || !strings.Contains(gpx.String(), "Base &lt;1&gt;") {
+		t.Fatalf("Unexpected gpx: %s", gpx.String())
+	}
+
+	kml := bytes.Buffer{}
+	if err := WriteKML(&kml, tracks); err != nil {
+		t.Fatalf("Error writing kml: %v", err)
+	}
+	if !strings.Contains(kml.String(), "-122.1,37.1,5 -122.2,37.2,6") {
+		t.Fatalf("Unexpected kml: %s", kml.String())
+	}
+
+	geo := bytes.Buffer{}
+	if err := WriteGeoJSON(&geo, tracks); err != nil {
+		t.Fatalf("Error writing geojson: %v", err)
+	}
+	collection := geoJSONCollection{}
+	if err := json.Unmarshal(geo.Bytes(), &collection); err != nil {
+		t.Fatalf("Invalid geojson: %v", err)
+	}
+	if len(collection.Features) != 2 || collection.Features[0].Geometry.Type != "Point" || collection.Features[1].Geometry.Type != "LineString" {
+		t.Fatalf("Unexpected features: %+v", collection.Features)
+	}
+}
@@ -0,0 +1,388 @@
+package gomesh
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultQueueTimeout is how long a send waits for queue space when no timeout is set
+const defaultQueueTimeout = 30 * time.Second
+
+// maxTrackedMessages caps how many outgoing messages are tracked waiting for a final state
+const maxTrackedMessages = 256
+
+// maxBacklog caps how many packets read while waiting on the queue are held for ReadResponse
+const maxBacklog = 512
+
+// ErrQueueFull is returned when the device transmit queue has no free entries
+var ErrQueueFull = errors.New("device queue full")
+
+// ErrRateLimited is returned when a channel rate limit does not allow a message to be sent in time
+var ErrRateLimited = errors.New("channel rate limit exceeded")
+
+// MessageState describes how far an outgoing mesh packet has progressed
+type MessageState int
+
+const (
+	// MessageQueued means the message is waiting for device queue space or a channel rate limit
+	MessageQueued MessageState = iota
+	// MessageSent means the message has been written to the device
+	MessageSent
+	// MessageEnqueued means the device accepted the message into its transmit queue
+	MessageEnqueued
+	// MessageRejected means the message was refused, either locally or by the device
+	MessageRejected
+	// MessageDelivered means the device reported an ack for the message
+	MessageDelivered
+	// MessageFailed means the device reported a routing error for the message
+	MessageFailed
+)
+
+// String returns a readable name for the message state
+func (s MessageState) String() string {
+	switch s {
+	case MessageQueued:
+		return "queued"
+	case MessageSent:
+		return "sent"
+	case MessageEnqueued:
+		return "enqueued"
+	case MessageRejected:
+		return "rejected"
+	case MessageDelivered:
+		return "delivered"
+	case MessageFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// MessageStatus reports a state change for an outgoing mesh packet
+type MessageStatus struct {
+	ID      uint32
+	To      uint32
+	Channel uint32
+	State   MessageState
+	// Result is the error code from the device QueueStatus, non zero when the device rejected the message
+	Result int32
+	// Routing is the routing error reported by the device when the message failed
+	Routing pb.Routing_Error
+}
+
+// QueuePolicy controls what happens when the device transmit queue is full
+type QueuePolicy struct {
+	// RejectWhenFull returns ErrQueueFull or ErrRateLimited immediately instead of waiting
+	RejectWhenFull bool
+	// Timeout bounds how long a send waits for queue space or a rate limit, 0 uses 30 seconds
+	Timeout time.Duration
+}
+
+// QueueState is the last transmit queue status reported by the device
+type QueueState struct {
+	Free   uint32
+	MaxLen uint32
+	// Known is false until the device has reported its queue status
+	Known bool
+}
+
+// sendQueue tracks the device transmit queue and the progress of outgoing messages
+type sendQueue struct {
+	mu         sync.Mutex
+	policy     QueuePolicy
+	status     QueueState
+	rateLimits map[uint32]time.Duration
+	lastSend   map[uint32]time.Time
+	tracked    map[uint32]*MessageStatus
+	order      []uint32
+	onStatus   func(MessageStatus)
+}
+
+// outbound returns the send queue for the radio, creating it on first use
+func (r *Radio) outbound() *sendQueue {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.queue == nil {
+		r.queue = &sendQueue{
+			rateLimits: make(map[uint32]time.Duration),
+			lastSend:   make(map[uint32]time.Time),
+			tracked:    make(map[uint32]*MessageStatus),
+		}
+	}
+	return r.queue
+}
+
+// SetQueuePolicy sets how sends behave when the device transmit queue is full
+func (r *Radio) SetQueuePolicy(policy QueuePolicy) {
+	q := r.outbound()
+	q.mu.Lock()
+	q.policy = policy
+	q.mu.Unlock()
+}
+
+// SetChannelRateLimit sets the minimum time between messages sent on a channel. An interval of 0 removes the limit
+func (r *Radio) SetChannelRateLimit(channel int, interval time.Duration) {
+	q := r.outbound()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if interval <= 0 {
+		delete(q.rateLimits, uint32(channel))
+		return
+	}
+	q.rateLimits[uint32(channel)] = interval
+}
+
+// OnMessageStatus registers a function that is called every time an outgoing message changes state.
+// The function is called synchronously and should return quickly
+func (r *Radio) OnMessageStatus(fn func(MessageStatus)) {
+	q := r.outbound()
+	q.mu.Lock()
+	q.onStatus = fn
+	q.mu.Unlock()
+}
+
+// MessageStatus returns the last known status of an outgoing message
+func (r *Radio) MessageStatus(id uint32) (MessageStatus, bool) {
+	q := r.outbound()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status, ok := q.tracked[id]
+	if !ok {
+		return MessageStatus{}, false
+	}
+	return *status, true
+}
+
+// QueueStatus returns the last transmit queue status reported by the device
+func (r *Radio) QueueStatus() QueueState {
+	q := r.outbound()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.status
+}
+
+// track starts tracking an outgoing packet
+func (q *sendQueue) track(packet *pb.MeshPacket) {
+	q.mu.Lock()
+	if len(q.order) >= maxTrackedMessages {
+		delete(q.tracked, q.order[0])
+		q.order = q.order[1:]
+	}
+	q.tracked[packet.Id] = &MessageStatus{ID: packet.Id, To: packet.To, Channel: packet.Channel, State: MessageQueued}
+	q.order = append(q.order, packet.Id)
+	q.mu.Unlock()
+
+	q.setState(packet.Id, MessageQueued, func(*MessageStatus) {})
+}
+
+// setState moves a tracked message to a new state and notifies the registered observer
+func (q *sendQueue) setState(id uint32, state MessageState, update func(*MessageStatus)) {
+	q.mu.Lock()
+	status, ok := q.tracked[id]
+	if !ok {
+		q.mu.Unlock()
+		return
+	}
+	status.State = state
+	update(status)
+	report := *status
+	fn := q.onStatus
+	q.mu.Unlock()
+
+	if fn != nil {
+		fn(report)
+	}
+}
+
+// reserve checks the rate limit and device queue for a channel. It returns how long to wait before
+// trying again, or zero when the message may be sent and the reservation has been recorded
+func (q *sendQueue) reserve(channel uint32, now time.Time) (wait time.Duration, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if interval, ok := q.rateLimits[channel]; ok {
+		if next := q.lastSend[channel].Add(interval); next.After(now) {
+			return next.Sub(now), ErrRateLimited
+		}
+	}
+
+	if q.status.Known && q.status.Free == 0 {
+		return 100 * time.Millisecond, ErrQueueFull
+	}
+
+	q.lastSend[channel] = now
+	// Assume the packet takes a slot until the device reports otherwise so bursts don't overrun the queue
+	if q.status.Known {
+		q.status.Free--
+	}
+
+	return 0, nil
+}
+
+// release gives back the slot reserved for a message that never reached the device
+func (q *sendQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.status.Known && q.status.Free < q.status.MaxLen {
+		q.status.Free++
+	}
+}
+
+// handleQueueStatus records a QueueStatus from the device and updates the message it refers to
+func (q *sendQueue) handleQueueStatus(status *pb.QueueStatus) {
+	q.mu.Lock()
+	q.status = QueueState{Free: status.Free, MaxLen: status.Maxlen, Known: true}
+	q.mu.Unlock()
+
+	if status.MeshPacketId == 0 {
+		return
+	}
+
+	if status.Res != 0 {
+		q.setState(status.MeshPacketId, MessageRejected, func(m *MessageStatus) { m.Result = status.Res })
+	} else {
+		q.setState(status.MeshPacketId, MessageEnqueued, func(*MessageStatus) {})
+	}
+}
+
+// handleRouting records an ack or routing error for a tracked message
+func (q *sendQueue) handleRouting(data *pb.Data) {
+	if data.RequestId == 0 {
+		return
+	}
+
+	routing := pb.Routing{}
+	if err := proto.Unmarshal(data.Payload, &routing); err != nil {
+		return
+	}
+
+	reason := routing.GetErrorReason()
+	if reason == pb.Routing_NONE {
+		q.setState(data.RequestId, MessageDelivered, func(*MessageStatus) {})
+	} else {
+		q.setState(data.RequestId, MessageFailed, func(m *MessageStatus) { m.Routing = reason })
+	}
+}
+
+// waitForQueue blocks until the channel rate limit and the device queue allow another message.
+// While waiting the stream is read so new QueueStatus updates arrive, other packets are kept for ReadResponse
+func (r *Radio) waitForQueue(ctx context.Context, channel uint32) error {
+	q := r.outbound()
+	q.mu.Lock()
+	policy := q.policy
+	q.mu.Unlock()
+
+	timeout := policy.Timeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		wait, err := q.reserve(channel, time.Now())
+		if err == nil {
+			return nil
+		}
+		if policy.RejectWhenFull || time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err == ErrQueueFull {
+			if err := r.pollBacklog(); err != nil {
+				return err
+			}
+		} else if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// pollBacklog reads pending packets from the radio and keeps them for the next ReadResponse
+func (r *Radio) pollBacklog() error {
+	packets, err := r.ReadResponse(true)
+	if err != nil {
+		return err
+	}
+
+	c := r.conn()
+	c.mu.Lock()
+	c.backlog = append(c.backlog, packets...)
+	if len(c.backlog) > maxBacklog {
+		c.backlog = c.backlog[len(c.backlog)-maxBacklog:]
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// takeBacklog returns and clears the packets held by pollBacklog
+func (r *Radio) takeBacklog() []*pb.FromRadio {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	backlog := c.backlog
+	c.backlog = nil
+	return backlog
+}
+
+// sendMeshPacket waits for the duty cycle budget and room in the device queue, sends the packet and tracks its progress
+func (r *Radio) sendMeshPacket(ctx context.Context, packet *pb.MeshPacket) error {
+
+	if packet.Id == 0 {
+		packet.Id = newPacketID()
+	}
+
+	q := r.outbound()
+	q.track(packet)
+
+	releaseAirtime, err := r.waitForAirtime(ctx, packet)
+	if err != nil {
+		q.setState(packet.Id, MessageRejected, func(*MessageStatus) {})
+		return err
+	}
+
+	if err := r.waitForQueue(ctx, packet.Channel); err != nil {
+		releaseAirtime()
+		q.setState(packet.Id, MessageRejected, func(*MessageStatus) {})
+		return err
+	}
+
+	radioMessage := pb.ToRadio{
+		PayloadVariant: &pb.ToRadio_Packet{
+			Packet: packet,
+		},
+	}
+
+	out, err := proto.Marshal(&radioMessage)
+	if err == nil {
+		err = r.sendPacket(out)
+	}
+	if err != nil {
+		// The device never got the packet, so its slot in the queue and its airtime are still free
+		q.release()
+		releaseAirtime()
+		q.setState(packet.Id, MessageRejected, func(*MessageStatus) {})
+		r.logSend(packet, err)
+		return err
+	}
+
+	q.setState(packet.Id, MessageSent, func(*MessageStatus) {})
+	r.registry().observe(packet, PacketSent)
+	r.logSend(packet, nil)
+
+	return nil
+}
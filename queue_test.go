@@ -0,0 +1,114 @@
+package gomesh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+func TestQueueReserve(t *testing.T) {
+
+	radio := Radio{}
+	q := radio.outbound()
+
+	q.handleQueueStatus(&pb.QueueStatus{Free: 1, Maxlen: 16})
+
+	now := time.Now()
+	if _, err := q.reserve(0, now); err != nil {
+		t.Fatalf("Expected first message to be allowed: %v", err)
+	}
+
+	if _, err := q.reserve(0, now); err != ErrQueueFull {
+		t.Fatalf("Expected full queue, got: %v", err)
+	}
+
+	q.handleQueueStatus(&pb.QueueStatus{Free: 4, Maxlen: 16})
+	radio.SetChannelRateLimit(1, time.Minute)
+
+	if _, err := q.reserve(1, now); err != nil {
+		t.Fatalf("Expected first message on channel to be allowed: %v", err)
+	}
+
+	wait, err := q.reserve(1, now.Add(10*time.Second))
+	if err != ErrRateLimited {
+		t.Fatalf("Expected rate limit, got: %v", err)
+	}
+	if wait != 50*time.Second {
+		t.Fatalf("Unexpected rate limit wait: %v", wait)
+	}
+}
+
+func TestQueueMessageStatus(t *testing.T) {
+
+	radio := Radio{}
+	q := radio.outbound()
+
+	states := make([]MessageState, 0)
+	radio.OnMessageStatus(func(status MessageStatus) {
+		states = append(states, status.State)
+	})
+
+	q.track(&pb.MeshPacket{Id: 7, To: broadcastNum})
+	q.handleQueueStatus(&pb.QueueStatus{Free: 3, Maxlen: 16, MeshPacketId: 7})
+	q.handleRouting(&pb.Data{Portnum: pb.PortNum_ROUTING_APP, RequestId: 7})
+
+	expected := []MessageState{MessageQueued, MessageEnqueued, MessageDelivered}
+	if len(states) != len(expected) {
+		t.Fatalf("Unexpected states: %v", states)
+	}
+	for i := range expected {
+		if states[i] != expected[i] {
+			t.Fatalf("Unexpected states: %v", states)
+		}
+	}
+}
+
+func TestQueueFailedSendReleases(t *testing.T) {
+
+	device := newFakeDevice(nil, nil)
+	device.fail()
+	radio := Radio{nodeNum: 1, streamer: streamer{transport: device}}
+	radio.airtime().handleLoRaConfig(&pb.Config_LoRaConfig{UsePreset: true, Region: pb.Config_LoRaConfig_EU_868})
+	radio.SetDutyCycleBudget(DutyCycleBudget{Window: time.Minute})
+	radio.outbound().handleQueueStatus(&pb.QueueStatus{Free: 1, Maxlen: 16})
+
+	var states []MessageState
+	radio.OnMessageStatus(func(status MessageStatus) { states = append(states, status.State) })
+
+	_, err := radio.SendData(context.Background(), DataRequest{To: 5, Port: pb.PortNum_PRIVATE_APP, Payload: []byte("x")})
+	if err == nil {
+		t.Fatal("Expected the send to fail")
+	}
+
+	if status := radio.QueueStatus(); status.Free != 1 {
+		t.Errorf("Expected the queue slot to be given back, got %d free", status.Free)
+	}
+	if used, _ := radio.AirtimeUsed(); used != 0 {
+		t.Errorf("Expected the airtime to be given back, got %v", used)
+	}
+	if len(states) != 2 || states[1] != MessageRejected {
+		t.Errorf("Expected the message to be rejected, got %v", states)
+	}
+}
+
+func TestPacketIDs(t *testing.T) {
+
+	seen := make(map[uint32]bool)
+	high := false
+	for i := 0; i < 1000; i++ {
+		id := newPacketID()
+		if id == 0 {
+			t.Fatal("Expected non zero packet ids")
+		}
+		if seen[id] {
+			t.Fatalf("Expected unique packet ids, got %d twice", id)
+		}
+		seen[id] = true
+		high = high || id > 1<<24
+	}
+	if !high {
+		t.Error("Expected ids over the full uint32 range")
+	}
+}
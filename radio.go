@@ -2,9 +2,9 @@ package gomesh
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
-	"math/rand"
 	"os"
 	"time"
 
@@ -23,48 +23,121 @@ const broadcastNum = 0xffffffff
 
 // Radio holds the port and serial io.ReadWriteCloser struct to maintain one serial connection
 type Radio struct {
-	streamer streamer
-	nodeNum  uint32
+	streamer   streamer
+	nodeNum    uint32
+	port       string
+	connection *connection
+	queue      *sendQueue
+	dutyCycle  *dutyCycle
+	fragments  *fragmenter
+	handlers   *handlerRegistry
+	transfer   *xmodemTransfer
+	tracker    *positionTracker
+	nodeDB     *nodeDirectory
+
+	compressText bool
 }
 
-// Init initializes the Serial connection for the radio
+// Init initializes the connection to the radio at a serial port, an IP address, or the http or https URL
+// of a device HTTP API
 func (r *Radio) Init(port string) error {
 
-	streamer := streamer{}
+	r.port = port
+	r.reopen()
+	r.setState(StateConnecting)
+
+	c := r.conn()
+	c.mu.Lock()
+	streamer := streamer{httpOptions: c.httpOptions}
+	c.mu.Unlock()
+
 	err := streamer.Init(port)
 	if err != nil {
+		r.setState(StateDisconnected)
 		return err
 	}
 	r.streamer = streamer
 
 	err = r.getNodeNum()
 	if err != nil {
+		r.setState(StateDisconnected)
 		return err
 	}
 
 	return nil
 }
 
-// sendPacket takes a protbuf packet, construct the appropriate header and sends it to the radio
+// sendPacket takes a protbuf packet, construct the appropriate header and sends it to the radio.
+// If the link has dropped and a reconnect policy is set the packet is held and replayed once
+// the radio is reconnected
 func (r *Radio) sendPacket(protobufPacket []byte) (err error) {
 
+	gen := r.generation()
+
+	err = r.writePacket(protobufPacket)
+	if err != nil {
+		if r.reconnectEnabled() {
+			r.holdPending(protobufPacket)
+		}
+		return r.reconnect(err, gen)
+	}
+
+	return
+
+}
+
+// writePacket frames a protobuf packet and writes it to the radio without any recovery
+func (r *Radio) writePacket(protobufPacket []byte) error {
+
 	packageLength := len(string(protobufPacket))
 
 	header := []byte{start1, start2, byte(packageLength>>8) & 0xff, byte(packageLength) & 0xff}
 
 	radioPacket := append(header, protobufPacket...)
-	err = r.streamer.Write(radioPacket)
-	if err != nil {
+
+	c := r.conn()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := r.streamer.Write(radioPacket); err != nil {
 		return err
 	}
 
-	return
-
+	r.captureFrame(PacketSent, radioPacket)
+	r.logFrame(PacketSent, radioPacket)
+	return nil
 }
 
-// ReadResponse reads any responses in the serial port, convert them to a FromRadio protobuf and return
+// ReadResponse reads any responses in the serial port, convert them to a FromRadio protobuf and return.
+// If the link has dropped and a reconnect policy is set the radio is reconnected before returning
 func (r *Radio) ReadResponse(timeout bool) (FromRadioPackets []*pb.FromRadio, err error) {
 
+	if r.isClosed() {
+		return nil, ErrClosed
+	}
+
+	gen := r.generation()
+
+	// Packets read while a send was waiting on the device queue are returned first
+	backlog := r.takeBacklog()
+
+	FromRadioPackets, err = r.readPackets()
+	if err != nil {
+		if err := r.reconnect(err, gen); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(backlog, FromRadioPackets...), nil
+}
+
+// readPackets reads and decodes frames from the radio until the stream goes quiet
+func (r *Radio) readPackets() (FromRadioPackets []*pb.FromRadio, err error) {
+
+	c := r.conn()
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
 	b := make([]byte, 1)
 
 	emptyByte := make([]byte, 0)
@@ -81,7 +154,6 @@ func (r *Radio) ReadResponse(timeout bool) (FromRadioPackets []*pb.FromRadio, er
 	 */
 	for {
 		err := r.streamer.Read(b)
-		// fmt.Printf("Byte: %q\n", b)
 		if bytes.Equal(b, previousByte) {
 			repeatByteCounter++
 		} else {
@@ -103,14 +175,17 @@ func (r *Radio) ReadResponse(timeout bool) (FromRadioPackets []*pb.FromRadio, er
 
 			if pointer == 0 {
 				if b[0] != start1 {
+					// Bytes outside a frame are the debug console of the device
+					r.debugBytes(b[0])
 					processedBytes = emptyByte
 				}
 			} else if pointer == 1 {
 				if b[0] != start2 {
+					r.debugBytes(processedBytes...)
 					processedBytes = emptyByte
 				}
 			} else if pointer >= headerLen {
-				packetLength := int((processedBytes[2] << 8) + processedBytes[3])
+				packetLength := int(processedBytes[2])<<8 + int(processedBytes[3])
 
 				if pointer == headerLen {
 					if packetLength > maxToFromRadioSzie {
@@ -119,11 +194,19 @@ func (r *Radio) ReadResponse(timeout bool) (FromRadioPackets []*pb.FromRadio, er
 				}
 
 				if len(processedBytes) != 0 && pointer+1 == packetLength+headerLen {
+					r.captureFrame(PacketReceived, processedBytes)
+					r.logFrame(PacketReceived, processedBytes)
+
+					// A frame that doesn't decode is dropped, the link itself is still fine
 					fromRadio := pb.FromRadio{}
-					if err := proto.Unmarshal(processedBytes[headerLen:], &fromRadio); err != nil {
-						return nil, err
+					if err := proto.Unmarshal(processedBytes[headerLen:], &fromRadio); err == nil {
+						// Handlers may send, which can read from the radio while waiting on the device
+						// queue, so the stream is unlocked while the packet is handled
+						c.readMu.Unlock()
+						delivered := r.handleFromRadio(&fromRadio)
+						c.readMu.Lock()
+						FromRadioPackets = append(FromRadioPackets, delivered)
 					}
-					FromRadioPackets = append(FromRadioPackets, &fromRadio)
 					processedBytes = emptyByte
 				}
 			}
@@ -138,6 +221,89 @@ func (r *Radio) ReadResponse(timeout bool) (FromRadioPackets []*pb.FromRadio, er
 
 }
 
+// handleFromRadio updates the radio state from a packet read off the stream and returns the message as
+// readers should see it, which differs from the one read only for compressed text
+func (r *Radio) handleFromRadio(fromRadio *pb.FromRadio) (delivered *pb.FromRadio) {
+
+	delivered = fromRadio
+	defer r.registry().observeFromRadio(fromRadio)
+
+	switch payload := fromRadio.GetPayloadVariant().(type) {
+	case *pb.FromRadio_ConfigCompleteId:
+		c := r.conn()
+		c.mu.Lock()
+		complete := payload.ConfigCompleteId == c.configID
+		c.mu.Unlock()
+
+		if complete {
+			r.setState(StateConfigured)
+		}
+	case *pb.FromRadio_Config:
+		r.directory().handleConfig(payload.Config)
+		if lora := payload.Config.GetLora(); lora != nil {
+			r.airtime().handleLoRaConfig(lora)
+			r.directory().handleLoRaConfig(lora)
+		}
+	case *pb.FromRadio_Metadata:
+		r.conn().handleMetadata(payload.Metadata)
+	case *pb.FromRadio_ModuleConfig:
+		r.directory().handleModuleConfig(payload.ModuleConfig)
+	case *pb.FromRadio_Channel:
+		r.positions().handleChannel(payload.Channel)
+		r.directory().handleChannel(payload.Channel)
+	case *pb.FromRadio_NodeInfo:
+		r.positions().handleNodeInfo(payload.NodeInfo)
+		r.directory().handleNodeInfo(payload.NodeInfo)
+	case *pb.FromRadio_XmodemPacket:
+		r.xmodem().handleXmodem(payload.XmodemPacket)
+	case *pb.FromRadio_QueueStatus:
+		r.outbound().handleQueueStatus(payload.QueueStatus)
+	case *pb.FromRadio_LogRecord:
+		r.handleLogRecord(payload.LogRecord)
+	case nil:
+		if file, ok := fileInfo(fromRadio); ok {
+			r.conn().handleFileInfo(file)
+		}
+	case *pb.FromRadio_Packet:
+		packet := payload.Packet
+		data := packet.GetDecoded()
+		if data == nil {
+			r.registry().observe(packet, PacketReceived)
+			return
+		}
+
+		if data.Portnum == pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP {
+			if plain, ok := decompressTextPacket(packet); ok {
+				packet, data = plain, plain.GetDecoded()
+				delivered = &pb.FromRadio{Id: fromRadio.Id, PayloadVariant: &pb.FromRadio_Packet{Packet: plain}}
+			}
+		}
+
+		switch data.Portnum {
+		case pb.PortNum_ROUTING_APP:
+			r.outbound().handleRouting(data)
+		case pb.PortNum_POSITION_APP:
+			r.positions().handlePosition(packet, data)
+		case pb.PortNum_ADMIN_APP:
+			r.logAdmin(PacketReceived, packet.From, data.Payload)
+		}
+		r.directory().handlePacket(packet, data)
+		if f := r.fragmenter(); f != nil {
+			switch data.Portnum {
+			case f.opts.Port:
+				r.handleFragment(f, packet)
+			case pb.PortNum_TEXT_MESSAGE_APP:
+				f.handleUnfragmented(packet, true)
+			}
+		}
+
+		r.registry().observe(packet, PacketReceived)
+		r.registry().dispatch(packet, data)
+	}
+
+	return
+}
+
 // createAdminPacket builds a admin message packet to send to the radio
 func (r *Radio) createAdminPacket(nodeNum uint32, payload []byte) (packetOut []byte, err error) {
 
@@ -162,23 +328,16 @@ func (r *Radio) createAdminPacket(nodeNum uint32, payload []byte) (packetOut []b
 		return nil, err
 	}
 
+	r.logAdmin(PacketSent, nodeNum, payload)
 	return
 
 }
 
-// getNodeNum returns the current NodeNumber after querying the radio
+// getNodeNum returns the current NodeNumber after querying the radio. This is the config
+// handshake for the link so it talks to the stream directly without any reconnect handling
 func (r *Radio) getNodeNum() (err error) {
-	// Send first request for Radio and Node information
-	nodeInfo := pb.ToRadio{PayloadVariant: &pb.ToRadio_WantConfigId{WantConfigId: 42}}
-
-	out, err := proto.Marshal(&nodeInfo)
-	if err != nil {
-		return err
-	}
 
-	r.sendPacket(out)
-
-	radioResponses, err := r.GetRadioInfo()
+	radioResponses, err := r.handshake()
 	if err != nil {
 		return err
 	}
@@ -195,10 +354,52 @@ func (r *Radio) getNodeNum() (err error) {
 	return
 }
 
+// handshake requests the config of the device and returns what it sent
+func (r *Radio) handshake() (radioResponses []*pb.FromRadio, err error) {
+	// Send first request for Radio and Node information
+	nodeInfo := pb.ToRadio{PayloadVariant: &pb.ToRadio_WantConfigId{WantConfigId: r.newConfigID()}}
+
+	out, err := proto.Marshal(&nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.writePacket(out); err != nil {
+		return nil, err
+	}
+
+	checks := 0
+
+	radioResponses, err = r.readPackets()
+	if err != nil {
+		return nil, err
+	}
+
+	for checks < 5 && len(radioResponses) == 0 {
+		if r.isClosed() {
+			return nil, ErrClosed
+		}
+
+		radioResponses, err = r.readPackets()
+		if err != nil {
+			return nil, err
+		}
+
+		checks++
+		time.Sleep(1 * time.Second)
+	}
+
+	if len(radioResponses) == 0 {
+		return nil, errors.New("failed to get radio info")
+	}
+
+	return radioResponses, nil
+}
+
 // GetRadioInfo retrieves information from the radio including config and adjacent Node information
 func (r *Radio) GetRadioInfo() (radioResponses []*pb.FromRadio, err error) {
 	// Send first request for Radio and Node information
-	nodeInfo := pb.ToRadio{PayloadVariant: &pb.ToRadio_WantConfigId{WantConfigId: 42}}
+	nodeInfo := pb.ToRadio{PayloadVariant: &pb.ToRadio_WantConfigId{WantConfigId: r.newConfigID()}}
 
 	out, err := proto.Marshal(&nodeInfo)
 	if err != nil {
@@ -237,41 +438,20 @@ func (r *Radio) SendTextMessage(message string, to int64, channel int64) error {
 		address = to
 	}
 
-	// This constant is defined in Constants_DATA_PAYLOAD_LEN, but not in a friendly way to use
-	if len(message) > 240 {
+	port, payload := textPayload(message, r.textCompression())
+	if len(payload) > int(pb.Constants_DATA_PAYLOAD_LEN) {
 		return errors.New("message too large")
 	}
 
-	rand.Seed(time.Now().UnixNano())
-	packetID := rand.Intn(2386828-1) + 1
+	_, err := r.SendData(context.Background(), DataRequest{
+		To:      uint32(address),
+		Channel: uint32(channel),
+		Port:    port,
+		Payload: payload,
+		WantAck: true,
+	})
 
-	radioMessage := pb.ToRadio{
-		PayloadVariant: &pb.ToRadio_Packet{
-			Packet: &pb.MeshPacket{
-				To:      uint32(address),
-				WantAck: true,
-				Id:      uint32(packetID),
-				Channel: uint32(channel),
-				PayloadVariant: &pb.MeshPacket_Decoded{
-					Decoded: &pb.Data{
-						Payload: []byte(message),
-						Portnum: pb.PortNum_TEXT_MESSAGE_APP,
-					},
-				},
-			},
-		},
-	}
-
-	out, err := proto.Marshal(&radioMessage)
-	if err != nil {
-		return err
-	}
-
-	if err := r.sendPacket(out); err != nil {
-		return err
-	}
-
-	return nil
+	return err
 
 }
 
@@ -437,5 +617,16 @@ func (r *Radio) FactoryRest() error {
 
 // Close closes the serial port. Added so users can defer the close after opening
 func (r *Radio) Close() {
+
+	// Marking the radio closed first stops a reconnect from reopening the link behind us
+	r.markClosed()
+
+	c := r.conn()
+	c.readMu.Lock()
+	c.writeMu.Lock()
 	r.streamer.Close()
+	c.writeMu.Unlock()
+	c.readMu.Unlock()
+
+	r.setState(StateDisconnected)
 }
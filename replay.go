@@ -0,0 +1,208 @@
+package gomesh
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// replayIdle is the longest a replay read waits for the next frame before reporting a quiet stream
+const replayIdle = 500 * time.Millisecond
+
+// ErrReplayFinished is returned by reads once every frame of a replayed capture was delivered
+var ErrReplayFinished = errors.New("replay finished")
+
+// ReplayOptions configures the pace of a replay
+type ReplayOptions struct {
+	// Speed multiplies the pace of the capture, 1 when not set. 10 replays ten times faster
+	Speed float64
+	// NoDelay delivers frames as fast as they are read
+	NoDelay bool
+}
+
+// ReplayTransport feeds the received frames of a capture to a Radio as if they came from a device. Frames the
+// radio writes are discarded, except that config requests are answered with the id the radio asked for
+type ReplayTransport struct {
+	capture *CaptureReader
+	opts    ReplayOptions
+	closed  chan struct{}
+	once    sync.Once
+
+	// Read state, only used by the reading goroutine
+	next     *CaptureFrame
+	buf      []byte
+	start    time.Time
+	first    time.Time
+	finished bool
+
+	mu       sync.Mutex
+	configID uint32
+}
+
+// NewReplayTransport creates a transport that replays a capture
+func NewReplayTransport(capture *CaptureReader, opts ReplayOptions) *ReplayTransport {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	return &ReplayTransport{capture: capture, opts: opts, closed: make(chan struct{})}
+}
+
+// InitTransport connects the radio over any byte stream carrying the framed device protocol and runs the
+// config handshake. Radios connected this way don't reconnect
+func (r *Radio) InitTransport(transport io.ReadWriteCloser) error {
+
+	r.reopen()
+	r.setState(StateConnecting)
+	r.streamer = streamer{transport: transport}
+
+	if err := r.getNodeNum(); err != nil {
+		r.setState(StateDisconnected)
+		return err
+	}
+
+	return nil
+}
+
+// InitReplay connects the radio to a replayed capture. Reading from the radio returns ErrReplayFinished
+// once the capture is exhausted
+func (r *Radio) InitReplay(capture *CaptureReader, opts ReplayOptions) error {
+	return r.InitTransport(NewReplayTransport(capture, opts))
+}
+
+// peek returns the next received frame of the capture without consuming it
+func (t *ReplayTransport) peek() (*CaptureFrame, error) {
+
+	for t.next == nil {
+		frame, err := t.capture.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		if frame.Direction == PacketReceived {
+			t.next = &frame
+		}
+	}
+
+	if t.start.IsZero() {
+		t.start = time.Now()
+		t.first = t.next.Time
+	}
+
+	return t.next, nil
+}
+
+// sleep waits for a duration or until the transport is closed
+func (t *ReplayTransport) sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-t.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+// Read delivers the bytes of the captured frames at the pace of the capture
+func (t *ReplayTransport) Read(p []byte) (int, error) {
+
+	for len(t.buf) == 0 {
+		select {
+		case <-t.closed:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+
+		frame, err := t.peek()
+		if err == io.EOF {
+			// Report a quiet stream once so the reader returns the last frames before the replay ends
+			if !t.finished {
+				t.finished = true
+				return 0, os.ErrDeadlineExceeded
+			}
+			return 0, ErrReplayFinished
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if !t.opts.NoDelay {
+			due := t.start.Add(time.Duration(float64(frame.Time.Sub(t.first)) / t.opts.Speed))
+			if wait := time.Until(due); wait > replayIdle {
+				// Let the reader see a quiet stream rather than blocking it for the whole gap
+				if err := t.sleep(replayIdle); err != nil {
+					return 0, err
+				}
+				return 0, os.ErrDeadlineExceeded
+			} else if wait > 0 {
+				if err := t.sleep(wait); err != nil {
+					return 0, err
+				}
+			}
+		}
+
+		t.buf = t.rewrite(frame.Data)
+		t.next = nil
+	}
+
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+// rewrite answers the config handshake of the replaying radio with its own config id
+func (t *ReplayTransport) rewrite(frame []byte) []byte {
+
+	t.mu.Lock()
+	configID := t.configID
+	t.mu.Unlock()
+
+	if configID == 0 || len(frame) <= headerLen {
+		return frame
+	}
+
+	fromRadio := pb.FromRadio{}
+	if err := proto.Unmarshal(frame[headerLen:], &fromRadio); err != nil || fromRadio.GetConfigCompleteId() == 0 {
+		return frame
+	}
+
+	fromRadio.PayloadVariant = &pb.FromRadio_ConfigCompleteId{ConfigCompleteId: configID}
+	out, err := proto.Marshal(&fromRadio)
+	if err != nil {
+		return frame
+	}
+
+	return append([]byte{start1, start2, byte(len(out) >> 8), byte(len(out))}, out...)
+}
+
+// Write discards a frame from the radio, remembering the id of config requests
+func (t *ReplayTransport) Write(p []byte) (int, error) {
+
+	select {
+	case <-t.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	if len(p) > headerLen {
+		toRadio := pb.ToRadio{}
+		if err := proto.Unmarshal(p[headerLen:], &toRadio); err == nil && toRadio.GetWantConfigId() != 0 {
+			t.mu.Lock()
+			t.configID = toRadio.GetWantConfigId()
+			t.mu.Unlock()
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close stops the replay
+func (t *ReplayTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
@@ -0,0 +1,67 @@
+package gomesh
+
+import "errors"
+
+// ErrPlatformUnsupported is returned by functions this operating system can't provide, such as OpenTUN
+// and ListSerialPorts outside Linux
+var ErrPlatformUnsupported = errors.New("not supported on this platform")
+
+// USBID is a USB vendor and product id. A zero product matches every product of the vendor
+type USBID struct {
+	Vendor  uint16
+	Product uint16
+	// Name describes the chip or board
+	Name string
+}
+
+// MeshtasticUSBIDs are the USB serial adapters and boards Meshtastic devices commonly use
+var MeshtasticUSBIDs = []USBID{
+	{Vendor: 0x10c4, Product: 0xea60, Name: "CP210x"},
+	{Vendor: 0x1a86, Product: 0x7523, Name: "CH340"},
+	{Vendor: 0x1a86, Product: 0x55d4, Name: "CH9102"},
+	{Vendor: 0x303a, Product: 0x1001, Name: "ESP32-S3"},
+	{Vendor: 0x303a, Product: 0x0002, Name: "ESP32-S3"},
+	{Vendor: 0x239a, Name: "nRF52"},
+	{Vendor: 0x2886, Name: "nRF52"},
+	{Vendor: 0x1915, Name: "nRF52"},
+}
+
+// SerialPort is a USB serial device found on the system
+type SerialPort struct {
+	// Path is the device to pass to Radio.Init, for example /dev/ttyUSB0
+	Path    string
+	Vendor  uint16
+	Product uint16
+	// Manufacturer, Description and SerialNumber are the USB strings of the device when it reports them
+	Manufacturer string
+	Description  string
+	SerialNumber string
+}
+
+// Matches reports whether the port has one of the ids
+func (p SerialPort) Matches(ids []USBID) bool {
+	for _, id := range ids {
+		if p.Vendor == id.Vendor && (id.Product == 0 || p.Product == id.Product) {
+			return true
+		}
+	}
+	return false
+}
+
+// MeshtasticPorts returns the serial ports whose USB ids match MeshtasticUSBIDs
+func MeshtasticPorts() ([]SerialPort, error) {
+
+	ports, err := ListSerialPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []SerialPort
+	for _, port := range ports {
+		if port.Matches(MeshtasticUSBIDs) {
+			matched = append(matched, port)
+		}
+	}
+
+	return matched, nil
+}
@@ -0,0 +1,117 @@
+//go:build linux
+// +build linux
+
+package gomesh
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sysfsRoot is where sysfs is mounted, changed by tests
+var sysfsRoot = "/sys"
+
+// ListSerialPorts returns the USB serial devices the kernel knows about, read from sysfs
+func ListSerialPorts() ([]SerialPort, error) {
+
+	entries, err := os.ReadDir(filepath.Join(sysfsRoot, "class", "tty"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ports []SerialPort
+	for _, entry := range entries {
+		device, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, "class", "tty", entry.Name(), "device"))
+		if err != nil {
+			// Virtual terminals have no device
+			continue
+		}
+
+		usb, ok := usbDeviceDir(device)
+		if !ok {
+			continue
+		}
+
+		port := SerialPort{
+			Path:         filepath.Join("/dev", entry.Name()),
+			Vendor:       readSysfsHex(filepath.Join(usb, "idVendor")),
+			Product:      readSysfsHex(filepath.Join(usb, "idProduct")),
+			Manufacturer: readSysfsString(filepath.Join(usb, "manufacturer")),
+			Description:  readSysfsString(filepath.Join(usb, "product")),
+			SerialNumber: readSysfsString(filepath.Join(usb, "serial")),
+		}
+		ports = append(ports, port)
+	}
+
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Path < ports[j].Path })
+	return ports, nil
+}
+
+// usbDeviceDir walks up from a tty device to the USB device that has the vendor and product ids
+func usbDeviceDir(device string) (string, bool) {
+
+	root := filepath.Clean(sysfsRoot)
+	for dir := device; dir != root && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+			return dir, true
+		}
+	}
+
+	return "", false
+}
+
+// readSysfsString reads a sysfs attribute, empty when it doesn't exist
+func readSysfsString(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// readSysfsHex reads a sysfs attribute holding a hex number such as a USB id
+func readSysfsHex(path string) uint16 {
+	n, err := strconv.ParseUint(readSysfsString(path), 16, 16)
+	if err != nil {
+		return 0
+	}
+	return uint16(n)
+}
+
+// lockSerialPort takes an exclusive flock on an open serial port and puts it in exclusive mode so no other
+// process can open it. A port another process holds the lock on or opened in exclusive mode returns ErrPortBusy
+func lockSerialPort(port io.ReadWriteCloser) error {
+
+	file, ok := port.(interface{ Fd() uintptr })
+	if !ok {
+		return nil
+	}
+	fd := file.Fd()
+
+	if err := syscall.Flock(int(fd), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return ErrPortBusy
+		}
+		return os.NewSyscallError("flock", err)
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCEXCL, 0); errno != 0 {
+		return os.NewSyscallError("ioctl TIOCEXCL", errno)
+	}
+
+	return nil
+}
+
+// isPortBusy reports whether opening a serial port failed because another process has it in exclusive mode
+func isPortBusy(err error) bool {
+	return errors.Is(err, syscall.EBUSY)
+}
@@ -0,0 +1,105 @@
+package gomesh
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestListSerialPorts(t *testing.T) {
+
+	root := t.TempDir()
+	defer func(old string) { sysfsRoot = old }(sysfsRoot)
+	sysfsRoot = root
+
+	usb := filepath.Join(root, "devices", "pci0000:00", "usb1", "1-2")
+	iface := filepath.Join(usb, "1-2:1.0", "ttyUSB0")
+	for _, dir := range []string{iface, filepath.Join(root, "class", "tty", "ttyUSB0"), filepath.Join(root, "class", "tty", "tty0")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("Error creating sysfs: %v", err)
+		}
+	}
+	for name, value := range map[string]string{"idVendor": "10c4\n", "idProduct": "ea60\n", "product": "CP2102 USB to UART\n", "serial": "0001\n"} {
+		if err := os.WriteFile(filepath.Join(usb, name), []byte(value), 0o644); err != nil {
+			t.Fatalf("Error writing sysfs: %v", err)
+		}
+	}
+	if err := os.Symlink(iface, filepath.Join(root, "class", "tty", "ttyUSB0", "device")); err != nil {
+		t.Fatalf("Error linking sysfs: %v", err)
+	}
+
+	ports, err := MeshtasticPorts()
+	if err != nil {
+		t.Fatalf("Error listing ports: %v", err)
+	}
+	if len(ports) != 1 {
+		t.Fatalf("Expected 1 port, got %d", len(ports))
+	}
+	if p := ports[0]; p.Path != "/dev/ttyUSB0" || p.Vendor != 0x10c4 || p.Product != 0xea60 || p.SerialNumber != "0001" {
+		t.Errorf("Unexpected port %+v", p)
+	}
+}
+
+// openPTY opens a pseudo terminal and returns its master and the path of the serial port it drives
+func openPTY(t *testing.T) (*os.File, string) {
+
+	// The master is opened non blocking so its reads honour deadlines
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("No pseudo terminals: %v", err)
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	t.Cleanup(func() { master.Close() })
+
+	var n, unlock uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Skipf("Error unlocking pseudo terminal: %v", errno)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		t.Skipf("Error reading pseudo terminal number: %v", errno)
+	}
+	return master, "/dev/pts/" + strconv.Itoa(int(n))
+}
+
+func TestProbeBusyPort(t *testing.T) {
+
+	master, path := openPTY(t)
+
+	// Another program holds the port and has locked it
+	other, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("Error opening %s: %v", path, err)
+	}
+	defer other.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := ProbePort(ctx, SerialPort{Path: path}); err != ErrPortBusy {
+		t.Fatalf("Expected ErrPortBusy, got %v", err)
+	}
+
+	// Nothing may reach a busy port
+	master.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := master.Read(make([]byte, 64)); n != 0 {
+		t.Errorf("Expected nothing written to a busy port, got %d bytes", n)
+	}
+
+	// Once it is free the probe locks it and writes its config request
+	other.Close()
+	if _, err := ProbePort(ctx, SerialPort{Path: path}); err == ErrPortBusy {
+		t.Fatal("Expected a free port to be probed")
+	}
+	master.SetReadDeadline(time.Now().Add(time.Second))
+	request := make([]byte, 64)
+	if n, _ := master.Read(request); n < headerLen || request[0] != start1 || request[1] != start2 {
+		t.Errorf("Expected the config request to be written, got %x", request[:n])
+	}
+}
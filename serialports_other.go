@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package gomesh
+
+import "io"
+
+// ListSerialPorts is only supported on Linux and returns ErrPlatformUnsupported elsewhere
+func ListSerialPorts() ([]SerialPort, error) {
+	return nil, ErrPlatformUnsupported
+}
+
+// lockSerialPort does nothing outside Linux, where ports are probed without checking whether they are in use
+func lockSerialPort(port io.ReadWriteCloser) error {
+	return nil
+}
+
+// isPortBusy reports whether opening a serial port failed because it is in use
+func isPortBusy(err error) bool {
+	return false
+}
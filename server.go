@@ -0,0 +1,438 @@
+package gomesh
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("server closed")
+
+// ServerOptions configures a Server
+type ServerOptions struct {
+	// Buffer is the number of frames queued for each client, and of packets from it waiting to be sent,
+	// before a slow client is disconnected, 256 when not set
+	Buffer int
+	// OnError is called when a client fails or the radio stops listening
+	OnError func(err error)
+}
+
+// Server shares one radio with many clients over TCP using the framed device protocol, the way the
+// firmware does on port 4403. Each client that asks for the config gets the config of the radio, and
+// everything else the radio reads, such as packets, queue status and device logs, is sent to all clients
+type Server struct {
+	radio *Radio
+	opts  ServerOptions
+
+	startOnce sync.Once
+	startErr  error
+	cancel    context.CancelFunc
+	remove    func()
+	listening chan struct{}
+
+	mu        sync.Mutex
+	dump      []*pb.FromRadio
+	clients   map[*serverClient]struct{}
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// serverClient is a connected client, its queue of frames to write and its queue of packets to send
+type serverClient struct {
+	conn    net.Conn
+	out     chan []byte
+	packets chan *pb.MeshPacket
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewServer creates a server for a connected radio. The server reads from the radio once it starts, so
+// callers must not call Listen or ReadResponse on it themselves
+func NewServer(radio *Radio, opts ServerOptions) *Server {
+	if opts.Buffer <= 0 {
+		opts.Buffer = 256
+	}
+	return &Server{
+		radio:     radio,
+		opts:      opts,
+		clients:   make(map[*serverClient]struct{}),
+		listeners: make(map[net.Listener]struct{}),
+	}
+}
+
+// ListenAndServe listens on a TCP address, ":4403" when empty, and serves clients until Close
+func (s *Server) ListenAndServe(addr string) error {
+
+	if addr == "" {
+		addr = ":4403"
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+// Serve accepts clients on a listener until Close. The first call fetches the config of the radio and
+// starts reading from it
+func (s *Server) Serve(ln net.Listener) error {
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+		ln.Close()
+	}()
+
+	if err := s.start(); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		client := &serverClient{
+			conn:    conn,
+			out:     make(chan []byte, s.opts.Buffer),
+			packets: make(chan *pb.MeshPacket, s.opts.Buffer),
+			done:    make(chan struct{}),
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.clients[client] = struct{}{}
+		s.mu.Unlock()
+
+		go s.writeClient(client)
+		go s.sendClient(client)
+		go s.readClient(client)
+	}
+}
+
+// start fetches the config dump from the radio and starts reading packets to fan out
+func (s *Server) start() error {
+
+	s.startOnce.Do(func() {
+		responses, err := s.radio.handshake()
+		if err != nil {
+			s.startErr = err
+			return
+		}
+
+		var dump []*pb.FromRadio
+		for _, response := range responses {
+			if _, ok := response.GetPayloadVariant().(*pb.FromRadio_ConfigCompleteId); !ok {
+				dump = append(dump, response)
+			}
+		}
+
+		s.mu.Lock()
+		s.dump = dump
+		s.mu.Unlock()
+
+		s.remove = s.radio.onFromRadio(func(fromRadio *pb.FromRadio) {
+			if !isConfigDump(fromRadio) {
+				s.broadcast(fromRadio)
+			}
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancel = cancel
+		s.listening = make(chan struct{})
+		go func() {
+			defer close(s.listening)
+			if err := s.radio.Listen(ctx); err != nil && ctx.Err() == nil {
+				s.report(err)
+			}
+		}()
+	})
+
+	return s.startErr
+}
+
+// isConfigDump reports whether a message is part of the config the device sends in answer to WantConfigId.
+// Clients get the config from the server when they ask for it, so these aren't passed on
+func isConfigDump(fromRadio *pb.FromRadio) bool {
+	switch fromRadio.GetPayloadVariant().(type) {
+	case *pb.FromRadio_MyInfo, *pb.FromRadio_NodeInfo, *pb.FromRadio_Config, *pb.FromRadio_ModuleConfig,
+		*pb.FromRadio_Channel, *pb.FromRadio_Metadata, *pb.FromRadio_ConfigCompleteId:
+		return true
+	}
+	_, ok := fileInfo(fromRadio)
+	return ok
+}
+
+// configDump returns the config of the radio to send a client, with the nodes as the radio knows them now
+func (s *Server) configDump(configID uint32) []*pb.FromRadio {
+
+	s.mu.Lock()
+	dump := s.dump
+	s.mu.Unlock()
+
+	var out []*pb.FromRadio
+	nodesSent := false
+	for _, fromRadio := range dump {
+		if _, ok := fromRadio.GetPayloadVariant().(*pb.FromRadio_NodeInfo); ok {
+			if nodesSent {
+				continue
+			}
+			nodesSent = true
+			for _, node := range s.radio.Nodes() {
+				out = append(out, &pb.FromRadio{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: node}})
+			}
+			continue
+		}
+		out = append(out, fromRadio)
+	}
+
+	return append(out, &pb.FromRadio{PayloadVariant: &pb.FromRadio_ConfigCompleteId{ConfigCompleteId: configID}})
+}
+
+// broadcast queues a message for every client
+func (s *Server) broadcast(fromRadio *pb.FromRadio) {
+
+	frame, err := frameMessage(fromRadio)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	clients := make([]*serverClient, 0, len(s.clients))
+	for client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.mu.Unlock()
+
+	for _, client := range clients {
+		s.send(client, frame)
+	}
+}
+
+// send queues a frame for a client, disconnecting it if it can't keep up. It never blocks because it runs
+// on the read goroutine of the radio
+func (s *Server) send(client *serverClient, frame []byte) {
+	select {
+	case <-client.done:
+	case client.out <- frame:
+	default:
+		s.report(errors.New("client too slow, disconnecting " + client.conn.RemoteAddr().String()))
+		s.drop(client)
+	}
+}
+
+// writeClient writes queued frames to a client until it is dropped
+func (s *Server) writeClient(client *serverClient) {
+	for {
+		select {
+		case <-client.done:
+			return
+		case frame := <-client.out:
+			if _, err := client.conn.Write(frame); err != nil {
+				s.drop(client)
+				return
+			}
+		}
+	}
+}
+
+// sendClient sends the packets of a client to the radio in the order it wrote them. It stops once
+// readClient is done and every queued packet is sent
+func (s *Server) sendClient(client *serverClient) {
+	for packet := range client.packets {
+		if err := s.radio.sendMeshPacket(context.Background(), packet); err != nil {
+			s.report(err)
+		}
+	}
+}
+
+// readClient reads frames from a client and acts on them until it disconnects
+func (s *Server) readClient(client *serverClient) {
+
+	defer close(client.packets)
+	defer s.drop(client)
+
+	reader := bufio.NewReader(client.conn)
+	for {
+		payload, err := readFrame(reader)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.report(err)
+			}
+			return
+		}
+
+		toRadio := pb.ToRadio{}
+		if err := proto.Unmarshal(payload, &toRadio); err != nil {
+			continue
+		}
+
+		switch variant := toRadio.GetPayloadVariant().(type) {
+		case *pb.ToRadio_WantConfigId:
+			for _, fromRadio := range s.configDump(variant.WantConfigId) {
+				frame, err := frameMessage(fromRadio)
+				if err != nil {
+					continue
+				}
+				// The dump can be larger than the queue, and waiting here only holds up this client
+				select {
+				case client.out <- frame:
+				case <-client.done:
+					return
+				}
+			}
+		case *pb.ToRadio_Disconnect:
+			return
+		case *pb.ToRadio_Packet:
+			// Sending waits on the device queue so it must not hold up reading this client
+			select {
+			case client.packets <- variant.Packet:
+			default:
+				s.report(errors.New("client sending too fast, disconnecting " + client.conn.RemoteAddr().String()))
+				return
+			}
+		default:
+			if err := s.radio.sendPacket(payload); err != nil {
+				s.report(err)
+			}
+		}
+	}
+}
+
+// drop disconnects a client
+func (s *Server) drop(client *serverClient) {
+	client.once.Do(func() {
+		s.mu.Lock()
+		delete(s.clients, client)
+		s.mu.Unlock()
+
+		client.conn.Close()
+		close(client.done)
+	})
+}
+
+// Clients returns the number of connected clients
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// report passes an error to OnError
+func (s *Server) report(err error) {
+	if s.opts.OnError != nil {
+		s.opts.OnError(err)
+	}
+}
+
+// Close stops serving, disconnects every client and stops reading from the radio. The radio stays open
+func (s *Server) Close() error {
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	clients := make([]*serverClient, 0, len(s.clients))
+	for client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.mu.Unlock()
+
+	for _, client := range clients {
+		s.drop(client)
+	}
+
+	// Make a later start a no op so a radio handed to a closed server isn't read
+	s.startOnce.Do(func() { s.startErr = ErrServerClosed })
+	if s.remove != nil {
+		s.remove()
+	}
+	if s.cancel != nil {
+		s.cancel()
+		<-s.listening
+	}
+
+	return nil
+}
+
+// frameMessage marshals a message and adds the stream header
+func frameMessage(message proto.Message) ([]byte, error) {
+	out, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{start1, start2, byte(len(out) >> 8), byte(len(out))}, out...), nil
+}
+
+// readFrame reads the next frame from a stream and returns its protobuf payload, skipping anything between
+// frames
+func readFrame(r *bufio.Reader) ([]byte, error) {
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != start1 {
+			continue
+		}
+
+		b, err = r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != start2 {
+			r.UnreadByte()
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, err
+		}
+		size := int(length[0])<<8 | int(length[1])
+		if size > maxToFromRadioSzie {
+			continue
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}
+}
@@ -0,0 +1,205 @@
+package gomesh
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// readFromRadio reads the next message a server sends a client
+func readFromRadio(t *testing.T, conn net.Conn, reader *bufio.Reader) *pb.FromRadio {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	payload, err := readFrame(reader)
+	if err != nil {
+		t.Fatalf("Error reading frame: %v", err)
+	}
+	fromRadio := &pb.FromRadio{}
+	if err := proto.Unmarshal(payload, fromRadio); err != nil {
+		t.Fatalf("Error decoding frame: %v", err)
+	}
+	return fromRadio
+}
+
+func TestServer(t *testing.T) {
+
+	var stream []byte
+	for _, fromRadio := range []*pb.FromRadio{
+		{PayloadVariant: &pb.FromRadio_MyInfo{MyInfo: &pb.MyNodeInfo{MyNodeNum: 1}}},
+		{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: &pb.NodeInfo{Num: 1}}},
+		{PayloadVariant: &pb.FromRadio_NodeInfo{NodeInfo: &pb.NodeInfo{Num: 2}}},
+		{PayloadVariant: &pb.FromRadio_Channel{Channel: &pb.Channel{Index: 0, Role: pb.Channel_PRIMARY}}},
+	} {
+		stream = append(stream, testFrame(t, fromRadio)...)
+	}
+
+	transport := newFakeDevice(stream, nil)
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: transport}}
+	server := NewServer(radio, ServerOptions{})
+	defer server.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	go server.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	request, _ := frameMessage(&pb.ToRadio{PayloadVariant: &pb.ToRadio_WantConfigId{WantConfigId: 77}})
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	var nodes, channels int
+	for {
+		fromRadio := readFromRadio(t, conn, reader)
+		if id := fromRadio.GetConfigCompleteId(); id != 0 {
+			if id != 77 {
+				t.Errorf("Expected config complete 77, got %d", id)
+			}
+			break
+		}
+		if fromRadio.GetNodeInfo() != nil {
+			nodes++
+		}
+		if fromRadio.GetChannel() != nil {
+			channels++
+		}
+	}
+	if nodes != 2 || channels != 1 {
+		t.Errorf("Expected 2 nodes and 1 channel, got %d and %d", nodes, channels)
+	}
+
+	radio.handleFromRadio(textPacket(10, 2, broadcastNum, 0, "hello", 0, false))
+	if packet := readFromRadio(t, conn, reader).GetPacket(); packet.GetId() != 10 {
+		t.Errorf("Expected packet 10, got %v", packet)
+	}
+
+	sent := len(transport.written())
+	packet, _ := frameMessage(&pb.ToRadio{PayloadVariant: &pb.ToRadio_Packet{Packet: &pb.MeshPacket{
+		Id:             20,
+		To:             broadcastNum,
+		PayloadVariant: &pb.MeshPacket_Decoded{Decoded: &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_APP, Payload: []byte("hi")}},
+	}}})
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(transport.written()) == sent && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bytes.Contains(transport.written()[sent:], []byte("hi")) {
+		t.Errorf("Expected the client packet to be sent to the radio")
+	}
+
+	// Config from a handshake isn't passed on, everything else the radio reads is
+	radio.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_Channel{Channel: &pb.Channel{Index: 1}}})
+	radio.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_QueueStatus{QueueStatus: &pb.QueueStatus{Free: 3, MeshPacketId: 20}}})
+	radio.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_XmodemPacket{XmodemPacket: &pb.XModem{Control: pb.XModem_ACK}}})
+	radio.handleFromRadio(&pb.FromRadio{PayloadVariant: &pb.FromRadio_LogRecord{LogRecord: &pb.LogRecord{Message: "booted"}}})
+
+	if status := readFromRadio(t, conn, reader).GetQueueStatus(); status.GetMeshPacketId() != 20 {
+		t.Errorf("Expected the queue status for packet 20, got %v", status)
+	}
+	if xmodem := readFromRadio(t, conn, reader).GetXmodemPacket(); xmodem.GetControl() != pb.XModem_ACK {
+		t.Errorf("Expected an XModem ACK, got %v", xmodem)
+	}
+	if record := readFromRadio(t, conn, reader).GetLogRecord(); record.GetMessage() != "booted" {
+		t.Errorf("Expected the device log record, got %v", record)
+	}
+}
+
+func TestServerSendsInOrder(t *testing.T) {
+
+	stream := testFrame(t, &pb.FromRadio{PayloadVariant: &pb.FromRadio_MyInfo{MyInfo: &pb.MyNodeInfo{MyNodeNum: 1}}})
+	transport := newFakeDevice(stream, nil)
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: transport}}
+	server := NewServer(radio, ServerOptions{})
+	defer server.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	go server.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	// Every packet goes out in one write so the server reads them as fast as it can
+	var frames []byte
+	for id := uint32(1); id <= 20; id++ {
+		frame, _ := frameMessage(&pb.ToRadio{PayloadVariant: &pb.ToRadio_Packet{Packet: &pb.MeshPacket{
+			Id:             id,
+			To:             broadcastNum,
+			PayloadVariant: &pb.MeshPacket_Decoded{Decoded: &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_APP, Payload: []byte{byte(id)}}},
+		}}})
+		frames = append(frames, frame...)
+	}
+	if _, err := conn.Write(frames); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	for i, packet := range waitSent(t, transport, 20) {
+		if packet.Id != uint32(i+1) {
+			t.Fatalf("Expected packet %d to be sent in position %d, got %d", i+1, i, packet.Id)
+		}
+	}
+}
+
+func TestServerDropsFloodingClient(t *testing.T) {
+
+	stream := testFrame(t, &pb.FromRadio{PayloadVariant: &pb.FromRadio_MyInfo{MyInfo: &pb.MyNodeInfo{MyNodeNum: 1}}})
+	transport := newFakeDevice(stream, nil)
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: transport}}
+
+	// The radio never has room, so the first packet waits and the rest fill the queue
+	radio.outbound().handleQueueStatus(&pb.QueueStatus{Free: 0, Maxlen: 16})
+
+	errs := make(chan error, 10)
+	server := NewServer(radio, ServerOptions{Buffer: 2, OnError: func(err error) { errs <- err }})
+	defer server.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	go server.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	var frames []byte
+	for id := uint32(1); id <= 10; id++ {
+		frame, _ := frameMessage(&pb.ToRadio{PayloadVariant: &pb.ToRadio_Packet{Packet: &pb.MeshPacket{Id: id, To: broadcastNum}}})
+		frames = append(frames, frame...)
+	}
+	conn.Write(frames)
+
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "too fast") {
+			t.Errorf("Expected the client to be disconnected for sending too fast, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a client that fills its send queue to be disconnected")
+	}
+}
@@ -0,0 +1,704 @@
+package gomesh
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// Stream packet kinds
+const (
+	streamOpen byte = iota + 1
+	streamOpenAck
+	streamData
+	streamAck
+	streamClose
+	streamProbe
+)
+
+// streamHeaderLen is the size of the magic, kind, stream id and sequence number header on every stream packet
+const streamHeaderLen = 8
+
+// streamMagic starts every stream packet so other traffic on the same port, such as fragments, is ignored
+const streamMagic = byte(0xc5)
+
+// streamChunkLen is the most data carried by a single stream packet
+const streamChunkLen = int(pb.Constants_DATA_PAYLOAD_LEN) - streamHeaderLen
+
+// streamReadBuffer is how much received data a stream holds before the sender has to wait
+const streamReadBuffer = 16 * 1024
+
+const (
+	defaultStreamWindow  = 4
+	defaultStreamTimeout = 20 * time.Second
+	defaultStreamRetries = 5
+)
+
+// ErrStreamClosed is returned when using a stream after it was closed
+var ErrStreamClosed = errors.New("stream closed")
+
+// ErrStreamTimeout is returned when the other end of a stream stops acknowledging data
+var ErrStreamTimeout = errors.New("stream peer stopped responding")
+
+// StreamOptions configures a stream between two goMesh endpoints. Both ends must use the same port
+type StreamOptions struct {
+	// Port carries the stream, PRIVATE_APP when not set. SERIAL_APP can be used as well
+	Port pb.PortNum
+	// Channel is the index of the channel to send on
+	Channel uint32
+	// Window is how many packets may be waiting for an acknowledgement, 4 when not set
+	Window int
+	// RetransmitTimeout is how long to wait for an acknowledgement before resending, 20 seconds when not set
+	RetransmitTimeout time.Duration
+	// MaxRetries is how many times unacknowledged data is resent before the stream fails, 5 when not set
+	MaxRetries int
+}
+
+func (o StreamOptions) withDefaults() StreamOptions {
+	if o.Port == pb.PortNum_UNKNOWN_APP {
+		o.Port = pb.PortNum_PRIVATE_APP
+	}
+	if o.Window <= 0 {
+		o.Window = defaultStreamWindow
+	}
+	if o.RetransmitTimeout <= 0 {
+		o.RetransmitTimeout = defaultStreamTimeout
+	}
+	if o.MaxRetries <= 0 {
+		o.MaxRetries = defaultStreamRetries
+	}
+	return o
+}
+
+// MeshAddr is the address of one end of a stream
+type MeshAddr struct {
+	Node   uint32
+	Stream uint16
+}
+
+// Network returns the name of the network
+func (a MeshAddr) Network() string {
+	return "meshtastic"
+}
+
+func (a MeshAddr) String() string {
+	return fmt.Sprintf("!%08x/%d", a.Node, a.Stream)
+}
+
+// streamChunk is sent data waiting for an acknowledgement
+type streamChunk struct {
+	seq    uint32
+	data   []byte
+	sentAt time.Time
+}
+
+// MeshStream is a reliable ordered byte stream to another node. It implements net.Conn. Data is split into
+// packets that fit the payload limit, acknowledged by the other end and resent when lost. Packets are received
+// while the radio is read, for example with Listen
+type MeshStream struct {
+	radio    *Radio
+	opts     StreamOptions
+	peer     uint32
+	id       uint16
+	transmit func(payload []byte) error
+	remove   func()
+	onClose  func()
+	done     chan struct{}
+	stopped  sync.Once
+
+	mu      sync.Mutex
+	changed chan struct{}
+	opened  bool
+	closed  bool
+	err     error
+
+	// Sending
+	nextSeq    uint32
+	unacked    []streamChunk
+	peerWindow int
+	retries    int
+	lastProbe  time.Time
+
+	// Receiving
+	expected   uint32
+	readBuf    []byte
+	pending    map[uint32][]byte
+	advertised int
+	closeSeq   uint32
+	closing    bool
+	eof        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// encodeStreamPacket builds the payload of a stream packet
+func encodeStreamPacket(kind byte, id uint16, seq uint32, data []byte) []byte {
+	out := make([]byte, streamHeaderLen, streamHeaderLen+len(data))
+	out[0] = streamMagic
+	out[1] = kind
+	binary.BigEndian.PutUint16(out[2:], id)
+	binary.BigEndian.PutUint32(out[4:], seq)
+	return append(out, data...)
+}
+
+// decodeStreamPacket splits the payload of a stream packet into its header fields and data
+func decodeStreamPacket(payload []byte) (kind byte, id uint16, seq uint32, data []byte, ok bool) {
+	if len(payload) < streamHeaderLen || payload[0] != streamMagic || payload[1] < streamOpen || payload[1] > streamProbe {
+		return 0, 0, 0, nil, false
+	}
+	return payload[1], binary.BigEndian.Uint16(payload[2:]), binary.BigEndian.Uint32(payload[4:]), payload[streamHeaderLen:], true
+}
+
+// newStream creates a stream to a peer and starts receiving its packets
+func newStream(r *Radio, opts StreamOptions, peer uint32, id uint16) *MeshStream {
+
+	s := &MeshStream{
+		radio:      r,
+		opts:       opts,
+		peer:       peer,
+		id:         id,
+		done:       make(chan struct{}),
+		changed:    make(chan struct{}),
+		pending:    make(map[uint32][]byte),
+		peerWindow: opts.Window,
+		advertised: streamWindow(streamReadBuffer),
+	}
+
+	if r != nil {
+		s.transmit = func(payload []byte) error {
+			ctx, cancel := context.WithTimeout(context.Background(), opts.RetransmitTimeout)
+			defer cancel()
+
+			_, err := r.SendData(ctx, DataRequest{To: peer, Channel: opts.Channel, Port: opts.Port, Payload: payload})
+			return err
+		}
+		s.remove = r.HandlePort(opts.Port, func(packet *pb.MeshPacket, data *pb.Data) {
+			if packet.From == peer {
+				s.receive(data.Payload)
+			}
+		})
+	}
+
+	go s.retransmitLoop()
+
+	return s
+}
+
+// streamWindow converts free buffer space to the number of packets the sender may have in flight
+func streamWindow(free int) int {
+	window := free / streamChunkLen
+	if window > 255 {
+		window = 255
+	}
+	return window
+}
+
+// DialStream opens a stream to a node that is listening with ListenStream
+func (r *Radio) DialStream(ctx context.Context, node uint32, opts StreamOptions) (*MeshStream, error) {
+
+	opts = opts.withDefaults()
+	s := newStream(r, opts, node, uint16(newPacketID()))
+
+	if err := s.open(ctx); err != nil {
+		s.shutdown()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// open sends open requests until the peer accepts the stream
+func (s *MeshStream) open(ctx context.Context) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 0; attempt <= s.opts.MaxRetries; attempt++ {
+		go s.send(streamOpen, 0, nil)
+
+		deadline := time.Now().Add(s.opts.RetransmitTimeout)
+		for !s.opened {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := s.waitLocked(deadline, ctx.Done()); err != nil {
+				break
+			}
+		}
+
+		if s.opened {
+			return nil
+		}
+	}
+
+	return ErrStreamTimeout
+}
+
+// send sends a stream packet to the peer
+func (s *MeshStream) send(kind byte, seq uint32, data []byte) error {
+	return s.transmit(encodeStreamPacket(kind, s.id, seq, data))
+}
+
+// notifyLocked wakes everything waiting for a change of the stream. The lock must be held
+func (s *MeshStream) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// waitLocked waits for a change of the stream, the deadline or cancel. The lock must be held and is held again
+// when it returns
+func (s *MeshStream) waitLocked(deadline time.Time, cancel <-chan struct{}) error {
+
+	changed := s.changed
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	s.mu.Unlock()
+	defer s.mu.Lock()
+
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-cancel:
+		return context.Canceled
+	}
+}
+
+// receive handles a stream packet from the peer
+func (s *MeshStream) receive(payload []byte) {
+
+	kind, id, seq, data, ok := decodeStreamPacket(payload)
+	if !ok || id != s.id {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch kind {
+	case streamOpen:
+		// Our accept was lost, send it again
+		go s.send(streamOpenAck, 0, []byte{byte(s.advertised)})
+	case streamOpenAck:
+		s.opened = true
+		if len(data) > 0 {
+			s.peerWindow = int(data[0])
+		}
+	case streamData:
+		buffered := len(s.readBuf)
+		for _, chunk := range s.pending {
+			buffered += len(chunk)
+		}
+
+		if seq-s.expected < 256 && buffered+len(data) <= streamReadBuffer {
+			if _, ok := s.pending[seq]; !ok {
+				s.pending[seq] = append([]byte(nil), data...)
+			}
+		}
+
+		for {
+			chunk, ok := s.pending[s.expected]
+			if !ok {
+				break
+			}
+			s.readBuf = append(s.readBuf, chunk...)
+			delete(s.pending, s.expected)
+			s.expected++
+		}
+		s.checkEOFLocked()
+		s.sendAckLocked()
+	case streamAck:
+		s.handleAckLocked(seq, data)
+	case streamProbe:
+		s.sendAckLocked()
+	case streamClose:
+		s.closing = true
+		s.closeSeq = seq
+		s.checkEOFLocked()
+		s.sendAckLocked()
+	}
+
+	s.notifyLocked()
+}
+
+// handleAckLocked drops acknowledged data and records the window of the peer. The lock must be held
+func (s *MeshStream) handleAckLocked(next uint32, data []byte) {
+
+	// Ignore acknowledgements older than the oldest unacknowledged data
+	if len(s.unacked) > 0 && next-s.unacked[0].seq > s.nextSeq-s.unacked[0].seq {
+		return
+	}
+
+	acked := 0
+	for acked < len(s.unacked) && s.unacked[acked].seq-next > 1<<31 {
+		acked++
+	}
+	if acked > 0 {
+		s.unacked = s.unacked[acked:]
+		s.retries = 0
+	}
+
+	if len(data) > 0 {
+		s.peerWindow = int(data[0])
+	}
+}
+
+// checkEOFLocked marks the end of the stream once all data before the close has arrived. The lock must be held
+func (s *MeshStream) checkEOFLocked() {
+	if s.closing && s.expected == s.closeSeq {
+		s.eof = true
+	}
+}
+
+// sendAckLocked acknowledges the data received so far with the free receive window. The lock must be held
+func (s *MeshStream) sendAckLocked() {
+	s.advertised = streamWindow(streamReadBuffer - len(s.readBuf))
+	go s.send(streamAck, s.expected, []byte{byte(s.advertised)})
+}
+
+// retransmitLoop resends data that wasn't acknowledged in time and probes a peer with a closed window
+func (s *MeshStream) retransmitLoop() {
+
+	interval := s.opts.RetransmitTimeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var resend []streamChunk
+		probe := false
+
+		s.mu.Lock()
+		switch {
+		case len(s.unacked) > 0 && now.Sub(s.unacked[0].sentAt) >= s.opts.RetransmitTimeout:
+			s.retries++
+			if s.retries > s.opts.MaxRetries {
+				s.failLocked(ErrStreamTimeout)
+				s.mu.Unlock()
+				return
+			}
+			for i := range s.unacked {
+				s.unacked[i].sentAt = now
+			}
+			resend = append(resend, s.unacked...)
+		case len(s.unacked) == 0 && s.peerWindow == 0 && now.Sub(s.lastProbe) >= s.opts.RetransmitTimeout:
+			s.lastProbe = now
+			probe = true
+		}
+		s.mu.Unlock()
+
+		for _, chunk := range resend {
+			s.send(streamData, chunk.seq, chunk.data)
+		}
+		if probe {
+			s.send(streamProbe, 0, nil)
+		}
+	}
+}
+
+// failLocked ends the stream with an error. The lock must be held
+func (s *MeshStream) failLocked(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+	s.notifyLocked()
+}
+
+// Read reads data received from the peer. It returns io.EOF once the peer closed the stream
+func (s *MeshStream) Read(p []byte) (int, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.readBuf) == 0 {
+		switch {
+		case s.eof:
+			return 0, io.EOF
+		case s.err != nil:
+			return 0, s.err
+		case s.closed:
+			return 0, ErrStreamClosed
+		}
+		if err := s.waitLocked(s.readDeadline, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.readBuf)
+	s.readBuf = s.readBuf[n:]
+
+	// Reopen the window of a sender that was told to wait
+	if s.advertised == 0 && streamWindow(streamReadBuffer-len(s.readBuf)) > 0 {
+		s.sendAckLocked()
+	}
+
+	return n, nil
+}
+
+// Write sends data to the peer. It blocks while the send window is full
+func (s *MeshStream) Write(p []byte) (int, error) {
+
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.err == nil && !s.closed && !s.eof && len(s.unacked) >= s.windowLocked() {
+			if err := s.waitLocked(s.writeDeadline, nil); err != nil {
+				s.mu.Unlock()
+				return written, err
+			}
+		}
+		switch {
+		case s.err != nil:
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		case s.closed || s.eof:
+			s.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := len(p)
+		if n > streamChunkLen {
+			n = streamChunkLen
+		}
+		chunk := streamChunk{seq: s.nextSeq, data: append([]byte(nil), p[:n]...), sentAt: time.Now()}
+		s.nextSeq++
+		s.unacked = append(s.unacked, chunk)
+		s.mu.Unlock()
+
+		// A failed send is treated as a lost packet and resent by the retransmit loop
+		s.send(streamData, chunk.seq, chunk.data)
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// windowLocked returns how many packets may be in flight. The lock must be held
+func (s *MeshStream) windowLocked() int {
+	if s.peerWindow < s.opts.Window {
+		return s.peerWindow
+	}
+	return s.opts.Window
+}
+
+// Close waits for sent data to be acknowledged, tells the peer the stream ended and stops receiving
+func (s *MeshStream) Close() error {
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	deadline := time.Now().Add(s.opts.RetransmitTimeout * time.Duration(s.opts.MaxRetries+1))
+	for len(s.unacked) > 0 && s.err == nil {
+		if err := s.waitLocked(deadline, nil); err != nil {
+			break
+		}
+	}
+
+	s.closed = true
+	seq := s.nextSeq
+	failed := s.err != nil
+	s.notifyLocked()
+	s.mu.Unlock()
+
+	if !failed {
+		s.send(streamClose, seq, nil)
+	}
+	s.shutdown()
+
+	return nil
+}
+
+// shutdown stops receiving packets and the retransmit loop
+func (s *MeshStream) shutdown() {
+	s.stopped.Do(func() {
+		if s.remove != nil {
+			s.remove()
+		}
+		if s.onClose != nil {
+			s.onClose()
+		}
+		close(s.done)
+	})
+}
+
+// LocalAddr returns the address of this end of the stream
+func (s *MeshStream) LocalAddr() net.Addr {
+	node := uint32(0)
+	if s.radio != nil {
+		node = s.radio.nodeNum
+	}
+	return MeshAddr{Node: node, Stream: s.id}
+}
+
+// RemoteAddr returns the address of the peer
+func (s *MeshStream) RemoteAddr() net.Addr {
+	return MeshAddr{Node: s.peer, Stream: s.id}
+}
+
+// SetDeadline sets the read and write deadlines
+func (s *MeshStream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	s.notifyLocked()
+	s.mu.Unlock()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read calls
+func (s *MeshStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.notifyLocked()
+	s.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls
+func (s *MeshStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.notifyLocked()
+	s.mu.Unlock()
+	return nil
+}
+
+// streamKey identifies an accepted stream
+type streamKey struct {
+	peer uint32
+	id   uint16
+}
+
+// StreamListener accepts streams opened by other nodes with DialStream. It implements net.Listener
+type StreamListener struct {
+	radio    *Radio
+	opts     StreamOptions
+	remove   func()
+	accepted chan *MeshStream
+	done     chan struct{}
+
+	mu      sync.Mutex
+	streams map[streamKey]*MeshStream
+	closed  bool
+}
+
+// ListenStream accepts streams from other nodes on the port in opts
+func (r *Radio) ListenStream(opts StreamOptions) *StreamListener {
+
+	l := &StreamListener{
+		radio:    r,
+		opts:     opts.withDefaults(),
+		accepted: make(chan *MeshStream, 16),
+		done:     make(chan struct{}),
+		streams:  make(map[streamKey]*MeshStream),
+	}
+
+	l.remove = r.HandlePort(l.opts.Port, func(packet *pb.MeshPacket, data *pb.Data) {
+		kind, id, _, _, ok := decodeStreamPacket(data.Payload)
+		if ok && kind == streamOpen {
+			l.handleOpen(streamKey{peer: packet.From, id: id})
+		}
+	})
+
+	return l
+}
+
+// handleOpen creates a stream for a new open request
+func (l *StreamListener) handleOpen(key streamKey) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.streams[key]; ok || l.closed {
+		// Known streams answer repeated open requests themselves
+		return
+	}
+
+	s := newStream(l.radio, l.opts, key.peer, key.id)
+	s.opened = true
+	s.onClose = func() {
+		l.mu.Lock()
+		delete(l.streams, key)
+		l.mu.Unlock()
+	}
+
+	select {
+	case l.accepted <- s:
+		l.streams[key] = s
+		go s.send(streamOpenAck, 0, []byte{byte(s.advertised)})
+	default:
+		// Nobody is accepting, the peer retries
+		s.onClose = nil
+		s.shutdown()
+	}
+}
+
+// Accept waits for the next stream
+func (l *StreamListener) Accept() (net.Conn, error) {
+	return l.AcceptStream(context.Background())
+}
+
+// AcceptStream waits for the next stream or for the context to be done
+func (l *StreamListener) AcceptStream(ctx context.Context) (*MeshStream, error) {
+	select {
+	case s := <-l.accepted:
+		return s, nil
+	case <-l.done:
+		return nil, ErrStreamClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops accepting streams. Streams already accepted stay open
+func (l *StreamListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.remove()
+	close(l.done)
+	return nil
+}
+
+// Addr returns the address of the listening radio
+func (l *StreamListener) Addr() net.Addr {
+	return MeshAddr{Node: l.radio.nodeNum}
+}
@@ -0,0 +1,168 @@
+package gomesh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// linkStreams connects two streams directly, dropping every packet for which drop returns true
+func linkStreams(a, b *MeshStream, drop func() bool) {
+	a.transmit = func(payload []byte) error {
+		if !drop() {
+			go b.receive(append([]byte(nil), payload...))
+		}
+		return nil
+	}
+	b.transmit = func(payload []byte) error {
+		if !drop() {
+			go a.receive(append([]byte(nil), payload...))
+		}
+		return nil
+	}
+}
+
+func testStreamPair(drop func() bool) (*MeshStream, *MeshStream) {
+	opts := StreamOptions{RetransmitTimeout: 50 * time.Millisecond, MaxRetries: 20}.withDefaults()
+	a := newStream(nil, opts, 2, 7)
+	b := newStream(nil, opts, 1, 7)
+	a.opened, b.opened = true, true
+	linkStreams(a, b, drop)
+	return a, b
+}
+
+func TestStreamPacketRoundTrip(t *testing.T) {
+	payload := encodeStreamPacket(streamData, 0x1234, 0xdeadbeef, []byte("hello"))
+	kind, id, seq, data, ok := decodeStreamPacket(payload)
+	if !ok || kind != streamData || id != 0x1234 || seq != 0xdeadbeef || string(data) != "hello" {
+		t.Fatalf("Unexpected decode %v %x %x %q %v", kind, id, seq, data, ok)
+	}
+	if len(payload) > streamChunkLen+streamHeaderLen {
+		t.Fatalf("Packet too large")
+	}
+	if _, _, _, _, ok := decodeStreamPacket([]byte{streamMagic, streamData, 1}); ok {
+		t.Fatalf("Short packet decoded")
+	}
+	if _, _, _, _, ok := decodeStreamPacket(append([]byte{0}, payload[1:]...)); ok {
+		t.Fatalf("Packet without the magic byte decoded")
+	}
+}
+
+func TestStreamTransfer(t *testing.T) {
+	var mu sync.Mutex
+	random := rand.New(rand.NewSource(1))
+	drop := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return random.Intn(5) == 0
+	}
+
+	a, b := testStreamPair(drop)
+	want := make([]byte, 5000)
+	random.Read(want)
+
+	errs := make(chan error, 1)
+	go func() {
+		if _, err := a.Write(want); err != nil {
+			errs <- err
+			return
+		}
+		errs <- a.Close()
+	}()
+
+	b.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatalf("Error reading stream: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Received %d bytes that differ from the %d sent", len(got), len(want))
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Error writing stream: %v", err)
+	}
+	b.Close()
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	a, b := testStreamPair(func() bool { return false })
+	defer a.Close()
+	defer b.Close()
+
+	b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := b.Read(make([]byte, 10)); err == nil {
+		t.Fatalf("Expected a deadline error")
+	}
+}
+
+func TestStreamsAndFragmentsShareDefaultPort(t *testing.T) {
+
+	link := newFakeDevice(nil, nil)
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: link}}
+
+	messages := make(chan LongMessage, 2)
+	radio.EnableFragmentation(FragmentOptions{
+		NakDelay:  10 * time.Millisecond,
+		OnMessage: func(message LongMessage) { messages <- message },
+	})
+	listener := radio.ListenStream(StreamOptions{})
+	defer listener.Close()
+
+	received := func(from uint32, payload []byte) *pb.FromRadio {
+		return &pb.FromRadio{PayloadVariant: &pb.FromRadio_Packet{Packet: &pb.MeshPacket{
+			From:           from,
+			To:             1,
+			PayloadVariant: &pb.MeshPacket_Decoded{Decoded: &pb.Data{Portnum: pb.PortNum_PRIVATE_APP, Payload: payload}},
+		}}}
+	}
+
+	payload := bytes.Repeat([]byte("x"), 300)
+	fragments, err := splitFragments(fragmentBinary, 9, payload)
+	if err != nil {
+		t.Fatalf("Error splitting message: %v", err)
+	}
+
+	radio.handleFromRadio(received(5, encodeStreamPacket(streamOpen, 3, 0, []byte{4})))
+	for _, fragment := range fragments {
+		radio.handleFromRadio(received(6, fragment))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream, err := listener.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("Error accepting stream: %v", err)
+	}
+	defer stream.Close()
+	if addr := stream.RemoteAddr().(MeshAddr); addr.Node != 5 || addr.Stream != 3 {
+		t.Errorf("Expected a stream from node 5, got %v", addr)
+	}
+
+	select {
+	case message := <-messages:
+		if message.From != 6 || !bytes.Equal(message.Payload, payload) {
+			t.Errorf("Reassembled message doesn't match: %+v", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the fragmented message to be reassembled")
+	}
+
+	// Give a stray NAK for the stream packet time to be sent
+	time.Sleep(30 * time.Millisecond)
+
+	for _, packet := range sentPackets(t, link.written()) {
+		data := packet.GetDecoded().GetPayload()
+		if _, _, _, _, ok := decodeStreamPacket(data); !ok {
+			t.Errorf("Expected only stream packets to be sent, got %x", data)
+		}
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected a single long message")
+	}
+}
@@ -12,10 +12,23 @@ type streamer struct {
 	serialPort io.ReadWriteCloser
 	netPort    net.Conn
 	isTCP      bool
+	// transport replaces the serial and TCP links when set, for example to replay a capture
+	transport io.ReadWriteCloser
+	// httpOptions configures the link when addr is the URL of a device HTTP API
+	httpOptions HTTPOptions
 }
 
 func (s *streamer) Init(addr string) error {
 
+	if isHTTPAddr(addr) {
+		transport, err := NewHTTPTransport(addr, s.httpOptions)
+		if err != nil {
+			return err
+		}
+		s.transport = transport
+		return nil
+	}
+
 	ip := net.ParseIP(addr)
 
 	if ip != nil {
@@ -56,6 +69,11 @@ func (s *streamer) Init(addr string) error {
 
 func (s *streamer) Write(p []byte) error {
 
+	if s.transport != nil {
+		_, err := s.transport.Write(p)
+		return err
+	}
+
 	if s.isTCP {
 		s.netPort.SetReadDeadline(time.Now().Add(1 * time.Second))
 		_, err := s.netPort.Write(p)
@@ -67,8 +85,6 @@ func (s *streamer) Write(p []byte) error {
 		if err != nil {
 			return err
 		}
-
-		time.Sleep(100 * time.Millisecond)
 	}
 
 	return nil
@@ -76,9 +92,18 @@ func (s *streamer) Write(p []byte) error {
 
 func (s *streamer) Read(p []byte) error {
 
+	if s.transport != nil {
+		_, err := s.transport.Read(p)
+		return err
+	}
+
 	if s.isTCP {
 		s.netPort.SetReadDeadline(time.Now().Add(2 * time.Second))
 		_, err := s.netPort.Read(p)
+		// A TCP stream only reports EOF when the device closed the connection
+		if err == io.EOF {
+			return errConnectionLost
+		}
 		if err != nil {
 			return err
 		}
@@ -94,9 +119,11 @@ func (s *streamer) Read(p []byte) error {
 }
 
 func (s *streamer) Close() {
-	if s.isTCP {
+	if s.transport != nil {
+		s.transport.Close()
+	} else if s.isTCP && s.netPort != nil {
 		s.netPort.Close()
-	} else {
+	} else if s.serialPort != nil {
 		s.serialPort.Close()
 	}
 }
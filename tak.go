@@ -0,0 +1,693 @@
+package gomesh
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultTAKStale is how long CoT events from the mesh stay valid when the bridge doesn't set it
+const defaultTAKStale = 10 * time.Minute
+
+// cotAllChatRooms is the chat room TAK clients use for messages to everyone
+const cotAllChatRooms = "All Chat Rooms"
+
+// cotTimeFormat is the timestamp format used in CoT events
+const cotTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// cotUnknown is the CoT value for an unknown error or height
+const cotUnknown = 9999999.0
+
+var takTeamNames = map[pb.Team]string{
+	pb.Team_White:      "White",
+	pb.Team_Yellow:     "Yellow",
+	pb.Team_Orange:     "Orange",
+	pb.Team_Magenta:    "Magenta",
+	pb.Team_Red:        "Red",
+	pb.Team_Maroon:     "Maroon",
+	pb.Team_Purple:     "Purple",
+	pb.Team_Dark_Blue:  "Dark Blue",
+	pb.Team_Blue:       "Blue",
+	pb.Team_Cyan:       "Cyan",
+	pb.Team_Teal:       "Teal",
+	pb.Team_Green:      "Green",
+	pb.Team_Dark_Green: "Dark Green",
+	pb.Team_Brown:      "Brown",
+}
+
+var takRoleNames = map[pb.MemberRole]string{
+	pb.MemberRole_TeamMember:      "Team Member",
+	pb.MemberRole_TeamLead:        "Team Lead",
+	pb.MemberRole_HQ:              "HQ",
+	pb.MemberRole_Sniper:          "Sniper",
+	pb.MemberRole_Medic:           "Medic",
+	pb.MemberRole_ForwardObserver: "Forward Observer",
+	pb.MemberRole_RTO:             "RTO",
+	pb.MemberRole_K9:              "K9",
+}
+
+// cotEvent is a Cursor on Target event as exchanged with TAK clients
+type cotEvent struct {
+	XMLName xml.Name  `xml:"event"`
+	Version string    `xml:"version,attr"`
+	UID     string    `xml:"uid,attr"`
+	Type    string    `xml:"type,attr"`
+	How     string    `xml:"how,attr"`
+	Time    string    `xml:"time,attr"`
+	Start   string    `xml:"start,attr"`
+	Stale   string    `xml:"stale,attr"`
+	Point   cotPoint  `xml:"point"`
+	Detail  cotDetail `xml:"detail"`
+}
+
+type cotPoint struct {
+	Lat float64 `xml:"lat,attr"`
+	Lon float64 `xml:"lon,attr"`
+	Hae float64 `xml:"hae,attr"`
+	Ce  float64 `xml:"ce,attr"`
+	Le  float64 `xml:"le,attr"`
+}
+
+type cotDetail struct {
+	Contact *cotContact `xml:"contact"`
+	Group   *cotGroup   `xml:"__group"`
+	Status  *cotStatus  `xml:"status"`
+	Track   *cotTrack   `xml:"track"`
+	Chat    *cotChat    `xml:"__chat"`
+	Link    *cotLink    `xml:"link"`
+	Remarks *cotRemarks `xml:"remarks"`
+}
+
+type cotContact struct {
+	Callsign string `xml:"callsign,attr"`
+	Endpoint string `xml:"endpoint,attr,omitempty"`
+}
+
+type cotGroup struct {
+	Name string `xml:"name,attr"`
+	Role string `xml:"role,attr"`
+}
+
+type cotStatus struct {
+	Battery uint32 `xml:"battery,attr"`
+}
+
+type cotTrack struct {
+	Course float64 `xml:"course,attr"`
+	Speed  float64 `xml:"speed,attr"`
+}
+
+type cotChat struct {
+	Parent         string       `xml:"parent,attr,omitempty"`
+	GroupOwner     string       `xml:"groupOwner,attr,omitempty"`
+	Chatroom       string       `xml:"chatroom,attr"`
+	ID             string       `xml:"id,attr"`
+	SenderCallsign string       `xml:"senderCallsign,attr"`
+	ChatGroup      cotChatGroup `xml:"chatgrp"`
+}
+
+type cotChatGroup struct {
+	UID0 string `xml:"uid0,attr"`
+	UID1 string `xml:"uid1,attr"`
+	ID   string `xml:"id,attr"`
+}
+
+type cotLink struct {
+	UID      string `xml:"uid,attr"`
+	Type     string `xml:"type,attr"`
+	Relation string `xml:"relation,attr"`
+}
+
+type cotRemarks struct {
+	Source string `xml:"source,attr,omitempty"`
+	To     string `xml:"to,attr,omitempty"`
+	Time   string `xml:"time,attr,omitempty"`
+	Text   string `xml:",chardata"`
+}
+
+// DecodeTAKPacket decodes the payload of an ATAK plugin packet. Packets using the compressed format have
+// their callsigns and chat text decompressed
+func DecodeTAKPacket(payload []byte) (*pb.TAKPacket, error) {
+
+	packet := pb.TAKPacket{}
+	if err := proto.Unmarshal(payload, &packet); err == nil && !packet.IsCompressed {
+		return &packet, nil
+	}
+
+	// Compressed strings usually aren't valid UTF-8, so they are decompressed on the wire format
+	decompressed, err := rewriteTAKStrings(payload, false, unishoxDecompress)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing tak packet: %w", err)
+	}
+
+	packet = pb.TAKPacket{}
+	if err := proto.Unmarshal(decompressed, &packet); err != nil {
+		return nil, err
+	}
+
+	return &packet, nil
+}
+
+// EncodeTAKPacket encodes a TAKPacket as the payload of an ATAK plugin packet. When compress is set the
+// callsigns and chat text are sent in the compressed format used by the firmware between nodes
+func EncodeTAKPacket(packet *pb.TAKPacket, compress bool) ([]byte, error) {
+
+	plain := proto.Clone(packet).(*pb.TAKPacket)
+	plain.IsCompressed = false
+
+	out, err := proto.Marshal(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	if !compress {
+		return out, nil
+	}
+
+	return rewriteTAKStrings(out, true, func(in []byte) ([]byte, error) {
+		return unishoxCompress(in), nil
+	})
+}
+
+// rewriteTAKStrings applies transform to the strings of the contact and chat of an encoded TAKPacket and
+// sets its is_compressed field
+func rewriteTAKStrings(payload []byte, compressed bool, transform func([]byte) ([]byte, error)) ([]byte, error) {
+
+	out := make([]byte, 0, len(payload))
+	if compressed {
+		out = protowire.AppendTag(out, 1, protowire.VarintType)
+		out = protowire.AppendVarint(out, 1)
+	}
+
+	for len(payload) > 0 {
+		num, typ, tagLen := protowire.ConsumeTag(payload)
+		if tagLen < 0 {
+			return nil, protowire.ParseError(tagLen)
+		}
+		valueLen := protowire.ConsumeFieldValue(num, typ, payload[tagLen:])
+		if valueLen < 0 {
+			return nil, protowire.ParseError(valueLen)
+		}
+
+		field := payload[:tagLen+valueLen]
+		payload = payload[tagLen+valueLen:]
+
+		switch {
+		case num == 1:
+			// is_compressed is set above
+		case (num == 2 || num == 6) && typ == protowire.BytesType:
+			// Contact and GeoChat only hold strings
+			inner, _ := protowire.ConsumeBytes(field[tagLen:])
+			rewritten, err := rewriteStrings(inner, transform)
+			if err != nil {
+				return nil, err
+			}
+			out = protowire.AppendTag(out, num, protowire.BytesType)
+			out = protowire.AppendBytes(out, rewritten)
+		default:
+			out = append(out, field...)
+		}
+	}
+
+	return out, nil
+}
+
+// rewriteStrings applies transform to every length delimited field of an encoded message
+func rewriteStrings(message []byte, transform func([]byte) ([]byte, error)) ([]byte, error) {
+
+	out := make([]byte, 0, len(message))
+	for len(message) > 0 {
+		num, typ, tagLen := protowire.ConsumeTag(message)
+		if tagLen < 0 {
+			return nil, protowire.ParseError(tagLen)
+		}
+		valueLen := protowire.ConsumeFieldValue(num, typ, message[tagLen:])
+		if valueLen < 0 {
+			return nil, protowire.ParseError(valueLen)
+		}
+
+		field := message[:tagLen+valueLen]
+		message = message[tagLen+valueLen:]
+
+		if typ != protowire.BytesType {
+			out = append(out, field...)
+			continue
+		}
+
+		value, _ := protowire.ConsumeBytes(field[tagLen:])
+		transformed, err := transform(value)
+		if err != nil {
+			return nil, err
+		}
+		out = protowire.AppendTag(out, num, protowire.BytesType)
+		out = protowire.AppendBytes(out, transformed)
+	}
+
+	return out, nil
+}
+
+// TAKPacketToCoT converts a TAKPacket from the mesh to a Cursor on Target event. Positions become friendly
+// ground unit events and chat becomes GeoChat events. from is the node that sent the packet and is used
+// as the uid when the packet has no device callsign
+func TAKPacketToCoT(packet *pb.TAKPacket, from uint32, now time.Time, stale time.Duration) ([]byte, error) {
+
+	if stale <= 0 {
+		stale = defaultTAKStale
+	}
+
+	uid := packet.GetContact().GetDeviceCallsign()
+	if uid == "" {
+		uid = fmt.Sprintf("!%08x", from)
+	}
+	callsign := packet.GetContact().GetCallsign()
+	if callsign == "" {
+		callsign = uid
+	}
+
+	now = now.UTC()
+	event := cotEvent{
+		Version: "2.0",
+		Time:    now.Format(cotTimeFormat),
+		Start:   now.Format(cotTimeFormat),
+		Stale:   now.Add(stale).Format(cotTimeFormat),
+		Point:   cotPoint{Hae: cotUnknown, Ce: cotUnknown, Le: cotUnknown},
+	}
+
+	switch payload := packet.PayloadVariant.(type) {
+	case *pb.TAKPacket_Pli:
+		pli := payload.Pli
+		event.UID = uid
+		event.Type = "a-f-G-U-C"
+		event.How = "m-g"
+		event.Point.Lat = float64(pli.LatitudeI) * 1e-7
+		event.Point.Lon = float64(pli.LongitudeI) * 1e-7
+		event.Point.Hae = float64(pli.Altitude)
+		event.Detail.Contact = &cotContact{Callsign: callsign}
+		event.Detail.Track = &cotTrack{Course: float64(pli.Course), Speed: float64(pli.Speed)}
+		if group := packet.GetGroup(); group != nil {
+			event.Detail.Group = &cotGroup{Name: takTeamNames[group.Team], Role: takRoleNames[group.Role]}
+		}
+		if status := packet.GetStatus(); status != nil {
+			event.Detail.Status = &cotStatus{Battery: status.Battery}
+		}
+	case *pb.TAKPacket_Chat:
+		chat := payload.Chat
+		room, roomUID := cotAllChatRooms, cotAllChatRooms
+		if chat.To != nil && *chat.To != "" && *chat.To != cotAllChatRooms {
+			room, roomUID = *chat.To, *chat.To
+		}
+
+		event.UID = fmt.Sprintf("GeoChat.%s.%s.%d", uid, room, newPacketID())
+		event.Type = "b-t-f"
+		event.How = "h-g-i-g-o"
+		event.Detail.Chat = &cotChat{
+			Parent:         "RootContactGroup",
+			GroupOwner:     "false",
+			Chatroom:       room,
+			ID:             roomUID,
+			SenderCallsign: callsign,
+			ChatGroup:      cotChatGroup{UID0: uid, UID1: roomUID, ID: roomUID},
+		}
+		event.Detail.Link = &cotLink{UID: uid, Type: "a-f-G-U-C", Relation: "p-p"}
+		event.Detail.Remarks = &cotRemarks{
+			Source: "BAO.F.ATAK." + uid,
+			To:     roomUID,
+			Time:   now.Format(cotTimeFormat),
+			Text:   chat.Message,
+		}
+	default:
+		return nil, errors.New("tak packet has no position or chat")
+	}
+
+	out, err := xml.Marshal(&event)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), out...), nil
+}
+
+// CoTToTAKPacket converts a Cursor on Target event from a TAK client to a TAKPacket. Unit positions and
+// GeoChat messages are supported
+func CoTToTAKPacket(data []byte) (*pb.TAKPacket, error) {
+
+	event := cotEvent{}
+	if err := xml.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+
+	return event.takPacket()
+}
+
+// takPacket converts a decoded CoT event to a TAKPacket
+func (event *cotEvent) takPacket() (*pb.TAKPacket, error) {
+
+	packet := pb.TAKPacket{}
+	detail := event.Detail
+
+	switch {
+	case strings.HasPrefix(event.Type, "b-t-f"):
+		if detail.Remarks == nil {
+			return nil, errors.New("chat event has no message")
+		}
+
+		uid := event.UID
+		callsign := ""
+		chat := pb.GeoChat{Message: detail.Remarks.Text}
+		if detail.Chat != nil {
+			callsign = detail.Chat.SenderCallsign
+			if detail.Chat.ChatGroup.UID0 != "" {
+				uid = detail.Chat.ChatGroup.UID0
+			}
+			if detail.Chat.Chatroom != "" && detail.Chat.Chatroom != cotAllChatRooms {
+				to := detail.Chat.ChatGroup.UID1
+				if to == "" {
+					to = detail.Chat.Chatroom
+				}
+				chat.To = &to
+			}
+		}
+		if detail.Link != nil && detail.Link.UID != "" && (detail.Chat == nil || detail.Chat.ChatGroup.UID0 == "") {
+			uid = detail.Link.UID
+		}
+
+		packet.Contact = &pb.Contact{Callsign: callsign, DeviceCallsign: uid}
+		packet.PayloadVariant = &pb.TAKPacket_Chat{Chat: &chat}
+	case strings.HasPrefix(event.Type, "a-"):
+		pli := pb.PLI{
+			LatitudeI:  int32(math.Round(event.Point.Lat * 1e7)),
+			LongitudeI: int32(math.Round(event.Point.Lon * 1e7)),
+		}
+		if event.Point.Hae != cotUnknown {
+			pli.Altitude = int32(math.Round(event.Point.Hae))
+		}
+		if detail.Track != nil {
+			pli.Course = uint32(math.Round(detail.Track.Course))
+			pli.Speed = uint32(math.Round(detail.Track.Speed))
+		}
+
+		packet.Contact = &pb.Contact{DeviceCallsign: event.UID}
+		if detail.Contact != nil {
+			packet.Contact.Callsign = detail.Contact.Callsign
+		}
+		if detail.Group != nil {
+			packet.Group = &pb.Group{}
+			for team, name := range takTeamNames {
+				if strings.EqualFold(name, detail.Group.Name) {
+					packet.Group.Team = team
+				}
+			}
+			for role, name := range takRoleNames {
+				if strings.EqualFold(name, detail.Group.Role) {
+					packet.Group.Role = role
+				}
+			}
+		}
+		if detail.Status != nil {
+			packet.Status = &pb.Status{Battery: detail.Status.Battery}
+		}
+		packet.PayloadVariant = &pb.TAKPacket_Pli{Pli: &pli}
+	default:
+		return nil, fmt.Errorf("unsupported cot event type %s", event.Type)
+	}
+
+	return &packet, nil
+}
+
+// TAKBridgeOptions configures a bridge between the mesh and TAK clients
+type TAKBridgeOptions struct {
+	// TCPAddr is the address TAK clients connect to for a CoT stream, for example ":8087". Empty disables it
+	TCPAddr string
+	// UDPAddr is where CoT events from the mesh are sent over UDP, for example the SA multicast group
+	// 239.2.3.1:6969. Empty disables it
+	UDPAddr string
+	// UDPListenAddr receives CoT events from TAK clients over UDP, a multicast group is joined. Empty disables it
+	UDPListenAddr string
+	// Channel is the index of the channel packets from TAK clients are sent on
+	Channel uint32
+	// Compress sends callsigns and chat text compressed. The firmware compresses packets from the client
+	// itself, so this is only needed when the device doesn't
+	Compress bool
+	// Stale is how long CoT events from the mesh stay valid, 0 uses ten minutes
+	Stale time.Duration
+	// OnError is called with errors handling single events, which don't stop the bridge
+	OnError func(error)
+}
+
+// TAKBridge relays ATAK plugin packets between the mesh and TAK clients as Cursor on Target events.
+// Packets from the mesh are delivered while the radio is read, for example with Listen
+type TAKBridge struct {
+	radio  *Radio
+	opts   TAKBridgeOptions
+	events chan []byte
+
+	mu      sync.Mutex
+	clients map[net.Conn]struct{}
+	udpOut  net.Conn
+}
+
+// NewTAKBridge returns a bridge between the radio and TAK clients. It starts relaying when Run is called
+func (r *Radio) NewTAKBridge(opts TAKBridgeOptions) *TAKBridge {
+	return &TAKBridge{
+		radio:   r,
+		opts:    opts,
+		events:  make(chan []byte, 64),
+		clients: make(map[net.Conn]struct{}),
+	}
+}
+
+// Run relays events until the context is done or a listener fails
+func (b *TAKBridge) Run(ctx context.Context) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+		b.mu.Lock()
+		for client := range b.clients {
+			client.Close()
+		}
+		b.mu.Unlock()
+	}()
+
+	failed := make(chan error, 2)
+
+	if b.opts.UDPAddr != "" {
+		conn, err := net.Dial("udp", b.opts.UDPAddr)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, conn)
+		b.mu.Lock()
+		b.udpOut = conn
+		b.mu.Unlock()
+	}
+
+	if b.opts.TCPAddr != "" {
+		listener, err := net.Listen("tcp", b.opts.TCPAddr)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, listener)
+		go b.accept(ctx, listener, failed)
+	}
+
+	if b.opts.UDPListenAddr != "" {
+		conn, err := listenTAKUDP(b.opts.UDPListenAddr)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, conn)
+		go b.readUDP(ctx, conn, failed)
+	}
+
+	remove := b.radio.HandlePort(pb.PortNum_ATAK_PLUGIN, b.handlePacket)
+	defer remove()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-failed:
+			return err
+		case event := <-b.events:
+			b.publish(event)
+		}
+	}
+}
+
+// listenTAKUDP listens for CoT datagrams, joining the group when the address is a multicast group
+func listenTAKUDP(address string) (*net.UDPConn, error) {
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp", nil, addr)
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+// handlePacket converts a packet from the mesh and queues it for the TAK clients
+func (b *TAKBridge) handlePacket(packet *pb.MeshPacket, data *pb.Data) {
+
+	takPacket, err := DecodeTAKPacket(data.Payload)
+	if err != nil {
+		b.reportError(err)
+		return
+	}
+
+	event, err := TAKPacketToCoT(takPacket, packet.From, time.Now(), b.opts.Stale)
+	if err != nil {
+		b.reportError(err)
+		return
+	}
+
+	select {
+	case b.events <- event:
+	default:
+		b.reportError(errors.New("tak event dropped, clients are too slow"))
+	}
+}
+
+// publish writes an event to every connected client and the UDP destination
+func (b *TAKBridge) publish(event []byte) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for client := range b.clients {
+		client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write(event); err != nil {
+			client.Close()
+			delete(b.clients, client)
+		}
+	}
+
+	if b.udpOut != nil {
+		if _, err := b.udpOut.Write(event); err != nil {
+			b.reportError(err)
+		}
+	}
+}
+
+// accept adds TAK clients connecting over TCP
+func (b *TAKBridge) accept(ctx context.Context, listener net.Listener, failed chan<- error) {
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				failed <- err
+			}
+			return
+		}
+
+		b.mu.Lock()
+		b.clients[conn] = struct{}{}
+		b.mu.Unlock()
+
+		go b.readClient(ctx, conn)
+	}
+}
+
+// readClient relays the events a TCP client sends until it disconnects
+func (b *TAKBridge) readClient(ctx context.Context, conn net.Conn) {
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, conn)
+		b.mu.Unlock()
+		conn.Close()
+	}()
+
+	decoder := xml.NewDecoder(conn)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "event" {
+			continue
+		}
+
+		event := cotEvent{}
+		if err := decoder.DecodeElement(&event, &start); err != nil {
+			b.reportError(err)
+			return
+		}
+		b.sendEvent(ctx, &event)
+	}
+}
+
+// readUDP relays events received as UDP datagrams
+func (b *TAKBridge) readUDP(ctx context.Context, conn *net.UDPConn, failed chan<- error) {
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				failed <- err
+			}
+			return
+		}
+
+		event := cotEvent{}
+		if err := xml.Unmarshal(buf[:n], &event); err != nil {
+			b.reportError(err)
+			continue
+		}
+		b.sendEvent(ctx, &event)
+	}
+}
+
+// sendEvent converts an event from a TAK client and sends it to the mesh
+func (b *TAKBridge) sendEvent(ctx context.Context, event *cotEvent) {
+
+	packet, err := event.takPacket()
+	if err != nil {
+		b.reportError(err)
+		return
+	}
+
+	payload, err := EncodeTAKPacket(packet, b.opts.Compress)
+	if err != nil {
+		b.reportError(err)
+		return
+	}
+
+	_, err = b.radio.SendData(ctx, DataRequest{
+		Channel: b.opts.Channel,
+		Port:    pb.PortNum_ATAK_PLUGIN,
+		Payload: payload,
+	})
+	if err != nil {
+		b.reportError(err)
+	}
+}
+
+func (b *TAKBridge) reportError(err error) {
+	if b.opts.OnError != nil {
+		b.opts.OnError(err)
+	}
+}
@@ -0,0 +1,101 @@
+package gomesh
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+func TestTAKPositionCoT(t *testing.T) {
+
+	packet := &pb.TAKPacket{
+		Contact: &pb.Contact{Callsign: "ALPHA-1", DeviceCallsign: "ANDROID-1234"},
+		Group:   &pb.Group{Role: pb.MemberRole_TeamLead, Team: pb.Team_Dark_Blue},
+		Status:  &pb.Status{Battery: 80},
+		PayloadVariant: &pb.TAKPacket_Pli{Pli: &pb.PLI{
+			LatitudeI:  377749000,
+			LongitudeI: -1224194000,
+			Altitude:   15,
+			Speed:      3,
+			Course:     270,
+		}},
+	}
+
+	event, err := TAKPacketToCoT(packet, 0x1234, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), time.Minute)
+	if err != nil {
+		t.Fatalf("Error converting to cot: %v", err)
+	}
+
+	for _, want := range []string{`uid="ANDROID-1234"`, `type="a-f-G-U-C"`, `callsign="ALPHA-1"`, `name="Dark Blue"`, `role="Team Lead"`, `stale="2024-01-02T03:05:05.000Z"`} {
+		if !strings.Contains(string(event), want) {
+			t.Fatalf("Event is missing %s: %s", want, event)
+		}
+	}
+
+	back, err := CoTToTAKPacket(event)
+	if err != nil {
+		t.Fatalf("Error converting from cot: %v", err)
+	}
+
+	pli := back.GetPli()
+	if pli.LatitudeI != 377749000 || pli.LongitudeI != -1224194000 || pli.Altitude != 15 || pli.Course != 270 || pli.Speed != 3 {
+		t.Fatalf("Unexpected position: %v", pli)
+	}
+	if back.Group.Team != pb.Team_Dark_Blue || back.Group.Role != pb.MemberRole_TeamLead || back.Status.Battery != 80 {
+		t.Fatalf("Unexpected group or status: %v %v", back.Group, back.Status)
+	}
+}
+
+func TestTAKChatCoT(t *testing.T) {
+
+	to := "ANDROID-5678"
+	packet := &pb.TAKPacket{
+		Contact:        &pb.Contact{Callsign: "ALPHA-1", DeviceCallsign: "ANDROID-1234"},
+		PayloadVariant: &pb.TAKPacket_Chat{Chat: &pb.GeoChat{Message: "Moving to checkpoint", To: &to}},
+	}
+
+	event, err := TAKPacketToCoT(packet, 0x1234, time.Now(), 0)
+	if err != nil {
+		t.Fatalf("Error converting to cot: %v", err)
+	}
+
+	back, err := CoTToTAKPacket(event)
+	if err != nil {
+		t.Fatalf("Error converting from cot: %v", err)
+	}
+
+	chat := back.GetChat()
+	if chat.Message != "Moving to checkpoint" || chat.GetTo() != to {
+		t.Fatalf("Unexpected chat: %v", chat)
+	}
+	if back.Contact.Callsign != "ALPHA-1" || back.Contact.DeviceCallsign != "ANDROID-1234" {
+		t.Fatalf("Unexpected contact: %v", back.Contact)
+	}
+}
+
+func TestTAKCompressed(t *testing.T) {
+
+	packet := &pb.TAKPacket{
+		Contact:        &pb.Contact{Callsign: "ALPHA-1", DeviceCallsign: "ANDROID-1234"},
+		PayloadVariant: &pb.TAKPacket_Chat{Chat: &pb.GeoChat{Message: "héllo from the field"}},
+	}
+
+	payload, err := EncodeTAKPacket(packet, true)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+
+	decoded, err := DecodeTAKPacket(payload)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+
+	if decoded.IsCompressed || decoded.Contact.Callsign != "ALPHA-1" || decoded.Contact.DeviceCallsign != "ANDROID-1234" {
+		t.Fatalf("Unexpected contact: %v", decoded.Contact)
+	}
+	if decoded.GetChat().Message != "héllo from the field" {
+		t.Fatalf("Unexpected message: %q", decoded.GetChat().Message)
+	}
+}
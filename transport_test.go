@@ -0,0 +1,139 @@
+package gomesh
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeDevice is a scripted device. Reads return the queued bytes and then go quiet like an idle device
+// instead of reporting EOF, so a radio can keep listening on it. Every message written is recorded and
+// passed to answer, and the messages it returns are queued for reading
+type fakeDevice struct {
+	mu       sync.Mutex
+	in       bytes.Buffer
+	out      bytes.Buffer
+	received []*pb.ToRadio
+	answer   func(*pb.ToRadio) []*pb.FromRadio
+	failed   bool
+}
+
+// newFakeDevice creates a device that first sends stream and answers what it receives with answer, which
+// may be nil
+func newFakeDevice(stream []byte, answer func(*pb.ToRadio) []*pb.FromRadio) *fakeDevice {
+	d := &fakeDevice{answer: answer}
+	d.in.Write(stream)
+	return d
+}
+
+func (d *fakeDevice) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	if d.failed {
+		d.mu.Unlock()
+		return 0, io.ErrUnexpectedEOF
+	}
+	if d.in.Len() == 0 {
+		d.mu.Unlock()
+		time.Sleep(time.Millisecond)
+		return 0, os.ErrDeadlineExceeded
+	}
+	defer d.mu.Unlock()
+	return d.in.Read(p)
+}
+
+func (d *fakeDevice) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.failed {
+		return 0, io.ErrClosedPipe
+	}
+	d.out.Write(p)
+
+	toRadio := &pb.ToRadio{}
+	if len(p) < headerLen || proto.Unmarshal(p[headerLen:], toRadio) != nil {
+		return len(p), nil
+	}
+	d.received = append(d.received, toRadio)
+
+	if d.answer == nil {
+		return len(p), nil
+	}
+	for _, fromRadio := range d.answer(toRadio) {
+		frame, err := frameMessage(fromRadio)
+		if err != nil {
+			return 0, err
+		}
+		d.in.Write(frame)
+	}
+	return len(p), nil
+}
+
+func (d *fakeDevice) Close() error { return nil }
+
+// fail makes every following read and write on the device fail like an unplugged cable
+func (d *fakeDevice) fail() {
+	d.mu.Lock()
+	d.failed = true
+	d.mu.Unlock()
+}
+
+// requests returns the messages written to the device so far
+func (d *fakeDevice) requests() []*pb.ToRadio {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*pb.ToRadio(nil), d.received...)
+}
+
+// written returns the bytes written so far
+func (d *fakeDevice) written() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]byte(nil), d.out.Bytes()...)
+}
+
+// sentPackets decodes the mesh packets a radio wrote to its transport
+func sentPackets(t *testing.T, written []byte) []*pb.MeshPacket {
+
+	var packets []*pb.MeshPacket
+	reader := bufio.NewReader(bytes.NewReader(written))
+	for {
+		payload, err := readFrame(reader)
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("Error reading frame: %v", err)
+		}
+		toRadio := &pb.ToRadio{}
+		if err := proto.Unmarshal(payload, toRadio); err != nil {
+			t.Fatalf("Error decoding frame: %v", err)
+		}
+		if packet := toRadio.GetPacket(); packet != nil {
+			packets = append(packets, packet)
+		}
+	}
+}
+
+// waitSent waits until a radio has written at least count mesh packets and returns them
+func waitSent(t *testing.T, transport *fakeDevice, count int) []*pb.MeshPacket {
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		packets := sentPackets(t, transport.written())
+		if len(packets) >= count {
+			return packets
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d packets to be sent, got %d", count, len(packets))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,88 @@
+//go:build linux
+// +build linux
+
+package gomesh
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunSetIff = 0x400454ca
+	iffTun    = 0x0001
+	iffNoPi   = 0x1000
+)
+
+// TUNDevice is a PacketDevice backed by a Linux TUN interface
+type TUNDevice struct {
+	file *os.File
+	name string
+}
+
+// OpenTUN creates or attaches to a TUN interface, which requires CAP_NET_ADMIN. An empty name lets the kernel
+// pick one. The interface still has to be given the tunnel address and brought up, for example with
+// "ip addr add 10.115.x.y/16 dev NAME" and "ip link set NAME mtu 200 up"
+func OpenTUN(name string) (*TUNDevice, error) {
+
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, errors.New("interface name too long")
+	}
+
+	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], name)
+	ifr.flags = iffTun | iffNoPi
+
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, tunSetIff, uintptr(unsafe.Pointer(&ifr)))
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &TUNDevice{file: file, name: strings.TrimRight(string(ifr.name[:]), "\x00")}, nil
+}
+
+// Name returns the name of the interface
+func (d *TUNDevice) Name() string {
+	return d.name
+}
+
+// ReadPacket reads the next packet sent to the interface
+func (d *TUNDevice) ReadPacket(p []byte) (int, error) {
+	return d.file.Read(p)
+}
+
+// WritePacket delivers a packet to the interface
+func (d *TUNDevice) WritePacket(p []byte) error {
+	_, err := d.file.Write(p)
+	return err
+}
+
+// Close removes a non persistent interface
+func (d *TUNDevice) Close() error {
+	return d.file.Close()
+}
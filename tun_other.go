@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package gomesh
+
+// TUNDevice is a PacketDevice backed by a Linux TUN interface
+type TUNDevice struct{}
+
+// OpenTUN is only supported on Linux and returns ErrPlatformUnsupported elsewhere
+func OpenTUN(name string) (*TUNDevice, error) {
+	return nil, ErrPlatformUnsupported
+}
+
+// Name returns the name of the interface
+func (d *TUNDevice) Name() string {
+	return ""
+}
+
+// ReadPacket reads the next packet sent to the interface
+func (d *TUNDevice) ReadPacket(p []byte) (int, error) {
+	return 0, ErrPlatformUnsupported
+}
+
+// WritePacket delivers a packet to the interface
+func (d *TUNDevice) WritePacket(p []byte) error {
+	return ErrPlatformUnsupported
+}
+
+// Close removes a non persistent interface
+func (d *TUNDevice) Close() error {
+	return nil
+}
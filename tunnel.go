@@ -0,0 +1,342 @@
+package gomesh
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+)
+
+// ipv4HeaderLen is the length of an IPv4 header without options
+const ipv4HeaderLen = 20
+
+// tunnelCompressed marks a payload with a compressed IPv4 header. Its version nibble can't be mistaken for
+// an IP packet, so uncompressed packets from other implementations are still recognized
+const tunnelCompressed = 0xc5
+
+// tunnelCompressedLen is the length of a compressed IPv4 header
+const tunnelCompressedLen = 8
+
+// maxTunnelPacket is the largest IP packet that can cross the mesh with a compressed header
+const maxTunnelPacket = int(pb.Constants_DATA_PAYLOAD_LEN) - tunnelCompressedLen + ipv4HeaderLen
+
+// defaultTunnelPrefix is the network of the virtual addresses, the same as the Python client uses
+var defaultTunnelPrefix = [2]byte{10, 115}
+
+// ErrUnknownNode is returned when an address doesn't belong to a known node
+var ErrUnknownNode = errors.New("no node for address")
+
+// PacketDevice reads and writes whole IP packets, for example a TUN device
+type PacketDevice interface {
+	// ReadPacket reads the next packet to send to the mesh
+	ReadPacket(p []byte) (int, error)
+	// WritePacket delivers a packet received from the mesh
+	WritePacket(p []byte) error
+	Close() error
+}
+
+// TunnelOptions configures an IP tunnel
+type TunnelOptions struct {
+	// Prefix is the first two bytes of the virtual addresses, 10.115 when not set. The last two bytes are the
+	// low bytes of the node number
+	Prefix [2]byte
+	// Channel is the index of the channel to send on
+	Channel uint32
+	// Compress sends IPv4 headers compressed when both ends are tunnel addresses. Only goMesh tunnels
+	// understand compressed headers
+	Compress bool
+	// OnError is called with packets that couldn't be forwarded when it isn't nil
+	OnError func(error)
+}
+
+// Tunnel forwards IPv4 packets between a packet device and the mesh on IP_TUNNEL_APP. Packets from the mesh
+// are received while the radio is read, for example with Listen
+type Tunnel struct {
+	radio  *Radio
+	device PacketDevice
+	opts   TunnelOptions
+	local  uint32
+	remove func()
+
+	mu    sync.Mutex
+	nodes map[uint16]uint32
+}
+
+// NodeIP returns the virtual address of a node
+func NodeIP(prefix [2]byte, node uint32) net.IP {
+	return net.IPv4(prefix[0], prefix[1], byte(node>>8), byte(node))
+}
+
+// newTunnel creates a tunnel for the local node without a radio or device
+func newTunnel(local uint32, opts TunnelOptions) *Tunnel {
+	if opts.Prefix == [2]byte{} {
+		opts.Prefix = defaultTunnelPrefix
+	}
+	t := &Tunnel{opts: opts, local: local, nodes: make(map[uint16]uint32)}
+	t.AddNode(local)
+	return t
+}
+
+// NewTunnel creates a tunnel between the device and the mesh. Run forwards packets from the device
+func (r *Radio) NewTunnel(device PacketDevice, opts TunnelOptions) *Tunnel {
+
+	t := newTunnel(r.nodeNum, opts)
+	t.radio = r
+	t.device = device
+
+	t.remove = r.HandlePort(pb.PortNum_IP_TUNNEL_APP, func(packet *pb.MeshPacket, data *pb.Data) {
+		if packet.From == t.local {
+			return
+		}
+
+		ip, err := t.decapsulate(packet.From, packet.To, data.Payload)
+		if err != nil {
+			t.report(err)
+			return
+		}
+
+		if err := t.device.WritePacket(ip); err != nil {
+			t.report(err)
+		}
+	})
+
+	return t
+}
+
+// Addr returns the virtual address of the radio
+func (t *Tunnel) Addr() net.IP {
+	return NodeIP(t.opts.Prefix, t.local)
+}
+
+// AddNode makes a node reachable through its virtual address. Nodes that send tunnel packets are added
+// automatically. A node replaces any earlier node with the same address
+func (t *Tunnel) AddNode(node uint32) {
+	t.mu.Lock()
+	t.nodes[uint16(node)] = node
+	t.mu.Unlock()
+}
+
+// NodeForIP returns the node with a virtual address
+func (t *Tunnel) NodeForIP(ip net.IP) (uint32, bool) {
+
+	ip4 := ip.To4()
+	if ip4 == nil || ip4[0] != t.opts.Prefix[0] || ip4[1] != t.opts.Prefix[1] {
+		return 0, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node, ok := t.nodes[binary.BigEndian.Uint16(ip4[2:])]
+	return node, ok
+}
+
+// broadcastIP returns the broadcast address of the virtual network
+func (t *Tunnel) broadcastIP() net.IP {
+	return net.IPv4(t.opts.Prefix[0], t.opts.Prefix[1], 255, 255)
+}
+
+// Run forwards packets read from the device to the mesh until the context is done or reading fails. The
+// device is closed when it returns
+func (t *Tunnel) Run(ctx context.Context) error {
+
+	defer t.remove()
+
+	go func() {
+		<-ctx.Done()
+		t.device.Close()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := t.device.ReadPacket(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		to, payload, err := t.encapsulate(buf[:n])
+		if err != nil {
+			t.report(err)
+			continue
+		}
+
+		req := DataRequest{To: to, Channel: t.opts.Channel, Port: pb.PortNum_IP_TUNNEL_APP, Payload: payload}
+		if _, err := t.radio.SendData(ctx, req); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			t.report(err)
+		}
+	}
+}
+
+func (t *Tunnel) report(err error) {
+	if t.opts.OnError != nil {
+		t.opts.OnError(err)
+	}
+}
+
+// encapsulate returns the destination node and the payload to send for an IP packet
+func (t *Tunnel) encapsulate(packet []byte) (uint32, []byte, error) {
+
+	if len(packet) < ipv4HeaderLen || packet[0]>>4 != 4 {
+		return 0, nil, errors.New("not an IPv4 packet")
+	}
+	headerLen := int(packet[0]&0x0f) * 4
+	if headerLen < ipv4HeaderLen || len(packet) < headerLen {
+		return 0, nil, errors.New("invalid IPv4 header")
+	}
+
+	dst := net.IP(packet[16:20])
+	to := uint32(broadcastNum)
+	if !dst.Equal(t.broadcastIP()) && !dst.IsMulticast() && !dst.Equal(net.IPv4bcast) {
+		node, ok := t.NodeForIP(dst)
+		if !ok {
+			return 0, nil, ErrUnknownNode
+		}
+		to = node
+	}
+
+	compressible := t.opts.Compress && headerLen == ipv4HeaderLen &&
+		net.IP(packet[12:16]).Equal(t.Addr()) &&
+		(dst.Equal(t.broadcastIP()) || (to != broadcastNum && dst.Equal(NodeIP(t.opts.Prefix, to))))
+
+	if !compressible {
+		if len(packet) > int(pb.Constants_DATA_PAYLOAD_LEN) {
+			return 0, nil, ErrPayloadTooLarge
+		}
+		return to, packet, nil
+	}
+
+	if len(packet) > maxTunnelPacket {
+		return 0, nil, ErrPayloadTooLarge
+	}
+
+	// Version, lengths, checksum and addresses can be recreated by the receiver
+	payload := make([]byte, 0, len(packet)-ipv4HeaderLen+tunnelCompressedLen)
+	payload = append(payload, tunnelCompressed, packet[1])
+	payload = append(payload, packet[4:10]...)
+	payload = append(payload, packet[ipv4HeaderLen:]...)
+
+	return to, payload, nil
+}
+
+// decapsulate returns the IP packet carried by a tunnel payload
+func (t *Tunnel) decapsulate(from, to uint32, payload []byte) ([]byte, error) {
+
+	t.AddNode(from)
+
+	if len(payload) == 0 {
+		return nil, errors.New("empty tunnel packet")
+	}
+
+	if payload[0] != tunnelCompressed {
+		if payload[0]>>4 != 4 || len(payload) < ipv4HeaderLen {
+			return nil, errors.New("not an IPv4 packet")
+		}
+		return payload, nil
+	}
+
+	if len(payload) < tunnelCompressedLen {
+		return nil, errors.New("short compressed tunnel packet")
+	}
+
+	dst := t.broadcastIP()
+	if to != broadcastNum {
+		dst = NodeIP(t.opts.Prefix, to)
+	}
+
+	total := ipv4HeaderLen + len(payload) - tunnelCompressedLen
+	packet := make([]byte, ipv4HeaderLen, total)
+	packet[0] = 0x45
+	packet[1] = payload[1]
+	binary.BigEndian.PutUint16(packet[2:], uint16(total))
+	copy(packet[4:10], payload[2:8])
+	copy(packet[12:16], NodeIP(t.opts.Prefix, from).To4())
+	copy(packet[16:20], dst.To4())
+	binary.BigEndian.PutUint16(packet[10:], ipv4Checksum(packet))
+
+	return append(packet, payload[tunnelCompressedLen:]...), nil
+}
+
+// ipv4Checksum computes the checksum of an IPv4 header with the checksum field set to zero
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// MemoryDevice is a PacketDevice backed by channels, for tests and for user space network stacks
+type MemoryDevice struct {
+	outbound chan []byte
+	inbound  chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewMemoryDevice creates a device that buffers up to queue packets in each direction
+func NewMemoryDevice(queue int) *MemoryDevice {
+	return &MemoryDevice{
+		outbound: make(chan []byte, queue),
+		inbound:  make(chan []byte, queue),
+		done:     make(chan struct{}),
+	}
+}
+
+// Inject queues a packet to be sent to the mesh
+func (d *MemoryDevice) Inject(packet []byte) error {
+	select {
+	case d.outbound <- append([]byte(nil), packet...):
+		return nil
+	case <-d.done:
+		return net.ErrClosed
+	}
+}
+
+// Received returns the packets received from the mesh
+func (d *MemoryDevice) Received() <-chan []byte {
+	return d.inbound
+}
+
+// ReadPacket returns the next injected packet
+func (d *MemoryDevice) ReadPacket(p []byte) (int, error) {
+	select {
+	case packet := <-d.outbound:
+		return copy(p, packet), nil
+	case <-d.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// WritePacket queues a packet on Received. Packets are dropped when the queue is full
+func (d *MemoryDevice) WritePacket(p []byte) error {
+	select {
+	case <-d.done:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case d.inbound <- append([]byte(nil), p...):
+		return nil
+	default:
+		return errors.New("memory device queue full")
+	}
+}
+
+// Close stops the device
+func (d *MemoryDevice) Close() error {
+	d.once.Do(func() { close(d.done) })
+	return nil
+}
@@ -0,0 +1,104 @@
+package gomesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// testIPv4Packet builds a UDP packet between two addresses with a valid header checksum
+func testIPv4Packet(src, dst net.IP, payload []byte) []byte {
+	packet := make([]byte, ipv4HeaderLen, ipv4HeaderLen+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(ipv4HeaderLen+len(payload)))
+	binary.BigEndian.PutUint16(packet[4:], 0x1234)
+	packet[6] = 0x40
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], src.To4())
+	copy(packet[16:20], dst.To4())
+	binary.BigEndian.PutUint16(packet[10:], ipv4Checksum(packet))
+	return append(packet, payload...)
+}
+
+func TestTunnelAddressing(t *testing.T) {
+
+	tunnel := newTunnel(0x1234abcd, TunnelOptions{})
+	if !tunnel.Addr().Equal(net.IPv4(10, 115, 0xab, 0xcd)) {
+		t.Fatalf("Unexpected address %v", tunnel.Addr())
+	}
+
+	tunnel.AddNode(0xdeadbeef)
+	if node, ok := tunnel.NodeForIP(net.IPv4(10, 115, 0xbe, 0xef)); !ok || node != 0xdeadbeef {
+		t.Fatalf("Expected node !deadbeef, got %x %v", node, ok)
+	}
+	if _, ok := tunnel.NodeForIP(net.IPv4(10, 116, 0xbe, 0xef)); ok {
+		t.Fatalf("Address outside the tunnel network was mapped")
+	}
+
+	packet := testIPv4Packet(tunnel.Addr(), net.IPv4(10, 115, 1, 1), []byte("data"))
+	if _, _, err := tunnel.encapsulate(packet); err != ErrUnknownNode {
+		t.Fatalf("Expected ErrUnknownNode, got %v", err)
+	}
+}
+
+func TestTunnelCompression(t *testing.T) {
+
+	for _, compress := range []bool{false, true} {
+		sender := newTunnel(0x11110001, TunnelOptions{Compress: compress})
+		receiver := newTunnel(0x22220002, TunnelOptions{Compress: compress})
+		sender.AddNode(receiver.local)
+
+		for _, dst := range []net.IP{receiver.Addr(), sender.broadcastIP()} {
+			packet := testIPv4Packet(sender.Addr(), dst, bytes.Repeat([]byte{0x5a}, 100))
+
+			to, payload, err := sender.encapsulate(packet)
+			if err != nil {
+				t.Fatalf("Error encapsulating: %v", err)
+			}
+			if dst.Equal(receiver.Addr()) && to != receiver.local {
+				t.Fatalf("Sent to %x instead of %x", to, receiver.local)
+			}
+			if compress && len(payload) != len(packet)-ipv4HeaderLen+tunnelCompressedLen {
+				t.Fatalf("Header wasn't compressed, %d bytes", len(payload))
+			}
+
+			got, err := receiver.decapsulate(sender.local, to, payload)
+			if err != nil {
+				t.Fatalf("Error decapsulating: %v", err)
+			}
+			if !bytes.Equal(got, packet) {
+				t.Fatalf("Packet changed in the tunnel\n%x\n%x", got, packet)
+			}
+		}
+
+		if node, ok := receiver.NodeForIP(sender.Addr()); !ok || node != sender.local {
+			t.Fatalf("Receiver didn't learn the sender")
+		}
+	}
+}
+
+func TestMemoryDevice(t *testing.T) {
+
+	device := NewMemoryDevice(1)
+	if err := device.Inject([]byte{1, 2, 3}); err != nil {
+		t.Fatalf("Error injecting: %v", err)
+	}
+
+	buf := make([]byte, 10)
+	n, err := device.ReadPacket(buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte{1, 2, 3}) {
+		t.Fatalf("Unexpected read %x %v", buf[:n], err)
+	}
+
+	device.WritePacket([]byte{4})
+	if got := <-device.Received(); !bytes.Equal(got, []byte{4}) {
+		t.Fatalf("Unexpected packet %x", got)
+	}
+
+	device.Close()
+	if _, err := device.ReadPacket(buf); err == nil {
+		t.Fatalf("Expected an error after close")
+	}
+}
@@ -0,0 +1,829 @@
+package gomesh
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// Unishox2 compression as used by the Meshtastic firmware for compressed text messages and ATAK strings.
+// The decoder follows the reference implementation with the default preset. The encoder produces a valid
+// subset of the format: it uses the character sets, repeats, back references and unicode deltas but leaves
+// out the hex, template and frequent sequence codes, which the decoder still understands
+
+const (
+	usxAlpha = 0
+	usxSym   = 1
+	usxNum   = 2
+	usxDict  = 3
+	usxDelta = 4
+)
+
+// usxEnd is returned by the readers when the input runs out or a code is invalid
+const usxEnd = 99
+
+// usxNiceLen is the shortest back reference worth encoding
+const usxNiceLen = 5
+
+// Codes for characters and sequences, the set is in the top three bits and the vertical position in the rest
+const (
+	usxRptCode    = 2<<5 + 26
+	usxTermCode   = 2<<5 + 27
+	usxLFCode     = 1<<5 + 7
+	usxCRLFCode   = 1<<5 + 8
+	usxCRCode     = 1<<5 + 22
+	usxTabCode    = 1<<5 + 14
+	usxNumSpcCode = 2<<5 + 17
+)
+
+// Special codes used while decoding continuous unicode deltas
+const (
+	usxSplCode    = 0xF8
+	usxSplCodeLen = 5
+	usxSplMarker  = 0x7FFFFF00
+)
+
+var usxSets = [3][28]byte{
+	{0, ' ', 'e', 't', 'a', 'o', 'i', 'n', 's', 'r', 'l', 'c', 'd', 'h', 'u', 'p', 'm', 'b', 'g', 'w', 'f', 'y', 'v', 'k', 'q', 'j', 'x', 'z'},
+	{'"', '{', '}', '_', '<', '>', ':', '\n', 0, '[', ']', '\\', ';', '\'', '\t', '@', '*', '&', '?', '!', '^', '|', '\r', '~', '`', 0, 0, 0},
+	{0, ',', '.', '0', '1', '9', '2', '5', '-', '/', '3', '4', '6', '7', '8', '(', ')', ' ', '=', '+', '$', '%', '#', 0, 0, 0, 0, 0},
+}
+
+var usxHCodes = [5]byte{0x00, 0x40, 0x80, 0xC0, 0xE0}
+var usxHCodeLens = [5]int{2, 2, 2, 3, 3}
+
+var usxVCodes = [28]byte{
+	0x00, 0x40, 0x60, 0x80, 0x90, 0xA0, 0xB0,
+	0xC0, 0xD0, 0xD8, 0xE0, 0xE4, 0xE8, 0xEC,
+	0xEE, 0xF0, 0xF2, 0xF4, 0xF6, 0xF7, 0xF8,
+	0xF9, 0xFA, 0xFB, 0xFC, 0xFD, 0xFE, 0xFF,
+}
+var usxVCodeLens = [28]int{
+	2, 3, 3, 4, 4, 4, 4,
+	4, 5, 5, 6, 6, 6, 7,
+	7, 7, 7, 7, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8,
+}
+
+var usxFreqSeq = [6]string{"\": \"", "\": ", "</", "=\"", "\":\"", "://"}
+var usxTemplates = [5]string{"tfff-of-tfTtf:rf:rf.fffZ", "tfff-of-tf", "(fff) fff-ffff", "tf:rf:rf", ""}
+
+var usxCountBitLens = [5]int{2, 4, 7, 11, 16}
+var usxCountAdder = [5]int{4, 20, 148, 2196, 67732}
+var usxCountCodes = [5]byte{0x01, 0x82, 0xC3, 0xE4, 0xF4}
+
+var usxUniBitLens = [5]int{6, 12, 14, 16, 21}
+var usxUniAdder = [5]int32{0, 64, 4160, 20544, 86080}
+var usxUniCodes = [5]byte{0x01, 0x82, 0xC3, 0xE4, 0xF5}
+
+var usxMask = [8]byte{0x80, 0xC0, 0xE0, 0xF0, 0xF8, 0xFC, 0xFE, 0xFF}
+
+// usxCode94 holds the code of every printable character from '!' to '~'
+var usxCode94 = func() (codes [94]byte) {
+	for i, set := range usxSets {
+		for j, c := range set {
+			if c <= 32 {
+				continue
+			}
+			codes[c-33] = byte(i<<5 + j)
+			if c >= 'a' && c <= 'z' {
+				codes[c-33-('a'-'A')] = byte(i<<5 + j)
+			}
+		}
+	}
+	return
+}()
+
+// usxWriter appends codes to a bit stream, most significant bit first
+type usxWriter struct {
+	out  []byte
+	bits int
+}
+
+// append writes the top clen bits of code
+func (w *usxWriter) append(code byte, clen int) {
+	for clen > 0 {
+		cur := w.bits % 8
+		blen := clen
+		b := (code & usxMask[blen-1]) >> cur
+		if blen+cur > 8 {
+			blen = 8 - cur
+		}
+		if cur == 0 {
+			w.out = append(w.out, b)
+		} else {
+			w.out[len(w.out)-1] |= b
+		}
+		code <<= blen
+		w.bits += blen
+		clen -= blen
+	}
+}
+
+func (w *usxWriter) appendSwitch(state int) {
+	if state == usxDelta {
+		w.append(usxSplCode, usxSplCodeLen)
+		w.append(0x80, 2)
+	} else {
+		w.append(0, 2)
+	}
+}
+
+func (w *usxWriter) appendCode(code byte, state *int) {
+	hcode := int(code >> 5)
+	vcode := int(code & 0x1F)
+
+	switch hcode {
+	case usxAlpha:
+		if *state != usxAlpha {
+			w.appendSwitch(*state)
+			w.append(usxHCodes[usxAlpha], usxHCodeLens[usxAlpha])
+			*state = usxAlpha
+		}
+	case usxSym:
+		w.appendSwitch(*state)
+		w.append(usxHCodes[usxSym], usxHCodeLens[usxSym])
+	case usxNum:
+		if *state != usxNum {
+			w.appendSwitch(*state)
+			w.append(usxHCodes[usxNum], usxHCodeLens[usxNum])
+			if c := usxSets[hcode][vcode]; c >= '0' && c <= '9' {
+				*state = usxNum
+			}
+		}
+	}
+
+	w.append(usxVCodes[vcode], usxVCodeLens[vcode])
+}
+
+func (w *usxWriter) appendCount(count int) {
+	for i := range usxCountAdder {
+		if count >= usxCountAdder[i] {
+			continue
+		}
+
+		w.append(usxCountCodes[i]&0xF8, int(usxCountCodes[i]&0x07))
+		base := 0
+		if i > 0 {
+			base = usxCountAdder[i-1]
+		}
+		value := uint16((count - base) << (16 - usxCountBitLens[i]))
+		if usxCountBitLens[i] > 8 {
+			w.append(byte(value>>8), 8)
+			w.append(byte(value), usxCountBitLens[i]-8)
+		} else {
+			w.append(byte(value>>8), usxCountBitLens[i])
+		}
+		return
+	}
+}
+
+func (w *usxWriter) appendUnicode(code int32, prev int32) {
+	diff := code - prev
+	if diff < 0 {
+		diff = -diff
+	}
+
+	till := int32(0)
+	for i := range usxUniBitLens {
+		till += 1 << usxUniBitLens[i]
+		if diff >= till {
+			continue
+		}
+
+		w.append(usxUniCodes[i]&0xF8, int(usxUniCodes[i]&0x07))
+		sign := byte(0)
+		if prev > code {
+			sign = 0x80
+		}
+		w.append(sign, 1)
+
+		value := diff - usxUniAdder[i]
+		bitLen := usxUniBitLens[i]
+		switch {
+		case bitLen > 16:
+			value <<= 24 - bitLen
+			w.append(byte(value>>16), 8)
+			w.append(byte(value>>8), 8)
+			w.append(byte(value), bitLen-16)
+		case bitLen > 8:
+			value <<= 16 - bitLen
+			w.append(byte(value>>8), 8)
+			w.append(byte(value), bitLen-8)
+		default:
+			value <<= 8 - bitLen
+			w.append(byte(value), bitLen)
+		}
+		return
+	}
+}
+
+// usxReadUTF8 returns the code point of a multibyte UTF-8 sequence at l and its length, or 0 if there isn't one
+func usxReadUTF8(in []byte, l int) (int32, int) {
+	n := len(in)
+	switch {
+	case l < n-1 && in[l]&0xE0 == 0xC0 && in[l+1]&0xC0 == 0x80:
+		code := int32(in[l]&0x1F)<<6 | int32(in[l+1]&0x3F)
+		if code >= 0x80 {
+			return code, 2
+		}
+	case l < n-2 && in[l]&0xF0 == 0xE0 && in[l+1]&0xC0 == 0x80 && in[l+2]&0xC0 == 0x80:
+		code := int32(in[l]&0x0F)<<12 | int32(in[l+1]&0x3F)<<6 | int32(in[l+2]&0x3F)
+		if code >= 0x800 {
+			return code, 3
+		}
+	case l < n-3 && in[l]&0xF8 == 0xF0 && in[l+1]&0xC0 == 0x80 && in[l+2]&0xC0 == 0x80 && in[l+3]&0xC0 == 0x80:
+		code := int32(in[l]&0x07)<<18 | int32(in[l+1]&0x3F)<<12 | int32(in[l+2]&0x3F)<<6 | int32(in[l+3]&0x3F)
+		if code >= 0x10000 {
+			return code, 4
+		}
+	}
+	return 0, 0
+}
+
+// usxMatch looks for an earlier copy of the text at l and writes a back reference to it. It returns the
+// last position covered by the reference
+func (w *usxWriter) appendMatch(in []byte, l int, state int) (int, bool) {
+	longestLen, longestDist := 0, 0
+
+	for j := l - usxNiceLen; j >= 0; j-- {
+		k := l
+		for k < len(in) && j+k-l < l && in[k] == in[j+k-l] {
+			k++
+		}
+		// Don't split a UTF-8 sequence
+		for k < len(in) && k > l && in[k]>>6 == 2 {
+			k--
+		}
+
+		if k-l > usxNiceLen-1 {
+			matchLen := k - l - usxNiceLen
+			if matchLen > longestLen {
+				longestLen = matchLen
+				longestDist = l - j - usxNiceLen + 1
+			}
+		}
+	}
+
+	if longestLen == 0 {
+		return l, false
+	}
+
+	w.appendSwitch(state)
+	w.append(usxHCodes[usxDict], usxHCodeLens[usxDict])
+	w.appendCount(longestLen)
+	w.appendCount(longestDist)
+
+	return l + longestLen + usxNiceLen - 1, true
+}
+
+// unishoxCompress compresses text with Unishox2
+func unishoxCompress(in []byte) []byte {
+
+	w := usxWriter{}
+	state := usxAlpha
+	prevUni := int32(0)
+	n := len(in)
+
+	// Magic bit identifying Unishox2
+	w.append(0xFF, 1)
+
+	for l := 0; l < n; l++ {
+
+		if l < n-usxNiceLen+1 {
+			if last, ok := w.appendMatch(in, l, state); ok {
+				l = last
+				continue
+			}
+		}
+
+		c := in[l]
+
+		// Runs of the same character repeat the previous one
+		if l > 0 && l < n-4 && c == in[l-1] && c == in[l+1] && c == in[l+2] && c == in[l+3] {
+			count := l + 4
+			for count < n && in[count] == c {
+				count++
+			}
+			count -= l
+			w.appendCode(usxRptCode, &state)
+			w.appendCount(count - 4)
+			l += count - 1
+			continue
+		}
+
+		switch {
+		case c >= 32 && c <= 126:
+			if c >= 'A' && c <= 'Z' {
+				if state == usxNum {
+					w.appendSwitch(state)
+					w.append(usxHCodes[usxAlpha], usxHCodeLens[usxAlpha])
+					state = usxAlpha
+				}
+				w.appendSwitch(state)
+				w.append(usxHCodes[usxAlpha], usxHCodeLens[usxAlpha])
+			}
+
+			if c == ' ' {
+				if state == usxNum {
+					w.append(usxVCodes[usxNumSpcCode&0x1F], usxVCodeLens[usxNumSpcCode&0x1F])
+				} else {
+					w.append(usxVCodes[1], usxVCodeLens[1])
+				}
+			} else {
+				w.appendCode(usxCode94[c-33], &state)
+			}
+		case c == '\r' && l+1 < n && in[l+1] == '\n':
+			w.appendCode(usxCRLFCode, &state)
+			l++
+		case c == '\n':
+			w.appendCode(usxLFCode, &state)
+		case c == '\r':
+			w.appendCode(usxCRCode, &state)
+		case c == '\t':
+			w.appendCode(usxTabCode, &state)
+		default:
+			if code, size := usxReadUTF8(in, l); code != 0 {
+				w.appendSwitch(state)
+				w.append(usxHCodes[usxDelta], usxHCodeLens[usxDelta])
+				w.appendUnicode(code, prevUni)
+				prevUni = code
+				l += size - 1
+				continue
+			}
+
+			// Anything else is sent as a raw byte
+			w.appendSwitch(state)
+			w.append(usxHCodes[usxNum], usxHCodeLens[usxNum])
+			w.append(0, 2)
+			w.append(0xF8, 5)
+			w.appendCount(1)
+			w.append(c, 8)
+		}
+	}
+
+	// The terminator is only kept as far as it fits in the last byte
+	length := (w.bits + 7) / 8
+	if state != usxNum {
+		w.appendSwitch(state)
+		w.append(usxHCodes[usxNum], usxHCodeLens[usxNum])
+	}
+	w.append(usxVCodes[usxTermCode&0x1F], usxVCodeLens[usxTermCode&0x1F])
+	w.append(0xFF, (8-w.bits%8)&7)
+
+	return w.out[:length]
+}
+
+// usxReader reads codes from a bit stream
+type usxReader struct {
+	in   []byte
+	bits int
+	pos  int
+}
+
+func (r *usxReader) bit(pos int) bool {
+	return r.in[pos>>3]&(0x80>>(pos%8)) != 0
+}
+
+// read8 returns the next 8 bits from pos, padded with ones past the end
+func (r *usxReader) read8(pos int) byte {
+	bitPos := uint(pos & 7)
+	charPos := pos >> 3
+
+	code := r.in[charPos] << bitPos
+	charPos++
+	if charPos < len(r.in) {
+		code |= r.in[charPos] >> (8 - bitPos)
+	} else {
+		code |= 0xFF >> (8 - bitPos)
+	}
+	return code
+}
+
+func (r *usxReader) readVCode() int {
+	if r.pos >= r.bits {
+		return usxEnd
+	}
+
+	code := r.read8(r.pos)
+	for i, vcode := range usxVCodes {
+		if code&usxMask[usxVCodeLens[i]-1] == vcode {
+			r.pos += usxVCodeLens[i]
+			if r.pos > r.bits {
+				return usxEnd
+			}
+			return i
+		}
+	}
+	return usxEnd
+}
+
+func (r *usxReader) readHCode() int {
+	if r.pos >= r.bits {
+		return usxEnd
+	}
+
+	code := r.read8(r.pos)
+	for i, hcode := range usxHCodes {
+		if code&usxMask[usxHCodeLens[i]-1] == hcode {
+			r.pos += usxHCodeLens[i]
+			return i
+		}
+	}
+	return usxEnd
+}
+
+// stepCode counts leading one bits up to limit, consuming the terminating zero when there is one
+func (r *usxReader) stepCode(limit int) int {
+	idx := 0
+	for r.pos < r.bits && r.bit(r.pos) {
+		idx++
+		r.pos++
+		if idx == limit {
+			return idx
+		}
+	}
+	if r.pos >= r.bits {
+		return usxEnd
+	}
+	r.pos++
+	return idx
+}
+
+// number reads count bits from pos without consuming them, or returns -1 past the end
+func (r *usxReader) number(pos int, count int) int32 {
+	value := int32(0)
+	for count > 0 && pos < r.bits {
+		count--
+		if r.bit(pos) {
+			value += 1 << uint(count)
+		}
+		pos++
+	}
+	if count > 0 {
+		return -1
+	}
+	return value
+}
+
+func (r *usxReader) readCount() int32 {
+	idx := r.stepCode(4)
+	if idx == usxEnd {
+		return -1
+	}
+	if r.pos+usxCountBitLens[idx]-1 >= r.bits {
+		return -1
+	}
+
+	count := r.number(r.pos, usxCountBitLens[idx])
+	if idx > 0 {
+		count += int32(usxCountAdder[idx-1])
+	}
+	r.pos += usxCountBitLens[idx]
+	return count
+}
+
+func (r *usxReader) readUnicode() int32 {
+	idx := r.stepCode(5)
+	if idx == usxEnd {
+		return usxSplMarker + usxEnd
+	}
+	if idx == 5 {
+		return usxSplMarker + int32(r.stepCode(4))
+	}
+
+	sign := r.pos < r.bits && r.bit(r.pos)
+	r.pos++
+
+	count := r.number(r.pos, usxUniBitLens[idx])
+	if count < 0 {
+		return usxSplMarker + usxEnd
+	}
+	count += usxUniAdder[idx]
+	r.pos += usxUniBitLens[idx]
+
+	if sign {
+		return -count
+	}
+	return count
+}
+
+func usxHexChar(nibble int32, upper bool) byte {
+	if nibble >= 0 && nibble <= 9 {
+		return byte('0' + nibble)
+	}
+	if upper {
+		return byte('A' + nibble - 10)
+	}
+	return byte('a' + nibble - 10)
+}
+
+// readRepeat copies an earlier part of the output referenced by a back reference
+func (r *usxReader) readRepeat(out []byte) ([]byte, error) {
+	length := r.readCount()
+	if length < 0 {
+		return nil, errors.New("invalid back reference")
+	}
+	length += usxNiceLen
+
+	dist := r.readCount()
+	if dist < 0 {
+		return nil, errors.New("invalid back reference")
+	}
+	dist += usxNiceLen - 1
+
+	start := len(out) - int(dist)
+	if start < 0 || start+int(length) > len(out) {
+		return nil, errors.New("invalid back reference")
+	}
+
+	return append(out, out[start:start+int(length)]...), nil
+}
+
+// unishoxDecompress decompresses text compressed with Unishox2
+func unishoxDecompress(in []byte) ([]byte, error) {
+
+	r := usxReader{in: in, bits: len(in) * 8, pos: 1}
+	out := make([]byte, 0, len(in)*2)
+
+	dstate, h := usxAlpha, usxAlpha
+	isAllUpper := false
+	prevUni := int32(0)
+
+decode:
+	for r.pos < r.bits {
+		orig := r.pos
+
+		if dstate == usxDelta || h == usxDelta {
+			if dstate != usxDelta {
+				h = dstate
+			}
+
+			delta := r.readUnicode()
+			if delta>>8 == usxSplMarker>>8 {
+				switch delta & 0xFF {
+				case usxEnd:
+					break decode
+				case 0:
+					out = append(out, ' ')
+					continue
+				case 1:
+					h = r.readHCode()
+					if h == usxEnd {
+						break decode
+					}
+					if h == usxDelta || h == usxAlpha {
+						dstate = h
+						continue
+					}
+					if h == usxDict {
+						var err error
+						if out, err = r.readRepeat(out); err != nil {
+							return nil, err
+						}
+						h = dstate
+						continue
+					}
+				case 2:
+					out = append(out, ',')
+					continue
+				case 3:
+					out = append(out, '.')
+					continue
+				case 4:
+					out = append(out, '\n')
+					continue
+				}
+			} else {
+				prevUni += delta
+				buf := make([]byte, utf8.UTFMax)
+				out = append(out, buf[:utf8.EncodeRune(buf, rune(prevUni))]...)
+			}
+
+			if dstate == usxDelta && h == usxDelta {
+				continue
+			}
+		} else {
+			h = dstate
+		}
+
+		isUpper := isAllUpper
+		v := r.readVCode()
+		if v == usxEnd || h == usxEnd {
+			r.pos = orig
+			break
+		}
+
+		if v == 0 && h != usxSym {
+			if r.pos >= r.bits {
+				break
+			}
+			if h != usxNum || dstate != usxDelta {
+				h = r.readHCode()
+				if h == usxEnd || r.pos >= r.bits {
+					r.pos = orig
+					break
+				}
+			}
+
+			switch h {
+			case usxAlpha:
+				if dstate != usxAlpha {
+					dstate = usxAlpha
+					continue
+				}
+				if isAllUpper {
+					isAllUpper = false
+					continue
+				}
+
+				v = r.readVCode()
+				if v == usxEnd {
+					r.pos = orig
+					break decode
+				}
+				if v == 0 {
+					h = r.readHCode()
+					if h == usxEnd {
+						r.pos = orig
+						break decode
+					}
+					if h == usxAlpha {
+						isAllUpper = true
+						continue
+					}
+				}
+				isUpper = true
+			case usxDict:
+				var err error
+				if out, err = r.readRepeat(out); err != nil {
+					return nil, err
+				}
+				continue
+			case usxDelta:
+				continue
+			default:
+				if h != usxNum || dstate != usxDelta {
+					v = r.readVCode()
+				}
+				if v == usxEnd {
+					r.pos = orig
+					break decode
+				}
+
+				if h == usxNum && v == 0 {
+					if !r.readNibbles(&out) {
+						break decode
+					}
+					if dstate == usxDelta {
+						h = usxDelta
+					}
+					continue
+				}
+			}
+		}
+
+		if isUpper && v == 1 {
+			// Upper case space starts continuous unicode deltas
+			h, dstate = usxDelta, usxDelta
+			continue
+		}
+
+		c := byte(0)
+		if h < 3 && v < 28 {
+			c = usxSets[h][v]
+		}
+
+		switch {
+		case c >= 'a' && c <= 'z':
+			dstate = usxAlpha
+			if isUpper {
+				c -= 32
+			}
+		case c >= '0' && c <= '9':
+			dstate = usxNum
+		case c == 0:
+			switch {
+			case v == 8:
+				out = append(out, '\r', '\n')
+			case h == usxNum && v == 26:
+				count := r.readCount()
+				if count < 0 {
+					break decode
+				}
+				if len(out) == 0 {
+					return nil, errors.New("repeat without a character")
+				}
+				last := out[len(out)-1]
+				for i := int32(0); i < count+4; i++ {
+					out = append(out, last)
+				}
+			case h == usxSym && v > 24:
+				out = append(out, usxFreqSeq[v-25]...)
+			case h == usxNum && v > 22 && v < 26:
+				out = append(out, usxFreqSeq[v-20]...)
+			default:
+				// Terminator
+				break decode
+			}
+
+			if dstate == usxDelta {
+				h = usxDelta
+			}
+			continue
+		}
+
+		if dstate == usxDelta {
+			h = usxDelta
+		}
+		out = append(out, c)
+	}
+
+	return out, nil
+}
+
+// readNibbles decodes the hex, GUID, template and binary sequences that follow a nibble escape.
+// It returns false when the input ends
+func (r *usxReader) readNibbles(out *[]byte) bool {
+
+	idx := r.stepCode(5)
+	switch {
+	case idx == usxEnd:
+		return false
+	case idx == 0:
+		idx = r.stepCode(4)
+		if idx >= len(usxTemplates) {
+			return false
+		}
+		rem := r.readCount()
+		if rem < 0 {
+			return false
+		}
+
+		template := usxTemplates[idx]
+		if template == "" || int(rem) > len(template) {
+			return false
+		}
+
+		for _, t := range []byte(template[:len(template)-int(rem)]) {
+			bitLen := 0
+			switch t {
+			case 'f', 'F':
+				bitLen = 4
+			case 'r':
+				bitLen = 3
+			case 't':
+				bitLen = 2
+			case 'o':
+				bitLen = 1
+			}
+
+			if bitLen == 0 {
+				*out = append(*out, t)
+				continue
+			}
+
+			value := r.number(r.pos, bitLen)
+			if value < 0 {
+				return false
+			}
+			*out = append(*out, usxHexChar(value, t != 'f'))
+			r.pos += bitLen
+		}
+	case idx == 5:
+		count := r.readCount()
+		if count <= 0 {
+			return false
+		}
+		for ; count > 0; count-- {
+			value := r.number(r.pos, 8)
+			if value < 0 {
+				break
+			}
+			*out = append(*out, byte(value))
+			r.pos += 8
+		}
+	default:
+		count := int32(32)
+		guid := idx == 2 || idx == 4
+		if !guid {
+			count = r.readCount()
+			if count <= 0 {
+				return false
+			}
+		}
+
+		for ; count > 0; count-- {
+			nibble := r.number(r.pos, 4)
+			if nibble < 0 {
+				return false
+			}
+			*out = append(*out, usxHexChar(nibble, idx >= 3))
+			if guid && (count == 25 || count == 21 || count == 17 || count == 13) {
+				*out = append(*out, '-')
+			}
+			r.pos += 4
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,73 @@
+package gomesh
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnishoxRoundTrip(t *testing.T) {
+
+	texts := []string{
+		"",
+		"Hello World",
+		"HELLO world, how are you?",
+		"Meet at 1200 near the bridge. Meet at 1200 near the bridge.",
+		"aaaaaaaaaa 1234567890 {json: \"value\"}",
+		"line one\r\nline two\nline\tthree\r",
+		"héllo wörld ☀ 😀",
+		"ctrl \x01\x02 and \xff bytes",
+	}
+
+	for _, text := range texts {
+		compressed := unishoxCompress([]byte(text))
+		out, err := unishoxDecompress(compressed)
+		if err != nil {
+			t.Fatalf("Error decompressing %q: %v", text, err)
+		}
+		if !bytes.Equal(out, []byte(text)) {
+			t.Fatalf("Round trip of %q returned %q", text, out)
+		}
+	}
+}
+
+func TestUnishoxCompresses(t *testing.T) {
+
+	text := "the quick brown fox jumps over the lazy dog"
+	if compressed := unishoxCompress([]byte(text)); len(compressed) >= len(text) {
+		t.Fatalf("Compressed %d bytes to %d", len(text), len(compressed))
+	}
+}
+
+// unishoxVectors are encodings worked out by hand from the code tables of the reference unishox2.c, so
+// they don't depend on this encoder. Each comment lists the codes in order
+var unishoxVectors = []struct {
+	text string
+	data []byte
+}{
+	// magic 1, t 1000, h 1110110, e 011, then the start of the terminator
+	{"the", []byte{0xc7, 0x66}},
+	// magic 1, upper case 00 00, h 1110110, e 011, l 111000, l 111000, o 1010
+	{"Hello", []byte{0x87, 0x67, 0xc7, 0x14}},
+	// magic 1, switch to deltas 00 111, 12 bit delta 10, positive 0, 0xe9-64 000010101001
+	{"é", []byte{0x9e, 0x05, 0x49}},
+	// magic 1, switch to numbers 00 10, 2 1011, 5 1100, terminator 111...
+	{"25", []byte{0x95, 0xe7}},
+}
+
+func TestUnishoxVectors(t *testing.T) {
+
+	for _, vector := range unishoxVectors {
+		if compressed := unishoxCompress([]byte(vector.text)); !bytes.Equal(compressed, vector.data) {
+			t.Errorf("Expected %q to compress to % x, got % x", vector.text, vector.data, compressed)
+		}
+
+		out, err := unishoxDecompress(vector.data)
+		if err != nil {
+			t.Errorf("Error decompressing % x: %v", vector.data, err)
+			continue
+		}
+		if string(out) != vector.text {
+			t.Errorf("Expected % x to decompress to %q, got %q", vector.data, vector.text, out)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package gomesh
 
 import (
+	"context"
 	"math/rand"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -36,3 +38,34 @@ func genPSK256() []byte {
 
 	return token
 }
+
+// packetIDs generates packet ids. Seeding it once keeps ids created in the same clock tick apart
+var packetIDs = struct {
+	sync.Mutex
+	rand *rand.Rand
+}{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// newPacketID generates a random non zero id for an outgoing mesh packet
+func newPacketID() uint32 {
+	packetIDs.Lock()
+	defer packetIDs.Unlock()
+
+	for {
+		if id := packetIDs.rand.Uint32(); id != 0 {
+			return id
+		}
+	}
+}
+
+// sleepContext waits for the duration or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,401 @@
+package gomesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// xmodemBlockLen is the size of the buffer in every XModem packet
+const xmodemBlockLen = 128
+
+// xmodemRetries is how many times a block is resent before a transfer is abandoned
+const xmodemRetries = 10
+
+// xmodemTimeout is how long to wait for the device to answer a packet
+const xmodemTimeout = 5 * time.Second
+
+// ErrUnsupported is returned when the device can't perform the requested operation
+var ErrUnsupported = errors.New("not supported by the device")
+
+// ErrTransferCanceled is returned when the device cancels a file transfer
+var ErrTransferCanceled = errors.New("transfer canceled by the device")
+
+// TransferProgress is called as a file transfer progresses with the bytes transferred so far.
+// total is -1 when the size isn't known, which is the case for downloads
+type TransferProgress func(transferred int, total int)
+
+// fromRadioFileInfo is the field of FromRadio that firmware 2.5 and later uses to list a file during the
+// config handshake. The protobufs goMesh is built with predate it, so it is read from the unknown fields
+const fromRadioFileInfo = protowire.Number(15)
+
+// FileInfo is a file on the device filesystem
+type FileInfo struct {
+	Name string
+	Size uint32
+}
+
+// xmodemTransfer holds the XModem packets received from the device for the transfer in progress
+type xmodemTransfer struct {
+	// mu allows a single transfer at a time
+	mu    sync.Mutex
+	inbox chan *pb.XModem
+}
+
+// xmodem returns the XModem transfer state for the radio, creating it on first use
+func (r *Radio) xmodem() *xmodemTransfer {
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.transfer == nil {
+		r.transfer = &xmodemTransfer{inbox: make(chan *pb.XModem, 16)}
+	}
+	return r.transfer
+}
+
+// handleXmodem passes an XModem packet from the device to the transfer in progress
+func (x *xmodemTransfer) handleXmodem(packet *pb.XModem) {
+	select {
+	case x.inbox <- packet:
+	default:
+		// Nobody is waiting for it, drop it
+	}
+}
+
+// drain removes any XModem packets left over from an earlier transfer
+func (x *xmodemTransfer) drain() {
+	for {
+		select {
+		case <-x.inbox:
+		default:
+			return
+		}
+	}
+}
+
+// crc16 computes the CRC-16/XMODEM checksum the firmware uses for XModem blocks
+func crc16(data []byte) uint32 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return uint32(crc)
+}
+
+// sendXmodem sends a single XModem packet to the device
+func (r *Radio) sendXmodem(packet *pb.XModem) error {
+
+	radioMessage := pb.ToRadio{
+		PayloadVariant: &pb.ToRadio_XmodemPacket{
+			XmodemPacket: packet,
+		},
+	}
+
+	out, err := proto.Marshal(&radioMessage)
+	if err != nil {
+		return err
+	}
+
+	return r.sendPacket(out)
+}
+
+// waitXmodem waits for the next XModem packet from the device. The radio is read while waiting
+// and other packets are kept for ReadResponse
+func (r *Radio) waitXmodem(ctx context.Context) (*pb.XModem, error) {
+
+	x := r.xmodem()
+	deadline := time.Now().Add(xmodemTimeout)
+
+	for {
+		select {
+		case packet := <-x.inbox:
+			return packet, nil
+		default:
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("timed out waiting for the device")
+		}
+
+		if err := r.pollBacklog(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// UploadFile writes a file to the device filesystem using XModem. Canceling the context cancels the
+// transfer and the device removes the partial file. Firmware too old for file transfer returns ErrUnsupported
+func (r *Radio) UploadFile(ctx context.Context, filename string, data []byte, progress TransferProgress) error {
+
+	if err := r.require(supportsFiles); err != nil {
+		return err
+	}
+
+	x := r.xmodem()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.drain()
+
+	// The first packet has sequence 0 and carries the destination file name
+	if err := r.xmodemExchange(ctx, &pb.XModem{Control: pb.XModem_SOH, Seq: 0, Buffer: []byte(filename)}); err != nil {
+		return fmt.Errorf("opening %s: %w", filename, err)
+	}
+
+	for seq, offset := uint32(1), 0; offset < len(data); seq, offset = seq+1, offset+xmodemBlockLen {
+		end := offset + xmodemBlockLen
+		if end > len(data) {
+			end = len(data)
+		}
+
+		block := data[offset:end]
+		packet := &pb.XModem{Control: pb.XModem_SOH, Seq: seq, Crc16: crc16(block), Buffer: block}
+
+		if err := r.xmodemExchange(ctx, packet); err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				r.sendXmodem(&pb.XModem{Control: pb.XModem_CAN})
+			}
+			return err
+		}
+
+		if progress != nil {
+			progress(end, len(data))
+		}
+	}
+
+	return r.xmodemExchange(ctx, &pb.XModem{Control: pb.XModem_EOT})
+}
+
+// xmodemExchange sends a packet and waits for the device to acknowledge it, resending on NAK or timeout
+func (r *Radio) xmodemExchange(ctx context.Context, packet *pb.XModem) error {
+
+	for attempt := 0; attempt < xmodemRetries; attempt++ {
+		if err := r.sendXmodem(packet); err != nil {
+			return err
+		}
+
+		reply, err := r.waitXmodem(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			continue
+		}
+
+		switch reply.Control {
+		case pb.XModem_ACK:
+			return nil
+		case pb.XModem_CAN:
+			return ErrTransferCanceled
+		case pb.XModem_NAK:
+			// The first packet is only refused when the device can't open the file
+			if packet.Seq == 0 && packet.Control != pb.XModem_EOT {
+				return errors.New("device refused the file")
+			}
+		}
+	}
+
+	return errors.New("too many retries")
+}
+
+// DownloadFile reads a file from the device filesystem using XModem. Blocks are checked against their
+// CRC and a NAK is sent to have the device resend damaged blocks
+func (r *Radio) DownloadFile(ctx context.Context, filename string, progress TransferProgress) ([]byte, error) {
+
+	if err := r.require(supportsFiles); err != nil {
+		return nil, err
+	}
+
+	x := r.xmodem()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.drain()
+
+	// Requesting sequence 0 with STX asks the device to transmit the named file
+	if err := r.sendXmodem(&pb.XModem{Control: pb.XModem_STX, Seq: 0, Buffer: []byte(filename)}); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0)
+	expected := uint32(1)
+	retries := 0
+
+	for {
+		packet, err := r.waitXmodem(ctx)
+		if err != nil {
+			// Canceling isn't sent to the device as it deletes the file it was transmitting
+			if ctx.Err() != nil || retries >= xmodemRetries {
+				return nil, err
+			}
+			retries++
+			if err := r.sendXmodem(&pb.XModem{Control: pb.XModem_NAK}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		switch packet.Control {
+		case pb.XModem_SOH, pb.XModem_STX:
+			if packet.Seq == expected && crc16(packet.Buffer) == packet.Crc16 {
+				data = append(data, packet.Buffer...)
+				expected++
+				retries = 0
+
+				if progress != nil {
+					progress(len(data), -1)
+				}
+
+				if err := r.sendXmodem(&pb.XModem{Control: pb.XModem_ACK}); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			if packet.Seq == expected-1 {
+				// The device missed our ACK and resent the previous block
+				if err := r.sendXmodem(&pb.XModem{Control: pb.XModem_ACK}); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			retries++
+			if retries > xmodemRetries {
+				return nil, errors.New("too many retries")
+			}
+			if err := r.sendXmodem(&pb.XModem{Control: pb.XModem_NAK}); err != nil {
+				return nil, err
+			}
+		case pb.XModem_EOT:
+			return data, nil
+		case pb.XModem_NAK:
+			if expected == 1 {
+				return nil, fmt.Errorf("device could not open %s", filename)
+			}
+		case pb.XModem_CAN:
+			return nil, ErrTransferCanceled
+		}
+	}
+}
+
+// fileInfo returns the file listed in a message from the radio, if it lists one
+func fileInfo(fromRadio *pb.FromRadio) (FileInfo, bool) {
+
+	unknown := fromRadio.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return FileInfo{}, false
+		}
+		unknown = unknown[n:]
+
+		if num != fromRadioFileInfo || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, unknown)
+			if n < 0 {
+				return FileInfo{}, false
+			}
+			unknown = unknown[n:]
+			continue
+		}
+
+		message, n := protowire.ConsumeBytes(unknown)
+		if n < 0 {
+			return FileInfo{}, false
+		}
+		return decodeFileInfo(message)
+	}
+
+	return FileInfo{}, false
+}
+
+// decodeFileInfo parses a FileInfo message: the file name in field 1 and its size in bytes in field 2
+func decodeFileInfo(message []byte) (FileInfo, bool) {
+
+	var file FileInfo
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return FileInfo{}, false
+		}
+		message = message[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			name, n := protowire.ConsumeString(message)
+			if n < 0 {
+				return FileInfo{}, false
+			}
+			file.Name = name
+			message = message[n:]
+		case num == 2 && typ == protowire.VarintType:
+			size, n := protowire.ConsumeVarint(message)
+			if n < 0 {
+				return FileInfo{}, false
+			}
+			file.Size = uint32(size)
+			message = message[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, message)
+			if n < 0 {
+				return FileInfo{}, false
+			}
+			message = message[n:]
+		}
+	}
+
+	return file, file.Name != ""
+}
+
+// handleFileInfo records a file the device listed
+func (c *connection) handleFileInfo(file FileInfo) {
+	c.mu.Lock()
+	c.files = append(c.files, file)
+	c.mu.Unlock()
+}
+
+// ListFiles returns the files on the device filesystem as the device listed them during the last config
+// handshake. Firmware before 2.5 doesn't list its files and returns ErrUnsupported
+func (r *Radio) ListFiles() ([]FileInfo, error) {
+
+	caps := r.Capabilities()
+	if !caps.Known || !supportsFileList(caps) {
+		return nil, ErrUnsupported
+	}
+
+	c := r.conn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]FileInfo{}, c.files...), nil
+}
+
+// DeleteFile removes a file from the device filesystem
+func (r *Radio) DeleteFile(filename string) error {
+
+	if err := r.require(supportsFiles); err != nil {
+		return err
+	}
+
+	adminPacket := pb.AdminMessage{
+		PayloadVariant: &pb.AdminMessage_DeleteFileRequest{
+			DeleteFileRequest: filename,
+		},
+	}
+
+	return sendAdminMessage(&adminPacket, r)
+}
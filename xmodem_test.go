@@ -0,0 +1,298 @@
+package gomesh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	pb "github.com/lmatte7/gomesh/github.com/meshtastic/gomeshproto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// answerXmodem answers the XModem packets written to a fake device like the device filesystem
+func answerXmodem(answer func(packet *pb.XModem) []*pb.XModem) func(*pb.ToRadio) []*pb.FromRadio {
+	return func(toRadio *pb.ToRadio) []*pb.FromRadio {
+		packet := toRadio.GetXmodemPacket()
+		if packet == nil {
+			return nil
+		}
+		var replies []*pb.FromRadio
+		for _, reply := range answer(packet) {
+			replies = append(replies, &pb.FromRadio{PayloadVariant: &pb.FromRadio_XmodemPacket{XmodemPacket: reply}})
+		}
+		return replies
+	}
+}
+
+// xmodemSent returns the XModem packets written to a fake device
+func xmodemSent(device *fakeDevice) []*pb.XModem {
+	var packets []*pb.XModem
+	for _, toRadio := range device.requests() {
+		if packet := toRadio.GetXmodemPacket(); packet != nil {
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
+
+// xmodemBlock is a block the device sends with its checksum
+func xmodemBlock(seq uint32, data []byte) *pb.XModem {
+	return &pb.XModem{Control: pb.XModem_SOH, Seq: seq, Crc16: crc16(data), Buffer: data}
+}
+
+func TestCRC16(t *testing.T) {
+
+	// CRC-16/XMODEM check value
+	if crc := crc16([]byte("123456789")); crc != 0x31c3 {
+		t.Fatalf("Unexpected crc: %#x", crc)
+	}
+
+	if crc := crc16(nil); crc != 0 {
+		t.Fatalf("Unexpected crc for empty block: %#x", crc)
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+
+	// The first copy of block 2 is refused and must be resent
+	var stored []byte
+	nakSent := false
+	device := newFakeDevice(nil, answerXmodem(func(packet *pb.XModem) []*pb.XModem {
+		if packet.Control == pb.XModem_SOH && packet.Seq == 2 && !nakSent {
+			nakSent = true
+			return []*pb.XModem{{Control: pb.XModem_NAK}}
+		}
+		if packet.Control == pb.XModem_SOH && packet.Seq > 0 {
+			if crc16(packet.Buffer) != packet.Crc16 {
+				return []*pb.XModem{{Control: pb.XModem_NAK}}
+			}
+			stored = append(stored, packet.Buffer...)
+		}
+		return []*pb.XModem{{Control: pb.XModem_ACK}}
+	}))
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+
+	data := bytes.Repeat([]byte("0123456789"), 30)
+	var progress []int
+	err := radio.UploadFile(context.Background(), "/prefs/test", data, func(transferred, total int) {
+		if total != len(data) {
+			t.Errorf("Expected a total of %d, got %d", len(data), total)
+		}
+		progress = append(progress, transferred)
+	})
+	if err != nil {
+		t.Fatalf("Error uploading: %v", err)
+	}
+
+	if !bytes.Equal(stored, data) {
+		t.Errorf("Expected the device to store the file, got %q", stored)
+	}
+	if len(progress) != 3 || progress[0] != 128 || progress[1] != 256 || progress[2] != 300 {
+		t.Errorf("Unexpected progress: %v", progress)
+	}
+
+	sent := xmodemSent(device)
+	if len(sent) != 6 {
+		t.Fatalf("Expected 6 packets, got %d", len(sent))
+	}
+	if sent[0].Seq != 0 || string(sent[0].Buffer) != "/prefs/test" {
+		t.Errorf("Expected the file name first, got %v", sent[0])
+	}
+	if sent[2].Seq != 2 || sent[3].Seq != 2 {
+		t.Errorf("Expected block 2 to be resent after the NAK, got %v and %v", sent[2], sent[3])
+	}
+	if sent[5].Control != pb.XModem_EOT {
+		t.Errorf("Expected EOT last, got %v", sent[5])
+	}
+}
+
+func TestUploadFileCanceledByDevice(t *testing.T) {
+
+	device := newFakeDevice(nil, answerXmodem(func(packet *pb.XModem) []*pb.XModem {
+		if packet.Seq == 2 {
+			return []*pb.XModem{{Control: pb.XModem_CAN}}
+		}
+		return []*pb.XModem{{Control: pb.XModem_ACK}}
+	}))
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+
+	err := radio.UploadFile(context.Background(), "/prefs/test", make([]byte, 300), nil)
+	if err != ErrTransferCanceled {
+		t.Fatalf("Expected ErrTransferCanceled, got %v", err)
+	}
+	if sent := xmodemSent(device); len(sent) != 3 {
+		t.Errorf("Expected the upload to stop at block 2, got %d packets", len(sent))
+	}
+}
+
+func TestUploadFileContextCanceled(t *testing.T) {
+
+	device := newFakeDevice(nil, answerXmodem(func(*pb.XModem) []*pb.XModem {
+		return []*pb.XModem{{Control: pb.XModem_ACK}}
+	}))
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := radio.UploadFile(ctx, "/prefs/test", make([]byte, 300), func(transferred, total int) { cancel() })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	sent := xmodemSent(device)
+	if last := sent[len(sent)-1]; last.Control != pb.XModem_CAN {
+		t.Errorf("Expected the transfer to be canceled on the device, got %v", last)
+	}
+}
+
+func TestUploadFileRefused(t *testing.T) {
+
+	device := newFakeDevice(nil, answerXmodem(func(*pb.XModem) []*pb.XModem {
+		return []*pb.XModem{{Control: pb.XModem_NAK}}
+	}))
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+
+	if err := radio.UploadFile(context.Background(), "/readonly", []byte("x"), nil); err == nil {
+		t.Fatal("Expected an error when the device can't open the file")
+	}
+	if sent := xmodemSent(device); len(sent) != 1 {
+		t.Errorf("Expected the file name not to be resent, got %d packets", len(sent))
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+
+	blocks := [][]byte{bytes.Repeat([]byte("01234567"), xmodemBlockLen/8), []byte("tail")}
+
+	// The first copy of block 2 arrives damaged
+	damaged := false
+	acks := 0
+	device := newFakeDevice(nil, answerXmodem(func(packet *pb.XModem) []*pb.XModem {
+		switch packet.Control {
+		case pb.XModem_STX:
+			return []*pb.XModem{xmodemBlock(1, blocks[0])}
+		case pb.XModem_NAK:
+			return []*pb.XModem{xmodemBlock(2, blocks[1])}
+		case pb.XModem_ACK:
+			acks++
+			if acks == 1 {
+				damaged = true
+				block := xmodemBlock(2, blocks[1])
+				block.Crc16++
+				return []*pb.XModem{block}
+			}
+			return []*pb.XModem{{Control: pb.XModem_EOT}}
+		}
+		return nil
+	}))
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+
+	var progress []int
+	data, err := radio.DownloadFile(context.Background(), "/prefs/test", func(transferred, total int) {
+		if total != -1 {
+			t.Errorf("Expected an unknown total, got %d", total)
+		}
+		progress = append(progress, transferred)
+	})
+	if err != nil {
+		t.Fatalf("Error downloading: %v", err)
+	}
+
+	if want := append(append([]byte(nil), blocks[0]...), blocks[1]...); !bytes.Equal(data, want) {
+		t.Errorf("Expected %d bytes, got %d", len(want), len(data))
+	}
+	if !damaged {
+		t.Error("Expected the damaged block to be sent")
+	}
+	if len(progress) != 2 || progress[0] != 128 || progress[1] != 132 {
+		t.Errorf("Unexpected progress: %v", progress)
+	}
+
+	controls := []pb.XModem_Control{pb.XModem_STX, pb.XModem_ACK, pb.XModem_NAK, pb.XModem_ACK}
+	sent := xmodemSent(device)
+	if len(sent) != len(controls) {
+		t.Fatalf("Expected %d packets, got %d", len(controls), len(sent))
+	}
+	for i, control := range controls {
+		if sent[i].Control != control {
+			t.Errorf("Expected packet %d to be %v, got %v", i, control, sent[i].Control)
+		}
+	}
+}
+
+func TestDownloadFileCanceled(t *testing.T) {
+
+	device := newFakeDevice(nil, answerXmodem(func(packet *pb.XModem) []*pb.XModem {
+		if packet.Control == pb.XModem_STX {
+			return []*pb.XModem{xmodemBlock(1, []byte("part"))}
+		}
+		return []*pb.XModem{{Control: pb.XModem_CAN}}
+	}))
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: device}}
+
+	if _, err := radio.DownloadFile(context.Background(), "/prefs/test", nil); err != ErrTransferCanceled {
+		t.Fatalf("Expected ErrTransferCanceled, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	device.answer = answerXmodem(func(packet *pb.XModem) []*pb.XModem {
+		return []*pb.XModem{xmodemBlock(packet.Seq+1, []byte("part"))}
+	})
+	_, err := radio.DownloadFile(ctx, "/prefs/test", func(int, int) { cancel() })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// fileInfoFrame is a frame listing a file the way firmware 2.5 does during the config handshake
+func fileInfoFrame(name string, size uint32) []byte {
+	var info []byte
+	info = protowire.AppendTag(info, 1, protowire.BytesType)
+	info = protowire.AppendString(info, name)
+	info = protowire.AppendTag(info, 2, protowire.VarintType)
+	info = protowire.AppendVarint(info, uint64(size))
+
+	var message []byte
+	message = protowire.AppendTag(message, fromRadioFileInfo, protowire.BytesType)
+	message = protowire.AppendBytes(message, info)
+	return append([]byte{start1, start2, byte(len(message) >> 8), byte(len(message))}, message...)
+}
+
+func TestListFiles(t *testing.T) {
+
+	var stream []byte
+	stream = append(stream, testFrame(t, &pb.FromRadio{PayloadVariant: &pb.FromRadio_Metadata{Metadata: &pb.DeviceMetadata{FirmwareVersion: "2.5.6.d55c08d"}}})...)
+	stream = append(stream, fileInfoFrame("/prefs/config.proto", 112)...)
+	stream = append(stream, fileInfoFrame("/static/index.html", 2048)...)
+
+	radio := &Radio{nodeNum: 1, streamer: streamer{transport: newFakeDevice(stream, nil)}}
+	if _, err := radio.ListFiles(); err != ErrUnsupported {
+		t.Errorf("Expected ErrUnsupported before the device sent its metadata, got %v", err)
+	}
+
+	if _, err := radio.ReadResponse(true); err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+
+	files, err := radio.ListFiles()
+	if err != nil {
+		t.Fatalf("Error listing files: %v", err)
+	}
+	if len(files) != 2 || files[0] != (FileInfo{Name: "/prefs/config.proto", Size: 112}) || files[1].Name != "/static/index.html" {
+		t.Errorf("Unexpected files: %v", files)
+	}
+
+	// A new handshake lists the files again
+	radio.newConfigID()
+	if files, _ := radio.ListFiles(); len(files) != 0 {
+		t.Errorf("Expected the list to be cleared for a new handshake, got %v", files)
+	}
+
+	old := &Radio{}
+	old.conn().handleMetadata(&pb.DeviceMetadata{FirmwareVersion: "2.3.2.63df972"})
+	if _, err := old.ListFiles(); err != ErrUnsupported {
+		t.Errorf("Expected ErrUnsupported for firmware that doesn't list files, got %v", err)
+	}
+}